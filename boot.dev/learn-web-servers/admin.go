@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mosamadeeb/chirpy/internal/chirpydb"
+)
+
+// Only lets requests through if they carry the admin API key
+// Admin endpoints are disabled entirely if no key is configured
+func (c *apiConfig) middlewareAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiKey, ok := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey ")
+		// Compared in constant time, so response times don't give the key away
+		if !ok || c.adminApiKey == "" || subtle.ConstantTimeCompare([]byte(apiKey), []byte(c.adminApiKey)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Limits on how many changes GET /admin/changes returns at once
+const (
+	defaultChangesLimit = 100
+	maxChangesLimit     = 1000
+)
+
+func (s serverState) handleAdminApi() {
+	// Changes after the sequence number in since, oldest first
+	s.Mux.Handle("GET /admin/changes", s.ApiCfg.middlewareAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var since uint64
+		if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+			var err error
+			if since, err = strconv.ParseUint(sinceStr, 10, 64); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Since must be a sequence number")
+				return
+			}
+		}
+
+		limit := defaultChangesLimit
+		if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+			var err error
+			if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 || limit > maxChangesLimit {
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Limit must be between 1 and %d", maxChangesLimit))
+				return
+			}
+		}
+
+		changes, err := s.DB.Changes(since, limit)
+		if err != nil {
+			log.Printf("Error reading changes: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, changes)
+	})))
+
+	// Audit log of a user's refresh tokens, newest first
+	s.Mux.Handle("GET /admin/users/{userID}/token-events", s.ApiCfg.middlewareAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userId, err := strconv.Atoi(r.PathValue("userID"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		opts, err := idPageOptions(r.URL.Query(), "token-events", userId)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		opts.Desc = true
+
+		pageOpts := opts
+		if opts.Limit > 0 {
+			pageOpts.Limit++
+		}
+
+		events, err := s.DB.GetTokenEvents(userId, pageOpts)
+		if err != nil {
+			log.Printf("Error loading token events from database: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if opts.Limit > 0 && len(events) > opts.Limit {
+			events = events[:opts.Limit]
+			setNextPageLink(w, r, "token-events", userId, events[len(events)-1].Id)
+		}
+
+		respondWithJSON(w, http.StatusOK, events)
+	})))
+
+	s.Mux.Handle("GET /admin/jwt-keys", s.ApiCfg.middlewareAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, s.ApiCfg.jwtKeys.list())
+	})))
+
+	// Switches to a new signing key, tokens signed with the old one stay valid until they expire
+	s.Mux.Handle("POST /admin/jwt-keys/rotate", s.ApiCfg.middlewareAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rotateReq struct {
+			// Defaults to the algorithm of the current signing key
+			Alg string `json:"alg"`
+		}
+
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&rotateReq); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Invalid request body")
+				return
+			}
+		}
+
+		key, err := s.ApiCfg.jwtKeys.rotate(rotateReq.Alg)
+		if err != nil {
+			if errors.Is(err, errUnknownAlg) {
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Algorithm must be one of %s", strings.Join(jwtAlgs, ", ")))
+				return
+			}
+
+			log.Printf("Error rotating JWT keys: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, http.StatusCreated, key)
+	})))
+
+	if s.Snapshots == nil {
+		// The storage backend can't take snapshots
+		return
+	}
+
+	s.Mux.Handle("POST /admin/snapshots", s.ApiCfg.middlewareAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshot, err := s.Snapshots.Create()
+		if err != nil {
+			log.Printf("Error taking snapshot: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, http.StatusCreated, snapshot)
+	})))
+
+	s.Mux.Handle("GET /admin/snapshots", s.ApiCfg.middlewareAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshots, err := s.Snapshots.List()
+		if err != nil {
+			log.Printf("Error listing snapshots: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, snapshots)
+	})))
+
+	s.Mux.Handle("POST /admin/snapshots/{name}/restore", s.ApiCfg.middlewareAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Snapshots.Restore(r.PathValue("name")); err != nil {
+			if errors.Is(err, chirpydb.ErrNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			log.Printf("Error restoring snapshot: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})))
+}
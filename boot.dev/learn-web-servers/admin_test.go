@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mosamadeeb/chirpy/internal/chirpydb"
+)
+
+const testAdminApiKey = "admin-key"
+
+func TestAdminSnapshots(t *testing.T) {
+	s := newTestServer(t)
+	s.ApiCfg.adminApiKey = testAdminApiKey
+	s.Snapshots = chirpydb.NewSnapshots(t.TempDir(), s.DB.(chirpydb.Snapshotter), chirpydb.RetentionPolicy{})
+
+	// Routes are registered again on a fresh mux now that snapshots are enabled
+	s.Mux = http.NewServeMux()
+	s.handleApi()
+
+	do := func(method, path, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if apiKey != "" {
+			req.Header.Set("Authorization", "ApiKey "+apiKey)
+		}
+
+		rec := httptest.NewRecorder()
+		s.Mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, key := range []string{"", "wrong"} {
+		if rec := do("POST", "/admin/snapshots", key); rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d with key %q, got %d", http.StatusUnauthorized, key, rec.Code)
+			return
+		}
+	}
+
+	if _, err := s.DB.CreateChirp("before", 1); err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	rec := do("POST", "/admin/snapshots", testAdminApiKey)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, rec.Code)
+		return
+	}
+
+	var created chirpydb.SnapshotInfo
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Errorf("could not decode snapshot: %v", err)
+		return
+	}
+
+	var list []chirpydb.SnapshotInfo
+	if err := json.NewDecoder(do("GET", "/admin/snapshots", testAdminApiKey).Body).Decode(&list); err != nil {
+		t.Errorf("could not decode snapshots: %v", err)
+		return
+	}
+	if len(list) != 1 || list[0].Name != created.Name {
+		t.Errorf("expected %v to be listed, got %v", created, list)
+		return
+	}
+
+	if _, err := s.DB.CreateChirp("after", 1); err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	if rec := do("POST", "/admin/snapshots/"+created.Name+"/restore", testAdminApiKey); rec.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, rec.Code)
+		return
+	}
+
+	if chirps, _ := s.DB.GetChirps(); len(chirps) != 1 {
+		t.Errorf("expected 1 chirp after restoring, got %d", len(chirps))
+		return
+	}
+
+	if rec := do("POST", "/admin/snapshots/missing/restore", testAdminApiKey); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestAdminChanges(t *testing.T) {
+	s := newTestServer(t)
+	s.ApiCfg.adminApiKey = testAdminApiKey
+
+	do := func(path, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if apiKey != "" {
+			req.Header.Set("Authorization", "ApiKey "+apiKey)
+		}
+
+		rec := httptest.NewRecorder()
+		s.Mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do("/admin/changes", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d without a key, got %d", http.StatusUnauthorized, rec.Code)
+		return
+	}
+
+	user, _ := newTestUser(t, s, "user@example.com")
+	if _, err := s.DB.CreateChirp("hello", user.Id); err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	for path, expected := range map[string]int{
+		"/admin/changes":                 2,
+		"/admin/changes?since=1":         1,
+		"/admin/changes?since=0&limit=1": 1,
+		"/admin/changes?since=2":         0,
+	} {
+		rec := do(path, testAdminApiKey)
+		if rec.Code != http.StatusOK {
+			t.Errorf("expected status %d for %s, got %d", http.StatusOK, path, rec.Code)
+			return
+		}
+
+		var changes []chirpydb.ChangeEvent
+		if err := json.NewDecoder(rec.Body).Decode(&changes); err != nil {
+			t.Errorf("could not decode changes: %v", err)
+			return
+		}
+		if len(changes) != expected {
+			t.Errorf("expected %d changes for %s, got %v", expected, path, changes)
+			return
+		}
+	}
+
+	for _, path := range []string{"/admin/changes?since=-1", "/admin/changes?since=abc", "/admin/changes?limit=0", "/admin/changes?limit=5000"} {
+		if rec := do(path, testAdminApiKey); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d for %s, got %d", http.StatusBadRequest, path, rec.Code)
+			return
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/mosamadeeb/chirpy/internal/chirpydb"
 )
@@ -12,11 +13,14 @@ import (
 type serverState struct {
 	Mux    *http.ServeMux
 	ApiCfg *apiConfig
-	DB     *chirpydb.DB
+	DB     chirpydb.Store
+
+	// Nil if the storage backend can't take snapshots
+	Snapshots *chirpydb.Snapshots
 }
 
-func newServerState(mux *http.ServeMux, apiCfg *apiConfig, db *chirpydb.DB) serverState {
-	return serverState{mux, apiCfg, db}
+func newServerState(mux *http.ServeMux, apiCfg *apiConfig, db chirpydb.Store) serverState {
+	return serverState{Mux: mux, ApiCfg: apiCfg, DB: db}
 }
 
 func (s serverState) handleApi() {
@@ -35,11 +39,17 @@ func (s serverState) handleApi() {
 		w.Write([]byte("OK"))
 	})
 
+	s.handleAdminApi()
 	s.handleAuthApi()
+	s.handleSessionsApi()
 	s.handleWebhooks()
 
 	// CRUD endpoints
 	s.handleChirpsApi()
+	s.handleThreadsApi()
+	s.handleReactionsApi()
+	s.handleFollowsApi()
+	s.handleHashtagsApi()
 	s.handleUsersApi()
 }
 
@@ -70,8 +80,13 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 
 type apiConfig struct {
 	fileserverHits int
-	jwtSecret      string
+	jwtKeys        *jwtKeyset
 	polkaApi       string
+	adminApiKey    string
+
+	// How long after posting a chirp its author can edit it, zero means forever
+	editWindow    time.Duration
+	redEditWindow time.Duration
 }
 
 // A simple middleware that inserts a handler in between
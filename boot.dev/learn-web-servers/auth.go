@@ -17,6 +17,9 @@ import (
 
 const jwtDefaultTimeout = time.Hour
 
+// How long a refresh token lasts, every refresh hands out a new one
+const refreshTokenLifetime = 60 * 24 * time.Hour
+
 func (s serverState) handleAuthApi() {
 	s.Mux.HandleFunc("POST /api/login", func(w http.ResponseWriter, r *http.Request) {
 		var loginReq struct {
@@ -56,14 +59,14 @@ func (s serverState) handleAuthApi() {
 			expiresIn = jwtDefaultTimeout
 		}
 
-		jwtToken, err := createJWT(user.Id, expiresIn, s.ApiCfg.jwtSecret)
+		jwtToken, err := createJWT(user.Id, expiresIn, s.ApiCfg.jwtKeys)
 		if err != nil {
 			log.Printf("Error creating JWT: %v\n", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		refreshToken, err := s.DB.AddRefreshToken(user.Id, time.Now().AddDate(0, 0, 60).UTC())
+		refreshToken, err := s.DB.AddRefreshToken(user.Id, time.Now().Add(refreshTokenLifetime).UTC(), requestClient(r))
 		if err != nil {
 			log.Printf("Error creating refresh token: %v\n", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -71,12 +74,10 @@ func (s serverState) handleAuthApi() {
 		}
 
 		respondWithJSON(w, http.StatusOK, struct {
-			Id           int    `json:"id"`
-			Email        string `json:"email"`
-			IsChirpyRed  bool   `json:"is_chirpy_red"`
+			userRes
 			Token        string `json:"token"`
 			RefreshToken string `json:"refresh_token"`
-		}{user.Id, user.Email, user.IsChirpyRed, jwtToken, refreshToken.Token})
+		}{createUserRes(user), jwtToken, refreshToken.Token})
 	})
 
 	s.Mux.HandleFunc("POST /api/refresh", func(w http.ResponseWriter, r *http.Request) {
@@ -86,19 +87,27 @@ func (s serverState) handleAuthApi() {
 			return
 		}
 
-		userId, err := s.DB.CheckRefreshToken(tokenString)
+		// The old refresh token can't be used again after this
+		refreshToken, err := s.DB.RotateRefreshToken(tokenString, time.Now().Add(refreshTokenLifetime).UTC(), requestClient(r))
 		if err != nil {
+			if errors.Is(err, chirpydb.ErrTokenReused) {
+				// Someone else has a copy of the token, so the user has to log in again
+				log.Printf("Refresh token was reused, its family has been revoked\n")
+				respondWithError(w, http.StatusUnauthorized, "Refresh token was already used")
+				return
+			}
+
 			if errors.Is(err, chirpydb.ErrNotExist) || errors.Is(err, chirpydb.ErrExpired) {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 
-			log.Printf("Error checking refresh token in DB: %v\n", err)
+			log.Printf("Error rotating refresh token in DB: %v\n", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		jwtToken, err := createJWT(userId, jwtDefaultTimeout, s.ApiCfg.jwtSecret)
+		jwtToken, err := createJWT(refreshToken.UserId, jwtDefaultTimeout, s.ApiCfg.jwtKeys)
 		if err != nil {
 			log.Printf("Error creating JWT: %v\n", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -106,8 +115,9 @@ func (s serverState) handleAuthApi() {
 		}
 
 		respondWithJSON(w, http.StatusOK, struct {
-			Token string `json:"token"`
-		}{jwtToken})
+			Token        string `json:"token"`
+			RefreshToken string `json:"refresh_token"`
+		}{jwtToken, refreshToken.Token})
 	})
 
 	s.Mux.HandleFunc("POST /api/revoke", func(w http.ResponseWriter, r *http.Request) {
@@ -125,35 +135,53 @@ func (s serverState) handleAuthApi() {
 
 		w.WriteHeader(http.StatusNoContent)
 	})
-}
 
-func createJWT(userId int, expiresIn time.Duration, jwtSecret string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
-		Subject:   strconv.Itoa(userId),
+	// Public keys for verifying access tokens elsewhere, HS256 keys are never published
+	s.Mux.HandleFunc("GET /.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		// Short enough that verifiers pick up a rotated key well before tokens signed with it show up
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		respondWithJSON(w, http.StatusOK, struct {
+			Keys []jwk `json:"keys"`
+		}{s.ApiCfg.jwtKeys.jwks()})
 	})
+}
 
-	return token.SignedString([]byte(jwtSecret))
+// Claims of the access tokens Chirpy issues
+type chirpyClaims struct {
+	jwt.RegisteredClaims
+
+	// Space separated, like in OAuth
+	Scope string `json:"scope,omitempty"`
+}
+
+func createJWT(userId int, expiresIn time.Duration, keys *jwtKeyset) (string, error) {
+	return createScopedJWT(userId, expiresIn, keys, allScopes)
+}
+
+func createScopedJWT(userId int, expiresIn time.Duration, keys *jwtKeyset, scopes []string) (string, error) {
+	return keys.sign(chirpyClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "chirpy",
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+			Subject:   strconv.Itoa(userId),
+		},
+		Scope: strings.Join(scopes, " "),
+	})
 }
 
-// TODO: Instead of authenticating in a function that takes a request, we can use a middleware
-func authenticateJWT(r *http.Request, jwtSecret string) (*jwt.Token, error) {
+// Validates the bearer token of a request, handlers get the caller from requireAuth or optionalAuth instead
+func authenticateJWT(r *http.Request, keys *jwtKeyset) (*chirpyClaims, error) {
 	tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
 	if !ok {
 		return nil, fmt.Errorf("unexpected authorization header format")
 	}
 
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-		if t.Method.Alg() != jwt.SigningMethodHS256.Alg() {
-			return nil, errors.New("unexpected signing method")
-		}
-		return []byte(jwtSecret), nil
-	})
+	claims := &chirpyClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, keys.keyFunc, jwt.WithValidMethods(jwtAlgs))
 	if err != nil {
 		return nil, err
 	}
 
-	return token, nil
+	return claims, nil
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mosamadeeb/chirpy/internal/chirpydb"
+)
+
+func TestRefreshTokenRotation(t *testing.T) {
+	s := newTestServer(t)
+	s.ApiCfg.adminApiKey = testAdminApiKey
+
+	do := func(method, path, auth, body string, v any) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+
+		rec := httptest.NewRecorder()
+		s.Mux.ServeHTTP(rec, req)
+
+		if v != nil {
+			json.NewDecoder(rec.Body).Decode(v)
+		}
+
+		return rec.Code
+	}
+
+	credentials := `{"email":"user@example.com","password":"hunter2"}`
+	var user userRes
+	if code := do("POST", "/api/users", "", credentials, &user); code != http.StatusCreated {
+		t.Errorf("could not create user, got status %d", code)
+		return
+	}
+
+	var login struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if code := do("POST", "/api/login", "", credentials, &login); code != http.StatusOK {
+		t.Errorf("could not log in, got status %d", code)
+		return
+	}
+
+	var refreshed struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if code := do("POST", "/api/refresh", "Bearer "+login.RefreshToken, "", &refreshed); code != http.StatusOK {
+		t.Errorf("could not refresh, got status %d", code)
+		return
+	}
+	if refreshed.Token == "" || refreshed.RefreshToken == "" || refreshed.RefreshToken == login.RefreshToken {
+		t.Errorf("expected a new access token and refresh token, got %v", refreshed)
+		return
+	}
+
+	// The login token was exchanged, so using it again revokes the new one too
+	if code := do("POST", "/api/refresh", "Bearer "+login.RefreshToken, "", nil); code != http.StatusUnauthorized {
+		t.Errorf("expected status %d for a reused refresh token, got %d", http.StatusUnauthorized, code)
+		return
+	}
+	if code := do("POST", "/api/refresh", "Bearer "+refreshed.RefreshToken, "", nil); code != http.StatusUnauthorized {
+		t.Errorf("expected status %d after the family was revoked, got %d", http.StatusUnauthorized, code)
+		return
+	}
+
+	var events []chirpydb.TokenEvent
+	path := fmt.Sprintf("/admin/users/%d/token-events", user.Id)
+	if code := do("GET", path, "", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("expected status %d without the admin key, got %d", http.StatusUnauthorized, code)
+		return
+	}
+	if code := do("GET", path, "ApiKey "+testAdminApiKey, "", &events); code != http.StatusOK {
+		t.Errorf("could not get token events, got status %d", code)
+		return
+	}
+	if len(events) != 3 || events[0].Kind != chirpydb.TokenReused || events[2].Kind != chirpydb.TokenIssued {
+		t.Errorf("expected the reuse to be logged, newest first, got %v", events)
+	}
+}
@@ -1,115 +1,207 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mosamadeeb/chirpy/internal/chirpydb"
 )
 
 func (s serverState) handleChirpsApi() {
-	s.Mux.HandleFunc("POST /api/chirps", func(w http.ResponseWriter, r *http.Request) {
-		token, err := authenticateJWT(r, s.ApiCfg.jwtSecret)
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
+	s.Mux.HandleFunc("POST /api/chirps", s.requireAuth(requireScope(scopeChirpsWrite))(func(w http.ResponseWriter, r *http.Request) {
+		userId := callerId(r)
+
+		var chirpReq chirpydb.Chirp
+		if err := json.NewDecoder(r.Body).Decode(&chirpReq); err != nil {
+			log.Printf("Error decoding chirp body: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		idStr, err := token.Claims.GetSubject()
-		if err != nil {
-			log.Printf("Could not get user ID from JWT: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
+		if len(chirpReq.Body) > 140 {
+			respondWithError(w, http.StatusBadRequest, "Chirp is too long")
 			return
 		}
 
-		userId, err := strconv.Atoi(idStr)
+		var chirp chirpydb.Chirp
+		var err error
+		if chirpReq.ReplyTo != 0 {
+			chirp, err = s.DB.CreateReply(cleanChirp(chirpReq.Body), userId, chirpReq.ReplyTo)
+		} else {
+			chirp, err = s.DB.CreateChirp(cleanChirp(chirpReq.Body), userId)
+		}
 		if err != nil {
-			log.Printf("Could not get user ID from JWT: %v\n", err)
+			if errors.Is(err, chirpydb.ErrParentNotExist) {
+				respondWithError(w, http.StatusBadRequest, "Chirp to reply to does not exist")
+				return
+			}
+
+			log.Printf("Error saving chirp to database: %v\n", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		var chirpReq chirpydb.Chirp
-		if err := json.NewDecoder(r.Body).Decode(&chirpReq); err != nil {
-			log.Printf("Error decoding chirp body: %v\n", err)
+		res, err := s.createChirpResponse(userId, chirp)
+		if err != nil {
+			log.Printf("Error loading reactions from database: %v\n", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		if len(chirpReq.Body) > 140 {
-			respondWithError(w, http.StatusBadRequest, "Chirp is too long")
+		respondWithJSON(w, http.StatusCreated, res)
+	}))
+
+	s.Mux.HandleFunc("GET /api/chirps", s.optionalAuth(func(w http.ResponseWriter, r *http.Request) {
+		viewerId := callerId(r)
+
+		query := r.URL.Query()
+
+		sortOrder := query.Get("sort")
+		if sortOrder == "" {
+			sortOrder = "asc"
+		}
+
+		opts, ok := chirpSortOrders[sortOrder]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		chirp, err := s.DB.CreateChirp(cleanChirp(chirpReq.Body), userId)
+		authorId := 0
+		if authorIdStr := query.Get("author_id"); authorIdStr != "" {
+			var err error
+			// Zero would mean no filter below
+			if authorId, err = strconv.Atoi(authorIdStr); err != nil || authorId <= 0 {
+				respondWithError(w, http.StatusBadRequest, "Author ID must be a positive integer")
+				return
+			}
+		}
+
+		// Chirps created at or after since, and before until
+		for _, bound := range []struct {
+			param, name string
+			value       *time.Time
+		}{{"since", "Since", &opts.Since}, {"until", "Until", &opts.Until}} {
+			if str := query.Get(bound.param); str != "" {
+				var err error
+				if *bound.value, err = time.Parse(time.RFC3339, str); err != nil {
+					respondWithError(w, http.StatusBadRequest, bound.name+" must be an RFC 3339 timestamp")
+					return
+				}
+			}
+		}
+
+		// Without a limit, everything is returned in one go like before
+		if limitStr := query.Get("limit"); limitStr != "" {
+			var err error
+			if opts.Limit, err = strconv.Atoi(limitStr); err != nil || opts.Limit <= 0 || opts.Limit > maxChirpsLimit {
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Limit must be between 1 and %d", maxChirpsLimit))
+				return
+			}
+		}
+
+		if cursor := query.Get("cursor"); cursor != "" {
+			c, ok := decodeChirpCursor(cursor)
+			if !ok || c.Sort != sortOrder || c.AuthorId != authorId {
+				respondWithError(w, http.StatusBadRequest, "Invalid cursor")
+				return
+			}
+
+			opts.After, opts.AfterTime = c.LastId, c.LastCreatedAt
+		}
+
+		// Ask for one more than the limit, to know whether there is a next page
+		pageOpts := opts
+		if opts.Limit > 0 {
+			pageOpts.Limit++
+		}
+
+		var chirps []chirpydb.Chirp
+		var err error
+		if authorId != 0 {
+			// The store keeps an index of chirps by author, so it can sort them for us
+			chirps, err = s.DB.GetChirpsByAuthor(authorId, pageOpts)
+		} else {
+			chirps, err = s.DB.ListChirps(pageOpts)
+		}
 		if err != nil {
-			log.Printf("Error saving chirp to database: %v\n", err)
+			log.Printf("Error loading chirps from database: %v\n", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		respondWithJSON(w, http.StatusCreated, chirp)
-	})
+		if opts.Limit > 0 && len(chirps) > opts.Limit {
+			chirps = chirps[:opts.Limit]
 
-	s.Mux.HandleFunc("GET /api/chirps", func(w http.ResponseWriter, r *http.Request) {
-		chirps, err := s.DB.GetChirps()
+			// Same query, continuing after the last chirp of this page
+			next := query
+			last := chirps[len(chirps)-1]
+			next.Set("cursor", encodeChirpCursor(chirpCursor{sortOrder, authorId, last.Id, last.CreatedAt}))
+			nextUrl := url.URL{Path: r.URL.Path, RawQuery: next.Encode()}
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextUrl.String()))
+		}
+
+		res, err := s.createChirpResponses(viewerId, chirps)
 		if err != nil {
-			log.Printf("Error loading chirps from database: %v\n", err)
+			log.Printf("Error loading reactions from database: %v\n", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		if authorIdStr := r.URL.Query().Get("author_id"); authorIdStr != "" {
-			authorId, err := strconv.Atoi(authorIdStr)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
+		respondWithJSON(w, http.StatusOK, res)
+	}))
 
-			filteredChirps := make([]chirpydb.Chirp, 0, len(chirps))
-			for _, c := range chirps {
-				if c.AuthorId == authorId {
-					filteredChirps = append(filteredChirps, c)
-				}
-			}
+	s.Mux.HandleFunc("GET /api/chirps/search", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
 
-			chirps = filteredChirps
+		q := query.Get("q")
+		if strings.TrimSpace(q) == "" {
+			respondWithError(w, http.StatusBadRequest, "Missing search query")
+			return
 		}
 
-		sortOrder := r.URL.Query().Get("sort")
-		if sortOrder == "" {
-			sortOrder = "asc"
+		limit := defaultSearchLimit
+		if limitStr := query.Get("limit"); limitStr != "" {
+			var err error
+			if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 || limit > maxSearchLimit {
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Limit must be between 1 and %d", maxSearchLimit))
+				return
+			}
 		}
 
-		switch sortOrder {
-		case "desc":
-			chirps = slices.SortedFunc(slices.Values(chirps), func(a, b chirpydb.Chirp) int {
-				return b.Id - a.Id
-			})
-		case "asc":
-			chirps = slices.SortedFunc(slices.Values(chirps), func(a, b chirpydb.Chirp) int {
-				return a.Id - b.Id
-			})
-		default:
-			w.WriteHeader(http.StatusBadRequest)
+		results, err := s.DB.SearchChirps(q, limit)
+		if err != nil {
+			if errors.Is(err, chirpydb.ErrBadQuery) {
+				respondWithError(w, http.StatusBadRequest, "Invalid search query")
+				return
+			}
+
+			log.Printf("Error searching chirps: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		respondWithJSON(w, http.StatusOK, chirps)
+		respondWithJSON(w, http.StatusOK, results)
 	})
 
-	s.Mux.HandleFunc("GET /api/chirps/{chirpID}", func(w http.ResponseWriter, r *http.Request) {
+	s.Mux.HandleFunc("GET /api/chirps/{chirpID}", s.optionalAuth(func(w http.ResponseWriter, r *http.Request) {
 		chirpId, err := strconv.Atoi(r.PathValue("chirpID"))
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
+		viewerId := callerId(r)
+
 		chirp, err := s.DB.GetChirp(chirpId)
 		if err != nil {
 			if errors.Is(err, chirpydb.ErrNotExist) {
@@ -122,30 +214,112 @@ func (s serverState) handleChirpsApi() {
 			return
 		}
 
-		respondWithJSON(w, http.StatusOK, chirp)
+		res, err := s.createChirpResponse(viewerId, chirp)
+		if err != nil {
+			log.Printf("Error loading reactions from database: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, res)
+	}))
+
+	s.Mux.HandleFunc("GET /api/chirps/{chirpID}/revisions", func(w http.ResponseWriter, r *http.Request) {
+		chirpId, err := strconv.Atoi(r.PathValue("chirpID"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		revisions, err := s.DB.GetChirpRevisions(chirpId)
+		if err != nil {
+			if errors.Is(err, chirpydb.ErrNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			log.Printf("Error loading chirp revisions from database: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, revisions)
 	})
 
-	s.Mux.HandleFunc("DELETE /api/chirps/{chirpID}", func(w http.ResponseWriter, r *http.Request) {
-		token, err := authenticateJWT(r, s.ApiCfg.jwtSecret)
+	// Only the body can be changed, so PUT and PATCH do the same thing
+	editChirp := func(w http.ResponseWriter, r *http.Request) {
+		userId := callerId(r)
+
+		chirpId, err := strconv.Atoi(r.PathValue("chirpID"))
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var chirpReq chirpydb.Chirp
+		if err := json.NewDecoder(r.Body).Decode(&chirpReq); err != nil {
+			log.Printf("Error decoding chirp body: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		idStr, err := token.Claims.GetSubject()
+		if len(chirpReq.Body) > 140 {
+			respondWithError(w, http.StatusBadRequest, "Chirp is too long")
+			return
+		}
+
+		// requireAuth already loaded the author
+		caller, _ := principalFromContext(r.Context())
+
+		// Checked in the same transaction as the edit, so a concurrent edit or delete can't slip in between
+		chirp, err := s.DB.UpdateChirp(chirpId, cleanChirp(chirpReq.Body), func(chirp chirpydb.Chirp) error {
+			if userId != chirp.AuthorId {
+				return errNotAuthor
+			}
+
+			if !s.ApiCfg.chirpEditable(chirp, caller, time.Now()) {
+				return errEditWindowClosed
+			}
+
+			return nil
+		})
 		if err != nil {
-			log.Printf("Could not get user ID from JWT: %v\n", err)
+			if errors.Is(err, chirpydb.ErrNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			if errors.Is(err, errNotAuthor) {
+				respondWithError(w, http.StatusForbidden, "Only the author can edit this chirp")
+				return
+			}
+
+			if errors.Is(err, errEditWindowClosed) {
+				respondWithError(w, http.StatusForbidden, "Chirp can no longer be edited")
+				return
+			}
+
+			log.Printf("Error updating chirp in database: %v\n", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		userId, err := strconv.Atoi(idStr)
+		res, err := s.createChirpResponse(userId, chirp)
 		if err != nil {
-			log.Printf("Could not get user ID from JWT: %v\n", err)
+			log.Printf("Error loading reactions from database: %v\n", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
+		respondWithJSON(w, http.StatusOK, res)
+	}
+
+	s.Mux.HandleFunc("PUT /api/chirps/{chirpID}", s.requireAuth(requireScope(scopeChirpsWrite))(editChirp))
+	s.Mux.HandleFunc("PATCH /api/chirps/{chirpID}", s.requireAuth(requireScope(scopeChirpsWrite))(editChirp))
+
+	s.Mux.HandleFunc("DELETE /api/chirps/{chirpID}", s.requireAuth(requireScope(scopeChirpsWrite))(func(w http.ResponseWriter, r *http.Request) {
+		userId := callerId(r)
+
 		chirpId, err := strconv.Atoi(r.PathValue("chirpID"))
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
@@ -165,7 +339,7 @@ func (s serverState) handleChirpsApi() {
 		}
 
 		if userId != chirp.AuthorId {
-			w.WriteHeader(http.StatusForbidden)
+			respondWithError(w, http.StatusForbidden, "Only the author can delete this chirp")
 			return
 		}
 
@@ -176,7 +350,71 @@ func (s serverState) handleChirpsApi() {
 		}
 
 		w.WriteHeader(http.StatusNoContent)
-	})
+	}))
+}
+
+// Largest page GET /api/chirps returns
+const maxChirpsLimit = 1000
+
+// Limits on how many results GET /api/chirps/search returns
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// Reasons an edit is refused, returned from the check run by UpdateChirp
+var (
+	errNotAuthor        = errors.New("only the author can edit this chirp")
+	errEditWindowClosed = errors.New("chirp can no longer be edited")
+)
+
+// Reports whether the author of a chirp can still edit it
+// Chirpy Red users get their own edit window, and a window of zero never closes
+func (c *apiConfig) chirpEditable(chirp chirpydb.Chirp, author principal, now time.Time) bool {
+	window := c.editWindow
+	if isRed, _ := requireRole(roleChirpyRed)(author); isRed {
+		window = c.redEditWindow
+	}
+
+	return window == 0 || now.Sub(chirp.CreatedAt) <= window
+}
+
+// Values of the sort parameter of GET /api/chirps
+// asc and desc sort by ID
+var chirpSortOrders = map[string]chirpydb.ListOptions{
+	"asc":         {},
+	"desc":        {Desc: true},
+	"created_at":  {SortBy: chirpydb.SortByCreatedAt},
+	"-created_at": {SortBy: chirpydb.SortByCreatedAt, Desc: true},
+}
+
+// Cursors point at the last chirp of a page, and remember which listing they belong to,
+// so they can't be used to continue a different one
+// They are opaque to clients, so the format can change
+// Listings other than GET /api/chirps use them too, with AuthorId set to the user or chirp they list for
+type chirpCursor struct {
+	Sort          string    `json:"s"`
+	AuthorId      int       `json:"a"`
+	LastId        int       `json:"i"`
+	LastCreatedAt time.Time `json:"t"`
+}
+
+func encodeChirpCursor(c chirpCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeChirpCursor(cursor string) (c chirpCursor, ok bool) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return chirpCursor{}, false
+	}
+
+	if err := json.Unmarshal(data, &c); err != nil || c.LastId <= 0 {
+		return chirpCursor{}, false
+	}
+
+	return c, true
 }
 
 func cleanChirp(body string) string {
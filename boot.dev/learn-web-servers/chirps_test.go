@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mosamadeeb/chirpy/internal/chirpydb"
+)
+
+const testJwtSecret = "test-secret"
+
+func newTestServer(t *testing.T) serverState {
+	t.Helper()
+
+	db, err := chirpydb.NewDB(filepath.Join(t.TempDir(), "database.json"), false)
+	if err != nil {
+		t.Fatalf("could not create database: %v", err)
+	}
+
+	keys, err := newSecretJWTKeyset(testJwtSecret)
+	if err != nil {
+		t.Fatalf("could not create JWT keys: %v", err)
+	}
+
+	state := newServerState(http.NewServeMux(), &apiConfig{jwtKeys: keys}, db)
+	state.handleApi()
+
+	return state
+}
+
+// Creates a user directly in the database and returns a valid access token for it
+func newTestUser(t *testing.T, s serverState, email string) (chirpydb.User, string) {
+	t.Helper()
+
+	user, err := s.DB.CreateUser(email, "not-a-real-hash")
+	if err != nil {
+		t.Fatalf("could not create user: %v", err)
+	}
+
+	token, err := createJWT(user.Id, time.Hour, s.ApiCfg.jwtKeys)
+	if err != nil {
+		t.Fatalf("could not create JWT: %v", err)
+	}
+
+	return user, token
+}
+
+func TestCreateChirpsConcurrently(t *testing.T) {
+	const numChirps = 200
+
+	s := newTestServer(t)
+	user, token := newTestUser(t, s, "chirper@example.com")
+
+	var wg sync.WaitGroup
+	codes := make(chan int, numChirps)
+	for i := 0; i < numChirps; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			req := httptest.NewRequest("POST", "/api/chirps", strings.NewReader(fmt.Sprintf(`{"body":"chirp %d"}`, i)))
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			s.Mux.ServeHTTP(rec, req)
+
+			codes <- rec.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	for code := range codes {
+		if code != http.StatusCreated {
+			t.Errorf("expected status %d, got %d", http.StatusCreated, code)
+			return
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.Mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/chirps", nil))
+
+	var chirps []chirpydb.Chirp
+	if err := json.NewDecoder(rec.Body).Decode(&chirps); err != nil {
+		t.Errorf("could not decode chirps: %v", err)
+		return
+	}
+
+	if len(chirps) != numChirps {
+		t.Errorf("expected %d chirps, got %d", numChirps, len(chirps))
+		return
+	}
+
+	bodies := map[string]bool{}
+	for i, c := range chirps {
+		if c.Id != i+1 {
+			t.Errorf("expected chirp ID %d, got %d", i+1, c.Id)
+			return
+		}
+		if c.AuthorId != user.Id {
+			t.Errorf("expected author ID %d, got %d", user.Id, c.AuthorId)
+			return
+		}
+		bodies[c.Body] = true
+	}
+
+	if len(bodies) != numChirps {
+		t.Errorf("expected %d distinct chirp bodies, got %d", numChirps, len(bodies))
+	}
+}
+
+func TestListChirpsPagination(t *testing.T) {
+	s := newTestServer(t)
+	user, _ := newTestUser(t, s, "chirper@example.com")
+
+	for i := 0; i < 10; i++ {
+		if _, err := s.DB.CreateChirp(fmt.Sprintf("chirp %d", i), user.Id); err != nil {
+			t.Errorf("could not create chirp: %v", err)
+			return
+		}
+	}
+
+	get := func(path string) ([]chirpydb.Chirp, string, int) {
+		rec := httptest.NewRecorder()
+		s.Mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+
+		var chirps []chirpydb.Chirp
+		json.NewDecoder(rec.Body).Decode(&chirps)
+
+		next := ""
+		if link := rec.Header().Get("Link"); link != "" {
+			next = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+
+		return chirps, next, rec.Code
+	}
+
+	for _, sortOrder := range []string{"asc", "desc", "created_at", "-created_at"} {
+		var seen []int
+		path := fmt.Sprintf("/api/chirps?sort=%s&author_id=%d&limit=4", sortOrder, user.Id)
+
+		for pages := 0; path != ""; pages++ {
+			if pages > 10 {
+				t.Errorf("too many pages")
+				return
+			}
+
+			chirps, next, code := get(path)
+			if code != http.StatusOK {
+				t.Errorf("expected status %d for %s, got %d", http.StatusOK, path, code)
+				return
+			}
+
+			for _, c := range chirps {
+				seen = append(seen, c.Id)
+			}
+
+			// Changes between pages don't make the walk skip or repeat anything
+			if pages == 0 {
+				if err := s.DB.DeleteChirp(seen[len(seen)-1]); err != nil {
+					t.Errorf("could not delete chirp: %v", err)
+					return
+				}
+				if _, err := s.DB.CreateChirp("late", user.Id); err != nil {
+					t.Errorf("could not create chirp: %v", err)
+					return
+				}
+			}
+
+			path = next
+		}
+
+		for i := 1; i < len(seen); i++ {
+			// Chirps are created in ID order, so sorting by time gives the same order
+			ascending := sortOrder == "asc" || sortOrder == "created_at"
+			if ascending != (seen[i] > seen[i-1]) {
+				t.Errorf("expected %s order, got %v", sortOrder, seen)
+				return
+			}
+		}
+
+		if len(seen) < 10 {
+			t.Errorf("expected the walk to visit every chirp that was there all along, got %v", seen)
+			return
+		}
+	}
+
+	_, next, _ := get("/api/chirps?limit=2")
+	if next == "" {
+		t.Errorf("expected a next page")
+		return
+	}
+
+	// Cursors only continue the listing they came from
+	cursor := next[strings.Index(next, "cursor=")+len("cursor="):]
+	cursor, _, _ = strings.Cut(cursor, "&")
+	for _, path := range []string{
+		"/api/chirps?sort=desc&limit=2&cursor=" + cursor,
+		"/api/chirps?sort=created_at&limit=2&cursor=" + cursor,
+		fmt.Sprintf("/api/chirps?author_id=%d&limit=2&cursor=%s", user.Id, cursor),
+		"/api/chirps?cursor=garbage",
+		"/api/chirps?limit=0",
+		"/api/chirps?limit=100000",
+		"/api/chirps?author_id=0",
+		"/api/chirps?author_id=-1",
+	} {
+		if _, _, code := get(path); code != http.StatusBadRequest {
+			t.Errorf("expected status %d for %s, got %d", http.StatusBadRequest, path, code)
+			return
+		}
+	}
+}
+
+func TestSearchChirps(t *testing.T) {
+	s := newTestServer(t)
+	user, _ := newTestUser(t, s, "chirper@example.com")
+
+	for _, body := range []string{"I like <b>cats</b>", "dogs are great", "cats and dogs"} {
+		if _, err := s.DB.CreateChirp(body, user.Id); err != nil {
+			t.Errorf("could not create chirp: %v", err)
+			return
+		}
+	}
+
+	cases := []struct {
+		query    string
+		code     int
+		expected []int
+	}{
+		{"q=cats", http.StatusOK, []int{3, 1}},
+		{"q=cats+-dogs", http.StatusOK, []int{1}},
+		{"q=%22cats+and%22", http.StatusOK, []int{3}},
+		{"q=cats&limit=1", http.StatusOK, []int{3}},
+		{"q=", http.StatusBadRequest, nil},
+		{"q=(cats", http.StatusBadRequest, nil},
+		{"q=cats&limit=0", http.StatusBadRequest, nil},
+	}
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		s.Mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/chirps/search?"+c.query, nil))
+
+		if rec.Code != c.code {
+			t.Errorf("expected status %d for %s, got %d", c.code, c.query, rec.Code)
+			return
+		}
+		if c.code != http.StatusOK {
+			continue
+		}
+
+		var results []chirpydb.SearchResult
+		if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+			t.Errorf("could not decode results: %v", err)
+			return
+		}
+
+		ids := []int{}
+		for _, r := range results {
+			ids = append(ids, r.Id)
+		}
+		if !slices.Equal(ids, c.expected) {
+			t.Errorf("expected %v for %s, got %v", c.expected, c.query, ids)
+			return
+		}
+
+		if c.query == "q=cats+-dogs" && results[0].Highlighted != "I like &lt;b&gt;<mark>cats</mark>&lt;/b&gt;" {
+			t.Errorf("unexpected highlight %q", results[0].Highlighted)
+			return
+		}
+	}
+}
+
+func TestListChirpsTimeRange(t *testing.T) {
+	s := newTestServer(t)
+	user, _ := newTestUser(t, s, "chirper@example.com")
+
+	var all []chirpydb.Chirp
+	for i := 0; i < 5; i++ {
+		chirp, err := s.DB.CreateChirp(fmt.Sprintf("chirp %d", i), user.Id)
+		if err != nil {
+			t.Errorf("could not create chirp: %v", err)
+			return
+		}
+		all = append(all, chirp)
+	}
+
+	get := func(path string) ([]map[string]any, int) {
+		rec := httptest.NewRecorder()
+		s.Mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+
+		var chirps []map[string]any
+		json.NewDecoder(rec.Body).Decode(&chirps)
+
+		return chirps, rec.Code
+	}
+
+	// Times go out in RFC 3339 and can be passed back in as they are
+	chirps, code := get("/api/chirps")
+	if code != http.StatusOK || len(chirps) != len(all) {
+		t.Errorf("expected %d chirps, got %d with status %d", len(all), len(chirps), code)
+		return
+	}
+	createdAt, _ := chirps[1]["created_at"].(string)
+	since, err := time.Parse(time.RFC3339, createdAt)
+	if err != nil || !since.Equal(all[1].CreatedAt) {
+		t.Errorf("expected created_at %v in RFC 3339, got %q", all[1].CreatedAt, createdAt)
+		return
+	}
+	until := all[3].CreatedAt.Format(time.RFC3339Nano)
+
+	var expected []float64
+	for _, c := range all {
+		if !c.CreatedAt.Before(since) && c.CreatedAt.Before(all[3].CreatedAt) {
+			expected = append(expected, float64(c.Id))
+		}
+	}
+
+	chirps, code = get("/api/chirps?" + url.Values{"since": {createdAt}, "until": {until}}.Encode())
+	if code != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, code)
+		return
+	}
+
+	var ids []float64
+	for _, c := range chirps {
+		ids = append(ids, c["id"].(float64))
+	}
+	if !slices.Equal(ids, expected) {
+		t.Errorf("expected %v between %s and %s, got %v", expected, createdAt, until, ids)
+		return
+	}
+
+	for _, path := range []string{
+		"/api/chirps?since=yesterday",
+		"/api/chirps?until=2024-01-01",
+		"/api/chirps?sort=updated_at",
+	} {
+		if _, code := get(path); code != http.StatusBadRequest {
+			t.Errorf("expected status %d for %s, got %d", http.StatusBadRequest, path, code)
+			return
+		}
+	}
+}
+
+func TestEditChirp(t *testing.T) {
+	s := newTestServer(t)
+	s.ApiCfg.editWindow = time.Hour
+	author, authorToken := newTestUser(t, s, "author@example.com")
+	_, otherToken := newTestUser(t, s, "other@example.com")
+
+	chirp, err := s.DB.CreateChirp("first", author.Id)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	edit := func(method, token, body string) (chirpydb.Chirp, int) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, fmt.Sprintf("/api/chirps/%d", chirp.Id), strings.NewReader(fmt.Sprintf(`{"body": %q}`, body)))
+		req.Header.Set("Authorization", "Bearer "+token)
+		s.Mux.ServeHTTP(rec, req)
+
+		var edited chirpydb.Chirp
+		json.NewDecoder(rec.Body).Decode(&edited)
+
+		return edited, rec.Code
+	}
+
+	if _, code := edit("PUT", otherToken, "hijacked"); code != http.StatusForbidden {
+		t.Errorf("expected status %d when editing someone else's chirp, got %d", http.StatusForbidden, code)
+		return
+	}
+	if _, code := edit("PUT", authorToken, strings.Repeat("a", 141)); code != http.StatusBadRequest {
+		t.Errorf("expected status %d for a long chirp, got %d", http.StatusBadRequest, code)
+		return
+	}
+
+	edited, code := edit("PUT", authorToken, "second kerfuffle")
+	if code != http.StatusOK || edited.Body != "second ****" || !edited.Edited {
+		t.Errorf("expected a cleaned up edited chirp, got %v with status %d", edited, code)
+		return
+	}
+	if edited, code = edit("PATCH", authorToken, "third"); code != http.StatusOK || edited.Body != "third" {
+		t.Errorf("expected PATCH to edit the chirp, got %v with status %d", edited, code)
+		return
+	}
+
+	rec := httptest.NewRecorder()
+	s.Mux.ServeHTTP(rec, httptest.NewRequest("GET", fmt.Sprintf("/api/chirps/%d/revisions", chirp.Id), nil))
+	var revisions []chirpydb.ChirpRevision
+	json.NewDecoder(rec.Body).Decode(&revisions)
+	if rec.Code != http.StatusOK || len(revisions) != 2 || revisions[0].Body != "first" || revisions[1].Body != "second ****" {
+		t.Errorf("expected both earlier versions, got %v with status %d", revisions, rec.Code)
+		return
+	}
+
+	rec = httptest.NewRecorder()
+	s.Mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/chirps/100/revisions", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for revisions of a missing chirp, got %d", http.StatusNotFound, rec.Code)
+		return
+	}
+
+	// Once the window closes, only Chirpy Red users can keep editing
+	s.ApiCfg.editWindow = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, code := edit("PUT", authorToken, "too late"); code != http.StatusForbidden {
+		t.Errorf("expected status %d after the edit window, got %d", http.StatusForbidden, code)
+		return
+	}
+
+	if err := s.DB.SetUserChirpyRed(author.Id, true); err != nil {
+		t.Errorf("could not upgrade user: %v", err)
+		return
+	}
+	if _, code := edit("PUT", authorToken, "red edit"); code != http.StatusOK {
+		t.Errorf("expected Chirpy Red users to edit after the window, got status %d", code)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/mosamadeeb/chirpy/internal/chirpydb"
+)
+
+const cliUsage = `usage: chirpy [flags] <command>
+
+Commands:
+  snapshot create          Take a snapshot of the database
+  snapshot list            List snapshots, newest first
+  snapshot restore <name>  Replace the database with a snapshot
+  db encrypt               Rewrite the JSON database, its backups and snapshots under the active encryption key
+  db decrypt [file]        Write the decrypted JSON database to a file, or to stdout
+  db check [-repair] [-json]
+                           Check the JSON database for inconsistencies, and optionally repair them
+
+Run without a command to start the server.
+`
+
+// Runs a command given on the command line instead of starting the server
+func runCommand(args []string, db chirpydb.Store, snapshots *chirpydb.Snapshots) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no command given\n%s", cliUsage)
+	}
+
+	switch args[0] {
+	case "snapshot":
+		return runSnapshotCommand(args[1:], snapshots)
+	case "db":
+		return runDBCommand(args[1:], db, snapshots)
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], cliUsage)
+	}
+}
+
+func runSnapshotCommand(args []string, snapshots *chirpydb.Snapshots) error {
+	if snapshots == nil {
+		return fmt.Errorf("the storage backend does not support snapshots")
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("missing snapshot command\n%s", cliUsage)
+	}
+
+	switch args[0] {
+	case "create":
+		snapshot, err := snapshots.Create()
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Created snapshot %s (%d bytes)\n", snapshot.Name, snapshot.Size)
+	case "list":
+		list, err := snapshots.List()
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSIZE\tCREATED")
+		for _, s := range list {
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", s.Name, s.Size, s.CreatedAt.Local().Format("2006-01-02 15:04:05"))
+		}
+		tw.Flush()
+	case "restore":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: chirpy snapshot restore <name>")
+		}
+
+		if err := snapshots.Restore(args[1]); err != nil {
+			return err
+		}
+
+		fmt.Printf("Restored snapshot %s\n", args[1])
+	default:
+		return fmt.Errorf("unknown snapshot command %q\n%s", args[0], cliUsage)
+	}
+
+	return nil
+}
+
+func runDBCommand(args []string, store chirpydb.Store, snapshots *chirpydb.Snapshots) error {
+	db, ok := store.(*chirpydb.DB)
+	if !ok {
+		return fmt.Errorf("database commands are only supported by the %s backend", chirpydb.BackendJSON)
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("missing db command\n%s", cliUsage)
+	}
+
+	switch args[0] {
+	case "encrypt":
+		if db.Keyring() == nil {
+			return fmt.Errorf("no encryption keys given, set DB_ENCRYPTION_KEYS or DB_ENCRYPTION_KEYS_FILE")
+		}
+
+		if err := db.Reencrypt(); err != nil {
+			return err
+		}
+		if snapshots != nil {
+			if err := snapshots.Reencrypt(db.Keyring()); err != nil {
+				return err
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "Encrypted database with key %s\n", db.Keyring().ActiveKeyId())
+	case "check":
+		return runDBCheck(args[1:], db)
+	default:
+		return fmt.Errorf("unknown db command %q\n%s", args[0], cliUsage)
+	}
+
+	return nil
+}
+
+// Runs db decrypt, which reads the database file without opening the database, see chirpydb.WritePlaintextFile
+func runDBDecrypt(args []string, backend string, path string, keys *chirpydb.Keyring) error {
+	if backend != chirpydb.BackendJSON {
+		return fmt.Errorf("database commands are only supported by the %s backend", chirpydb.BackendJSON)
+	}
+
+	if len(args) > 1 {
+		return fmt.Errorf("usage: chirpy db decrypt [file]")
+	}
+
+	if len(args) == 0 {
+		return chirpydb.WritePlaintextFile(path, keys, os.Stdout)
+	}
+
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := chirpydb.WritePlaintextFile(path, keys, f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Wrote decrypted database to %s\n", args[0])
+	return nil
+}
+
+func runDBCheck(args []string, db *chirpydb.DB) error {
+	flags := flag.NewFlagSet("db check", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "Repair the issues that can be repaired")
+	asJson := flags.Bool("json", false, "Print the issues as JSON")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	check := db.Verify
+	if *repair {
+		check = db.Repair
+	}
+
+	issues, err := check()
+	if err != nil {
+		return err
+	}
+
+	if *asJson {
+		if issues == nil {
+			issues = []chirpydb.Issue{}
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(issues); err != nil {
+			return err
+		}
+	} else if len(issues) == 0 {
+		fmt.Println("No issues found")
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KIND\tTABLE\tKEY\tPROBLEM\tREPAIRED")
+		for _, issue := range issues {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\n", issue.Kind, issue.Table, issue.Key, issue.Message, issue.Repaired)
+		}
+		tw.Flush()
+	}
+
+	// Fail like fsck does, so scripts can tell something needs attention
+	remaining := 0
+	for _, issue := range issues {
+		if !issue.Repaired {
+			remaining++
+		}
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%d issues left unrepaired", remaining)
+	}
+
+	return nil
+}
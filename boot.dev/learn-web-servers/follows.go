@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mosamadeeb/chirpy/internal/chirpydb"
+)
+
+// Limits on how many chirps GET /api/timeline returns
+const (
+	defaultTimelineLimit = 20
+	maxTimelineLimit     = 100
+)
+
+// What anyone can see about a user, unlike userRes it does not have their email
+type profileRes struct {
+	Id             int `json:"id"`
+	FollowerCount  int `json:"follower_count"`
+	FollowingCount int `json:"following_count"`
+}
+
+func createProfileRes(u chirpydb.User) profileRes {
+	return profileRes{u.Id, u.FollowerCount, u.FollowingCount}
+}
+
+// A page of followers or followed users, along with how many there are in total
+type followListRes struct {
+	Count int         `json:"count"`
+	Users []followRes `json:"users"`
+}
+
+type followRes struct {
+	UserId    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (s serverState) handleFollowsApi() {
+	// Following twice, or unfollowing someone you don't follow, is not an error
+	follow := func(w http.ResponseWriter, r *http.Request) {
+		userId := callerId(r)
+
+		followeeId, err := strconv.Atoi(r.PathValue("userID"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var followee chirpydb.User
+		if r.Method == http.MethodDelete {
+			followee, err = s.DB.Unfollow(userId, followeeId)
+		} else {
+			followee, err = s.DB.Follow(userId, followeeId)
+		}
+		if err != nil {
+			if errors.Is(err, chirpydb.ErrFollowSelf) {
+				respondWithError(w, http.StatusBadRequest, "Users can't follow themselves")
+				return
+			}
+
+			if errors.Is(err, chirpydb.ErrNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			log.Printf("Error saving follow to database: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, createProfileRes(followee))
+	}
+
+	s.Mux.HandleFunc("POST /api/users/{userID}/follow", s.requireAuth(requireScope(scopeUsersWrite))(follow))
+	s.Mux.HandleFunc("DELETE /api/users/{userID}/follow", s.requireAuth(requireScope(scopeUsersWrite))(follow))
+
+	for _, listing := range []struct {
+		path   string
+		count  func(u chirpydb.User) int
+		list   func(userId int, opts chirpydb.ListOptions) ([]chirpydb.Follow, error)
+		userId func(f chirpydb.Follow) int
+	}{
+		{
+			"followers",
+			func(u chirpydb.User) int { return u.FollowerCount },
+			s.DB.GetFollowers,
+			func(f chirpydb.Follow) int { return f.FollowerId },
+		},
+		{
+			"following",
+			func(u chirpydb.User) int { return u.FollowingCount },
+			s.DB.GetFollowing,
+			func(f chirpydb.Follow) int { return f.FolloweeId },
+		},
+	} {
+		// Sorted by user ID
+		s.Mux.HandleFunc("GET /api/users/{userID}/"+listing.path, func(w http.ResponseWriter, r *http.Request) {
+			userId, err := strconv.Atoi(r.PathValue("userID"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			opts, err := idPageOptions(r.URL.Query(), listing.path, userId)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			user, err := s.DB.GetUser(userId)
+			if err != nil {
+				if errors.Is(err, chirpydb.ErrNotExist) {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				log.Printf("Error loading user from database: %v\n", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			// Ask for one more than the limit, to know whether there is a next page
+			pageOpts := opts
+			if opts.Limit > 0 {
+				pageOpts.Limit++
+			}
+
+			follows, err := listing.list(userId, pageOpts)
+			if err != nil {
+				if errors.Is(err, chirpydb.ErrNotExist) {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				log.Printf("Error loading %s from database: %v\n", listing.path, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if opts.Limit > 0 && len(follows) > opts.Limit {
+				follows = follows[:opts.Limit]
+				setNextPageLink(w, r, listing.path, userId, listing.userId(follows[len(follows)-1]))
+			}
+
+			res := followListRes{Count: listing.count(user), Users: make([]followRes, len(follows))}
+			for i, f := range follows {
+				res.Users[i] = followRes{listing.userId(f), f.CreatedAt}
+			}
+
+			respondWithJSON(w, http.StatusOK, res)
+		})
+	}
+
+	// Chirps of the users the caller follows, newest first
+	s.Mux.HandleFunc("GET /api/timeline", s.requireAuth()(func(w http.ResponseWriter, r *http.Request) {
+		userId := callerId(r)
+
+		query := r.URL.Query()
+		opts := chirpydb.ListOptions{SortBy: chirpydb.SortByCreatedAt, Desc: true, Limit: defaultTimelineLimit}
+
+		var err error
+		if limitStr := query.Get("limit"); limitStr != "" {
+			if opts.Limit, err = strconv.Atoi(limitStr); err != nil || opts.Limit <= 0 || opts.Limit > maxTimelineLimit {
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Limit must be between 1 and %d", maxTimelineLimit))
+				return
+			}
+		}
+
+		if cursor := query.Get("cursor"); cursor != "" {
+			c, ok := decodeChirpCursor(cursor)
+			if !ok || c.Sort != "timeline" || c.AuthorId != userId {
+				respondWithError(w, http.StatusBadRequest, "Invalid cursor")
+				return
+			}
+
+			opts.After, opts.AfterTime = c.LastId, c.LastCreatedAt
+		}
+
+		pageOpts := opts
+		pageOpts.Limit++
+
+		chirps, err := s.DB.GetTimeline(userId, pageOpts)
+		if err != nil {
+			if errors.Is(err, chirpydb.ErrNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			log.Printf("Error loading timeline from database: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if len(chirps) > opts.Limit {
+			chirps = chirps[:opts.Limit]
+
+			next := query
+			last := chirps[len(chirps)-1]
+			next.Set("cursor", encodeChirpCursor(chirpCursor{"timeline", userId, last.Id, last.CreatedAt}))
+			nextUrl := url.URL{Path: r.URL.Path, RawQuery: next.Encode()}
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextUrl.String()))
+		}
+
+		res, err := s.createChirpResponses(userId, chirps)
+		if err != nil {
+			log.Printf("Error loading reactions from database: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, res)
+	}))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFollowsAndTimeline(t *testing.T) {
+	s := newTestServer(t)
+	reader, readerToken := newTestUser(t, s, "reader@example.com")
+	author, authorToken := newTestUser(t, s, "author@example.com")
+	other, _ := newTestUser(t, s, "other@example.com")
+
+	do := func(method, path, token string, v any) (int, http.Header) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		s.Mux.ServeHTTP(rec, req)
+
+		if v != nil {
+			json.NewDecoder(rec.Body).Decode(v)
+		}
+
+		return rec.Code, rec.Header()
+	}
+
+	followPath := fmt.Sprintf("/api/users/%d/follow", author.Id)
+
+	if code, _ := do("POST", followPath, "", nil); code != http.StatusUnauthorized {
+		t.Errorf("expected status %d when following without a token, got %d", http.StatusUnauthorized, code)
+		return
+	}
+	if code, _ := do("POST", fmt.Sprintf("/api/users/%d/follow", reader.Id), readerToken, nil); code != http.StatusBadRequest {
+		t.Errorf("expected status %d when following yourself, got %d", http.StatusBadRequest, code)
+		return
+	}
+	if code, _ := do("POST", "/api/users/100/follow", readerToken, nil); code != http.StatusNotFound {
+		t.Errorf("expected status %d when following a missing user, got %d", http.StatusNotFound, code)
+		return
+	}
+
+	var profile map[string]any
+	for range 2 {
+		if code, _ := do("POST", followPath, readerToken, &profile); code != http.StatusOK {
+			t.Errorf("expected status %d when following, got %d", http.StatusOK, code)
+			return
+		}
+	}
+	if profile["follower_count"] != 1.0 || profile["email"] != nil {
+		t.Errorf("expected the author's public profile with one follower, got %v", profile)
+		return
+	}
+
+	var followers followListRes
+	if code, _ := do("GET", fmt.Sprintf("/api/users/%d/followers", author.Id), "", &followers); code != http.StatusOK ||
+		followers.Count != 1 || len(followers.Users) != 1 || followers.Users[0].UserId != reader.Id {
+		t.Errorf("expected the reader to follow the author, got %v with status %d", followers, code)
+		return
+	}
+	var following followListRes
+	if code, _ := do("GET", fmt.Sprintf("/api/users/%d/following", reader.Id), "", &following); code != http.StatusOK ||
+		following.Count != 1 || len(following.Users) != 1 || following.Users[0].UserId != author.Id {
+		t.Errorf("expected the reader to follow the author, got %v with status %d", following, code)
+		return
+	}
+
+	for i := range 3 {
+		if _, err := s.DB.CreateChirp(fmt.Sprintf("chirp %d", i), author.Id); err != nil {
+			t.Errorf("could not create chirp: %v", err)
+			return
+		}
+	}
+	if _, err := s.DB.CreateChirp("not followed", other.Id); err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	if code, _ := do("GET", "/api/timeline", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("expected status %d for the timeline without a token, got %d", http.StatusUnauthorized, code)
+		return
+	}
+
+	var bodies []string
+	next := "/api/timeline?limit=2"
+	for pages := 0; next != ""; pages++ {
+		if pages > 3 {
+			t.Errorf("too many pages")
+			return
+		}
+
+		var chirps []chirpRes
+		code, header := do("GET", next, readerToken, &chirps)
+		if code != http.StatusOK {
+			t.Errorf("expected status %d for the timeline, got %d", http.StatusOK, code)
+			return
+		}
+		for _, c := range chirps {
+			bodies = append(bodies, c.Body)
+		}
+
+		next = ""
+		if link := header.Get("Link"); link != "" {
+			next = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+
+	if strings.Join(bodies, ",") != "chirp 2,chirp 1,chirp 0" {
+		t.Errorf("expected the author's chirps newest first, got %v", bodies)
+		return
+	}
+
+	// Cursors belong to whoever asked for the timeline
+	var chirps []chirpRes
+	_, header := do("GET", "/api/timeline?limit=1", readerToken, &chirps)
+	link := strings.TrimSuffix(strings.TrimPrefix(header.Get("Link"), "<"), `>; rel="next"`)
+	if code, _ := do("GET", link, authorToken, nil); code != http.StatusBadRequest {
+		t.Errorf("expected status %d for someone else's cursor, got %d", http.StatusBadRequest, code)
+		return
+	}
+
+	if code, _ := do("DELETE", followPath, readerToken, &profile); code != http.StatusOK || profile["follower_count"] != 0.0 {
+		t.Errorf("expected no followers after unfollowing, got %v with status %d", profile, code)
+		return
+	}
+	if code, _ := do("GET", "/api/timeline", readerToken, &chirps); code != http.StatusOK || len(chirps) != 0 {
+		t.Errorf("expected an empty timeline after unfollowing, got %v with status %d", chirps, code)
+	}
+}
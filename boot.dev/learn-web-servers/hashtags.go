@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mosamadeeb/chirpy/internal/chirpydb"
+)
+
+// Limits on the window GET /api/trending looks at, and how many hashtags it returns
+const (
+	defaultTrendingWindow = 24 * time.Hour
+	maxTrendingWindow     = 7 * 24 * time.Hour
+	defaultTrendingLimit  = 10
+	maxTrendingLimit      = 50
+)
+
+func (s serverState) handleHashtagsApi() {
+	// Chirps with a hashtag, newest first
+	s.Mux.HandleFunc("GET /api/hashtags/{tag}", s.optionalAuth(func(w http.ResponseWriter, r *http.Request) {
+		tag, ok := chirpydb.NormalizeHashtag(r.PathValue("tag"))
+		if !ok {
+			respondWithError(w, http.StatusBadRequest, "Invalid hashtag")
+			return
+		}
+
+		viewerId := callerId(r)
+
+		listing := "hashtag:" + tag
+		opts, err := idPageOptions(r.URL.Query(), listing, 0)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		opts.Desc = true
+
+		// Ask for one more than the limit, to know whether there is a next page
+		pageOpts := opts
+		if opts.Limit > 0 {
+			pageOpts.Limit++
+		}
+
+		chirps, err := s.DB.GetChirpsByHashtag(tag, pageOpts)
+		if err != nil {
+			log.Printf("Error loading chirps from database: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if opts.Limit > 0 && len(chirps) > opts.Limit {
+			chirps = chirps[:opts.Limit]
+			setNextPageLink(w, r, listing, 0, chirps[len(chirps)-1].Id)
+		}
+
+		res, err := s.createChirpResponses(viewerId, chirps)
+		if err != nil {
+			log.Printf("Error loading reactions from database: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, res)
+	}))
+
+	// Hashtags used the most in the window, where recent uses count more than older ones
+	s.Mux.HandleFunc("GET /api/trending", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		window := defaultTrendingWindow
+		if windowStr := query.Get("window"); windowStr != "" {
+			var err error
+			if window, err = time.ParseDuration(windowStr); err != nil || window <= 0 || window > maxTrendingWindow {
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Window must be a duration up to %s", maxTrendingWindow))
+				return
+			}
+		}
+
+		limit := defaultTrendingLimit
+		if limitStr := query.Get("limit"); limitStr != "" {
+			var err error
+			if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 || limit > maxTrendingLimit {
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Limit must be between 1 and %d", maxTrendingLimit))
+				return
+			}
+		}
+
+		trending, err := s.DB.TrendingHashtags(chirpydb.TrendingOptions{
+			Now:    time.Now().UTC(),
+			Window: window,
+			// Uses from the start of the window count a sixteenth as much as new ones
+			HalfLife: window / 4,
+			Limit:    limit,
+		})
+		if err != nil {
+			log.Printf("Error loading trending hashtags from database: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, trending)
+	})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mosamadeeb/chirpy/internal/chirpydb"
+)
+
+func TestHashtagsAndMentions(t *testing.T) {
+	s := newTestServer(t)
+	_, token := newTestUser(t, s, "chirper@example.com")
+	friend, _ := newTestUser(t, s, "friend@example.com")
+
+	post := func(body string) (chirpydb.Chirp, int) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/chirps", strings.NewReader(fmt.Sprintf(`{"body": %q}`, body)))
+		req.Header.Set("Authorization", "Bearer "+token)
+		s.Mux.ServeHTTP(rec, req)
+
+		var chirp chirpydb.Chirp
+		json.NewDecoder(rec.Body).Decode(&chirp)
+
+		return chirp, rec.Code
+	}
+
+	chirp, code := post(fmt.Sprintf("#Go is great @%d", friend.Id))
+	if code != http.StatusCreated || len(chirp.Mentions) != 1 || chirp.Mentions[0] != friend.Id || len(chirp.Hashtags) != 1 || chirp.Hashtags[0] != "go" {
+		t.Errorf("expected the chirp to mention the friend and be tagged go, got %v with status %d", chirp, code)
+		return
+	}
+	for _, body := range []string{"#go #news", "#news"} {
+		if _, code := post(body); code != http.StatusCreated {
+			t.Errorf("could not create chirp, got status %d", code)
+			return
+		}
+	}
+
+	get := func(path string, v any) int {
+		rec := httptest.NewRecorder()
+		s.Mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		json.NewDecoder(rec.Body).Decode(v)
+		return rec.Code
+	}
+
+	var chirps []chirpRes
+	if code := get("/api/hashtags/GO", &chirps); code != http.StatusOK || len(chirps) != 2 || chirps[0].Id != 2 || chirps[1].Id != 1 {
+		t.Errorf("expected both chirps tagged go newest first, got %v with status %d", chirps, code)
+		return
+	}
+	if code := get("/api/hashtags/no%20tag", &chirps); code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid hashtag, got %d", http.StatusBadRequest, code)
+		return
+	}
+
+	var trending []chirpydb.TrendingTag
+	if code := get("/api/trending?limit=1", &trending); code != http.StatusOK || len(trending) != 1 || trending[0].Count != 2 {
+		t.Errorf("expected the top hashtag with 2 uses, got %v with status %d", trending, code)
+		return
+	}
+	if code := get("/api/trending?window=forever", &trending); code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid window, got %d", http.StatusBadRequest, code)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// Serves a request with h, which is usually the server's mux, and records the response
+// auth is the whole Authorization header, left out if empty, and headers are extra name and value pairs
+// If v is not nil, the response body is decoded into it
+func doRequest(h http.Handler, method, path, auth, body string, v any, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if v != nil {
+		json.NewDecoder(rec.Body).Decode(v)
+	}
+
+	return rec
+}
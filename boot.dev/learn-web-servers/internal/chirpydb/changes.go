@@ -0,0 +1,608 @@
+package chirpydb
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Every committed change to a chirp or a user is recorded in an ordered change feed, so that other tools can follow along
+// Refresh tokens are secrets and are left out of the feed, as are password hashes
+
+type ChangeOp string
+
+const (
+	ChangeCreate ChangeOp = "create"
+	ChangeUpdate ChangeOp = "update"
+	ChangeDelete ChangeOp = "delete"
+)
+
+// Entity types in the change feed
+const (
+	EntityChirp = "chirp"
+	EntityUser  = "user"
+)
+
+// Tables that are part of the change feed, and the entity type their changes are reported as
+var feedEntities = map[string]string{
+	tableChirps: EntityChirp,
+	tableUsers:  EntityUser,
+}
+
+type ChangeEvent struct {
+	// Sequence numbers start at 1 and have no gaps
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Op     ChangeOp  `json:"op"`
+	Entity string    `json:"entity"`
+	Id     string    `json:"id"`
+
+	// Before is missing for creates, and After for deletes
+	Before json.RawMessage `json:"before,omitempty"`
+	After  json.RawMessage `json:"after,omitempty"`
+}
+
+// The JSON database keeps its change feed in a log file next to it with this suffix
+const changesSuffix = ".changes"
+
+// How many of the latest changes the JSON database keeps in memory, so that subscribers that are keeping up
+// don't have to read the log file
+const recentChangesSize = 1024
+
+// Subscribers check for new changes this often even if they are not woken up,
+// which catches changes made by other processes
+const subscribePollInterval = time.Second
+
+// How many changes subscribers read at a time
+const subscribeBatchSize = 100
+
+// Every this many changes, the JSON database remembers where in the log a change starts,
+// so reading old changes doesn't have to start at the beginning of the log
+const changeIndexInterval = 256
+
+// Where a change starts in the change log
+type changeOffset struct {
+	seq    uint64
+	offset int64
+}
+
+// Marshals an entity for the change feed, without any secrets
+func feedValue(v any) (json.RawMessage, error) {
+	if user, ok := v.(User); ok {
+		user.Password = ""
+		v = user
+	}
+
+	return json.Marshal(v)
+}
+
+// Turns a change into an event, or returns false if the change is not part of the feed
+func newChangeEvent(c change, seq uint64, now time.Time) (ChangeEvent, bool, error) {
+	entity, ok := feedEntities[c.Table]
+	if !ok {
+		return ChangeEvent{}, false, nil
+	}
+
+	event := ChangeEvent{
+		Seq:    seq,
+		Time:   now,
+		Op:     ChangeUpdate,
+		Entity: entity,
+		Id:     fmt.Sprint(c.Key),
+	}
+
+	var err error
+	if c.Before == nil {
+		event.Op = ChangeCreate
+	} else if event.Before, err = feedValue(c.Before); err != nil {
+		return ChangeEvent{}, false, err
+	}
+
+	if c.After == nil {
+		event.Op = ChangeDelete
+	} else if event.After, err = feedValue(c.After); err != nil {
+		return ChangeEvent{}, false, err
+	}
+
+	return event, true, nil
+}
+
+// Numbers the changes of a transaction that are part of the feed, continuing from ChangeSeq
+func (s *DBStructure) newChangeEvents(changes []change, now time.Time) ([]ChangeEvent, error) {
+	var events []ChangeEvent
+
+	for _, c := range changes {
+		event, ok, err := newChangeEvent(c, s.ChangeSeq+1, now)
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling change: %w", err)
+		}
+		if !ok {
+			continue
+		}
+
+		events = append(events, event)
+		s.ChangeSeq++
+	}
+
+	return events, nil
+}
+
+// Lists the changes that turn one version of a table into another, in key order
+func diffTable[K comparable, T any](table string, before, after map[K]T, less func(a, b K) int) []change {
+	keys := slices.Collect(maps.Keys(before))
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.SortFunc(keys, less)
+
+	var changes []change
+	for _, k := range keys {
+		b, hadBefore := before[k]
+		a, hasAfter := after[k]
+
+		switch {
+		case !hadBefore:
+			changes = append(changes, change{Table: table, Key: k, After: a})
+		case !hasAfter:
+			changes = append(changes, change{Table: table, Key: k, Before: b})
+		case !reflect.DeepEqual(a, b):
+			changes = append(changes, change{Table: table, Key: k, Before: b, After: a})
+		}
+	}
+
+	return changes
+}
+
+// Lists the changes to the tables in the feed that turn one structure into another
+func diffFeedTables(before, after *DBStructure) []change {
+	return slices.Concat(
+		diffTable(tableChirps, before.Chirps.Items, after.Chirps.Items, cmp.Compare[int]),
+		diffTable(tableUsers, before.Users.Items, after.Users.Items, cmp.Compare[int]),
+	)
+}
+
+// Wakes up subscribers when changes are committed
+// The zero value is ready to use
+type changeNotifier struct {
+	mux    sync.Mutex
+	wake   chan struct{}
+	closed bool
+}
+
+// Returns a channel that is closed by the next notify, or once the store is closed
+func (n *changeNotifier) wait() <-chan struct{} {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.wake == nil {
+		n.wake = make(chan struct{})
+	}
+
+	return n.wake
+}
+
+func (n *changeNotifier) notify() {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.wake != nil && !n.closed {
+		close(n.wake)
+		n.wake = nil
+	}
+}
+
+// Wakes up all subscribers for good
+func (n *changeNotifier) shutdown() {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	if n.closed {
+		return
+	}
+	n.closed = true
+
+	if n.wake == nil {
+		n.wake = make(chan struct{})
+	}
+	close(n.wake)
+}
+
+func (n *changeNotifier) isClosed() bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	return n.closed
+}
+
+// Streams the changes after since from read, and then new changes as they are committed
+// Subscribers never miss a change: they read the feed itself instead of being pushed events that could be dropped
+// The channel is closed once ctx is done or the store is closed
+func subscribe(ctx context.Context, since uint64, n *changeNotifier, read func(since uint64, limit int) ([]ChangeEvent, error)) <-chan ChangeEvent {
+	ch := make(chan ChangeEvent)
+
+	go func() {
+		defer close(ch)
+
+		for !n.isClosed() {
+			// Take the wake channel before reading, so a change committed in between still wakes us up
+			wake := n.wait()
+
+			events, err := read(since, subscribeBatchSize)
+			if err != nil {
+				log.Printf("could not read changes: %v", err)
+			}
+
+			for _, event := range events {
+				select {
+				case ch <- event:
+					since = event.Seq
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if len(events) == subscribeBatchSize {
+				// There is probably more
+				continue
+			}
+
+			select {
+			case <-wake:
+			case <-time.After(subscribePollInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+func (db *DB) changesPath() string {
+	return db.path + changesSuffix
+}
+
+// Opens the change log for appending, dropping any changes that were never committed to the database
+// Changes are appended before the database is written, so a crash in between leaves them behind
+func (db *DB) openChangeLog() error {
+	db.changeOffsets = nil
+	goodSize, err := scanChanges(db.changesPath(), db.keys, 0, func(event ChangeEvent, offset int64) bool {
+		if event.Seq > db.data.ChangeSeq {
+			return false
+		}
+
+		db.indexChange(event.Seq, offset)
+		return true
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not read change log: %w", err)
+	}
+
+	f, err := os.OpenFile(db.changesPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open change log: %w", err)
+	}
+
+	if err := f.Truncate(goodSize); err != nil {
+		f.Close()
+		return fmt.Errorf("could not truncate change log: %w", err)
+	}
+
+	db.changeLog = f
+
+	return nil
+}
+
+// Calls fn with every complete event in the change log from offset from on, in order, until it returns false
+// fn also gets the offset the event starts at, and goodSize is the length of the log up to the last event fn accepted
+func scanChanges(path string, keys *Keyring, from int64, fn func(event ChangeEvent, offset int64) bool) (goodSize int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		return 0, err
+	}
+	goodSize = from
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// Whatever is left has no newline, so it was never completely written
+			return goodSize, nil
+		} else if err != nil {
+			return goodSize, err
+		}
+
+		// Events are appended in a single write, so a line that made it to its newline is complete
+		event, err := decodeChangeLine(bytes.TrimSpace(line), keys)
+		if err != nil {
+			return goodSize, fmt.Errorf("could not decode change at offset %d: %w", goodSize, err)
+		}
+
+		if !fn(event, goodSize) {
+			return goodSize, nil
+		}
+
+		goodSize += int64(len(line))
+	}
+}
+
+func decodeChangeLine(line []byte, keys *Keyring) (ChangeEvent, error) {
+	line, err := decryptFile(line, keys)
+	if err != nil {
+		return ChangeEvent{}, err
+	}
+
+	var event ChangeEvent
+	err = json.Unmarshal(line, &event)
+	return event, err
+}
+
+// Writes the change log again under the active key
+// The caller must hold db.mux for writing
+func (db *DB) rewriteChangeLog() error {
+	var buf bytes.Buffer
+	var offsets []changeOffset
+	var encodeErr error
+	_, err := scanChanges(db.changesPath(), db.keys, 0, func(event ChangeEvent, _ int64) bool {
+		if event.Seq > db.data.ChangeSeq {
+			return false
+		}
+
+		if n := len(offsets); n == 0 || event.Seq >= offsets[n-1].seq+changeIndexInterval {
+			offsets = append(offsets, changeOffset{event.Seq, int64(buf.Len())})
+		}
+
+		line, err := json.Marshal(event)
+		if err == nil {
+			line, err = encryptFile(line, db.keys)
+		}
+		if err != nil {
+			encodeErr = err
+			return false
+		}
+
+		buf.Write(line)
+		buf.WriteByte('\n')
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("could not read change log: %w", err)
+	}
+	if encodeErr != nil {
+		return fmt.Errorf("could not encrypt change log: %w", encodeErr)
+	}
+
+	if err := WriteFileAtomic(db.changesPath(), buf.Bytes()); err != nil {
+		return fmt.Errorf("could not write change log: %w", err)
+	}
+
+	// The old file is gone, append to the new one
+	f, err := os.OpenFile(db.changesPath(), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open change log: %w", err)
+	}
+
+	db.changeLog.Close()
+	db.changeLog = f
+	db.changeOffsets = offsets
+
+	return nil
+}
+
+// Remembers where a change starts in the log, if it is far enough from the last one remembered
+// The caller must hold db.mux for writing
+func (db *DB) indexChange(seq uint64, offset int64) {
+	if n := len(db.changeOffsets); n > 0 && seq < db.changeOffsets[n-1].seq+changeIndexInterval {
+		return
+	}
+
+	db.changeOffsets = append(db.changeOffsets, changeOffset{seq, offset})
+}
+
+// Truncates the change log back to size, after the transaction that appended to it failed
+// The caller must hold db.mux for writing
+func (db *DB) truncateChanges(size int64) {
+	db.changeLog.Truncate(size)
+
+	i := slices.IndexFunc(db.changeOffsets, func(o changeOffset) bool { return o.offset >= size })
+	if i >= 0 {
+		db.changeOffsets = db.changeOffsets[:i]
+	}
+}
+
+// Returns the last remembered change at or before seq, or the start of the log if there is none
+// The caller must hold db.mux
+func (db *DB) changeOffsetBefore(seq uint64) changeOffset {
+	i, found := slices.BinarySearchFunc(db.changeOffsets, seq, func(o changeOffset, seq uint64) int {
+		return cmp.Compare(o.seq, seq)
+	})
+	if found {
+		return db.changeOffsets[i]
+	}
+	if i == 0 {
+		return changeOffset{}
+	}
+
+	return db.changeOffsets[i-1]
+}
+
+// Appends events to the change log
+// Returns the size of the log before the append, so that it can be truncated back if the transaction fails
+// The caller must hold db.mux for writing
+func (db *DB) appendChanges(events []ChangeEvent) (int64, error) {
+	offset, err := db.changeLog.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("could not append to change log: %w", err)
+	}
+
+	if len(events) == 0 {
+		return offset, nil
+	}
+
+	var buf bytes.Buffer
+	var offsets []changeOffset
+	for _, event := range events {
+		offsets = append(offsets, changeOffset{event.Seq, offset + int64(buf.Len())})
+
+		line, err := json.Marshal(event)
+		if err != nil {
+			return 0, fmt.Errorf("error marshalling change: %w", err)
+		}
+
+		if line, err = encryptFile(line, db.keys); err != nil {
+			return 0, fmt.Errorf("could not encrypt change: %w", err)
+		}
+
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+
+	_, err = db.changeLog.Write(buf.Bytes())
+
+	// Changes of transactions that are lost in a crash are dropped on load anyway, so only sync if the
+	// transaction itself is going to be synced
+	if err == nil && db.flushInterval == 0 {
+		err = db.changeLog.Sync()
+	}
+
+	if err != nil {
+		db.changeLog.Truncate(offset)
+		return 0, fmt.Errorf("could not append to change log: %w", err)
+	}
+
+	for _, o := range offsets {
+		db.indexChange(o.seq, o.offset)
+	}
+
+	return offset, nil
+}
+
+// Keeps the latest committed events in memory
+// The caller must hold db.mux for writing
+func (db *DB) rememberChanges(events []ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	// Only keep a run without gaps, other processes may have committed changes in between
+	if n := len(db.recentChanges); n > 0 && db.recentChanges[n-1].Seq+1 != events[0].Seq {
+		db.recentChanges = nil
+	}
+
+	db.recentChanges = append(db.recentChanges, events...)
+	if n := len(db.recentChanges); n > recentChangesSize {
+		db.recentChanges = slices.Clone(db.recentChanges[n-recentChangesSize:])
+	}
+
+	db.changes.notify()
+}
+
+// Sequence number of the last change that can be published
+// In write-behind mode, changes are only published once they are flushed, so that a crash can't take back
+// changes that subscribers have already seen
+// The caller must hold db.mux
+func (db *DB) publishedChangeSeq() uint64 {
+	if db.flushInterval > 0 {
+		return db.flushedChangeSeq
+	}
+
+	return db.data.ChangeSeq
+}
+
+// Returns up to limit changes after sequence number since, oldest first
+// A limit of zero or less means no limit
+func (db *DB) Changes(since uint64, limit int) ([]ChangeEvent, error) {
+	if err := db.refreshForRead(); err != nil {
+		return nil, err
+	}
+
+	db.mux.RLock()
+	committed := db.publishedChangeSeq()
+
+	if since >= committed {
+		db.mux.RUnlock()
+		return []ChangeEvent{}, nil
+	}
+
+	if n := len(db.recentChanges); n > 0 && db.recentChanges[0].Seq <= since+1 && db.recentChanges[n-1].Seq >= committed {
+		first := db.recentChanges[0].Seq
+		events := db.recentChanges[since+1-first : committed+1-first]
+		if limit > 0 && len(events) > limit {
+			events = events[:limit]
+		}
+
+		events = slices.Clone(events)
+		db.mux.RUnlock()
+		return events, nil
+	}
+
+	start := db.changeOffsetBefore(since + 1)
+	db.mux.RUnlock()
+
+	events, err := db.readChanges(start, since, committed, limit)
+	if errors.Is(err, errStaleChangeOffset) {
+		// Another process rewrote the log, read it from the start
+		events, err = db.readChanges(changeOffset{}, since, committed, limit)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read change log: %w", err)
+	}
+
+	return events, nil
+}
+
+// The change log no longer has the change that was remembered at an offset
+var errStaleChangeOffset = errors.New("change log was rewritten")
+
+// Reads up to limit changes after since from the log, starting at the change at start
+// Everything up to the committed sequence number is in the log, no matter what is being appended right now
+func (db *DB) readChanges(start changeOffset, since, committed uint64, limit int) ([]ChangeEvent, error) {
+	events := []ChangeEvent{}
+	stale := false
+	_, err := scanChanges(db.changesPath(), db.keys, start.offset, func(event ChangeEvent, offset int64) bool {
+		if offset == start.offset && start.seq != 0 && event.Seq != start.seq {
+			stale = true
+			return false
+		}
+
+		if event.Seq > committed || (limit > 0 && len(events) >= limit) {
+			return false
+		}
+
+		if event.Seq > since {
+			events = append(events, event)
+		}
+
+		return true
+	})
+	if stale || (err != nil && start.offset > 0 && !errors.Is(err, os.ErrNotExist)) {
+		return nil, errStaleChangeOffset
+	}
+
+	return events, err
+}
+
+// Streams the changes after sequence number since, and then new changes as they are committed,
+// until ctx is done or the database is closed
+func (db *DB) Subscribe(ctx context.Context, since uint64) <-chan ChangeEvent {
+	return subscribe(ctx, since, &db.changes, db.Changes)
+}
@@ -0,0 +1,187 @@
+package chirpydb
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func changeSeqs(t *testing.T, db *DB) []uint64 {
+	t.Helper()
+
+	changes, err := db.Changes(0, 0)
+	if err != nil {
+		t.Fatalf("could not get changes: %v", err)
+	}
+
+	seqs := []uint64{}
+	for _, c := range changes {
+		seqs = append(seqs, c.Seq)
+	}
+
+	return seqs
+}
+
+func TestChangeLogSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := newJournaledDB(t, path)
+	fillJournaledDB(t, db)
+	crash(db)
+
+	// The journal is replayed, and the change feed continues where it left off
+	db = newJournaledDB(t, path)
+	defer db.Close()
+
+	if seqs := changeSeqs(t, db); len(seqs) != 5 || seqs[4] != 5 {
+		t.Errorf("expected changes 1 to 5 after reopening, got %v", seqs)
+		return
+	}
+
+	if _, err := db.CreateChirp("after", 1); err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	if seqs := changeSeqs(t, db); len(seqs) != 6 || seqs[5] != 6 {
+		t.Errorf("expected changes 1 to 6, got %v", seqs)
+	}
+}
+
+func TestChangeLogOffsets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db, err := NewDB(path, false)
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+	err = db.Update(func(s *DBStructure) error {
+		for i := 0; i < 3*changeIndexInterval; i++ {
+			s.PutChirp(Chirp{Id: s.NewChirpId(), Body: "chirp", AuthorId: 1})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("could not create chirps: %v", err)
+		return
+	}
+	db.Close()
+
+	// Reopening forgets the recent changes, so they come from the log
+	db, err = NewDB(path, false)
+	if err != nil {
+		t.Errorf("could not reopen database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if len(db.changeOffsets) != 3 {
+		t.Errorf("expected 3 offsets in the change log index, got %v", db.changeOffsets)
+		return
+	}
+
+	since := uint64(2*changeIndexInterval + 10)
+	events, err := db.Changes(since, 2)
+	if err != nil || len(events) != 2 || events[0].Seq != since+1 {
+		t.Errorf("expected changes %d and %d, got %v (%v)", since+1, since+2, events, err)
+		return
+	}
+
+	// An offset that no longer points at its change, like after another process rewrote the log, is not trusted
+	db.changeOffsets[2].offset = db.changeOffsets[1].offset
+	events, err = db.Changes(since, 2)
+	if err != nil || len(events) != 2 || events[0].Seq != since+1 {
+		t.Errorf("expected changes %d and %d with a stale offset, got %v (%v)", since+1, since+2, events, err)
+	}
+}
+
+func TestChangeLogDropsUncommitted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db, err := NewDB(path, false)
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+	if _, err := db.CreateUser("user@example.com", "hash"); err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+	db.Close()
+
+	// A crash after the change was logged but before the database was written leaves it behind,
+	// and a torn write leaves half a line
+	uncommitted, _ := json.Marshal(ChangeEvent{Seq: 2, Op: ChangeCreate, Entity: EntityChirp, Id: "1"})
+	f, err := os.OpenFile(db.changesPath(), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Errorf("could not open change log: %v", err)
+		return
+	}
+	f.Write(append(uncommitted, '\n'))
+	f.Write([]byte(`{"seq":3,"op":"cre`))
+	f.Close()
+
+	db, err = NewDB(path, false)
+	if err != nil {
+		t.Errorf("could not reopen database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if seqs := changeSeqs(t, db); len(seqs) != 1 {
+		t.Errorf("expected only the committed change, got %v", seqs)
+		return
+	}
+
+	if _, err := db.CreateChirp("hello", 1); err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	data, err := os.ReadFile(db.changesPath())
+	if err != nil {
+		t.Errorf("could not read change log: %v", err)
+		return
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 2 {
+		t.Errorf("expected 2 lines in the change log, got %d:\n%s", lines, data)
+		return
+	}
+
+	if seqs := changeSeqs(t, db); len(seqs) != 2 || seqs[1] != 2 {
+		t.Errorf("expected the new change to take sequence number 2, got %v", seqs)
+	}
+}
+
+func TestWriteBehindPublishesFlushedChanges(t *testing.T) {
+	db, err := NewDBWithOptions(filepath.Join(t.TempDir(), "database.json"), Options{FlushInterval: time.Hour})
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if _, err := db.CreateChirp("not on disk yet", 1); err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	// A crash now would lose the chirp, so nobody may see its change yet
+	if seqs := changeSeqs(t, db); len(seqs) != 0 {
+		t.Errorf("expected no changes before flushing, got %v", seqs)
+		return
+	}
+
+	if err := db.Flush(); err != nil {
+		t.Errorf("could not flush: %v", err)
+		return
+	}
+
+	if seqs := changeSeqs(t, db); len(seqs) != 1 || seqs[0] != 1 {
+		t.Errorf("expected the flushed change, got %v", seqs)
+	}
+}
@@ -3,31 +3,96 @@ package chirpydb
 import (
 	"maps"
 	"slices"
+	"time"
 )
 
 type Chirp struct {
 	Id       int    `json:"id"`
 	Body     string `json:"body"`
 	AuthorId int    `json:"author_id"`
+
+	// Always in UTC
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// Whether the body was changed since the chirp was created
+	Edited bool `json:"edited"`
+
+	// The chirp this one replies to, zero if it starts a thread
+	// Replies keep pointing at their parent after it is deleted
+	ReplyTo int `json:"reply_to,omitempty"`
+
+	// The chirp that started the thread, which is the chirp itself if it is not a reply
+	RootId int `json:"root_id"`
+
+	// Number of direct replies that were not deleted
+	ReplyCount int `json:"reply_count"`
+
+	LikeCount    int `json:"like_count"`
+	RechirpCount int `json:"rechirp_count"`
+
+	// Lowercased hashtags without the #, and IDs of mentioned users, in the order they appear in the body
+	Hashtags []string `json:"hashtags"`
+	Mentions []int    `json:"mentions"`
+}
+
+// An earlier version of a chirp
+type ChirpRevision struct {
+	// Revisions are numbered from 1, the original body
+	Revision int    `json:"revision"`
+	Body     string `json:"body"`
+
+	// When this version was written
+	CreatedAt time.Time `json:"created_at"`
 }
 
 // Creates a new chirp and saves it to disk
 func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
+	return db.createChirp(body, authorId, 0)
+}
 
-	chirp := Chirp{
-		dbStruct.Chirps.IdCount,
-		body,
-		authorId,
-	}
+// Creates a chirp that replies to parentId, in the same thread as it
+func (db *DB) CreateReply(body string, authorId int, parentId int) (Chirp, error) {
+	return db.createChirp(body, authorId, parentId)
+}
+
+func (db *DB) createChirp(body string, authorId int, parentId int) (Chirp, error) {
+	var chirp Chirp
+
+	err := db.Update(func(dbStruct *DBStructure) error {
+		now := time.Now().UTC()
+		chirp = Chirp{
+			Body:      body,
+			AuthorId:  authorId,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
 
-	dbStruct.Chirps.IdCount++
-	dbStruct.Chirps.Items[chirp.Id] = chirp
+		if parentId != 0 {
+			parent, ok := dbStruct.Chirps.Items[parentId]
+			if !ok {
+				return ErrParentNotExist
+			}
 
-	if err := db.writeDB(dbStruct); err != nil {
+			parent.ReplyCount++
+			dbStruct.PutChirp(parent)
+
+			chirp.ReplyTo = parentId
+			chirp.RootId = parent.RootId
+		}
+
+		chirp.Id = dbStruct.NewChirpId()
+		if chirp.RootId == 0 {
+			chirp.RootId = chirp.Id
+		}
+
+		dbStruct.tagChirp(&chirp)
+
+		dbStruct.PutChirp(chirp)
+
+		return nil
+	})
+	if err != nil {
 		return Chirp{}, err
 	}
 
@@ -36,44 +101,188 @@ func (db *DB) CreateChirp(body string, authorId int) (Chirp, error) {
 
 // Returns all chirps in the database, sorted by ID
 func (db *DB) GetChirps() ([]Chirp, error) {
-	dbStruct, err := db.loadDB()
+	var chirps []Chirp
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		chirps = slices.Collect(maps.Values(dbStruct.Chirps.Items))
+		return nil
+	})
 	if err != nil {
 		return []Chirp{}, err
 	}
 
-	return slices.Collect(maps.Values(dbStruct.Chirps.Items)), nil
+	return chirps, nil
+}
+
+// Returns a page of all chirps, sorted the way opts asks for
+func (db *DB) ListChirps(opts ListOptions) ([]Chirp, error) {
+	chirps := []Chirp{}
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		for _, id := range pageChirpIds(dbStruct.idx.chirpIds, dbStruct.idx.chirpsByTime, opts) {
+			chirps = append(chirps, dbStruct.Chirps.Items[id])
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []Chirp{}, err
+	}
+
+	return chirps, nil
+}
+
+// Searches chirps by content, best matches first
+// See search.go for the query syntax
+func (db *DB) SearchChirps(query string, limit int) ([]SearchResult, error) {
+	results := []SearchResult{}
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		ids, matches, err := searchIds(query, indexSearchSource{dbStruct}, limit)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			results = append(results, newSearchResult(dbStruct.Chirps.Items[id], matches[id]))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []SearchResult{}, err
+	}
+
+	return results, nil
 }
 
 func (db *DB) GetChirp(id int) (Chirp, error) {
-	dbStruct, err := db.loadDB()
+	var chirp Chirp
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		var ok bool
+		if chirp, ok = dbStruct.Chirps.Items[id]; !ok {
+			return ErrNotExist
+		}
+
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	chirp, ok := dbStruct.Chirps.Items[id]
-	if !ok {
-		return Chirp{}, ErrNotExist
+	return chirp, nil
+}
+
+// Replaces the body of a chirp, keeping the old one as a revision
+// Setting the body it already has changes nothing
+func (db *DB) UpdateChirp(id int, body string, check func(Chirp) error) (Chirp, error) {
+	var chirp Chirp
+
+	err := db.Update(func(dbStruct *DBStructure) error {
+		var ok bool
+		if chirp, ok = dbStruct.Chirps.Items[id]; !ok {
+			return ErrNotExist
+		}
+
+		if check != nil {
+			if err := check(chirp); err != nil {
+				return err
+			}
+		}
+
+		if chirp.Body == body {
+			return nil
+		}
+
+		dbStruct.AddChirpRevision(id, ChirpRevision{
+			Revision:  len(dbStruct.ChirpRevisions[id]) + 1,
+			Body:      chirp.Body,
+			CreatedAt: chirp.UpdatedAt,
+		})
+
+		chirp.Body = body
+		chirp.UpdatedAt = time.Now().UTC()
+		chirp.Edited = true
+		dbStruct.tagChirp(&chirp)
+		dbStruct.PutChirp(chirp)
+
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
 	}
 
 	return chirp, nil
 }
 
-func (db *DB) DeleteChirp(id int) error {
-	dbStruct, err := db.loadDB()
+// Returns the earlier versions of a chirp, oldest first
+func (db *DB) GetChirpRevisions(id int) ([]ChirpRevision, error) {
+	revisions := []ChirpRevision{}
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Chirps.Items[id]; !ok {
+			return ErrNotExist
+		}
+
+		revisions = append(revisions, dbStruct.ChirpRevisions[id]...)
+
+		return nil
+	})
 	if err != nil {
-		return err
+		return []ChirpRevision{}, err
 	}
 
-	_, ok := dbStruct.Chirps.Items[id]
-	if !ok {
-		return ErrNotExist
+	return revisions, nil
+}
+
+// Deletes a chirp, its replies stay in the thread
+func (db *DB) DeleteChirp(id int) error {
+	return db.Update(func(dbStruct *DBStructure) error {
+		if !dbStruct.DeleteChirp(id) {
+			return ErrNotExist
+		}
+
+		return nil
+	})
+}
+
+// Returns the chirps of the thread started by rootId, including the root if it was not deleted, sorted by ID
+func (db *DB) GetThread(rootId int) ([]Chirp, error) {
+	chirps := []Chirp{}
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		for _, id := range dbStruct.idx.chirpsByRoot[rootId] {
+			chirps = append(chirps, dbStruct.Chirps.Items[id])
+		}
+
+		if len(chirps) == 0 {
+			return ErrNotExist
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []Chirp{}, err
 	}
 
-	delete(dbStruct.Chirps.Items, id)
+	return chirps, nil
+}
 
-	if err := db.writeDB(dbStruct); err != nil {
-		return err
+// Returns a page of the chirps of an author, sorted the way opts asks for
+func (db *DB) GetChirpsByAuthor(authorId int, opts ListOptions) ([]Chirp, error) {
+	chirps := []Chirp{}
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		for _, id := range pageChirpIds(dbStruct.chirpIdsByAuthor(authorId), dbStruct.idx.chirpsByAuthorTime[authorId], opts) {
+			chirps = append(chirps, dbStruct.Chirps.Items[id])
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []Chirp{}, err
 	}
 
-	return nil
+	return chirps, nil
 }
@@ -0,0 +1,352 @@
+package chirpydb
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Database files can be encrypted at rest with envelope encryption:
+// every write generates a fresh data key that encrypts the contents with AES-256-GCM,
+// and the data key itself is encrypted (wrapped) with a long-lived key from the keyring, identified by its ID
+// This way, keys can be rotated by writing the file again under a different key ID
+
+var (
+	ErrEncrypted  = errors.New("database is encrypted but no encryption key was provided")
+	ErrUnknownKey = errors.New("database is encrypted with an unknown key")
+)
+
+// Current version of the envelope format
+const encryptionVersion = 1
+
+// Every encrypted file starts with this, which no plain database file does
+var encryptedPrefix = []byte(`{"chirpy_encrypted":`)
+
+// Additional data bound to every ciphertext, so they can't be confused with ciphertexts from elsewhere
+var encryptionAAD = []byte("chirpydb")
+
+// The envelope an encrypted file is stored in
+// The wrapped key and the ciphertext are both prefixed with their GCM nonce
+type encryptedFile struct {
+	Version    int    `json:"chirpy_encrypted"`
+	KeyId      string `json:"key_id"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// A set of key encryption keys
+// Files can be decrypted with any of them, but are only encrypted with the active one
+type Keyring struct {
+	keys   map[string][]byte
+	active string
+}
+
+// Creates a keyring from 32-byte AES-256 keys
+func NewKeyring(active string, keys map[string][]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("keyring has no keys")
+	}
+
+	for id, key := range keys {
+		if id == "" || strings.ContainsAny(id, ":,") {
+			return nil, fmt.Errorf("invalid key ID %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes long, got %d", id, len(key))
+		}
+	}
+
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active key %q is not in the keyring", active)
+	}
+
+	return &Keyring{keys, active}, nil
+}
+
+// Parses a keyring from a list of id:base64key pairs, separated by commas or newlines
+// If active is empty, the last key listed is the active one
+func ParseKeyring(spec string, active string) (*Keyring, error) {
+	keys := map[string][]byte{}
+	last := ""
+
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("key entry must be id:base64key, got %q", entry)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q is not valid base64: %w", id, err)
+		}
+
+		keys[id] = key
+		last = id
+	}
+
+	if active == "" {
+		active = last
+	}
+
+	return NewKeyring(active, keys)
+}
+
+// ID of the key new files are encrypted with
+func (k *Keyring) ActiveKeyId() string {
+	return k.active
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Encrypts plaintext and prefixes the result with the nonce
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, encryptionAAD), nil
+}
+
+func unseal(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], encryptionAAD)
+}
+
+// Encrypts data under the active key
+func (k *Keyring) encrypt(data []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := seal(dataKey, data)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := seal(k.keys[k.active], dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(encryptedFile{encryptionVersion, k.active, wrappedKey, ciphertext})
+}
+
+func (k *Keyring) decrypt(data []byte) ([]byte, error) {
+	var envelope encryptedFile
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("could not read encrypted file: %w", err)
+	}
+
+	if envelope.Version != encryptionVersion {
+		return nil, fmt.Errorf("unsupported encryption version %d", envelope.Version)
+	}
+
+	key, ok := k.keys[envelope.KeyId]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, envelope.KeyId)
+	}
+
+	dataKey, err := unseal(key, envelope.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not unwrap data key: %w", err)
+	}
+
+	plaintext, err := unseal(dataKey, envelope.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt file: %w", err)
+	}
+
+	return plaintext, nil
+}
+
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedPrefix)
+}
+
+// Returns the ID of the key an encrypted file was written with, or an empty string if it is not encrypted
+func encryptionKeyId(data []byte) string {
+	if !isEncrypted(data) {
+		return ""
+	}
+
+	var envelope encryptedFile
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return ""
+	}
+
+	return envelope.KeyId
+}
+
+// Encrypts data if there is a keyring, otherwise returns it as is
+func encryptFile(data []byte, keys *Keyring) ([]byte, error) {
+	if keys == nil {
+		return data, nil
+	}
+
+	return keys.encrypt(data)
+}
+
+// Decrypts data if it is encrypted, otherwise returns it as is
+// Plain files are accepted even with a keyring, so that existing databases can be encrypted by just adding a key
+func decryptFile(data []byte, keys *Keyring) ([]byte, error) {
+	if !isEncrypted(data) {
+		return data, nil
+	}
+
+	if keys == nil {
+		return nil, ErrEncrypted
+	}
+
+	return keys.decrypt(data)
+}
+
+// Keyring the database is encrypted with, or nil if it is not encrypted
+func (db *DB) Keyring() *Keyring {
+	return db.keys
+}
+
+// Rewrites a file under the active key, it may be plain or encrypted with any key of the keyring
+func reencryptFile(path string, keys *Keyring) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if data, err = decryptFile(data, keys); err != nil {
+		return fmt.Errorf("could not decrypt %s: %w", path, err)
+	}
+
+	if data, err = encryptFile(data, keys); err != nil {
+		return fmt.Errorf("could not encrypt %s: %w", path, err)
+	}
+
+	return WriteFileAtomic(path, data)
+}
+
+// Rewrites the database file, its backups and the change log under the active key
+// With a new active key this rotates the encryption key
+// In journaled mode, the journal is compacted first so no record is left under the old key
+// Snapshots are kept elsewhere, see Snapshots.Reencrypt
+func (db *DB) Reencrypt() error {
+	if db.journal != nil {
+		if err := db.Compact(); err != nil {
+			return err
+		}
+	}
+
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	return db.withFileLock(true, func() error {
+		if err := db.reloadIfChanged(); err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(db.data)
+		if err != nil {
+			return fmt.Errorf("error marshalling database json: %w", err)
+		}
+
+		if data, err = encryptFile(data, db.keys); err != nil {
+			return fmt.Errorf("could not encrypt database: %w", err)
+		}
+
+		// Don't go through writeData, the backup would keep the data under the old key
+		if err := WriteFileAtomic(db.path, data); err != nil {
+			return fmt.Errorf("could not write database file: %w", err)
+		}
+		if err := WriteFileAtomic(db.backupPath(), data); err != nil {
+			return fmt.Errorf("could not write database backup: %w", err)
+		}
+
+		if err := db.rewriteChangeLog(); err != nil {
+			return err
+		}
+
+		// Backups from before migrations are kept as they were, but not under an old key
+		backups, err := db.migrationBackupPaths()
+		if err != nil {
+			return err
+		}
+		for _, path := range backups {
+			if err := reencryptFile(path, db.keys); err != nil {
+				return fmt.Errorf("could not re-encrypt migration backup: %w", err)
+			}
+		}
+
+		// Pending write-behind changes were included
+		db.flushedGen = db.gen
+		db.flushedChangeSeq = db.data.ChangeSeq
+
+		return db.rememberFile()
+	})
+}
+
+// Writes the decrypted database file at path as indented JSON, without opening the database
+// Nothing is migrated, recovered or written, so the file is dumped as it is on disk
+func WritePlaintextFile(path string, keys *Keyring, w io.Writer) error {
+	// The file alone would be missing the changes in the journal
+	if info, err := os.Stat(path + journalSuffix); err == nil && info.Size() > 0 {
+		return fmt.Errorf("the journal of %s has changes that are not in the database file yet, open the database once to compact it", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if data, err = decryptFile(data, keys); err != nil {
+		return fmt.Errorf("could not decrypt %s: %w", path, err)
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	out.WriteByte('\n')
+
+	_, err = out.WriteTo(w)
+	return err
+}
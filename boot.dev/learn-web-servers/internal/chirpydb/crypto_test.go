@@ -0,0 +1,303 @@
+package chirpydb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestKeyring(t *testing.T, ids ...string) *Keyring {
+	t.Helper()
+
+	var spec []string
+	for _, id := range ids {
+		key := make([]byte, 32)
+		rand.Read(key)
+		spec = append(spec, id+":"+base64.StdEncoding.EncodeToString(key))
+	}
+
+	keys, err := ParseKeyring(strings.Join(spec, ","), "")
+	if err != nil {
+		t.Fatalf("could not create keyring: %v", err)
+	}
+
+	return keys
+}
+
+// Same keyring with a different active key
+func withActiveKey(t *testing.T, keys *Keyring, active string) *Keyring {
+	t.Helper()
+
+	rotated, err := NewKeyring(active, keys.keys)
+	if err != nil {
+		t.Fatalf("could not create keyring: %v", err)
+	}
+
+	return rotated
+}
+
+func TestEncryptedDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	keys := newTestKeyring(t, "k1")
+
+	db, err := NewDBWithOptions(path, Options{Keys: keys})
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+
+	for _, email := range []string{"first@example.com", "second@example.com"} {
+		if _, err := db.CreateUser(email, "hash"); err != nil {
+			t.Errorf("could not create user: %v", err)
+			return
+		}
+	}
+	db.Close()
+
+	for _, p := range []string{path, db.backupPath()} {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Errorf("could not read %s: %v", p, err)
+			return
+		}
+
+		if bytes.Contains(data, []byte("example.com")) {
+			t.Errorf("expected %s to be encrypted, found plain data", p)
+			return
+		}
+		if id := encryptionKeyId(data); id != "k1" {
+			t.Errorf("expected %s to be encrypted with k1, got %q", p, id)
+			return
+		}
+	}
+
+	if _, err := NewDB(path, false); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("expected opening without keys to fail with ErrEncrypted, got %v", err)
+		return
+	}
+
+	if _, err := NewDBWithOptions(path, Options{Keys: newTestKeyring(t, "other")}); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected opening with another key to fail with ErrUnknownKey, got %v", err)
+		return
+	}
+
+	// Same key ID, different key material
+	if _, err := NewDBWithOptions(path, Options{Keys: newTestKeyring(t, "k1")}); err == nil {
+		t.Errorf("expected opening with the wrong key to fail")
+		return
+	}
+
+	reopened, err := NewDBWithOptions(path, Options{Keys: keys})
+	if err != nil {
+		t.Errorf("could not reopen database: %v", err)
+		return
+	}
+	defer reopened.Close()
+
+	if _, err := reopened.GetUserByEmail("second@example.com"); err != nil {
+		t.Errorf("could not read user from encrypted database: %v", err)
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	keys := newTestKeyring(t, "k1", "k2")
+
+	db, err := NewDBWithOptions(path, Options{Keys: withActiveKey(t, keys, "k1")})
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+	if _, err := db.CreateUser("user@example.com", "hash"); err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+
+	snapshots := NewSnapshots(filepath.Join(filepath.Dir(path), "snapshots"), db, RetentionPolicy{})
+	snap, err := snapshots.Create()
+	if err != nil {
+		t.Errorf("could not take snapshot: %v", err)
+		return
+	}
+	db.Close()
+
+	// A backup from before encryption, and one under the old key
+	if err := os.WriteFile(path+".v0.bak", []byte(`{}`), 0o600); err != nil {
+		t.Errorf("could not write migration backup: %v", err)
+		return
+	}
+	oldBackup, err := encryptFile([]byte(`{}`), withActiveKey(t, keys, "k1"))
+	if err != nil {
+		t.Errorf("could not encrypt migration backup: %v", err)
+		return
+	}
+	if err := os.WriteFile(path+".v1.bak", oldBackup, 0o600); err != nil {
+		t.Errorf("could not write migration backup: %v", err)
+		return
+	}
+
+	db, err = NewDBWithOptions(path, Options{Keys: keys})
+	if err != nil {
+		t.Errorf("could not open database with both keys: %v", err)
+		return
+	}
+	if err := db.Reencrypt(); err != nil {
+		t.Errorf("could not re-encrypt database: %v", err)
+		return
+	}
+	if err := snapshots.Reencrypt(db.Keyring()); err != nil {
+		t.Errorf("could not re-encrypt snapshots: %v", err)
+		return
+	}
+	db.Close()
+
+	for _, p := range []string{path + ".v0.bak", path + ".v1.bak", filepath.Join(filepath.Dir(path), "snapshots", snap.Name)} {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Errorf("could not read %s: %v", p, err)
+			return
+		}
+		if keyId := encryptionKeyId(data); keyId != "k2" {
+			t.Errorf("expected %s to be under the new key, got %q", filepath.Base(p), keyId)
+			return
+		}
+	}
+
+	// The old key can now be dropped
+	onlyNew, err := NewKeyring("k2", map[string][]byte{"k2": keys.keys["k2"]})
+	if err != nil {
+		t.Errorf("could not create keyring: %v", err)
+		return
+	}
+
+	db, err = NewDBWithOptions(path, Options{Keys: onlyNew})
+	if err != nil {
+		t.Errorf("could not open rotated database with the new key only: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if _, err := readDBFile(db.backupPath(), onlyNew, nil); err != nil {
+		t.Errorf("expected the backup to be rotated too: %v", err)
+		return
+	}
+
+	if _, err := db.GetUserByEmail("user@example.com"); err != nil {
+		t.Errorf("could not read user after rotation: %v", err)
+	}
+}
+
+func TestEncryptExistingPlainDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db, err := NewDB(path, false)
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+	if _, err := db.CreateUser("user@example.com", "hash"); err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+	db.Close()
+
+	keys := newTestKeyring(t, "k1")
+	db, err = NewDBWithOptions(path, Options{Keys: keys})
+	if err != nil {
+		t.Errorf("could not open plain database with a key: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if err := db.Reencrypt(); err != nil {
+		t.Errorf("could not encrypt database: %v", err)
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Errorf("could not read database file: %v", err)
+		return
+	}
+	if !isEncrypted(data) {
+		t.Errorf("expected database file to be encrypted")
+		return
+	}
+
+	var out bytes.Buffer
+	if err := WritePlaintextFile(path, keys, &out); err != nil {
+		t.Errorf("could not write plaintext: %v", err)
+		return
+	}
+	if !strings.Contains(out.String(), "user@example.com") {
+		t.Errorf("expected plaintext to contain the user, got %s", out.String())
+	}
+}
+
+func TestWritePlaintextFileIsReadOnly(t *testing.T) {
+	path := writeLegacyDB(t)
+
+	var out bytes.Buffer
+	if err := WritePlaintextFile(path, nil, &out); err != nil {
+		t.Errorf("could not write plaintext: %v", err)
+		return
+	}
+	if !strings.Contains(out.String(), "user@example.com") {
+		t.Errorf("expected plaintext to contain the user, got %s", out.String())
+		return
+	}
+
+	// The old file is dumped as it is, without migrating it
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != legacyDB {
+		t.Errorf("expected database file to be untouched, got %s, %v", data, err)
+		return
+	}
+	if matches, _ := filepath.Glob(path + ".*"); len(matches) != 0 {
+		t.Errorf("expected no other files to be created, got %v", matches)
+	}
+}
+
+func TestEncryptedJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	keys := newTestKeyring(t, "k1")
+
+	db, err := NewDBWithOptions(path, Options{Journal: true, Keys: keys})
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+	fillJournaledDB(t, db)
+	crash(db)
+
+	journal, err := os.ReadFile(db.journalPath())
+	if err != nil {
+		t.Errorf("could not read journal: %v", err)
+		return
+	}
+	if bytes.Contains(journal, []byte("example.com")) {
+		t.Errorf("expected journal records to be encrypted, found plain data")
+		return
+	}
+
+	db, err = NewDBWithOptions(path, Options{Journal: true, Keys: keys})
+	if err != nil {
+		t.Errorf("could not reopen database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Errorf("could not get chirps: %v", err)
+		return
+	}
+	if len(chirps) != 2 {
+		t.Errorf("expected 2 chirps after replaying the encrypted journal, got %d", len(chirps))
+	}
+}
@@ -7,11 +7,19 @@ import (
 	"log"
 	"os"
 	"sync"
+	"time"
 )
 
 var (
 	ErrExists   = errors.New("entity already exists")
 	ErrNotExist = errors.New("entity does not exist")
+	ErrClosed   = errors.New("database is closed")
+
+	// A reply was made to a chirp that does not exist
+	ErrParentNotExist = errors.New("parent chirp does not exist")
+
+	// A user tried to follow themselves
+	ErrFollowSelf = errors.New("users cannot follow themselves")
 )
 
 type DBMap[T any] struct {
@@ -20,102 +28,531 @@ type DBMap[T any] struct {
 }
 
 type DBStructure struct {
+	// Version of the file format, see migrate.go
+	SchemaVersion int `json:"schema_version"`
+
 	Chirps DBMap[Chirp] `json:"chirps"`
 	Users  DBMap[User]  `json:"users"`
 
 	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+
+	// Audit log of refresh tokens
+	TokenEvents DBMap[TokenEvent] `json:"token_events"`
+
+	// Chirp ID -> earlier versions of the chirp, oldest first
+	ChirpRevisions map[int][]ChirpRevision `json:"chirp_revisions"`
+
+	// Keyed by reactionKey
+	Likes    map[string]Reaction `json:"likes"`
+	Rechirps map[string]Reaction `json:"rechirps"`
+
+	// Keyed by followKey
+	Follows map[string]Follow `json:"follows"`
+
+	// Sequence number of the last journal record included in this structure
+	JournalSeq uint64 `json:"journal_seq,omitempty"`
+
+	// Sequence number of the last event in the change feed
+	ChangeSeq uint64 `json:"change_seq,omitempty"`
+
+	// Bumped by every committed transaction, so other processes can tell the file changed
+	Generation uint64 `json:"generation"`
+
+	// Log of the transaction currently modifying the structure, if any
+	tx *txLog
+
+	idx dbIndexes
+}
+
+// Options for opening a database
+type Options struct {
+	// Delete the existing database before opening it
+	Debug bool
+
+	// How often changes are written to disk in the background
+	// Zero means every transaction is written to disk before it returns
+	// This is ignored in journaled mode, where every transaction is appended to the journal before it returns
+	FlushInterval time.Duration
+
+	// Append each transaction to a journal instead of rewriting the whole database file
+	Journal bool
+
+	// How often the journal is folded into the database file in the background
+	// Zero means the journal is only compacted when the database is opened or closed
+	CompactInterval time.Duration
+
+	// Encrypt the database files with the active key of this keyring
+	// Files are read with any key in the keyring, and plain files are still accepted
+	Keys *Keyring
+
+	// Key of the HMAC that refresh tokens are stored as
+	// If empty, a key is generated and kept next to the database, see loadTokenKey
+	// Changing it invalidates every refresh token
+	TokenKey []byte
+
+	// Allow other processes to use the database file at the same time
+	// Every transaction is then written to disk while holding a file lock, so this can't be combined
+	// with write-behind or journaled mode
+	Shared bool
 }
 
 type DB struct {
 	path string
 	mux  *sync.RWMutex
+
+	// Nil if the database is not encrypted
+	keys *Keyring
+
+	// See Options.TokenKey
+	tokenKey []byte
+
+	// The decoded database, kept in memory so that reads don't have to touch the disk
+	data DBStructure
+
+	// Write-behind state
+	// gen is bumped by every committed transaction, and flushedGen is the last generation written to disk
+	// flushedChangeSeq is the last change written to disk, later changes are not published until they are flushed
+	flushInterval    time.Duration
+	flushMux         sync.Mutex
+	gen              uint64
+	flushedGen       uint64
+	flushedChangeSeq uint64
+
+	// Journaled mode state, journal is nil if the database is not journaled
+	journal     *os.File
+	journalSize int64
+
+	// Change feed state
+	// recentChanges holds the latest committed events without gaps, and changes wakes up subscribers
+	changeLog     *os.File
+	recentChanges []ChangeEvent
+	changes       changeNotifier
+
+	// Where some of the changes start in the log, sorted by sequence number, see changeIndexInterval
+	changeOffsets []changeOffset
+
+	// Shared mode state, lockFile is nil if the database is not shared
+	// fileInfo describes the database file as we last read or wrote it
+	lockFile *os.File
+	fileInfo os.FileInfo
+
+	// Closed to stop the background goroutines
+	stop       chan struct{}
+	background sync.WaitGroup
+
+	closed bool
 }
 
 // Creates a new database connection and creates the database file if it doesn't exist
+// If the database file is damaged, it is recovered from the backup of the last good write
 func NewDB(path string, debug bool) (*DB, error) {
-	if debug {
-		if err := os.Remove(path); err != nil {
-			// Log the error and continue
-			log.Printf("could not remove test database: %v", err)
+	return NewDBWithOptions(path, Options{Debug: debug})
+}
+
+// Same as NewDB, but allows configuring how the database is persisted
+func NewDBWithOptions(path string, opts Options) (*DB, error) {
+	if len(opts.TokenKey) == 0 {
+		key, err := loadTokenKey(path)
+		if err != nil {
+			return nil, err
 		}
+		opts.TokenKey = key
 	}
 
 	db := &DB{
-		path,
-		&sync.RWMutex{},
+		path:          path,
+		mux:           &sync.RWMutex{},
+		flushInterval: opts.FlushInterval,
+		keys:          opts.Keys,
+		tokenKey:      opts.TokenKey,
+		stop:          make(chan struct{}),
+	}
+
+	if opts.Journal {
+		db.flushInterval = 0
+	}
+
+	if opts.Shared {
+		if opts.Journal || opts.FlushInterval > 0 {
+			return nil, errors.New("a shared database can't use write-behind or journaled mode")
+		}
+
+		if err := db.openLockFile(); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := db.ensureDB(); err != nil {
+	// Nobody else can be in the middle of writing while we clean up and load the database
+	if err := db.withFileLock(true, func() error { return db.load(opts) }); err != nil {
+		if db.lockFile != nil {
+			db.lockFile.Close()
+		}
+		if db.changeLog != nil {
+			db.changeLog.Close()
+		}
 		return nil, err
 	}
 
+	if opts.Journal {
+		if err := db.openJournal(); err != nil {
+			return nil, err
+		}
+
+		if opts.CompactInterval > 0 {
+			db.every(opts.CompactInterval, db.Compact)
+		}
+	}
+
+	if db.flushInterval > 0 {
+		db.every(db.flushInterval, db.Flush)
+	}
+
 	return db, nil
 }
 
-// Creates a new database file if it doesn't exist
-func (db *DB) ensureDB() error {
-	file, err := os.Open(db.path)
-	if err == nil {
-		file.Close()
+// Loads the database from disk into memory, recovering, migrating and replaying the journal as needed
+func (db *DB) load(opts Options) error {
+	if opts.Debug {
+		for _, p := range []string{db.path, db.backupPath(), db.journalPath(), db.changesPath()} {
+			if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+				// Log the error and continue
+				log.Printf("could not remove test database: %v", err)
+			}
+		}
+	}
+
+	db.removeStaleTemps()
+
+	dbStruct, version, err := db.recoverDB()
+	if err != nil {
+		return err
+	}
+
+	if version < dbStruct.SchemaVersion {
+		if err := db.finishMigration(version, dbStruct); err != nil {
+			return err
+		}
+	}
+
+	db.data = dbStruct
+
+	// A journal can be left over even if we're not in journaled mode anymore, so always replay it
+	applied, err := db.replayJournal()
+	if err != nil {
+		return err
+	}
+
+	db.data.buildIndexes()
+
+	// Fold the leftover journal into the database file if not journaling, since nothing will replay it otherwise
+	if !opts.Journal && applied > 0 {
+		if err := db.writeDB(db.data); err != nil {
+			return err
+		}
+	}
+
+	if !opts.Journal {
+		if err := os.Remove(db.journalPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not remove journal: %w", err)
+		}
+	}
+
+	if err := db.openChangeLog(); err != nil {
+		return err
+	}
+	db.flushedChangeSeq = db.data.ChangeSeq
+
+	return db.rememberFile()
+}
+
+func newDBStructure() DBStructure {
+	return DBStructure{
+		SchemaVersion:  latestSchemaVersion(),
+		Chirps:         DBMap[Chirp]{1, map[int]Chirp{}},
+		Users:          DBMap[User]{1, map[int]User{}},
+		RefreshTokens:  map[string]RefreshToken{},
+		TokenEvents:    DBMap[TokenEvent]{1, map[int]TokenEvent{}},
+		ChirpRevisions: map[int][]ChirpRevision{},
+		Likes:          map[string]Reaction{},
+		Rechirps:       map[string]Reaction{},
+		Follows:        map[string]Follow{},
+	}
+}
+
+// Fills in anything missing from a structure that was decoded from disk
+func (s *DBStructure) init() {
+	if s.Chirps.Items == nil {
+		s.Chirps.Items = map[int]Chirp{}
+	}
+	if s.Users.Items == nil {
+		s.Users.Items = map[int]User{}
+	}
+	if s.RefreshTokens == nil {
+		s.RefreshTokens = map[string]RefreshToken{}
+	}
+	if s.TokenEvents.Items == nil {
+		s.TokenEvents = DBMap[TokenEvent]{1, map[int]TokenEvent{}}
+	}
+	if s.ChirpRevisions == nil {
+		s.ChirpRevisions = map[int][]ChirpRevision{}
+	}
+	if s.Likes == nil {
+		s.Likes = map[string]Reaction{}
+	}
+	if s.Rechirps == nil {
+		s.Rechirps = map[string]Reaction{}
+	}
+	if s.Follows == nil {
+		s.Follows = map[string]Follow{}
+	}
+}
+
+// Runs fn with a read-only view of the database
+// The read lock is held until fn returns, so fn should not call other DB methods or keep references to the structure
+func (db *DB) View(fn func(*DBStructure) error) error {
+	if err := db.refreshForRead(); err != nil {
+		return err
+	}
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	return fn(&db.data)
+}
+
+// Runs fn inside a write transaction
+// The write lock is held for the whole mutate-persist cycle, so no other transaction can interleave with it
+// fn must modify the structure through its Put/Delete methods, so that the changes can be rolled back
+// if fn returns an error or the changes cannot be persisted
+func (db *DB) Update(fn func(*DBStructure) error) (err error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	// In shared mode, hold the file lock until the transaction is on disk, and start from the latest data
+	if db.lockFile != nil {
+		if err := lockFile(db.lockFile, true); err != nil {
+			return fmt.Errorf("could not lock database: %w", err)
+		}
+		defer unlockFile(db.lockFile)
+
+		if err := db.reloadIfChanged(); err != nil {
+			return err
+		}
+	}
+
+	tx := &txLog{}
+	db.data.tx = tx
+
+	defer func() {
+		db.data.tx = nil
+
+		if r := recover(); r != nil {
+			tx.rollback()
+			panic(r)
+		}
+
+		if err != nil {
+			tx.rollback()
+		}
+	}()
+
+	if err := fn(&db.data); err != nil {
+		return err
+	}
+
+	// Nothing changed, not even an ID counter
+	if len(tx.undo) == 0 {
 		return nil
-	} else if errors.Is(err, os.ErrNotExist) {
-		data, err := json.Marshal(DBStructure{
-			DBMap[Chirp]{1, map[int]Chirp{}},
-			DBMap[User]{1, map[int]User{}},
-			map[string]RefreshToken{},
-		})
+	}
+
+	return db.commit(tx)
+}
+
+// Persists the in-memory structure after a transaction changed it
+// The caller must hold db.mux for writing
+func (db *DB) commit(tx *txLog) (err error) {
+	changeSeq := db.data.ChangeSeq
+	db.gen++
+	db.data.Generation++
+
+	defer func() {
 		if err != nil {
-			return fmt.Errorf("error marshalling database json: %w", err)
+			db.gen--
+			db.data.Generation--
+			db.data.ChangeSeq = changeSeq
 		}
+	}()
+
+	// The changes go to the log first, and are dropped on load if the transaction never made it to disk
+	events, err := db.data.newChangeEvents(tx.changes, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	logSize, err := db.appendChanges(events)
+	if err != nil {
+		return err
+	}
 
-		os.WriteFile(db.path, data, 0o666)
+	if err := db.persist(tx); err != nil {
+		db.truncateChanges(logSize)
+		return err
+	}
+
+	db.rememberChanges(events)
+
+	return nil
+}
+
+// Writes a committed transaction to the journal or the database file, depending on the mode
+func (db *DB) persist(tx *txLog) error {
+	if db.journal != nil {
+		if err := db.appendJournal(tx.changes); err != nil {
+			return err
+		}
+
+		db.flushedGen = db.gen
+		return nil
+	}
 
+	if db.flushInterval > 0 {
+		// Leave it to the flusher
 		return nil
-	} else {
-		return fmt.Errorf("could not create database file: %w", err)
 	}
+
+	if err := db.writeDB(db.data); err != nil {
+		return err
+	}
+
+	db.flushedGen = db.gen
+
+	return nil
 }
 
-// Reads the database file into memory
-func (db *DB) loadDB() (DBStructure, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// Runs fn periodically in the background until the database is closed
+func (db *DB) every(interval time.Duration, fn func() error) {
+	db.background.Add(1)
+
+	go func() {
+		defer db.background.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := fn(); err != nil {
+					log.Printf("background database write failed: %v", err)
+				}
+			case <-db.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Writes any changes that are still pending to disk
+// This is only needed in write-behind mode, as otherwise transactions are written before they return
+func (db *DB) Flush() error {
+	if db.flushInterval <= 0 {
+		return nil
+	}
+
+	// Only one flush can write at a time, but readers can keep going while the file is written
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
 
-	if err := db.ensureDB(); err != nil {
-		return DBStructure{}, err
+	db.mux.RLock()
+	gen, changeSeq := db.gen, db.data.ChangeSeq
+	if gen == db.flushedGen {
+		db.mux.RUnlock()
+		return nil
 	}
 
-	data, err := os.ReadFile(db.path)
+	data, err := json.Marshal(db.data)
+	db.mux.RUnlock()
+
 	if err != nil {
-		return DBStructure{}, fmt.Errorf("could read write database file: %w", err)
+		return fmt.Errorf("error marshalling database json: %w", err)
 	}
 
-	var dbStruct DBStructure
+	// The changes in the file must be in the log too, or they would leave a gap in the feed after a crash
+	if err := db.changeLog.Sync(); err != nil {
+		return fmt.Errorf("could not sync change log: %w", err)
+	}
 
-	if err := json.Unmarshal(data, &dbStruct); err != nil {
-		return DBStructure{}, fmt.Errorf("error unmarshalling database json: %w", err)
+	if err := db.writeData(data); err != nil {
+		return err
 	}
 
-	return dbStruct, nil
+	db.flushedGen = gen
+
+	// The flushed changes are safe from crashes now, so they can be published
+	db.mux.Lock()
+	db.flushedChangeSeq = changeSeq
+	db.mux.Unlock()
+	db.changes.notify()
+
+	return nil
 }
 
-// Writes the database file to disk
-func (db *DB) writeDB(dbStructure DBStructure) error {
+// Stops the background goroutines and writes any pending changes to disk
+// Transactions fail with ErrClosed after the database is closed
+func (db *DB) Close() error {
 	db.mux.Lock()
-	defer db.mux.Unlock()
+	if db.closed {
+		db.mux.Unlock()
+		return nil
+	}
+	db.closed = true
+	db.mux.Unlock()
 
-	if err := db.ensureDB(); err != nil {
-		return err
+	close(db.stop)
+	db.background.Wait()
+	db.changes.shutdown()
+
+	if db.lockFile != nil {
+		defer db.lockFile.Close()
 	}
+	defer db.changeLog.Close()
 
+	if db.journal != nil {
+		err := db.Compact()
+		return errors.Join(err, db.journal.Close())
+	}
+
+	return db.Flush()
+}
+
+// Writes the database file to disk, keeping the previous generation as a backup
+func (db *DB) writeDB(dbStructure DBStructure) error {
 	data, err := json.Marshal(dbStructure)
 	if err != nil {
 		return fmt.Errorf("error marshalling database json: %w", err)
 	}
 
-	if err := os.WriteFile(db.path, data, 0o666); err != nil {
+	return db.writeData(data)
+}
+
+func (db *DB) writeData(data []byte) error {
+	data, err := encryptFile(data, db.keys)
+	if err != nil {
+		return fmt.Errorf("could not encrypt database: %w", err)
+	}
+
+	if err := db.backupCurrent(); err != nil {
+		return err
+	}
+
+	if err := WriteFileAtomic(db.path, data); err != nil {
 		return fmt.Errorf("could not write database file: %w", err)
 	}
 
-	return nil
+	// Don't mistake our own write for someone else's
+	return db.rememberFile()
 }
@@ -0,0 +1,364 @@
+package chirpydb
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+
+	db, err := NewDB(filepath.Join(t.TempDir(), "database.json"), false)
+	if err != nil {
+		t.Fatalf("could not create database: %v", err)
+	}
+
+	return db
+}
+
+func TestWriteKeepsBackup(t *testing.T) {
+	db := newTestDB(t)
+
+	if _, err := db.CreateUser("first@example.com", "hash"); err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+	if _, err := db.CreateUser("second@example.com", "hash"); err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+
+	backup, err := readDBFile(db.backupPath(), nil, nil)
+	if err != nil {
+		t.Errorf("could not read backup: %v", err)
+		return
+	}
+
+	if len(backup.Users.Items) != 1 {
+		t.Errorf("expected backup to hold the previous generation with 1 user, got %d", len(backup.Users.Items))
+		return
+	}
+
+	matches, _ := filepath.Glob(db.path + tempSuffix + "*")
+	if len(matches) != 0 {
+		t.Errorf("expected no temporary files to be left behind, got %v", matches)
+	}
+}
+
+func TestRecoverFromTornWrite(t *testing.T) {
+	cases := []struct {
+		name string
+		tear func(path string) error
+	}{
+		{
+			name: "truncated",
+			tear: func(path string) error {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				return os.WriteFile(path, data[:len(data)/2], 0o600)
+			},
+		},
+		{
+			name: "empty",
+			tear: func(path string) error {
+				return os.Truncate(path, 0)
+			},
+		},
+		{
+			name: "missing",
+			tear: os.Remove,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db := newTestDB(t)
+
+			if _, err := db.CreateUser("first@example.com", "hash"); err != nil {
+				t.Errorf("could not create user: %v", err)
+				return
+			}
+			if _, err := db.CreateUser("second@example.com", "hash"); err != nil {
+				t.Errorf("could not create user: %v", err)
+				return
+			}
+
+			// Simulate a crash in the middle of writing the primary file, plus a leftover temp file
+			if err := c.tear(db.path); err != nil {
+				t.Errorf("could not tear database file: %v", err)
+				return
+			}
+			if err := os.WriteFile(db.path+tempSuffix+"123", []byte(`{"chirps":`), 0o600); err != nil {
+				t.Errorf("could not create temp file: %v", err)
+				return
+			}
+
+			db, err := NewDB(db.path, false)
+			if err != nil {
+				t.Errorf("expected database to be recovered, got %v", err)
+				return
+			}
+
+			if _, err := db.GetUserByEmail("first@example.com"); err != nil {
+				t.Errorf("expected user from backup to exist, got %v", err)
+				return
+			}
+
+			matches, _ := filepath.Glob(db.path + tempSuffix + "*")
+			if len(matches) != 0 {
+				t.Errorf("expected stale temporary files to be removed, got %v", matches)
+			}
+		})
+	}
+}
+
+func TestRecoverFailsWithoutGoodBackup(t *testing.T) {
+	db := newTestDB(t)
+
+	if _, err := db.CreateUser("first@example.com", "hash"); err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+
+	for _, p := range []string{db.path, db.backupPath()} {
+		if err := os.WriteFile(p, []byte(`{"chirps":{`), 0o600); err != nil {
+			t.Errorf("could not damage file: %v", err)
+			return
+		}
+	}
+
+	if _, err := NewDB(db.path, false); err == nil {
+		t.Errorf("expected an error when both files are damaged")
+	}
+}
+
+func TestGeneratedTokenKey(t *testing.T) {
+	for _, backend := range []string{BackendJSON, BackendSQLite} {
+		path := filepath.Join(t.TempDir(), "database")
+
+		db, err := Open(backend, path, Options{})
+		if err != nil {
+			t.Errorf("could not open %s database without a token key: %v", backend, err)
+			return
+		}
+		token, err := db.AddRefreshToken(1, time.Now().Add(time.Hour), Client{})
+		if err != nil {
+			t.Errorf("could not add refresh token: %v", err)
+			return
+		}
+		db.Close()
+
+		info, err := os.Stat(path + tokenKeySuffix)
+		if err != nil || info.Mode().Perm() != 0o600 {
+			t.Errorf("expected a private %s token key file, got %v (%v)", backend, info, err)
+			return
+		}
+
+		// The key is kept, so tokens survive a restart
+		db, err = Open(backend, path, Options{})
+		if err != nil {
+			t.Errorf("could not reopen %s database: %v", backend, err)
+			return
+		}
+		defer db.Close()
+
+		if userId, err := db.CheckRefreshToken(token.Token); err != nil || userId != 1 {
+			t.Errorf("expected the %s token to still work, got user %d (%v)", backend, userId, err)
+			return
+		}
+	}
+}
+
+func TestUpdateRollsBack(t *testing.T) {
+	db := newTestDB(t)
+
+	chirp, err := db.CreateChirp("keep me", 1)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	errAbort := errors.New("abort")
+	err = db.Update(func(s *DBStructure) error {
+		s.PutChirp(Chirp{Id: s.NewChirpId(), Body: "drop me", AuthorId: 1})
+		s.DeleteChirp(chirp.Id)
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Errorf("expected the transaction error, got %v", err)
+		return
+	}
+
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Errorf("could not get chirps: %v", err)
+		return
+	}
+	if len(chirps) != 1 || !reflect.DeepEqual(chirps[0], chirp) {
+		t.Errorf("expected only %v after rollback, got %v", chirp, chirps)
+		return
+	}
+
+	next, err := db.CreateChirp("next", 1)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	if next.Id != chirp.Id+1 {
+		t.Errorf("expected the reserved ID to be released, got %d", next.Id)
+	}
+}
+
+func TestWriteBehind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	// Long enough that the flusher never runs during the test
+	db, err := NewDBWithOptions(path, Options{FlushInterval: time.Hour})
+	if err != nil {
+		t.Errorf("could not create database: %v", err)
+		return
+	}
+
+	if _, err := db.CreateUser("user@example.com", "hash"); err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+
+	// Reads are served from memory before anything is written
+	if _, err := db.GetUserByEmail("user@example.com"); err != nil {
+		t.Errorf("expected user to be readable before flushing, got %v", err)
+		return
+	}
+
+	onDisk, err := readDBFile(path, nil, nil)
+	if err != nil {
+		t.Errorf("could not read database file: %v", err)
+		return
+	}
+	if len(onDisk.Users.Items) != 0 {
+		t.Errorf("expected nothing on disk before flushing, got %d users", len(onDisk.Users.Items))
+		return
+	}
+
+	if err := db.Close(); err != nil {
+		t.Errorf("could not close database: %v", err)
+		return
+	}
+
+	onDisk, err = readDBFile(path, nil, nil)
+	if err != nil {
+		t.Errorf("could not read database file: %v", err)
+		return
+	}
+	if len(onDisk.Users.Items) != 1 {
+		t.Errorf("expected close to flush 1 user, got %d", len(onDisk.Users.Items))
+		return
+	}
+
+	if _, err := db.CreateUser("late@example.com", "hash"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed after closing, got %v", err)
+	}
+}
+
+// Read latency should stay flat as the database grows
+func BenchmarkGetChirp(b *testing.B) {
+	for _, size := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("chirps=%d", size), func(b *testing.B) {
+			db, err := NewDB(filepath.Join(b.TempDir(), "database.json"), false)
+			if err != nil {
+				b.Fatalf("could not create database: %v", err)
+			}
+
+			err = db.Update(func(s *DBStructure) error {
+				for i := 0; i < size; i++ {
+					s.PutChirp(Chirp{Id: s.NewChirpId(), Body: fmt.Sprintf("chirp %d", i), AuthorId: i % 10})
+				}
+				return nil
+			})
+			if err != nil {
+				b.Fatalf("could not fill database: %v", err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.GetChirp(i%size + 1); err != nil {
+					b.Fatalf("could not get chirp: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestIndexesFollowChanges(t *testing.T) {
+	db := newTestDB(t)
+
+	user, err := db.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := db.CreateChirp("chirp", i%2+1); err != nil {
+			t.Errorf("could not create chirp: %v", err)
+			return
+		}
+	}
+
+	token, err := db.AddRefreshToken(user.Id, time.Now().Add(time.Hour), Client{})
+	if err != nil {
+		t.Errorf("could not add refresh token: %v", err)
+		return
+	}
+	if _, err := db.RotateRefreshToken(token.Token, time.Now().Add(time.Hour), Client{}); err != nil {
+		t.Errorf("could not rotate refresh token: %v", err)
+		return
+	}
+
+	// Changes that are rolled back must not leave anything in the indexes
+	db.Update(func(s *DBStructure) error {
+		s.revokeTokenFamily(token.FamilyId)
+		s.DeleteChirp(1)
+		s.PutChirp(Chirp{Id: s.NewChirpId(), Body: "moved", AuthorId: 3})
+		user.Email = "renamed@example.com"
+		s.PutUser(user)
+		return errors.New("abort")
+	})
+
+	if _, err := db.ChangeUserCredentials(user.Id, "final@example.com", "hash"); err != nil {
+		t.Errorf("could not update user: %v", err)
+		return
+	}
+	if err := db.DeleteChirp(2); err != nil {
+		t.Errorf("could not delete chirp: %v", err)
+		return
+	}
+	if _, err := db.AddReaction(ReactionLike, 3, user.Id); err != nil {
+		t.Errorf("could not like chirp: %v", err)
+		return
+	}
+
+	db.View(func(s *DBStructure) error {
+		got := s.idx
+		s.buildIndexes()
+
+		if !maps.Equal(got.usersByEmail, s.idx.usersByEmail) {
+			t.Errorf("expected email index %v, got %v", s.idx.usersByEmail, got.usersByEmail)
+		}
+		if !maps.EqualFunc(got.chirpsByAuthor, s.idx.chirpsByAuthor, slices.Equal) {
+			t.Errorf("expected author index %v, got %v", s.idx.chirpsByAuthor, got.chirpsByAuthor)
+		}
+		if !maps.EqualFunc(got.tokensByFamily, s.idx.tokensByFamily, slices.Equal) || len(got.tokensByFamily[token.FamilyId]) != 2 {
+			t.Errorf("expected token family index %v, got %v", s.idx.tokensByFamily, got.tokensByFamily)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,165 @@
+package chirpydb
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// A user following another user
+type Follow struct {
+	FollowerId int       `json:"follower_id"`
+	FolloweeId int       `json:"followee_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Follows are stored under the two users they connect
+func followKey(followerId, followeeId int) string {
+	return fmt.Sprintf("%d:%d", followerId, followeeId)
+}
+
+// Makes a user follow another, following twice changes nothing
+// Returns the user being followed, with the updated follower count
+func (db *DB) Follow(followerId, followeeId int) (User, error) {
+	if followerId == followeeId {
+		return User{}, ErrFollowSelf
+	}
+
+	var followee User
+
+	err := db.Update(func(dbStruct *DBStructure) error {
+		follower, ok := dbStruct.Users.Items[followerId]
+		if !ok {
+			return ErrNotExist
+		}
+		if followee, ok = dbStruct.Users.Items[followeeId]; !ok {
+			return ErrNotExist
+		}
+
+		if _, ok := dbStruct.Follows[followKey(followerId, followeeId)]; ok {
+			return nil
+		}
+
+		dbStruct.PutFollow(Follow{followerId, followeeId, time.Now().UTC()})
+
+		follower.FollowingCount++
+		followee.FollowerCount++
+		dbStruct.PutUser(follower)
+		dbStruct.PutUser(followee)
+
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return followee, nil
+}
+
+// Makes a user stop following another, unfollowing twice changes nothing
+// Returns the user that was followed, with the updated follower count
+func (db *DB) Unfollow(followerId, followeeId int) (User, error) {
+	var followee User
+
+	err := db.Update(func(dbStruct *DBStructure) error {
+		follower, ok := dbStruct.Users.Items[followerId]
+		if !ok {
+			return ErrNotExist
+		}
+		if followee, ok = dbStruct.Users.Items[followeeId]; !ok {
+			return ErrNotExist
+		}
+
+		if !dbStruct.DeleteFollow(followerId, followeeId) {
+			return nil
+		}
+
+		follower.FollowingCount--
+		followee.FollowerCount--
+		dbStruct.PutUser(follower)
+		dbStruct.PutUser(followee)
+
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return followee, nil
+}
+
+// Returns a page of the users following a user, sorted by follower ID
+func (db *DB) GetFollowers(userId int, opts ListOptions) ([]Follow, error) {
+	return db.listFollows(userId, opts, func(s *DBStructure) ([]int, func(id int) string) {
+		return s.idx.followers[userId], func(id int) string { return followKey(id, userId) }
+	})
+}
+
+// Returns a page of the users a user follows, sorted by followee ID
+func (db *DB) GetFollowing(userId int, opts ListOptions) ([]Follow, error) {
+	return db.listFollows(userId, opts, func(s *DBStructure) ([]int, func(id int) string) {
+		return s.idx.following[userId], func(id int) string { return followKey(userId, id) }
+	})
+}
+
+// Pages through the sorted IDs of the other side of a user's follows
+func (db *DB) listFollows(userId int, opts ListOptions, ids func(s *DBStructure) ([]int, func(id int) string)) ([]Follow, error) {
+	follows := []Follow{}
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Users.Items[userId]; !ok {
+			return ErrNotExist
+		}
+
+		sorted, key := ids(dbStruct)
+		for _, id := range pageIds(sorted, opts) {
+			follows = append(follows, dbStruct.Follows[key(id)])
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []Follow{}, err
+	}
+
+	return follows, nil
+}
+
+// Returns a page of the chirps of the users a user follows, sorted by creation time
+// The page is merged from a page of each followed user's chirps, so nothing is copied per follower when a chirp is posted
+func (db *DB) GetTimeline(userId int, opts ListOptions) ([]Chirp, error) {
+	chirps := []Chirp{}
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Users.Items[userId]; !ok {
+			return ErrNotExist
+		}
+
+		opts.SortBy = SortByCreatedAt
+		keys := []chirpKey{}
+		for _, followeeId := range dbStruct.idx.following[userId] {
+			for _, id := range pageChirpIds(nil, dbStruct.idx.chirpsByAuthorTime[followeeId], opts) {
+				keys = append(keys, chirpKey{dbStruct.Chirps.Items[id].CreatedAt, id})
+			}
+		}
+
+		slices.SortFunc(keys, compareChirpKeys)
+		if opts.Desc {
+			slices.Reverse(keys)
+		}
+		if opts.Limit > 0 && len(keys) > opts.Limit {
+			keys = keys[:opts.Limit]
+		}
+
+		for _, k := range keys {
+			chirps = append(chirps, dbStruct.Chirps.Items[k.id])
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []Chirp{}, err
+	}
+
+	return chirps, nil
+}
@@ -0,0 +1,508 @@
+package chirpydb
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// In-memory secondary indexes over DBStructure
+// They are not stored on disk, but built when the database is loaded and kept up to date by every change
+type dbIndexes struct {
+	// Lowercased email -> user ID
+	usersByEmail map[string]int
+
+	// Author ID -> IDs of their chirps, sorted ascending
+	chirpsByAuthor map[int][]int
+
+	// IDs of all chirps, sorted ascending
+	chirpIds []int
+
+	// Reaction table -> chirp ID -> IDs of the users that reacted, sorted ascending
+	// and reaction table -> user ID -> IDs of the chirps they reacted to, sorted ascending
+	reactionsByChirp map[string]map[int][]int
+	reactionsByUser  map[string]map[int][]int
+
+	// Followee ID -> IDs of their followers, and follower ID -> IDs of the users they follow, sorted ascending
+	followers map[int][]int
+	following map[int][]int
+
+	// User ID -> IDs of their token events, sorted ascending
+	tokenEventsByUser map[int][]int
+
+	// User ID -> family ID -> hash of the latest refresh token of the family
+	sessionsByUser map[int]map[string]string
+
+	// Family ID -> hashes of its refresh tokens, sorted ascending
+	tokensByFamily map[string][]string
+
+	// Hashtag -> IDs of the chirps using it, sorted ascending
+	chirpsByHashtag map[string][]int
+
+	// Trending bucket -> hashtag -> chirps using it created in the bucket
+	// hashtagBuckets holds the buckets that have any, sorted ascending
+	hashtagCounts  map[int]map[string]int
+	hashtagBuckets []int
+
+	// Thread root ID -> IDs of the chirps in the thread, sorted ascending
+	chirpsByRoot map[int][]int
+
+	// All chirps and the chirps of each author, sorted by creation time
+	chirpsByTime       []chirpKey
+	chirpsByAuthorTime map[int][]chirpKey
+
+	// Full-text search index, term -> chirp ID -> positions of the term in the chirp
+	// searchTerms holds the same terms sorted, for prefix searches
+	postings    map[string]map[int][]int
+	searchTerms []string
+}
+
+func emailKey(email string) string {
+	return strings.ToLower(email)
+}
+
+// Builds the indexes from scratch
+func (s *DBStructure) buildIndexes() {
+	s.idx = dbIndexes{
+		usersByEmail:       make(map[string]int, len(s.Users.Items)),
+		chirpsByAuthor:     map[int][]int{},
+		chirpIds:           make([]int, 0, len(s.Chirps.Items)),
+		chirpsByAuthorTime: map[int][]chirpKey{},
+		chirpsByRoot:       map[int][]int{},
+		reactionsByChirp:   map[string]map[int][]int{tableLikes: {}, tableRechirps: {}},
+		reactionsByUser:    map[string]map[int][]int{tableLikes: {}, tableRechirps: {}},
+		followers:          map[int][]int{},
+		following:          map[int][]int{},
+		chirpsByHashtag:    map[string][]int{},
+		hashtagCounts:      map[int]map[string]int{},
+		tokenEventsByUser:  map[int][]int{},
+		sessionsByUser:     map[int]map[string]string{},
+		tokensByFamily:     map[string][]string{},
+		postings:           map[string]map[int][]int{},
+	}
+
+	for _, u := range s.Users.Items {
+		s.reindex(tableUsers, nil, u)
+	}
+
+	// In ID order, so that the sorted indexes are only ever appended to
+	for _, id := range slices.Sorted(maps.Keys(s.Chirps.Items)) {
+		s.reindex(tableChirps, nil, s.Chirps.Items[id])
+	}
+
+	for _, table := range []string{tableLikes, tableRechirps} {
+		for _, r := range s.reactions(table) {
+			s.reindex(table, nil, r)
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(s.TokenEvents.Items)) {
+		s.reindex(tableTokenEvents, nil, s.TokenEvents.Items[id])
+	}
+
+	for _, t := range s.RefreshTokens {
+		s.reindex(tableRefreshTokens, nil, t)
+	}
+
+	// After the chirps, so that following someone brings their chirps into the timeline
+	for _, f := range s.Follows {
+		s.reindex(tableFollows, nil, f)
+	}
+}
+
+// Removes id from a sorted slice of IDs
+func removeSorted(ids []int, id int) []int {
+	if i, found := slices.BinarySearch(ids, id); found {
+		ids = slices.Delete(ids, i, i+1)
+	}
+
+	return ids
+}
+
+// Adds id to a sorted slice of IDs
+func insertSorted(ids []int, id int) []int {
+	if i, found := slices.BinarySearch(ids, id); !found {
+		ids = slices.Insert(ids, i, id)
+	}
+
+	return ids
+}
+
+// Position of a chirp when sorting by creation time, the ID breaks ties
+type chirpKey struct {
+	createdAt time.Time
+	id        int
+}
+
+func compareChirpKeys(a, b chirpKey) int {
+	if c := a.createdAt.Compare(b.createdAt); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.id, b.id)
+}
+
+func removeSortedKey(keys []chirpKey, key chirpKey) []chirpKey {
+	if i, found := slices.BinarySearchFunc(keys, key, compareChirpKeys); found {
+		keys = slices.Delete(keys, i, i+1)
+	}
+
+	return keys
+}
+
+func insertSortedKey(keys []chirpKey, key chirpKey) []chirpKey {
+	if i, found := slices.BinarySearchFunc(keys, key, compareChirpKeys); !found {
+		keys = slices.Insert(keys, i, key)
+	}
+
+	return keys
+}
+
+// Updates the indexes after an entity in table changed from before to after
+// Before is nil if the entity was created, and after is nil if it was deleted
+func (s *DBStructure) reindex(table string, before, after any) {
+	if s.idx.usersByEmail == nil {
+		// Indexes are not built yet
+		return
+	}
+
+	switch table {
+	case tableUsers:
+		if u, ok := before.(User); ok {
+			delete(s.idx.usersByEmail, emailKey(u.Email))
+		}
+		if u, ok := after.(User); ok {
+			s.idx.usersByEmail[emailKey(u.Email)] = u.Id
+		}
+	case tableTokenEvents:
+		if e, ok := before.(TokenEvent); ok {
+			s.idx.tokenEventsByUser[e.UserId] = removeSorted(s.idx.tokenEventsByUser[e.UserId], e.Id)
+			if len(s.idx.tokenEventsByUser[e.UserId]) == 0 {
+				delete(s.idx.tokenEventsByUser, e.UserId)
+			}
+		}
+		if e, ok := after.(TokenEvent); ok {
+			s.idx.tokenEventsByUser[e.UserId] = insertSorted(s.idx.tokenEventsByUser[e.UserId], e.Id)
+		}
+	case tableRefreshTokens:
+		if t, ok := before.(RefreshToken); ok {
+			if i, found := slices.BinarySearch(s.idx.tokensByFamily[t.FamilyId], t.TokenHash); found {
+				s.idx.tokensByFamily[t.FamilyId] = slices.Delete(s.idx.tokensByFamily[t.FamilyId], i, i+1)
+			}
+			if len(s.idx.tokensByFamily[t.FamilyId]) == 0 {
+				delete(s.idx.tokensByFamily, t.FamilyId)
+			}
+
+			// Only the latest token of a family stands for the session
+			if t.RotatedAt == nil && s.idx.sessionsByUser[t.UserId][t.FamilyId] == t.TokenHash {
+				delete(s.idx.sessionsByUser[t.UserId], t.FamilyId)
+				if len(s.idx.sessionsByUser[t.UserId]) == 0 {
+					delete(s.idx.sessionsByUser, t.UserId)
+				}
+			}
+		}
+		if t, ok := after.(RefreshToken); ok {
+			if i, found := slices.BinarySearch(s.idx.tokensByFamily[t.FamilyId], t.TokenHash); !found {
+				s.idx.tokensByFamily[t.FamilyId] = slices.Insert(s.idx.tokensByFamily[t.FamilyId], i, t.TokenHash)
+			}
+
+			if t.RotatedAt == nil {
+				if s.idx.sessionsByUser[t.UserId] == nil {
+					s.idx.sessionsByUser[t.UserId] = map[string]string{}
+				}
+				s.idx.sessionsByUser[t.UserId][t.FamilyId] = t.TokenHash
+			}
+		}
+	case tableChirps:
+		// Reactions and replies only change counts, which nothing is indexed by
+		if sameIndexedChirp(before, after) {
+			return
+		}
+
+		if c, ok := before.(Chirp); ok {
+			ids := removeSorted(s.idx.chirpsByAuthor[c.AuthorId], c.Id)
+			if len(ids) == 0 {
+				delete(s.idx.chirpsByAuthor, c.AuthorId)
+			} else {
+				s.idx.chirpsByAuthor[c.AuthorId] = ids
+			}
+
+			s.idx.chirpIds = removeSorted(s.idx.chirpIds, c.Id)
+
+			if ids := removeSorted(s.idx.chirpsByRoot[c.RootId], c.Id); len(ids) == 0 {
+				delete(s.idx.chirpsByRoot, c.RootId)
+			} else {
+				s.idx.chirpsByRoot[c.RootId] = ids
+			}
+
+			key := chirpKey{c.CreatedAt, c.Id}
+			s.idx.chirpsByTime = removeSortedKey(s.idx.chirpsByTime, key)
+			if keys := removeSortedKey(s.idx.chirpsByAuthorTime[c.AuthorId], key); len(keys) == 0 {
+				delete(s.idx.chirpsByAuthorTime, c.AuthorId)
+			} else {
+				s.idx.chirpsByAuthorTime[c.AuthorId] = keys
+			}
+
+			s.idx.unindexText(c.Id, c.Body)
+
+			for _, tag := range c.Hashtags {
+				if ids := removeSorted(s.idx.chirpsByHashtag[tag], c.Id); len(ids) == 0 {
+					delete(s.idx.chirpsByHashtag, tag)
+				} else {
+					s.idx.chirpsByHashtag[tag] = ids
+				}
+			}
+			s.idx.countHashtags(c, -1)
+		}
+		if c, ok := after.(Chirp); ok {
+			s.idx.chirpsByAuthor[c.AuthorId] = insertSorted(s.idx.chirpsByAuthor[c.AuthorId], c.Id)
+			s.idx.chirpIds = insertSorted(s.idx.chirpIds, c.Id)
+			s.idx.chirpsByRoot[c.RootId] = insertSorted(s.idx.chirpsByRoot[c.RootId], c.Id)
+
+			key := chirpKey{c.CreatedAt, c.Id}
+			s.idx.chirpsByTime = insertSortedKey(s.idx.chirpsByTime, key)
+			s.idx.chirpsByAuthorTime[c.AuthorId] = insertSortedKey(s.idx.chirpsByAuthorTime[c.AuthorId], key)
+
+			s.idx.indexText(c.Id, c.Body)
+
+			for _, tag := range c.Hashtags {
+				s.idx.chirpsByHashtag[tag] = insertSorted(s.idx.chirpsByHashtag[tag], c.Id)
+			}
+			s.idx.countHashtags(c, 1)
+		}
+	case tableFollows:
+		if f, ok := before.(Follow); ok {
+			s.idx.followers[f.FolloweeId] = removeSorted(s.idx.followers[f.FolloweeId], f.FollowerId)
+			if len(s.idx.followers[f.FolloweeId]) == 0 {
+				delete(s.idx.followers, f.FolloweeId)
+			}
+			s.idx.following[f.FollowerId] = removeSorted(s.idx.following[f.FollowerId], f.FolloweeId)
+			if len(s.idx.following[f.FollowerId]) == 0 {
+				delete(s.idx.following, f.FollowerId)
+			}
+		}
+		if f, ok := after.(Follow); ok {
+			s.idx.followers[f.FolloweeId] = insertSorted(s.idx.followers[f.FolloweeId], f.FollowerId)
+			s.idx.following[f.FollowerId] = insertSorted(s.idx.following[f.FollowerId], f.FolloweeId)
+		}
+	case tableLikes, tableRechirps:
+		byChirp, byUser := s.idx.reactionsByChirp[table], s.idx.reactionsByUser[table]
+		if r, ok := before.(Reaction); ok {
+			if ids := removeSorted(byChirp[r.ChirpId], r.UserId); len(ids) == 0 {
+				delete(byChirp, r.ChirpId)
+			} else {
+				byChirp[r.ChirpId] = ids
+			}
+			if ids := removeSorted(byUser[r.UserId], r.ChirpId); len(ids) == 0 {
+				delete(byUser, r.UserId)
+			} else {
+				byUser[r.UserId] = ids
+			}
+		}
+		if r, ok := after.(Reaction); ok {
+			byChirp[r.ChirpId] = insertSorted(byChirp[r.ChirpId], r.UserId)
+			byUser[r.UserId] = insertSorted(byUser[r.UserId], r.ChirpId)
+		}
+	}
+}
+
+// Adds delta to the uses of the hashtags of a chirp in its trending bucket
+func (idx *dbIndexes) countHashtags(c Chirp, delta int) {
+	if len(c.Hashtags) == 0 {
+		return
+	}
+
+	bucket := trendingBucketOf(c.CreatedAt)
+	counts, ok := idx.hashtagCounts[bucket]
+	if !ok {
+		counts = map[string]int{}
+		idx.hashtagCounts[bucket] = counts
+		idx.hashtagBuckets = insertSorted(idx.hashtagBuckets, bucket)
+	}
+
+	for _, tag := range c.Hashtags {
+		if counts[tag] += delta; counts[tag] <= 0 {
+			delete(counts, tag)
+		}
+	}
+
+	if len(counts) == 0 {
+		delete(idx.hashtagCounts, bucket)
+		idx.hashtagBuckets = removeSorted(idx.hashtagBuckets, bucket)
+	}
+}
+
+// Reports whether a change to a chirp leaves alone everything the indexes are built from
+func sameIndexedChirp(before, after any) bool {
+	b, hadBefore := before.(Chirp)
+	a, hasAfter := after.(Chirp)
+
+	return hadBefore && hasAfter && b.Id == a.Id && b.AuthorId == a.AuthorId && b.RootId == a.RootId &&
+		b.CreatedAt.Equal(a.CreatedAt) && b.Body == a.Body && slices.Equal(b.Hashtags, a.Hashtags)
+}
+
+// Looks up a user by email, ignoring case
+func (s *DBStructure) userByEmail(email string) (User, bool) {
+	id, ok := s.idx.usersByEmail[emailKey(email)]
+	if !ok {
+		return User{}, false
+	}
+
+	user, ok := s.Users.Items[id]
+	return user, ok
+}
+
+// Returns the IDs of an author's chirps, sorted ascending
+// The returned slice must not be modified
+func (s *DBStructure) chirpIdsByAuthor(authorId int) []int {
+	return s.idx.chirpsByAuthor[authorId]
+}
+
+// Returns the page of a sorted slice of IDs that opts asks for, in the order it asks for
+// Only the IDs on the page are visited, so this doesn't get slower as the slice grows
+func pageIds(ids []int, opts ListOptions) []int {
+	start, end := 0, len(ids)
+
+	if opts.Desc {
+		if opts.After > 0 {
+			end, _ = slices.BinarySearch(ids, opts.After)
+		}
+		if opts.Limit > 0 {
+			start = max(0, end-opts.Limit)
+		}
+
+		page := slices.Clone(ids[start:end])
+		slices.Reverse(page)
+		return page
+	}
+
+	if opts.After > 0 {
+		var found bool
+		if start, found = slices.BinarySearch(ids, opts.After); found {
+			start++
+		}
+	}
+	if opts.Limit > 0 {
+		end = min(end, start+opts.Limit)
+	}
+
+	return slices.Clone(ids[start:end])
+}
+
+// Returns the IDs of the page of chirps that opts asks for
+// byId and byTime must hold the same chirps, sorted by ID and by creation time
+func pageChirpIds(byId []int, byTime []chirpKey, opts ListOptions) []int {
+	if opts.SortBy != SortByCreatedAt && opts.Since.IsZero() && opts.Until.IsZero() {
+		return pageIds(byId, opts)
+	}
+
+	// Chirps in the time range
+	start, end := 0, len(byTime)
+	if !opts.Since.IsZero() {
+		start, _ = slices.BinarySearchFunc(byTime, chirpKey{opts.Since, 0}, compareChirpKeys)
+	}
+	if !opts.Until.IsZero() {
+		end, _ = slices.BinarySearchFunc(byTime, chirpKey{opts.Until, 0}, compareChirpKeys)
+	}
+	end = max(start, end)
+
+	if opts.SortBy != SortByCreatedAt {
+		// IDs don't follow creation times exactly, so the IDs in range are sorted to page through them
+		ids := make([]int, 0, end-start)
+		for _, k := range byTime[start:end] {
+			ids = append(ids, k.id)
+		}
+		slices.Sort(ids)
+
+		return pageIds(ids, opts)
+	}
+
+	if opts.After > 0 {
+		cursor, found := slices.BinarySearchFunc(byTime, chirpKey{opts.AfterTime, opts.After}, compareChirpKeys)
+		if opts.Desc {
+			end = min(end, cursor)
+		} else {
+			if found {
+				cursor++
+			}
+			start = max(start, cursor)
+		}
+	}
+
+	if opts.Limit > 0 {
+		if opts.Desc {
+			start = max(start, end-opts.Limit)
+		} else {
+			end = min(end, start+opts.Limit)
+		}
+	}
+
+	ids := []int{}
+	for i := start; i < end; i++ {
+		ids = append(ids, byTime[i].id)
+	}
+	if opts.Desc {
+		slices.Reverse(ids)
+	}
+
+	return ids
+}
+
+// Adds the words of a chirp to the search index
+func (idx *dbIndexes) indexText(id int, text string) {
+	for term, positions := range termPositions(text) {
+		docs, ok := idx.postings[term]
+		if !ok {
+			docs = map[int][]int{}
+			idx.postings[term] = docs
+
+			i, _ := slices.BinarySearch(idx.searchTerms, term)
+			idx.searchTerms = slices.Insert(idx.searchTerms, i, term)
+		}
+
+		docs[id] = positions
+	}
+}
+
+// Removes the words of a chirp from the search index
+func (idx *dbIndexes) unindexText(id int, text string) {
+	for term := range termPositions(text) {
+		docs := idx.postings[term]
+		delete(docs, id)
+
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+
+			if i, found := slices.BinarySearch(idx.searchTerms, term); found {
+				idx.searchTerms = slices.Delete(idx.searchTerms, i, i+1)
+			}
+		}
+	}
+}
+
+// Serves searches from the in-memory index
+// It must only be used while the structure is locked
+type indexSearchSource struct {
+	s *DBStructure
+}
+
+func (src indexSearchSource) postings(term string) (map[int][]int, error) {
+	return src.s.idx.postings[term], nil
+}
+
+func (src indexSearchSource) termsWithPrefix(prefix string, limit int) ([]string, error) {
+	terms := src.s.idx.searchTerms
+
+	i, _ := slices.BinarySearch(terms, prefix)
+	end := i
+	for end < len(terms) && end-i < limit && strings.HasPrefix(terms[end], prefix) {
+		end++
+	}
+
+	return terms[i:end], nil
+}
+
+func (src indexSearchSource) chirpCount() (int, error) {
+	return len(src.s.Chirps.Items), nil
+}
@@ -0,0 +1,308 @@
+package chirpydb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// In journaled mode, every transaction is appended to a log file next to the database with this suffix
+// The database file itself then acts as a snapshot that the log is replayed on top of
+const journalSuffix = ".wal"
+
+// A single put or delete inside a journal record
+// Deletes have no value
+type journalOp struct {
+	Table string          `json:"table"`
+	Key   json.RawMessage `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Everything one transaction changed, stored as one line in the journal
+type journalRecord struct {
+	Seq      uint64         `json:"seq"`
+	Ops      []journalOp    `json:"ops"`
+	IdCounts map[string]int `json:"id_counts"`
+
+	// Sequence number of the last change feed event of the transaction
+	ChangeSeq uint64 `json:"change_seq,omitempty"`
+}
+
+func (db *DB) journalPath() string {
+	return db.path + journalSuffix
+}
+
+func newJournalRecord(seq uint64, s *DBStructure, changes []change) (journalRecord, error) {
+	rec := journalRecord{
+		Seq: seq,
+		Ops: make([]journalOp, 0, len(changes)),
+		IdCounts: map[string]int{
+			tableChirps:      s.Chirps.IdCount,
+			tableUsers:       s.Users.IdCount,
+			tableTokenEvents: s.TokenEvents.IdCount,
+		},
+		ChangeSeq: s.ChangeSeq,
+	}
+
+	for _, c := range changes {
+		key, err := json.Marshal(c.Key)
+		if err != nil {
+			return journalRecord{}, err
+		}
+
+		op := journalOp{Table: c.Table, Key: key}
+		if c.After != nil {
+			if op.Value, err = json.Marshal(c.After); err != nil {
+				return journalRecord{}, err
+			}
+		}
+
+		rec.Ops = append(rec.Ops, op)
+	}
+
+	return rec, nil
+}
+
+// Applies a journal record to the structure
+func (s *DBStructure) applyJournalRecord(rec journalRecord) error {
+	for _, op := range rec.Ops {
+		var err error
+
+		switch op.Table {
+		case tableChirps:
+			err = applyJournalOp(s.Chirps.Items, op)
+		case tableUsers:
+			err = applyJournalOp(s.Users.Items, op)
+		case tableRefreshTokens:
+			err = applyJournalOp(s.RefreshTokens, op)
+		case tableTokenEvents:
+			err = applyJournalOp(s.TokenEvents.Items, op)
+		case tableChirpRevisions:
+			err = applyJournalOp(s.ChirpRevisions, op)
+		case tableLikes:
+			err = applyJournalOp(s.Likes, op)
+		case tableRechirps:
+			err = applyJournalOp(s.Rechirps, op)
+		case tableFollows:
+			err = applyJournalOp(s.Follows, op)
+		default:
+			err = fmt.Errorf("unknown table %q", op.Table)
+		}
+
+		if err != nil {
+			return fmt.Errorf("could not apply journal record %d: %w", rec.Seq, err)
+		}
+	}
+
+	if n, ok := rec.IdCounts[tableChirps]; ok {
+		s.Chirps.IdCount = n
+	}
+	if n, ok := rec.IdCounts[tableUsers]; ok {
+		s.Users.IdCount = n
+	}
+	if n, ok := rec.IdCounts[tableTokenEvents]; ok {
+		s.TokenEvents.IdCount = n
+	}
+
+	if rec.ChangeSeq > 0 {
+		s.ChangeSeq = rec.ChangeSeq
+	}
+
+	s.JournalSeq = rec.Seq
+
+	return nil
+}
+
+func applyJournalOp[K comparable, T any](items map[K]T, op journalOp) error {
+	var key K
+	if err := json.Unmarshal(op.Key, &key); err != nil {
+		return err
+	}
+
+	if op.Value == nil {
+		delete(items, key)
+		return nil
+	}
+
+	var v T
+	if err := json.Unmarshal(op.Value, &v); err != nil {
+		return err
+	}
+
+	items[key] = v
+
+	return nil
+}
+
+// Reads all complete records from the journal
+// A damaged last record is what a crash in the middle of an append looks like, so it is dropped
+// goodSize is the length of the journal up to the last complete record
+func readJournal(path string, keys *Keyring) (records []journalRecord, goodSize int64, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("could not read journal: %w", err)
+	}
+
+	for len(data) > 0 {
+		line, rest, found := bytes.Cut(data, []byte("\n"))
+
+		rec, err := decodeJournalLine(line, keys)
+		if err != nil || !found {
+			if len(bytes.TrimSpace(rest)) == 0 {
+				log.Printf("dropping incomplete last journal record at offset %d", goodSize)
+				break
+			}
+
+			return nil, 0, fmt.Errorf("journal record at offset %d is damaged: %w", goodSize, err)
+		}
+
+		records = append(records, rec)
+		goodSize += int64(len(line)) + 1
+		data = rest
+	}
+
+	return records, goodSize, nil
+}
+
+func decodeJournalLine(line []byte, keys *Keyring) (journalRecord, error) {
+	line, err := decryptFile(line, keys)
+	if err != nil {
+		return journalRecord{}, err
+	}
+
+	var rec journalRecord
+	err = json.Unmarshal(line, &rec)
+	return rec, err
+}
+
+// Replays the journal on top of the snapshot that was just loaded
+// Records that are already part of the snapshot are skipped, so replaying is idempotent
+// Returns the number of records that were applied
+func (db *DB) replayJournal() (int, error) {
+	records, goodSize, err := readJournal(db.journalPath(), db.keys)
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, rec := range records {
+		if rec.Seq <= db.data.JournalSeq {
+			continue
+		}
+
+		if rec.Seq != db.data.JournalSeq+1 {
+			return 0, fmt.Errorf("journal is missing records between %d and %d", db.data.JournalSeq, rec.Seq)
+		}
+
+		if err := db.data.applyJournalRecord(rec); err != nil {
+			return 0, err
+		}
+
+		applied++
+	}
+
+	// Get rid of the damaged tail so that new records are not appended after it
+	if info, err := os.Stat(db.journalPath()); err == nil && info.Size() > goodSize {
+		if err := os.Truncate(db.journalPath(), goodSize); err != nil {
+			return 0, fmt.Errorf("could not truncate journal: %w", err)
+		}
+	}
+
+	return applied, nil
+}
+
+// Opens the journal for appending
+func (db *DB) openJournal() error {
+	f, err := os.OpenFile(db.journalPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open journal: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not open journal: %w", err)
+	}
+
+	db.journal = f
+	db.journalSize = info.Size()
+
+	return nil
+}
+
+// Appends the changes of a transaction to the journal and syncs it
+// The caller must hold db.mux for writing
+func (db *DB) appendJournal(changes []change) error {
+	rec, err := newJournalRecord(db.data.JournalSeq+1, &db.data, changes)
+	if err != nil {
+		return fmt.Errorf("error marshalling journal record: %w", err)
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("error marshalling journal record: %w", err)
+	}
+
+	// Each record is encrypted on its own, envelopes are single line JSON too
+	if line, err = encryptFile(line, db.keys); err != nil {
+		return fmt.Errorf("could not encrypt journal record: %w", err)
+	}
+
+	line = append(line, '\n')
+
+	if _, err := db.journal.Write(line); err == nil {
+		err = db.journal.Sync()
+	}
+	if err != nil {
+		// Don't leave a partial record behind for the next append to follow
+		db.journal.Truncate(db.journalSize)
+		return fmt.Errorf("could not append to journal: %w", err)
+	}
+
+	db.journalSize += int64(len(line))
+	db.data.JournalSeq = rec.Seq
+
+	return nil
+}
+
+// Folds the journal into a fresh snapshot of the database and empties it
+// This is done periodically in the background and when the database is closed
+func (db *DB) Compact() error {
+	if db.journal == nil {
+		return nil
+	}
+
+	// Compactions can't overlap, and transactions can't append while we hold the read lock
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	if db.journalSize == 0 {
+		return nil
+	}
+
+	// The snapshot records the last sequence number it includes, so if we crash before the journal is emptied,
+	// those records are skipped when replaying
+	if err := db.writeDB(db.data); err != nil {
+		return err
+	}
+
+	if err := db.journal.Truncate(0); err != nil {
+		return fmt.Errorf("could not truncate journal: %w", err)
+	}
+
+	if err := db.journal.Sync(); err != nil {
+		return fmt.Errorf("could not sync journal: %w", err)
+	}
+
+	db.journalSize = 0
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package chirpydb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newJournaledDB(t *testing.T, path string) *DB {
+	t.Helper()
+
+	db, err := NewDBWithOptions(path, Options{Journal: true})
+	if err != nil {
+		t.Fatalf("could not open journaled database: %v", err)
+	}
+
+	return db
+}
+
+// Stops the database without compacting, as if the process died
+func crash(db *DB) {
+	close(db.stop)
+	db.background.Wait()
+	db.journal.Close()
+}
+
+func fillJournaledDB(t *testing.T, db *DB) {
+	t.Helper()
+
+	user, err := db.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Fatalf("could not create user: %v", err)
+	}
+
+	for _, body := range []string{"first", "second", "third"} {
+		if _, err := db.CreateChirp(body, user.Id); err != nil {
+			t.Fatalf("could not create chirp: %v", err)
+		}
+	}
+
+	if err := db.DeleteChirp(2); err != nil {
+		t.Fatalf("could not delete chirp: %v", err)
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := newJournaledDB(t, path)
+	fillJournaledDB(t, db)
+	crash(db)
+
+	snapshot, err := readDBFile(path, nil, nil)
+	if err != nil {
+		t.Errorf("could not read snapshot: %v", err)
+		return
+	}
+	if len(snapshot.Chirps.Items) != 0 {
+		t.Errorf("expected changes to only be in the journal, got %d chirps in the snapshot", len(snapshot.Chirps.Items))
+		return
+	}
+
+	db = newJournaledDB(t, path)
+	defer db.Close()
+
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Errorf("could not get chirps: %v", err)
+		return
+	}
+	if len(chirps) != 2 {
+		t.Errorf("expected 2 chirps after replay, got %d", len(chirps))
+		return
+	}
+
+	// The ID counter is restored too
+	chirp, err := db.CreateChirp("fourth", 1)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	if chirp.Id != 4 {
+		t.Errorf("expected chirp ID 4, got %d", chirp.Id)
+	}
+}
+
+func TestJournalTruncatedLastRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := newJournaledDB(t, path)
+	fillJournaledDB(t, db)
+	crash(db)
+
+	// Half of a record, as if we crashed in the middle of appending it
+	f, err := os.OpenFile(path+journalSuffix, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Errorf("could not open journal: %v", err)
+		return
+	}
+	f.Write([]byte(`{"seq":6,"ops":[{"table":"chirps","key":5,"val`))
+	f.Close()
+
+	db = newJournaledDB(t, path)
+
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Errorf("could not get chirps: %v", err)
+		return
+	}
+	if len(chirps) != 2 {
+		t.Errorf("expected 2 chirps after dropping the torn record, got %d", len(chirps))
+		return
+	}
+
+	// New records must not end up glued to the torn one
+	if _, err := db.CreateChirp("after crash", 1); err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	crash(db)
+
+	db = newJournaledDB(t, path)
+	defer db.Close()
+
+	if chirps, _ := db.GetChirps(); len(chirps) != 3 {
+		t.Errorf("expected 3 chirps after reopening, got %d", len(chirps))
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := newJournaledDB(t, path)
+	fillJournaledDB(t, db)
+
+	journal, err := os.ReadFile(path + journalSuffix)
+	if err != nil {
+		t.Errorf("could not read journal: %v", err)
+		return
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Errorf("could not compact: %v", err)
+		return
+	}
+
+	if info, err := os.Stat(path + journalSuffix); err != nil || info.Size() != 0 {
+		t.Errorf("expected an empty journal after compaction, got %v, %v", info, err)
+		return
+	}
+
+	snapshot, err := readDBFile(path, nil, nil)
+	if err != nil {
+		t.Errorf("could not read snapshot: %v", err)
+		return
+	}
+	if len(snapshot.Chirps.Items) != 2 {
+		t.Errorf("expected 2 chirps in the snapshot, got %d", len(snapshot.Chirps.Items))
+		return
+	}
+	crash(db)
+
+	// Crashing after the snapshot was written but before the journal was emptied must not apply records twice
+	if err := os.WriteFile(path+journalSuffix, journal, 0o600); err != nil {
+		t.Errorf("could not restore journal: %v", err)
+		return
+	}
+
+	db = newJournaledDB(t, path)
+	defer db.Close()
+
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Errorf("could not get chirps: %v", err)
+		return
+	}
+	if len(chirps) != 2 {
+		t.Errorf("expected 2 chirps, got %d", len(chirps))
+		return
+	}
+
+	chirp, err := db.CreateChirp("fourth", 1)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	if chirp.Id != 4 {
+		t.Errorf("expected chirp ID 4, got %d", chirp.Id)
+	}
+}
+
+func TestJournalFoldedWhenNotJournaled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := newJournaledDB(t, path)
+	fillJournaledDB(t, db)
+	crash(db)
+
+	plain, err := NewDB(path, false)
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+
+	if chirps, _ := plain.GetChirps(); len(chirps) != 2 {
+		t.Errorf("expected 2 chirps from the leftover journal, got %d", len(chirps))
+		return
+	}
+
+	if _, err := os.Stat(path + journalSuffix); !os.IsNotExist(err) {
+		t.Errorf("expected leftover journal to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package chirpydb
+
+import (
+	"errors"
+	"os"
+)
+
+// Advisory locks are only implemented with flock for now
+func lockFile(f *os.File, exclusive bool) error {
+	return errors.ErrUnsupported
+}
+
+func unlockFile(f *os.File) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,689 @@
+package chirpydb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A step that upgrades a database file to the next schema version
+// Migrations work on the decoded JSON document rather than DBStructure, since older files may not fit the current types
+type migration struct {
+	version     int
+	description string
+	migrate     func(doc map[string]any, env migrationEnv) error
+}
+
+// What migrations may need besides the document itself
+type migrationEnv struct {
+	// See Options.TokenKey
+	tokenKey []byte
+}
+
+// The version that stopped storing refresh tokens in plain text
+// Files from before it, like backups and snapshots, still have working tokens in them
+const tokenHashVersion = 10
+
+// The database file was written by a newer build, so we can't read it
+var errSchemaTooNew = errors.New("database schema version is newer than this build supports")
+
+// Registry of all migrations, in order
+// Files without a schema_version are version 0
+// Every migration must upgrade to exactly one version higher than the one before it
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Add schema version and any missing tables",
+		migrate: func(doc map[string]any, env migrationEnv) error {
+			for _, table := range []string{tableChirps, tableUsers} {
+				if _, ok := doc[table].(map[string]any); !ok {
+					doc[table] = map[string]any{"id_count": 1, "items": map[string]any{}}
+				}
+			}
+
+			// Refresh tokens were added after chirps and users
+			if _, ok := doc[tableRefreshTokens].(map[string]any); !ok {
+				doc[tableRefreshTokens] = map[string]any{}
+			}
+
+			return nil
+		},
+	},
+	{
+		version:     2,
+		description: "Add creation and update times to chirps and users",
+		migrate: func(doc map[string]any, env migrationEnv) error {
+			// When records were really created is not known, so they all get the time of the migration
+			now := time.Now().UTC().Format(time.RFC3339Nano)
+
+			for _, table := range []string{tableChirps, tableUsers} {
+				items, _ := doc[table].(map[string]any)["items"].(map[string]any)
+				for key, item := range items {
+					record, ok := item.(map[string]any)
+					if !ok {
+						return fmt.Errorf("%s %s is not an object", table, key)
+					}
+
+					if _, ok := record["created_at"]; !ok {
+						record["created_at"] = now
+					}
+					if _, ok := record["updated_at"]; !ok {
+						record["updated_at"] = record["created_at"]
+					}
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		version:     3,
+		description: "Add chirp revisions and mark chirps that were edited",
+		migrate: func(doc map[string]any, env migrationEnv) error {
+			if _, ok := doc[tableChirpRevisions].(map[string]any); !ok {
+				doc[tableChirpRevisions] = map[string]any{}
+			}
+
+			// Nothing could be edited before, so every chirp is unedited
+			items, _ := doc[tableChirps].(map[string]any)["items"].(map[string]any)
+			for key, item := range items {
+				record, ok := item.(map[string]any)
+				if !ok {
+					return fmt.Errorf("%s %s is not an object", tableChirps, key)
+				}
+
+				if _, ok := record["edited"]; !ok {
+					record["edited"] = false
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		version:     4,
+		description: "Add threads, every existing chirp starts its own",
+		migrate: func(doc map[string]any, env migrationEnv) error {
+			items, _ := doc[tableChirps].(map[string]any)["items"].(map[string]any)
+			for key, item := range items {
+				record, ok := item.(map[string]any)
+				if !ok {
+					return fmt.Errorf("%s %s is not an object", tableChirps, key)
+				}
+
+				if _, ok := record["root_id"]; !ok {
+					record["root_id"] = record["id"]
+				}
+				if _, ok := record["reply_count"]; !ok {
+					record["reply_count"] = 0
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		version:     5,
+		description: "Add likes and rechirps",
+		migrate: func(doc map[string]any, env migrationEnv) error {
+			for _, table := range []string{tableLikes, tableRechirps} {
+				if _, ok := doc[table].(map[string]any); !ok {
+					doc[table] = map[string]any{}
+				}
+			}
+
+			items, _ := doc[tableChirps].(map[string]any)["items"].(map[string]any)
+			for key, item := range items {
+				record, ok := item.(map[string]any)
+				if !ok {
+					return fmt.Errorf("%s %s is not an object", tableChirps, key)
+				}
+
+				for _, field := range []string{"like_count", "rechirp_count"} {
+					if _, ok := record[field]; !ok {
+						record[field] = 0
+					}
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		version:     6,
+		description: "Add follows",
+		migrate: func(doc map[string]any, env migrationEnv) error {
+			if _, ok := doc[tableFollows].(map[string]any); !ok {
+				doc[tableFollows] = map[string]any{}
+			}
+
+			items, _ := doc[tableUsers].(map[string]any)["items"].(map[string]any)
+			for key, item := range items {
+				record, ok := item.(map[string]any)
+				if !ok {
+					return fmt.Errorf("%s %s is not an object", tableUsers, key)
+				}
+
+				for _, field := range []string{"follower_count", "following_count"} {
+					if _, ok := record[field]; !ok {
+						record[field] = 0
+					}
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		version:     7,
+		description: "Add hashtags and mentions to chirps",
+		migrate: func(doc map[string]any, env migrationEnv) error {
+			userIds := map[int]bool{}
+			users, _ := doc[tableUsers].(map[string]any)["items"].(map[string]any)
+			for key, item := range users {
+				record, ok := item.(map[string]any)
+				if !ok {
+					return fmt.Errorf("%s %s is not an object", tableUsers, key)
+				}
+
+				n, _ := record["id"].(json.Number)
+				id, err := n.Int64()
+				if err != nil {
+					return fmt.Errorf("%s %s has an invalid id: %w", tableUsers, key, err)
+				}
+				userIds[int(id)] = true
+			}
+
+			items, _ := doc[tableChirps].(map[string]any)["items"].(map[string]any)
+			for key, item := range items {
+				record, ok := item.(map[string]any)
+				if !ok {
+					return fmt.Errorf("%s %s is not an object", tableChirps, key)
+				}
+
+				body, _ := record["body"].(string)
+
+				if _, ok := record["hashtags"]; !ok {
+					record["hashtags"] = extractHashtags(body)
+				}
+
+				if _, ok := record["mentions"]; !ok {
+					record["mentions"] = extractMentions(body, func(id int) bool {
+						return userIds[id]
+					})
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		version:     8,
+		description: "Add refresh token families and the token audit log",
+		migrate: func(doc map[string]any, env migrationEnv) error {
+			if _, ok := doc[tableTokenEvents].(map[string]any); !ok {
+				doc[tableTokenEvents] = map[string]any{"id_count": 1, "items": map[string]any{}}
+			}
+
+			// When tokens were really created is not known, so they all get the time of the migration
+			now := time.Now().UTC().Format(time.RFC3339Nano)
+
+			tokens, _ := doc[tableRefreshTokens].(map[string]any)
+			for key, item := range tokens {
+				record, ok := item.(map[string]any)
+				if !ok {
+					return fmt.Errorf("%s %s is not an object", tableRefreshTokens, tokenRef(key))
+				}
+
+				// Every existing token starts a family of its own
+				if _, ok := record["family_id"]; !ok {
+					familyId, err := randomHex(16)
+					if err != nil {
+						return err
+					}
+					record["family_id"] = familyId
+				}
+				if _, ok := record["created_at"]; !ok {
+					record["created_at"] = now
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		version:     9,
+		description: "Record when refresh token sessions started and were last used",
+		migrate: func(doc map[string]any, env migrationEnv) error {
+			tokens, _ := doc[tableRefreshTokens].(map[string]any)
+			for key, item := range tokens {
+				record, ok := item.(map[string]any)
+				if !ok {
+					return fmt.Errorf("%s %s is not an object", tableRefreshTokens, tokenRef(key))
+				}
+
+				// Rotation history is not kept, so a token's own creation is the best guess for both
+				for _, field := range []string{"logged_in_at", "last_used_at"} {
+					if _, ok := record[field]; !ok {
+						record[field] = record["created_at"]
+					}
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		version:     tokenHashVersion,
+		description: "Store refresh tokens as keyed hashes instead of in plain text",
+		migrate: func(doc map[string]any, env migrationEnv) error {
+			// Anyone could compute hashes made without a key
+			if len(env.tokenKey) == 0 {
+				return ErrNoTokenKey
+			}
+
+			tokens, _ := doc[tableRefreshTokens].(map[string]any)
+			for _, key := range slices.Sorted(maps.Keys(tokens)) {
+				record, ok := tokens[key].(map[string]any)
+				if !ok {
+					return fmt.Errorf("%s %s is not an object", tableRefreshTokens, tokenRef(key))
+				}
+
+				// Already keyed by its hash
+				if _, ok := record["token_hash"]; ok {
+					continue
+				}
+
+				tokenHash := hashRefreshToken(env.tokenKey, key)
+				delete(record, "token")
+				record["token_hash"] = tokenHash
+
+				delete(tokens, key)
+				tokens[tokenHash] = record
+			}
+
+			return nil
+		},
+	},
+}
+
+// The schema version written by this build
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// Decodes a database file into a generic JSON document
+// Numbers are kept as json.Number so that IDs survive the round trip exactly
+func decodeDoc(data []byte) (map[string]any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	if doc == nil {
+		return nil, errors.New("database json is null")
+	}
+
+	return doc, nil
+}
+
+func docVersion(doc map[string]any) (int, error) {
+	v, ok := doc["schema_version"]
+	if !ok {
+		return 0, nil
+	}
+
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("schema_version is not a number: %v", v)
+	}
+
+	version, err := n.Int64()
+	return int(version), err
+}
+
+// Runs all migrations after version on doc
+// If step is not nil, it is called after each migration with the document before and after it
+func migrateDoc(doc map[string]any, version int, env migrationEnv, step func(m migration, before, after map[string]any)) error {
+	if version > latestSchemaVersion() {
+		return fmt.Errorf("%w (%d > %d)", errSchemaTooNew, version, latestSchemaVersion())
+	}
+
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		var before map[string]any
+		if step != nil {
+			before = cloneDoc(doc)
+		}
+
+		if err := m.migrate(doc, env); err != nil {
+			return fmt.Errorf("error migrating database to schema version %d: %w", m.version, err)
+		}
+
+		doc["schema_version"] = json.Number(fmt.Sprint(m.version))
+
+		if step != nil {
+			step(m, before, doc)
+		}
+	}
+
+	return nil
+}
+
+func cloneDoc(doc map[string]any) map[string]any {
+	data, _ := json.Marshal(doc)
+	clone, _ := decodeDoc(data)
+	return clone
+}
+
+// Decodes a database file, upgrading it to the latest schema version in memory
+// fromVersion is the version the file was at before it was upgraded
+// tokenKey is only needed to upgrade files from before tokenHashVersion
+func decodeDB(data []byte, tokenKey []byte) (dbStruct DBStructure, fromVersion int, err error) {
+	var header struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+
+	if err := json.Unmarshal(data, &header); err != nil {
+		return DBStructure{}, 0, fmt.Errorf("error unmarshalling database json: %w", err)
+	}
+
+	fromVersion = header.SchemaVersion
+
+	if fromVersion != latestSchemaVersion() {
+		doc, err := decodeDoc(data)
+		if err != nil {
+			return DBStructure{}, 0, fmt.Errorf("error unmarshalling database json: %w", err)
+		}
+
+		if err := migrateDoc(doc, fromVersion, migrationEnv{tokenKey: tokenKey}, nil); err != nil {
+			return DBStructure{}, 0, err
+		}
+
+		if data, err = json.Marshal(doc); err != nil {
+			return DBStructure{}, 0, fmt.Errorf("error marshalling migrated database json: %w", err)
+		}
+	}
+
+	if err := json.Unmarshal(data, &dbStruct); err != nil {
+		return DBStructure{}, 0, fmt.Errorf("error unmarshalling database json: %w", err)
+	}
+
+	dbStruct.init()
+
+	return dbStruct, fromVersion, nil
+}
+
+// Path of the backup taken before migrating a database file away from version
+func (db *DB) migrationBackupPath(version int) string {
+	return fmt.Sprintf("%s.v%d%s", db.path, version, backupSuffix)
+}
+
+// Paths of all backups taken before migrations, in no particular order
+func (db *DB) migrationBackupPaths() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Dir(db.path))
+	if err != nil {
+		return nil, fmt.Errorf("could not list migration backups: %w", err)
+	}
+
+	var paths []string
+	for _, e := range entries {
+		version, ok := strings.CutPrefix(e.Name(), filepath.Base(db.path)+".v")
+		if !ok {
+			continue
+		}
+		if version, ok = strings.CutSuffix(version, backupSuffix); !ok {
+			continue
+		}
+		if _, err := strconv.Atoi(version); err != nil || !e.Type().IsRegular() {
+			continue
+		}
+
+		paths = append(paths, filepath.Join(filepath.Dir(db.path), e.Name()))
+	}
+
+	return paths, nil
+}
+
+// Persists a database that was upgraded while loading it
+// The file as it was before the upgrade is kept next to it, so that the migration can be undone by hand
+func (db *DB) finishMigration(fromVersion int, dbStruct DBStructure) error {
+	// Journal records are in the format of the old version, so they can't be replayed on the upgraded snapshot
+	if info, err := os.Stat(db.journalPath()); err == nil && info.Size() > 0 {
+		return fmt.Errorf("cannot migrate database from schema version %d while its journal is not compacted", fromVersion)
+	}
+
+	original, err := os.ReadFile(db.path)
+	if err != nil {
+		return fmt.Errorf("could not back up database before migrating: %w", err)
+	}
+
+	// Keep the oldest backup if we are somehow migrating from the same version twice
+	if _, err := os.Stat(db.migrationBackupPath(fromVersion)); errors.Is(err, os.ErrNotExist) {
+		if err := WriteFileAtomic(db.migrationBackupPath(fromVersion), original); err != nil {
+			return fmt.Errorf("could not back up database before migrating: %w", err)
+		}
+	}
+
+	if err := db.writeDB(dbStruct); err != nil {
+		return err
+	}
+
+	log.Printf("migrated database from schema version %d to %d, the original was saved to %s",
+		fromVersion, dbStruct.SchemaVersion, db.migrationBackupPath(fromVersion))
+
+	if fromVersion < tokenHashVersion {
+		return db.scrubPlainRefreshTokens()
+	}
+
+	return nil
+}
+
+// Removes the refresh tokens that were stored in plain text from the files kept around by earlier writes
+// The migration backups lose their tokens, so restoring one of them by hand logs everyone out
+// The journal has no records from before the migration, since migrating requires it to be compacted
+func (db *DB) scrubPlainRefreshTokens() error {
+	// The backup of the last write is the file from before the migration, replace it with the migrated one
+	if err := db.backupCurrent(); err != nil {
+		return err
+	}
+
+	paths, err := db.migrationBackupPaths()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if err := scrubRefreshTokens(path, db.keys); err != nil {
+			return fmt.Errorf("could not remove refresh tokens from %s: %w", path, err)
+		}
+	}
+
+	log.Printf("refresh tokens are now stored hashed, snapshots taken before this still have them in plain text and should be deleted")
+
+	return nil
+}
+
+// Empties the refresh tokens table of the database file at path
+func scrubRefreshTokens(path string, keys *Keyring) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if data, err = decryptFile(data, keys); err != nil {
+		return err
+	}
+
+	doc, err := decodeDoc(data)
+	if err != nil {
+		return err
+	}
+
+	if tokens, _ := doc[tableRefreshTokens].(map[string]any); len(tokens) == 0 {
+		return nil
+	}
+	doc[tableRefreshTokens] = map[string]any{}
+
+	if data, err = json.Marshal(doc); err != nil {
+		return err
+	}
+
+	if data, err = encryptFile(data, keys); err != nil {
+		return err
+	}
+
+	return WriteFileAtomic(path, data)
+}
+
+// A migration that would be applied to a database file, and what it would change
+type MigrationStep struct {
+	Version     int
+	Description string
+
+	// Paths in the JSON document that would be added, removed or modified
+	Changes []string
+
+	// Total number of changes, Changes is cut off after maxReportedChanges
+	NumChanges int
+}
+
+// Report of what migrating a database file would do
+type MigrationPlan struct {
+	FromVersion int
+	ToVersion   int
+	Steps       []MigrationStep
+}
+
+const maxReportedChanges = 50
+
+// Reports which migrations would be applied to the database file at path and what they would change,
+// without modifying anything
+// keys may be nil if the file is not encrypted
+func PlanMigrations(path string, keys *Keyring) (MigrationPlan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return MigrationPlan{}, fmt.Errorf("could not read database file: %w", err)
+	}
+
+	if data, err = decryptFile(data, keys); err != nil {
+		return MigrationPlan{}, err
+	}
+
+	doc, err := decodeDoc(data)
+	if err != nil {
+		return MigrationPlan{}, fmt.Errorf("error unmarshalling database json: %w", err)
+	}
+
+	version, err := docVersion(doc)
+	if err != nil {
+		return MigrationPlan{}, err
+	}
+
+	plan := MigrationPlan{FromVersion: version, ToVersion: latestSchemaVersion()}
+
+	// Token hashes are not reported, so any key does
+	env := migrationEnv{tokenKey: []byte("dry run")}
+
+	err = migrateDoc(doc, version, env, func(m migration, before, after map[string]any) {
+		changes := diffDocs("", before, after)
+		slices.Sort(changes)
+
+		step := MigrationStep{
+			Version:     m.version,
+			Description: m.description,
+			NumChanges:  len(changes),
+			Changes:     changes[:min(len(changes), maxReportedChanges)],
+		}
+
+		plan.Steps = append(plan.Steps, step)
+	})
+	if err != nil {
+		return MigrationPlan{}, err
+	}
+
+	return plan, nil
+}
+
+// Lists the paths that differ between two JSON documents
+func diffDocs(path string, before, after any) []string {
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		// Refresh tokens may be keyed by the plain token
+		if path == tableRefreshTokens {
+			key = tokenRef(key)
+		}
+		return path + "." + key
+	}
+
+	b, bIsObj := before.(map[string]any)
+	a, aIsObj := after.(map[string]any)
+
+	if !bIsObj || !aIsObj {
+		bData, _ := json.Marshal(before)
+		aData, _ := json.Marshal(after)
+		if bytes.Equal(bData, aData) {
+			return nil
+		}
+
+		return []string{"modified " + path}
+	}
+
+	var changes []string
+	for k, bv := range b {
+		av, ok := a[k]
+		if !ok {
+			changes = append(changes, "removed "+join(k))
+			continue
+		}
+
+		changes = append(changes, diffDocs(join(k), bv, av)...)
+	}
+
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			changes = append(changes, "added "+join(k))
+		}
+	}
+
+	return changes
+}
+
+func (p MigrationPlan) String() string {
+	var sb strings.Builder
+
+	if len(p.Steps) == 0 {
+		fmt.Fprintf(&sb, "Database is at schema version %d, nothing to migrate\n", p.FromVersion)
+		return sb.String()
+	}
+
+	fmt.Fprintf(&sb, "Database would be migrated from schema version %d to %d\n", p.FromVersion, p.ToVersion)
+	for _, s := range p.Steps {
+		fmt.Fprintf(&sb, "\nVersion %d: %s (%d changes)\n", s.Version, s.Description, s.NumChanges)
+		for _, c := range s.Changes {
+			fmt.Fprintf(&sb, "  %s\n", c)
+		}
+		if s.NumChanges > len(s.Changes) {
+			fmt.Fprintf(&sb, "  ... and %d more\n", s.NumChanges-len(s.Changes))
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,205 @@
+package chirpydb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A database file from before schema versions and refresh tokens existed
+const legacyDB = `{"chirps":{"id_count":2,"items":{"1":{"id":1,"body":"hello #World @1","author_id":1}}},"users":{"id_count":2,"items":{"1":{"id":1,"email":"user@example.com","password":"hash","is_chirpy_red":false}}}}`
+
+func writeLegacyDB(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "database.json")
+	if err := os.WriteFile(path, []byte(legacyDB), 0o600); err != nil {
+		t.Fatalf("could not write legacy database: %v", err)
+	}
+
+	return path
+}
+
+func TestMigrateLegacyDB(t *testing.T) {
+	path := writeLegacyDB(t)
+
+	db, err := NewDB(path, false)
+	if err != nil {
+		t.Errorf("could not open legacy database: %v", err)
+		return
+	}
+
+	chirp, err := db.GetChirp(1)
+	if err != nil {
+		t.Errorf("expected chirp to survive the migration, got %v", err)
+		return
+	}
+	if chirp.CreatedAt.IsZero() || !chirp.UpdatedAt.Equal(chirp.CreatedAt) {
+		t.Errorf("expected the chirp to be given a creation time, got %v", chirp)
+		return
+	}
+	if !slices.Equal(chirp.Hashtags, []string{"world"}) || !slices.Equal(chirp.Mentions, []int{1}) {
+		t.Errorf("expected the chirp to be tagged, got %v", chirp)
+		return
+	}
+
+	// The new table works
+	token, err := db.AddRefreshToken(1, time.Now().Add(time.Hour), Client{})
+	if err != nil {
+		t.Errorf("could not add refresh token: %v", err)
+		return
+	}
+	if _, err := db.CheckRefreshToken(token.Token); err != nil {
+		t.Errorf("could not check refresh token: %v", err)
+		return
+	}
+
+	onDisk, version, err := loadDBFile(path, nil, nil)
+	if err != nil {
+		t.Errorf("could not read database file: %v", err)
+		return
+	}
+	if version != latestSchemaVersion() || onDisk.SchemaVersion != latestSchemaVersion() {
+		t.Errorf("expected file to be at schema version %d, got %d", latestSchemaVersion(), version)
+		return
+	}
+
+	backup, err := os.ReadFile(db.migrationBackupPath(0))
+	if err != nil {
+		t.Errorf("expected a backup from before the migration: %v", err)
+		return
+	}
+	if string(backup) != legacyDB {
+		t.Errorf("expected backup to hold the original file, got %s", backup)
+	}
+}
+
+func TestPlanMigrations(t *testing.T) {
+	path := writeLegacyDB(t)
+
+	plan, err := PlanMigrations(path, nil)
+	if err != nil {
+		t.Errorf("could not plan migrations: %v", err)
+		return
+	}
+
+	if plan.FromVersion != 0 || plan.ToVersion != latestSchemaVersion() || len(plan.Steps) != latestSchemaVersion() {
+		t.Errorf("unexpected plan %+v", plan)
+		return
+	}
+
+	for _, expected := range []string{"added refresh_tokens", "added schema_version"} {
+		if !slices.Contains(plan.Steps[0].Changes, expected) {
+			t.Errorf("expected %q in %v", expected, plan.Steps[0].Changes)
+			return
+		}
+	}
+
+	// A dry run doesn't touch anything
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != legacyDB {
+		t.Errorf("expected database file to be untouched, got %s, %v", data, err)
+		return
+	}
+
+	matches, _ := filepath.Glob(path + ".*")
+	if len(matches) != 0 {
+		t.Errorf("expected no other files to be created, got %v", matches)
+	}
+}
+
+func TestSchemaTooNew(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	future := `{"schema_version":1000,"chirps":{"id_count":1,"items":{}},"users":{"id_count":1,"items":{}},"refresh_tokens":{}}`
+	if err := os.WriteFile(path, []byte(future), 0o600); err != nil {
+		t.Errorf("could not write database: %v", err)
+		return
+	}
+
+	if _, err := NewDB(path, false); !errors.Is(err, errSchemaTooNew) {
+		t.Errorf("expected errSchemaTooNew, got %v", err)
+		return
+	}
+
+	data, _ := os.ReadFile(path)
+	if string(data) != future {
+		t.Errorf("expected database file to be untouched, got %s", data)
+	}
+}
+
+func TestMigrateRefusesUncompactedJournal(t *testing.T) {
+	path := writeLegacyDB(t)
+	if err := os.WriteFile(path+journalSuffix, []byte(`{"seq":1,"ops":[]}`+"\n"), 0o600); err != nil {
+		t.Errorf("could not write journal: %v", err)
+		return
+	}
+
+	if _, err := NewDB(path, false); err == nil {
+		t.Errorf("expected migrating with a non-empty journal to fail")
+	}
+}
+
+func TestHashPlainRefreshTokens(t *testing.T) {
+	// Refresh tokens were stored in plain text, keyed by themselves
+	path := filepath.Join(t.TempDir(), "database.json")
+	plainDB := `{"schema_version":1,"chirps":{"id_count":1,"items":{}},"users":{"id_count":2,"items":{"1":{"id":1,"email":"user@example.com","password":"hash"}}},` +
+		`"refresh_tokens":{"plain-token":{"token":"plain-token","user_id":1,"expires_at":"2999-01-01T00:00:00Z"}}}`
+	if err := os.WriteFile(path, []byte(plainDB), 0o600); err != nil {
+		t.Errorf("could not write database file: %v", err)
+		return
+	}
+
+	// Hashing is a migration like any other, and the plan doesn't give the token away
+	plan, err := PlanMigrations(path, nil)
+	if err != nil {
+		t.Errorf("could not plan migrations: %v", err)
+		return
+	}
+	if last := plan.Steps[len(plan.Steps)-1]; last.Version != tokenHashVersion || last.NumChanges == 0 || strings.Contains(plan.String(), "plain-token") {
+		t.Errorf("expected the plan to hash the token without showing it, got %s", plan)
+		return
+	}
+
+	if _, err := readDBFile(path, nil, nil); !errors.Is(err, ErrNoTokenKey) {
+		t.Errorf("expected ErrNoTokenKey without a key, got %v", err)
+		return
+	}
+
+	db, err := NewDBWithOptions(path, Options{TokenKey: []byte("key")})
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+
+	// Neither the file nor the backups left next to it have the plain token anymore
+	for _, p := range []string{path, db.backupPath(), db.migrationBackupPath(1)} {
+		raw, err := os.ReadFile(p)
+		if err != nil {
+			t.Errorf("could not read %s: %v", p, err)
+			return
+		}
+		if strings.Contains(string(raw), "plain-token") {
+			t.Errorf("expected the plain token to be gone from %s, got %s", p, raw)
+			return
+		}
+	}
+
+	if userId, err := db.CheckRefreshToken("plain-token"); err != nil || userId != 1 {
+		t.Errorf("expected the existing token to keep working, got user %d (%v)", userId, err)
+		return
+	}
+
+	// A different key doesn't match the stored hash
+	other, err := NewDBWithOptions(path, Options{TokenKey: []byte("other key")})
+	if err != nil {
+		t.Errorf("could not reopen database: %v", err)
+		return
+	}
+	if _, err := other.CheckRefreshToken("plain-token"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist with a different key, got %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package chirpydb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// The previous generation of the database is kept next to it with this suffix
+const backupSuffix = ".bak"
+
+// Temporary files are created next to the database with this suffix followed by a random string
+const tempSuffix = ".tmp-"
+
+func (db *DB) backupPath() string {
+	return db.path + backupSuffix
+}
+
+// Atomically replaces the file at path with data
+// The data is written to a temporary file in the same directory, synced to disk and then renamed over path,
+// so a crash at any point leaves either the old file or the new one, but never a partially written one
+func WriteFileAtomic(path string, data []byte) (err error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+tempSuffix+"*")
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+
+	// Make sure the data actually hit the disk before the rename makes it visible
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	syncDir(filepath.Dir(path))
+
+	return nil
+}
+
+// Syncs a directory so that renames inside it are durable
+// This is not supported on every platform, so errors are ignored
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+
+	d.Sync()
+}
+
+// Copies the current database file to the backup path
+// The file is hard linked when possible so that we don't have to read it again
+func (db *DB) backupCurrent() error {
+	if _, err := os.Stat(db.path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	tmpPath := db.backupPath() + tempSuffix + "link"
+	os.Remove(tmpPath)
+
+	if err := os.Link(db.path, tmpPath); err == nil {
+		if err := os.Rename(tmpPath, db.backupPath()); err != nil {
+			os.Remove(tmpPath)
+			return fmt.Errorf("could not back up database file: %w", err)
+		}
+
+		return nil
+	}
+
+	// Hard links are not supported here, fall back to copying
+	src, err := os.Open(db.path)
+	if err != nil {
+		return fmt.Errorf("could not back up database file: %w", err)
+	}
+	defer src.Close()
+
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return fmt.Errorf("could not back up database file: %w", err)
+	}
+
+	if err := WriteFileAtomic(db.backupPath(), data); err != nil {
+		return fmt.Errorf("could not back up database file: %w", err)
+	}
+
+	return nil
+}
+
+// Removes temporary files left behind by writes that were interrupted
+func (db *DB) removeStaleTemps() {
+	for _, p := range []string{db.path, db.backupPath(), db.changesPath()} {
+		matches, err := filepath.Glob(p + tempSuffix + "*")
+		if err != nil {
+			continue
+		}
+
+		for _, m := range matches {
+			if err := os.Remove(m); err == nil {
+				log.Printf("removed stale temporary database file %s", m)
+			}
+		}
+	}
+}
+
+// Reads and parses a database file, upgrading it to the latest schema version in memory
+// keys may be nil if the file is not encrypted, and tokenKey is only needed to upgrade old files, see decodeDB
+func readDBFile(path string, keys *Keyring, tokenKey []byte) (DBStructure, error) {
+	dbStruct, _, err := loadDBFile(path, keys, tokenKey)
+	return dbStruct, err
+}
+
+// Same as readDBFile, but also returns the schema version the file was at
+func loadDBFile(path string, keys *Keyring, tokenKey []byte) (DBStructure, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return DBStructure{}, 0, err
+	}
+
+	return decodeDBFile(data, keys, tokenKey)
+}
+
+// Decrypts and decodes the contents of a database file
+func decodeDBFile(data []byte, keys *Keyring, tokenKey []byte) (DBStructure, int, error) {
+	data, err := decryptFile(data, keys)
+	if err != nil {
+		return DBStructure{}, 0, err
+	}
+
+	return decodeDB(data, tokenKey)
+}
+
+// Loads the database file, making sure it exists and can be parsed
+// If the database file is missing or damaged, the backup is restored in its place
+// A new empty database is only created if neither file exists
+// Also returns the schema version of the loaded file, before it was upgraded in memory
+func (db *DB) recoverDB() (DBStructure, int, error) {
+	dbStruct, version, err := loadDBFile(db.path, db.keys, db.tokenKey)
+	if err == nil {
+		return dbStruct, version, nil
+	}
+
+	// The file is fine, we just can't read it
+	if errors.Is(err, errSchemaTooNew) || errors.Is(err, ErrEncrypted) || errors.Is(err, ErrUnknownKey) {
+		return DBStructure{}, 0, err
+	}
+
+	primaryMissing := errors.Is(err, os.ErrNotExist)
+	if !primaryMissing {
+		log.Printf("database file %s is damaged: %v", db.path, err)
+	}
+
+	backup, bakErr := os.ReadFile(db.backupPath())
+	if errors.Is(bakErr, os.ErrNotExist) {
+		if primaryMissing {
+			dbStruct = newDBStructure()
+			return dbStruct, dbStruct.SchemaVersion, db.writeDB(dbStruct)
+		}
+
+		return DBStructure{}, 0, fmt.Errorf("database file is damaged and there is no backup: %w", err)
+	} else if bakErr != nil {
+		return DBStructure{}, 0, fmt.Errorf("could not read database backup: %w", bakErr)
+	}
+
+	dbStruct, version, bakErr = decodeDBFile(backup, db.keys, db.tokenKey)
+	if bakErr != nil {
+		return DBStructure{}, 0, fmt.Errorf("database file and its backup are both damaged: %w", errors.Join(err, bakErr))
+	}
+
+	// Restore without going through writeDB, as that would back up the damaged file over the good one
+	if err := WriteFileAtomic(db.path, backup); err != nil {
+		return DBStructure{}, 0, fmt.Errorf("could not restore database backup: %w", err)
+	}
+
+	log.Printf("restored database from backup %s", db.backupPath())
+
+	return dbStruct, version, nil
+}
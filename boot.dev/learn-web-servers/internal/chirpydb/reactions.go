@@ -0,0 +1,209 @@
+package chirpydb
+
+import (
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Kinds of reactions users can have to a chirp
+// Each user can have at most one reaction of each kind to a chirp
+type ReactionKind string
+
+const (
+	ReactionLike    ReactionKind = "like"
+	ReactionRechirp ReactionKind = "rechirp"
+)
+
+var reactionKinds = []ReactionKind{ReactionLike, ReactionRechirp}
+
+// A user liking or rechirping a chirp
+type Reaction struct {
+	ChirpId   int       `json:"chirp_id"`
+	UserId    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Table the reactions of a kind are stored in
+func reactionTable(kind ReactionKind) (string, error) {
+	switch kind {
+	case ReactionLike:
+		return tableLikes, nil
+	case ReactionRechirp:
+		return tableRechirps, nil
+	default:
+		return "", fmt.Errorf("unknown reaction kind %q", kind)
+	}
+}
+
+// Reactions are stored under the chirp and user they connect
+func reactionKey(chirpId, userId int) string {
+	return fmt.Sprintf("%d:%d", chirpId, userId)
+}
+
+// Points at the counter of a kind of reaction on a chirp
+func (c *Chirp) reactionCount(kind ReactionKind) *int {
+	if kind == ReactionRechirp {
+		return &c.RechirpCount
+	}
+	return &c.LikeCount
+}
+
+// Adds a reaction to a chirp and counts it
+// Reacting again changes nothing
+func (db *DB) AddReaction(kind ReactionKind, chirpId, userId int) (Chirp, error) {
+	table, err := reactionTable(kind)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	var chirp Chirp
+
+	err = db.Update(func(dbStruct *DBStructure) error {
+		var ok bool
+		if chirp, ok = dbStruct.Chirps.Items[chirpId]; !ok {
+			return ErrNotExist
+		}
+
+		items := dbStruct.reactions(table)
+		if _, ok := items[reactionKey(chirpId, userId)]; ok {
+			return nil
+		}
+
+		dbStruct.PutReaction(table, Reaction{chirpId, userId, time.Now().UTC()})
+
+		*chirp.reactionCount(kind)++
+		dbStruct.PutChirp(chirp)
+
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+// Takes back a reaction to a chirp
+// Removing a reaction that is not there changes nothing
+func (db *DB) RemoveReaction(kind ReactionKind, chirpId, userId int) (Chirp, error) {
+	table, err := reactionTable(kind)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	var chirp Chirp
+
+	err = db.Update(func(dbStruct *DBStructure) error {
+		var ok bool
+		if chirp, ok = dbStruct.Chirps.Items[chirpId]; !ok {
+			return ErrNotExist
+		}
+
+		if !dbStruct.DeleteReaction(table, chirpId, userId) {
+			return nil
+		}
+
+		*chirp.reactionCount(kind)--
+		dbStruct.PutChirp(chirp)
+
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+// Returns a page of the reactions to a chirp, sorted by user ID
+func (db *DB) GetReactions(kind ReactionKind, chirpId int, opts ListOptions) ([]Reaction, error) {
+	table, err := reactionTable(kind)
+	if err != nil {
+		return []Reaction{}, err
+	}
+
+	reactions := []Reaction{}
+
+	err = db.View(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Chirps.Items[chirpId]; !ok {
+			return ErrNotExist
+		}
+
+		items := dbStruct.reactions(table)
+		for _, userId := range pageIds(dbStruct.idx.reactionsByChirp[table][chirpId], opts) {
+			reactions = append(reactions, items[reactionKey(chirpId, userId)])
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []Reaction{}, err
+	}
+
+	return reactions, nil
+}
+
+// Returns a page of the reactions of a user, sorted by chirp ID
+func (db *DB) GetUserReactions(kind ReactionKind, userId int, opts ListOptions) ([]Reaction, error) {
+	table, err := reactionTable(kind)
+	if err != nil {
+		return []Reaction{}, err
+	}
+
+	reactions := []Reaction{}
+
+	err = db.View(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Users.Items[userId]; !ok {
+			return ErrNotExist
+		}
+
+		items := dbStruct.reactions(table)
+		for _, chirpId := range pageIds(dbStruct.idx.reactionsByUser[table][userId], opts) {
+			reactions = append(reactions, items[reactionKey(chirpId, userId)])
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []Reaction{}, err
+	}
+
+	return reactions, nil
+}
+
+// Reports which of the chirps a user has reacted to
+func (db *DB) ReactedTo(kind ReactionKind, userId int, chirpIds []int) (map[int]bool, error) {
+	table, err := reactionTable(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	reacted := map[int]bool{}
+
+	err = db.View(func(dbStruct *DBStructure) error {
+		items := dbStruct.reactions(table)
+		for _, chirpId := range chirpIds {
+			if _, ok := items[reactionKey(chirpId, userId)]; ok {
+				reacted[chirpId] = true
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reacted, nil
+}
+
+// Removes every reaction to a chirp
+func (s *DBStructure) deleteChirpReactions(chirpId int) {
+	for _, table := range []string{tableLikes, tableRechirps} {
+		// Deleting updates the index, so walk over a copy of it
+		for _, userId := range slices.Clone(s.idx.reactionsByChirp[table][chirpId]) {
+			s.DeleteReaction(table, chirpId, userId)
+		}
+	}
+}
@@ -1,84 +1,465 @@
 package chirpydb
 
 import (
+	"bytes"
+	"cmp"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
 	"time"
 )
 
-var ErrExpired = errors.New("token expired")
+// Refresh tokens are single use: refreshing exchanges a token for a new one in the same family
+// A token that was already exchanged and shows up again has most likely been stolen,
+// so its whole family is revoked, logging out both the thief and the user
+//
+// Only a keyed hash of each token is stored, so reading the database does not give away working tokens
+//
+// A family is what users see as a session: it starts when they log in and ends when it is revoked or its latest token expires
+
+var (
+	ErrExpired = errors.New("token expired")
+
+	// A refresh token was presented after it had already been exchanged for a new one
+	ErrTokenReused = errors.New("refresh token was already used")
+
+	// Plain refresh tokens were to be hashed without a key, which anyone could then compute token hashes with
+	ErrNoTokenKey = errors.New("no refresh token key was provided")
+)
 
 type RefreshToken struct {
-	Token     string    `json:"token"`
+	// Only known when the token is issued, the database only keeps its hash
+	Token string `json:"-"`
+
+	// See hashRefreshToken
+	TokenHash string    `json:"token_hash"`
 	UserId    int       `json:"user_id"`
 	ExpiresAt time.Time `json:"expires_at"`
+
+	// Shared by a token and every token it was exchanged for
+	FamilyId  string    `json:"family_id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// When the token was exchanged for a new one, nil if it is still the latest of its family
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+
+	// When the family was started by logging in
+	LoggedInAt time.Time `json:"logged_in_at"`
+	// When the family was last refreshed, which is when this token was issued
+	LastUsedAt time.Time `json:"last_used_at"`
+
+	// The client this token was issued to
+	UserAgent string `json:"user_agent,omitempty"`
+	ClientIP  string `json:"client_ip,omitempty"`
 }
 
-func (db *DB) AddRefreshToken(userId int, expiresAt time.Time) (RefreshToken, error) {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return RefreshToken{}, err
+// Who a refresh token is issued to, as far as the server can tell
+type Client struct {
+	UserAgent string
+	IP        string
+}
+
+// A login on one device, made of the latest token of a family
+type Session struct {
+	// The family ID of the session's tokens
+	Id         string    `json:"id"`
+	UserId     int       `json:"user_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	ClientIP   string    `json:"client_ip"`
+}
+
+func sessionOf(token RefreshToken) Session {
+	return Session{
+		Id:         token.FamilyId,
+		UserId:     token.UserId,
+		CreatedAt:  token.LoggedInAt,
+		LastUsedAt: token.LastUsedAt,
+		ExpiresAt:  token.ExpiresAt,
+		UserAgent:  token.UserAgent,
+		ClientIP:   token.ClientIP,
 	}
+}
+
+// Sorts sessions by last use, most recent first
+func sortSessions(sessions []Session) {
+	slices.SortFunc(sessions, func(a, b Session) int {
+		return cmp.Or(b.LastUsedAt.Compare(a.LastUsedAt), cmp.Compare(a.Id, b.Id))
+	})
+}
+
+type TokenEventKind string
 
-	randBytes := make([]byte, 32)
+const (
+	// A new family was started by logging in
+	TokenIssued TokenEventKind = "issued"
+	// A token was exchanged for a new one
+	TokenRotated TokenEventKind = "rotated"
+	// An exchanged token was presented again, and its family was revoked
+	TokenReused TokenEventKind = "reused"
+	// The family was revoked by the user
+	TokenRevoked TokenEventKind = "revoked"
+)
+
+// An entry in the audit log of refresh tokens
+// Token values are secrets, so events only refer to their family
+type TokenEvent struct {
+	Id        int            `json:"id"`
+	Kind      TokenEventKind `json:"kind"`
+	FamilyId  string         `json:"family_id"`
+	UserId    int            `json:"user_id"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+func randomHex(n int) (string, error) {
+	randBytes := make([]byte, n)
 	if _, err := rand.Read(randBytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(randBytes), nil
+}
+
+// Suffix of the file next to the database that keeps the generated refresh token key
+const tokenKeySuffix = ".tokenkey"
+
+// Returns the refresh token key kept next to the database at path, generating it the first time
+// Used when Options.TokenKey is not set, so tokens are still hashed with a secret and survive restarts
+func loadTokenKey(path string) ([]byte, error) {
+	keyPath := path + tokenKeySuffix
+
+	key, err := os.ReadFile(keyPath)
+	if err == nil {
+		key = bytes.TrimSpace(key)
+		if len(key) == 0 {
+			return nil, fmt.Errorf("refresh token key file %s is empty", keyPath)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read refresh token key: %w", err)
+	}
+
+	generated, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	// Linked into place instead of renamed, so two processes opening the database at once can't replace each other's key
+	tmp, err := os.CreateTemp(filepath.Dir(keyPath), filepath.Base(keyPath)+tempSuffix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("could not create refresh token key: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(generated)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not write refresh token key: %w", err)
+	}
+
+	if err := os.Link(tmp.Name(), keyPath); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			// Someone else got there first
+			return loadTokenKey(path)
+		}
+		return nil, fmt.Errorf("could not save refresh token key: %w", err)
+	}
+	syncDir(filepath.Dir(keyPath))
+
+	log.Printf("no refresh token key was configured, generated one in %s", keyPath)
+
+	return []byte(generated), nil
+}
+
+// HMAC-SHA256 of a token, which is what tokens are stored and looked up by
+func hashRefreshToken(key []byte, token string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Generates a new token for client, starting a new family if familyId is empty
+func newRefreshToken(key []byte, userId int, familyId string, expiresAt time.Time, client Client) (RefreshToken, error) {
+	tokenString, err := randomHex(32)
+	if err != nil {
 		return RefreshToken{}, err
 	}
 
-	tokenString := hex.EncodeToString(randBytes)
-	refreshToken := RefreshToken{tokenString, userId, expiresAt}
+	if familyId == "" {
+		if familyId, err = randomHex(16); err != nil {
+			return RefreshToken{}, err
+		}
+	}
+
+	now := time.Now().UTC()
+	return RefreshToken{
+		Token:      tokenString,
+		TokenHash:  hashRefreshToken(key, tokenString),
+		UserId:     userId,
+		ExpiresAt:  expiresAt,
+		FamilyId:   familyId,
+		CreatedAt:  now,
+		LoggedInAt: now,
+		LastUsedAt: now,
+		UserAgent:  client.UserAgent,
+		ClientIP:   client.IP,
+	}, nil
+}
+
+func (s *DBStructure) addTokenEvent(kind TokenEventKind, token RefreshToken, now time.Time) {
+	s.PutTokenEvent(TokenEvent{
+		Id:        s.NewTokenEventId(),
+		Kind:      kind,
+		FamilyId:  token.FamilyId,
+		UserId:    token.UserId,
+		CreatedAt: now,
+	})
+}
+
+// Deletes every token of a family
+func (s *DBStructure) revokeTokenFamily(familyId string) {
+	// Deleting updates the index, so go through a copy of it
+	for _, tokenHash := range slices.Clone(s.idx.tokensByFamily[familyId]) {
+		s.DeleteRefreshToken(tokenHash)
+	}
+}
 
-	dbStruct.RefreshTokens[tokenString] = refreshToken
+// Deletes the tokens of a family that were exchanged and have expired since
+// They are only kept to notice them being reused, and past their expiry they are rejected as expired anyway
+func (s *DBStructure) pruneTokenFamily(familyId string, now time.Time) {
+	for _, tokenHash := range slices.Clone(s.idx.tokensByFamily[familyId]) {
+		if t := s.RefreshTokens[tokenHash]; t.RotatedAt != nil && now.After(t.ExpiresAt) {
+			s.DeleteRefreshToken(tokenHash)
+		}
+	}
+}
 
-	if err := db.writeDB(dbStruct); err != nil {
+// Starts a new token family
+func (db *DB) AddRefreshToken(userId int, expiresAt time.Time, client Client) (RefreshToken, error) {
+	refreshToken, err := newRefreshToken(db.tokenKey, userId, "", expiresAt, client)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	err = db.Update(func(dbStruct *DBStructure) error {
+		dbStruct.PutRefreshToken(refreshToken)
+		dbStruct.addTokenEvent(TokenIssued, refreshToken, refreshToken.CreatedAt)
+		return nil
+	})
+	if err != nil {
 		return RefreshToken{}, err
 	}
 
 	return refreshToken, nil
 }
 
+// Revokes the family of a token
 func (db *DB) RevokeRefreshToken(tokenString string) error {
-	dbStruct, err := db.loadDB()
+	tokenHash := hashRefreshToken(db.tokenKey, tokenString)
+
+	return db.Update(func(dbStruct *DBStructure) error {
+		refreshToken, ok := dbStruct.RefreshTokens[tokenHash]
+		if !ok {
+			return ErrNotExist
+		}
+
+		dbStruct.revokeTokenFamily(refreshToken.FamilyId)
+		dbStruct.addTokenEvent(TokenRevoked, refreshToken, time.Now().UTC())
+		return nil
+	})
+}
+
+func (db *DB) CheckRefreshToken(tokenString string) (userId int, err error) {
+	tokenHash := hashRefreshToken(db.tokenKey, tokenString)
+	var refreshToken RefreshToken
+
+	err = db.View(func(dbStruct *DBStructure) error {
+		var ok bool
+		if refreshToken, ok = dbStruct.RefreshTokens[tokenHash]; !ok {
+			return ErrNotExist
+		}
+
+		return nil
+	})
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	_, ok := dbStruct.RefreshTokens[tokenString]
-	if !ok {
-		return ErrNotExist
+	if time.Now().UTC().After(refreshToken.ExpiresAt.UTC()) {
+		// The token may have been revoked in the meantime, which is fine since we're deleting it anyway
+		err := db.Update(func(dbStruct *DBStructure) error {
+			dbStruct.DeleteRefreshToken(tokenHash)
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("error deleting expired token: %w", err)
+		}
+
+		return 0, ErrExpired
+	}
+
+	if refreshToken.RotatedAt != nil {
+		return 0, ErrTokenReused
+	}
+
+	return refreshToken.UserId, nil
+}
+
+// Exchanges a token for a new one in the same family that expires at expiresAt
+// Presenting a token that was already exchanged revokes its family and fails with ErrTokenReused
+func (db *DB) RotateRefreshToken(tokenString string, expiresAt time.Time, client Client) (RefreshToken, error) {
+	tokenHash := hashRefreshToken(db.tokenKey, tokenString)
+	next, err := newRefreshToken(db.tokenKey, 0, "", expiresAt, client)
+	if err != nil {
+		return RefreshToken{}, err
 	}
 
-	delete(dbStruct.RefreshTokens, tokenString)
+	// Expired and reused tokens still commit their cleanup, so they are not returned as errors from the transaction
+	var rejected error
+
+	err = db.Update(func(dbStruct *DBStructure) error {
+		refreshToken, ok := dbStruct.RefreshTokens[tokenHash]
+		if !ok {
+			return ErrNotExist
+		}
+
+		now := time.Now().UTC()
+		if now.After(refreshToken.ExpiresAt) {
+			dbStruct.DeleteRefreshToken(tokenHash)
+			rejected = ErrExpired
+			return nil
+		}
+
+		if refreshToken.RotatedAt != nil {
+			dbStruct.revokeTokenFamily(refreshToken.FamilyId)
+			dbStruct.addTokenEvent(TokenReused, refreshToken, now)
+			rejected = ErrTokenReused
+			return nil
+		}
+
+		dbStruct.pruneTokenFamily(refreshToken.FamilyId, now)
+
+		refreshToken.RotatedAt = &now
+		dbStruct.PutRefreshToken(refreshToken)
+
+		next.UserId, next.FamilyId, next.CreatedAt = refreshToken.UserId, refreshToken.FamilyId, now
+		next.LoggedInAt, next.LastUsedAt = refreshToken.LoggedInAt, now
+		dbStruct.PutRefreshToken(next)
+		dbStruct.addTokenEvent(TokenRotated, next, now)
 
-	if err := db.writeDB(dbStruct); err != nil {
-		return err
+		return nil
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if rejected != nil {
+		return RefreshToken{}, rejected
 	}
 
-	return nil
+	return next, nil
 }
 
-func (db *DB) CheckRefreshToken(tokenString string) (userId int, err error) {
-	dbStruct, err := db.loadDB()
+// Returns a page of the token events of a user, sorted by ID
+// Events are kept after the user is gone, so a missing user is not an error
+func (db *DB) GetTokenEvents(userId int, opts ListOptions) ([]TokenEvent, error) {
+	events := []TokenEvent{}
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		for _, id := range pageIds(dbStruct.idx.tokenEventsByUser[userId], opts) {
+			events = append(events, dbStruct.TokenEvents.Items[id])
+		}
+
+		return nil
+	})
 	if err != nil {
-		return 0, err
+		return []TokenEvent{}, err
 	}
 
-	refreshToken, ok := dbStruct.RefreshTokens[tokenString]
-	if !ok {
-		return 0, ErrNotExist
+	return events, nil
+}
+
+// Returns the sessions of a user that have not expired, most recently used first
+func (db *DB) GetSessions(userId int) ([]Session, error) {
+	sessions := []Session{}
+	now := time.Now().UTC()
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		for _, tokenHash := range dbStruct.idx.sessionsByUser[userId] {
+			if token := dbStruct.RefreshTokens[tokenHash]; now.Before(token.ExpiresAt) {
+				sessions = append(sessions, sessionOf(token))
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []Session{}, err
 	}
 
-	if time.Now().UTC().After(refreshToken.ExpiresAt.UTC()) {
-		delete(dbStruct.RefreshTokens, tokenString)
+	sortSessions(sessions)
+	return sessions, nil
+}
 
-		if err := db.writeDB(dbStruct); err != nil {
-			return 0, fmt.Errorf("error deleting expired token: %w", err)
+// Revokes one of the sessions of a user
+// Sessions of other users are reported as not existing
+func (db *DB) RevokeSession(userId int, sessionId string) error {
+	return db.Update(func(dbStruct *DBStructure) error {
+		tokenHash, ok := dbStruct.idx.sessionsByUser[userId][sessionId]
+		if !ok {
+			return ErrNotExist
 		}
 
-		return 0, ErrExpired
+		refreshToken := dbStruct.RefreshTokens[tokenHash]
+		dbStruct.revokeTokenFamily(refreshToken.FamilyId)
+		dbStruct.addTokenEvent(TokenRevoked, refreshToken, time.Now().UTC())
+		return nil
+	})
+}
+
+// Revokes every session of a user, returning how many had not expired yet
+func (db *DB) RevokeAllSessions(userId int) (int, error) {
+	revoked := 0
+
+	err := db.Update(func(dbStruct *DBStructure) error {
+		revoked = dbStruct.revokeAllSessions(userId, time.Now().UTC())
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	return refreshToken.UserId, nil
+	return revoked, nil
+}
+
+// Deletes the token families of every session of a user, returning how many sessions had not expired yet
+// Expired sessions are deleted too, but not counted or logged since GetSessions doesn't show them either
+func (s *DBStructure) revokeAllSessions(userId int, now time.Time) int {
+	revoked := 0
+	for _, familyId := range slices.Sorted(maps.Keys(s.idx.sessionsByUser[userId])) {
+		refreshToken := s.RefreshTokens[s.idx.sessionsByUser[userId][familyId]]
+		s.revokeTokenFamily(familyId)
+
+		if now.Before(refreshToken.ExpiresAt) {
+			s.addTokenEvent(TokenRevoked, refreshToken, now)
+			revoked++
+		}
+	}
+
+	return revoked
 }
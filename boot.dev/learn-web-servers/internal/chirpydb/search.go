@@ -0,0 +1,644 @@
+package chirpydb
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Chirps can be searched by content with a small query language:
+//
+//	hello world        chirps with both words
+//	"hello world"      chirps with the words next to each other, in that order
+//	hell*              words starting with "hell"
+//	cats OR dogs       chirps with either word
+//	cats -dogs         chirps with "cats" but not "dogs", NOT dogs works too
+//	(cats OR dogs) pet grouping
+//
+// Both backends keep an inverted index from words to the chirps and positions they appear at,
+// and evaluate queries against it with the same code, so they rank results the same way
+
+var ErrBadQuery = errors.New("invalid search query")
+
+// Limits that keep a single query from doing too much work
+const (
+	maxQueryTerms  = 20
+	maxPrefixTerms = 50
+)
+
+// Matched words that are part of a phrase count for more than words on their own
+const phraseBoost = 2
+
+// A search hit, with the parts of the body that matched the query
+type SearchResult struct {
+	Chirp
+
+	Score float64 `json:"score"`
+
+	// Byte offsets of the matched words in Body
+	Matches []Span `json:"matches"`
+
+	// Body with HTML special characters escaped and matched words wrapped in <mark> tags
+	Highlighted string `json:"highlighted"`
+}
+
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// A word in a piece of text, normalized for indexing
+type token struct {
+	term string
+	span Span
+}
+
+// Splits text into lowercased words made of letters and digits
+func tokenize(text string) []token {
+	var tokens []token
+
+	start := -1
+	for i, r := range text {
+		isWordRune := unicode.IsLetter(r) || unicode.IsDigit(r)
+
+		if isWordRune && start < 0 {
+			start = i
+		} else if !isWordRune && start >= 0 {
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), Span{start, i}})
+			start = -1
+		}
+	}
+
+	if start >= 0 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), Span{start, len(text)}})
+	}
+
+	return tokens
+}
+
+// Positions of each term in text, for the inverted index
+func termPositions(text string) map[string][]int {
+	positions := map[string][]int{}
+	for i, t := range tokenize(text) {
+		positions[t.term] = append(positions[t.term], i)
+	}
+
+	return positions
+}
+
+// The parsed form of a query
+type queryNode interface{}
+
+type termQuery struct {
+	term   string
+	prefix bool
+}
+
+// Terms that must appear right after each other
+type phraseQuery struct {
+	terms []termQuery
+}
+
+// Chirps that match everything in must and nothing in not
+type andQuery struct {
+	must []queryNode
+	not  []queryNode
+}
+
+type orQuery struct {
+	any []queryNode
+}
+
+// Only valid inside an AND, the parser turns it into a not clause there
+type notQuery struct {
+	node queryNode
+}
+
+type queryParser struct {
+	input string
+	pos   int
+	terms int
+}
+
+func parseQuery(input string) (queryNode, error) {
+	p := &queryParser{input: input}
+
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("%w: unexpected %q", ErrBadQuery, p.input[p.pos:p.pos+1])
+	}
+
+	if p.terms == 0 {
+		return nil, fmt.Errorf("%w: no search terms", ErrBadQuery)
+	}
+
+	return node, nil
+}
+
+func (p *queryParser) skipSpace() {
+	for p.pos < len(p.input) {
+		r, size := utf8.DecodeRuneInString(p.input[p.pos:])
+		if !unicode.IsSpace(r) {
+			return
+		}
+		p.pos += size
+	}
+}
+
+// Returns the keyword at the current position without consuming it, if there is one
+func (p *queryParser) peekKeyword() string {
+	p.skipSpace()
+
+	for _, kw := range []string{"AND", "OR", "NOT"} {
+		rest := p.input[p.pos:]
+		if !strings.HasPrefix(rest, kw) {
+			continue
+		}
+
+		// Keywords have to stand on their own, ORANGE is a word
+		if next, _ := utf8.DecodeRuneInString(rest[len(kw):]); len(rest) == len(kw) || unicode.IsSpace(next) || next == '(' || next == '"' {
+			return kw
+		}
+	}
+
+	return ""
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	var nodes []queryNode
+
+	for {
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+
+		if p.peekKeyword() != "OR" {
+			break
+		}
+		p.pos += len("OR")
+	}
+
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+
+	for _, n := range nodes {
+		if _, ok := n.(notQuery); ok {
+			return nil, fmt.Errorf("%w: NOT needs something to exclude from", ErrBadQuery)
+		}
+	}
+
+	return orQuery{nodes}, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	and := andQuery{}
+
+	for {
+		switch p.peekKeyword() {
+		case "OR":
+			return p.finishAnd(and)
+		case "AND":
+			p.pos += len("AND")
+		}
+
+		p.skipSpace()
+		if p.pos >= len(p.input) || p.input[p.pos] == ')' {
+			return p.finishAnd(and)
+		}
+
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		if not, ok := node.(notQuery); ok {
+			and.not = append(and.not, not.node)
+		} else if node != nil {
+			and.must = append(and.must, node)
+		}
+	}
+}
+
+func (p *queryParser) finishAnd(and andQuery) (queryNode, error) {
+	if len(and.must) == 0 && len(and.not) == 0 {
+		return nil, fmt.Errorf("%w: expected a search term", ErrBadQuery)
+	}
+
+	if len(and.must) == 0 {
+		// Left for the caller to reject or fold into an outer AND
+		if len(and.not) == 1 {
+			return notQuery{and.not[0]}, nil
+		}
+		return notQuery{orQuery{and.not}}, nil
+	}
+
+	if len(and.must) == 1 && len(and.not) == 0 {
+		return and.must[0], nil
+	}
+
+	return and, nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	p.skipSpace()
+
+	if p.peekKeyword() == "NOT" {
+		p.pos += len("NOT")
+	} else if p.input[p.pos] == '-' {
+		p.pos++
+	} else {
+		return p.parsePrimary()
+	}
+
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return nil, fmt.Errorf("%w: expected a search term after NOT", ErrBadQuery)
+	}
+
+	node, err := p.parsePrimary()
+	if err != nil || node == nil {
+		return nil, err
+	}
+
+	if _, ok := node.(notQuery); ok {
+		return nil, fmt.Errorf("%w: NOT can't be nested", ErrBadQuery)
+	}
+
+	return notQuery{node}, nil
+}
+
+// Returns nil if the input at the current position has no terms, e.g. only punctuation
+func (p *queryParser) parsePrimary() (queryNode, error) {
+	switch p.input[p.pos] {
+	case '(':
+		p.pos++
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		p.skipSpace()
+		if p.pos >= len(p.input) || p.input[p.pos] != ')' {
+			return nil, fmt.Errorf("%w: missing )", ErrBadQuery)
+		}
+		p.pos++
+
+		return node, nil
+	case '"':
+		end := strings.IndexByte(p.input[p.pos+1:], '"')
+		if end < 0 {
+			return nil, fmt.Errorf("%w: missing closing quote", ErrBadQuery)
+		}
+
+		text := p.input[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+
+		return p.phrase(text)
+	default:
+		end := p.pos
+		for end < len(p.input) {
+			r, size := utf8.DecodeRuneInString(p.input[end:])
+			if unicode.IsSpace(r) || r == '(' || r == ')' || r == '"' {
+				break
+			}
+			end += size
+		}
+
+		text := p.input[p.pos:end]
+		p.pos = end
+
+		// Words that split into several tokens, like e-mail, are searched as phrases
+		return p.phrase(text)
+	}
+}
+
+// Turns text into a term, or a phrase if it has several words
+// A trailing * makes the last word a prefix
+func (p *queryParser) phrase(text string) (queryNode, error) {
+	prefix := strings.HasSuffix(text, "*")
+
+	var terms []termQuery
+	for _, t := range tokenize(text) {
+		terms = append(terms, termQuery{term: t.term})
+	}
+
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	terms[len(terms)-1].prefix = prefix
+
+	p.terms += len(terms)
+	if p.terms > maxQueryTerms {
+		return nil, fmt.Errorf("%w: too many terms, at most %d are allowed", ErrBadQuery, maxQueryTerms)
+	}
+
+	if len(terms) == 1 {
+		return terms[0], nil
+	}
+
+	return phraseQuery{terms}, nil
+}
+
+// Where the inverted index comes from, which depends on the backend
+type searchSource interface {
+	// Chirp ID -> positions of term in the chirp
+	postings(term string) (map[int][]int, error)
+	// Terms that start with prefix, at most limit of them
+	termsWithPrefix(prefix string, limit int) ([]string, error)
+	// Number of chirps, for weighing rare terms higher
+	chirpCount() (int, error)
+}
+
+// How well a chirp matches, and which of its words matched
+type docMatch struct {
+	score     float64
+	positions map[int]bool
+}
+
+func (m *docMatch) merge(other *docMatch) {
+	m.score += other.score
+	for pos := range other.positions {
+		m.positions[pos] = true
+	}
+}
+
+type queryEvaluator struct {
+	src   searchSource
+	total int
+}
+
+// Evaluates a query, returning the matching chirps by ID
+func evalQuery(q queryNode, src searchSource) (map[int]*docMatch, error) {
+	if _, ok := q.(notQuery); ok {
+		return nil, fmt.Errorf("%w: NOT needs something to exclude from", ErrBadQuery)
+	}
+
+	total, err := src.chirpCount()
+	if err != nil {
+		return nil, err
+	}
+
+	e := queryEvaluator{src, total}
+	return e.eval(q)
+}
+
+// Inverse document frequency, terms that appear in fewer chirps count for more
+func (e *queryEvaluator) idf(docs int) float64 {
+	return math.Log(1 + float64(e.total)/float64(max(docs, 1)))
+}
+
+// The postings of a term, with prefixes expanded to all terms they match
+func (e *queryEvaluator) termPostings(t termQuery) ([]map[int][]int, error) {
+	terms := []string{t.term}
+	if t.prefix {
+		var err error
+		if terms, err = e.src.termsWithPrefix(t.term, maxPrefixTerms); err != nil {
+			return nil, err
+		}
+	}
+
+	var all []map[int][]int
+	for _, term := range terms {
+		postings, err := e.src.postings(term)
+		if err != nil {
+			return nil, err
+		}
+		if len(postings) > 0 {
+			all = append(all, postings)
+		}
+	}
+
+	return all, nil
+}
+
+func (e *queryEvaluator) eval(q queryNode) (map[int]*docMatch, error) {
+	switch q := q.(type) {
+	case termQuery:
+		return e.evalTerm(q)
+	case phraseQuery:
+		return e.evalPhrase(q)
+	case andQuery:
+		return e.evalAnd(q)
+	case orQuery:
+		matches := map[int]*docMatch{}
+		for _, node := range q.any {
+			nodeMatches, err := e.eval(node)
+			if err != nil {
+				return nil, err
+			}
+
+			for id, m := range nodeMatches {
+				if existing, ok := matches[id]; ok {
+					existing.merge(m)
+				} else {
+					matches[id] = m
+				}
+			}
+		}
+		return matches, nil
+	default:
+		return nil, fmt.Errorf("%w: unexpected NOT", ErrBadQuery)
+	}
+}
+
+func (e *queryEvaluator) evalTerm(t termQuery) (map[int]*docMatch, error) {
+	all, err := e.termPostings(t)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := map[int]*docMatch{}
+	for _, postings := range all {
+		idf := e.idf(len(postings))
+
+		for id, positions := range postings {
+			m, ok := matches[id]
+			if !ok {
+				m = &docMatch{positions: map[int]bool{}}
+				matches[id] = m
+			}
+
+			m.score += float64(len(positions)) * idf
+			for _, pos := range positions {
+				m.positions[pos] = true
+			}
+		}
+	}
+
+	return matches, nil
+}
+
+func (e *queryEvaluator) evalPhrase(q phraseQuery) (map[int]*docMatch, error) {
+	// Position -> set of positions of each word, merged over prefix expansions
+	wordPositions := make([]map[int]map[int]bool, len(q.terms))
+	weight := 0.0
+
+	for i, t := range q.terms {
+		all, err := e.termPostings(t)
+		if err != nil {
+			return nil, err
+		}
+
+		byDoc := map[int]map[int]bool{}
+		docs := 0
+		for _, postings := range all {
+			docs += len(postings)
+			for id, positions := range postings {
+				if byDoc[id] == nil {
+					byDoc[id] = map[int]bool{}
+				}
+				for _, pos := range positions {
+					byDoc[id][pos] = true
+				}
+			}
+		}
+
+		wordPositions[i] = byDoc
+		weight += e.idf(docs)
+	}
+
+	matches := map[int]*docMatch{}
+	for id, firstPositions := range wordPositions[0] {
+		m := &docMatch{positions: map[int]bool{}}
+
+		for start := range firstPositions {
+			found := true
+			for i := 1; i < len(q.terms) && found; i++ {
+				found = wordPositions[i][id][start+i]
+			}
+			if !found {
+				continue
+			}
+
+			m.score += weight * phraseBoost
+			for i := range q.terms {
+				m.positions[start+i] = true
+			}
+		}
+
+		if len(m.positions) > 0 {
+			matches[id] = m
+		}
+	}
+
+	return matches, nil
+}
+
+func (e *queryEvaluator) evalAnd(q andQuery) (map[int]*docMatch, error) {
+	if len(q.must) == 0 {
+		return nil, fmt.Errorf("%w: NOT needs something to exclude from", ErrBadQuery)
+	}
+
+	matches, err := e.eval(q.must[0])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, node := range q.must[1:] {
+		if len(matches) == 0 {
+			return matches, nil
+		}
+
+		nodeMatches, err := e.eval(node)
+		if err != nil {
+			return nil, err
+		}
+
+		for id, m := range matches {
+			if other, ok := nodeMatches[id]; ok {
+				m.merge(other)
+			} else {
+				delete(matches, id)
+			}
+		}
+	}
+
+	for _, node := range q.not {
+		if len(matches) == 0 {
+			return matches, nil
+		}
+
+		excluded, err := e.eval(node)
+		if err != nil {
+			return nil, err
+		}
+
+		for id := range excluded {
+			delete(matches, id)
+		}
+	}
+
+	return matches, nil
+}
+
+// Parses and evaluates a query, returning the IDs of the best matches first, at most limit of them
+func searchIds(query string, src searchSource, limit int) ([]int, map[int]*docMatch, error) {
+	q, err := parseQuery(query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	matches, err := evalQuery(q, src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]int, 0, len(matches))
+	for id := range matches {
+		ids = append(ids, id)
+	}
+
+	// Best score first, and newer chirps first among equally good ones
+	slices.SortFunc(ids, func(a, b int) int {
+		if c := cmp.Compare(matches[b].score, matches[a].score); c != 0 {
+			return c
+		}
+		return cmp.Compare(b, a)
+	})
+
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	return ids, matches, nil
+}
+
+// Builds the result for a chirp, marking the words at the matched positions
+func newSearchResult(chirp Chirp, m *docMatch) SearchResult {
+	result := SearchResult{Chirp: chirp, Score: m.score, Matches: []Span{}}
+
+	var b strings.Builder
+	last := 0
+	for i, t := range tokenize(chirp.Body) {
+		if !m.positions[i] {
+			continue
+		}
+
+		result.Matches = append(result.Matches, t.span)
+
+		b.WriteString(html.EscapeString(chirp.Body[last:t.span.Start]))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(chirp.Body[t.span.Start:t.span.End]))
+		b.WriteString("</mark>")
+		last = t.span.End
+	}
+	b.WriteString(html.EscapeString(chirp.Body[last:]))
+
+	result.Highlighted = b.String()
+
+	return result
+}
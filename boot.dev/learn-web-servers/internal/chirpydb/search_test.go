@@ -0,0 +1,93 @@
+package chirpydb
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	cases := []struct {
+		query    string
+		expected queryNode
+	}{
+		{"hello", termQuery{term: "hello"}},
+		{"Hello", termQuery{term: "hello"}},
+		{"hel*", termQuery{term: "hel", prefix: true}},
+		{"hello world", andQuery{must: []queryNode{termQuery{term: "hello"}, termQuery{term: "world"}}}},
+		{`"hello world"`, phraseQuery{terms: []termQuery{{term: "hello"}, {term: "world"}}}},
+		// Words that split into several terms have to match together
+		{"e-mail", phraseQuery{terms: []termQuery{{term: "e"}, {term: "mail"}}}},
+		{"cats OR dogs", orQuery{any: []queryNode{termQuery{term: "cats"}, termQuery{term: "dogs"}}}},
+		{"cats -dogs", andQuery{must: []queryNode{termQuery{term: "cats"}}, not: []queryNode{termQuery{term: "dogs"}}}},
+		{"cats NOT dogs", andQuery{must: []queryNode{termQuery{term: "cats"}}, not: []queryNode{termQuery{term: "dogs"}}}},
+		{"(cats OR dogs) pet", andQuery{must: []queryNode{
+			orQuery{any: []queryNode{termQuery{term: "cats"}, termQuery{term: "dogs"}}},
+			termQuery{term: "pet"},
+		}}},
+		// Keywords are only keywords in uppercase
+		{"cats or dogs", andQuery{must: []queryNode{termQuery{term: "cats"}, termQuery{term: "or"}, termQuery{term: "dogs"}}}},
+	}
+
+	for _, c := range cases {
+		q, err := parseQuery(c.query)
+		if err != nil {
+			t.Errorf("could not parse %q: %v", c.query, err)
+			return
+		}
+
+		if !reflect.DeepEqual(q, c.expected) {
+			t.Errorf("expected %#v for %q, got %#v", c.expected, c.query, q)
+			return
+		}
+	}
+}
+
+// A search index with nothing in it
+type emptySearchSource struct{}
+
+func (emptySearchSource) postings(term string) (map[int][]int, error) { return map[int][]int{}, nil }
+func (emptySearchSource) termsWithPrefix(prefix string, limit int) ([]string, error) {
+	return nil, nil
+}
+func (emptySearchSource) chirpCount() (int, error) { return 0, nil }
+
+func TestBadQueries(t *testing.T) {
+	queries := []string{
+		"",
+		"   ",
+		"!!!",
+		"(cats",
+		"cats)",
+		`"cats`,
+		"-cats",
+		"NOT cats",
+		"cats OR",
+		"a b c d e f g h i j k l m n o p q r s t u",
+	}
+
+	for _, query := range queries {
+		// Some queries parse fine and are only rejected once they are evaluated
+		if _, _, err := searchIds(query, emptySearchSource{}, 10); !errors.Is(err, ErrBadQuery) {
+			t.Errorf("expected ErrBadQuery for %q, got %v", query, err)
+			return
+		}
+	}
+}
+
+func TestSearchHighlightEscapes(t *testing.T) {
+	chirp := Chirp{Id: 1, Body: "<b>bold</b> & bold"}
+	m := &docMatch{score: 1, positions: map[int]bool{1: true, 3: true}}
+
+	result := newSearchResult(chirp, m)
+
+	if expected := "&lt;b&gt;<mark>bold</mark>&lt;/b&gt; &amp; <mark>bold</mark>"; result.Highlighted != expected {
+		t.Errorf("expected highlight %q, got %q", expected, result.Highlighted)
+		return
+	}
+
+	if expected := []Span{{3, 7}, {14, 18}}; !slices.Equal(result.Matches, expected) {
+		t.Errorf("expected matches %v, got %v", expected, result.Matches)
+	}
+}
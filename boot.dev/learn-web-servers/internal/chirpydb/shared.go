@@ -0,0 +1,143 @@
+package chirpydb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// In shared mode, several processes can use the same database file
+// Every access takes an advisory lock on a lock file next to the database (the database file itself is replaced
+// on every write, so it can't hold a lock), and the in-memory copy is reloaded whenever another process wrote the file
+const lockSuffix = ".lock"
+
+func (db *DB) lockPath() string {
+	return db.path + lockSuffix
+}
+
+func (db *DB) openLockFile() error {
+	f, err := os.OpenFile(db.lockPath(), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open lock file: %w", err)
+	}
+
+	db.lockFile = f
+
+	return nil
+}
+
+// Runs fn while holding the cross-process lock
+// This just runs fn if the database is not shared
+func (db *DB) withFileLock(exclusive bool, fn func() error) error {
+	if db.lockFile == nil {
+		return fn()
+	}
+
+	if err := lockFile(db.lockFile, exclusive); err != nil {
+		return fmt.Errorf("could not lock database: %w", err)
+	}
+	defer unlockFile(db.lockFile)
+
+	return fn()
+}
+
+// Runs fn while holding an exclusive lock on the lock file at path, creating it if needed
+// This is for other files that several processes replace, like the JWT keyset,
+// and where advisory locks are not supported, fn runs without one
+func WithLockFile(path string, fn func() error) error {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("could not open lock file: %w", err)
+	}
+	defer f.Close()
+
+	if err := lockFile(f, true); err == nil {
+		defer unlockFile(f)
+	} else if !errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Errorf("could not lock %s: %w", path, err)
+	}
+
+	return fn()
+}
+
+// Records the state of the database file after we read or wrote it, to tell when someone else changes it
+func (db *DB) rememberFile() error {
+	if db.lockFile == nil {
+		return nil
+	}
+
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return err
+	}
+
+	db.fileInfo = info
+
+	return nil
+}
+
+// Reports whether the database file is not the one we last read or wrote
+// Every write replaces the file, so a different inode is the main signal, with size and mtime as a fallback
+func (db *DB) changedOnDisk() (bool, error) {
+	info, err := os.Stat(db.path)
+	if err != nil {
+		return false, err
+	}
+
+	return db.fileInfo == nil ||
+		!os.SameFile(info, db.fileInfo) ||
+		info.Size() != db.fileInfo.Size() ||
+		!info.ModTime().Equal(db.fileInfo.ModTime()), nil
+}
+
+// Reloads the in-memory database if another process changed the file
+// The caller must hold db.mux for writing, and the cross-process lock
+func (db *DB) reloadIfChanged() error {
+	if db.lockFile == nil {
+		return nil
+	}
+
+	changed, err := db.changedOnDisk()
+	if err != nil {
+		return fmt.Errorf("could not check database file: %w", err)
+	}
+	if !changed {
+		return nil
+	}
+
+	dbStruct, err := readDBFile(db.path, db.keys, db.tokenKey)
+	if err != nil {
+		return fmt.Errorf("could not reload database file: %w", err)
+	}
+
+	// The file may have been touched without its contents changing
+	if dbStruct.Generation != db.data.Generation {
+		dbStruct.buildIndexes()
+		db.data = dbStruct
+	}
+
+	return db.rememberFile()
+}
+
+// Makes sure View sees the latest data written by other processes
+func (db *DB) refreshForRead() error {
+	if db.lockFile == nil {
+		return nil
+	}
+
+	db.mux.RLock()
+	changed, err := db.changedOnDisk()
+	db.mux.RUnlock()
+
+	if err != nil {
+		return fmt.Errorf("could not check database file: %w", err)
+	}
+	if !changed {
+		return nil
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	return db.withFileLock(false, db.reloadIfChanged)
+}
@@ -0,0 +1,123 @@
+//go:build unix
+
+package chirpydb
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newSharedDB(t *testing.T, path string) *DB {
+	t.Helper()
+
+	db, err := NewDBWithOptions(path, Options{Shared: true})
+	if err != nil {
+		t.Fatalf("could not open shared database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestSharedSeesExternalChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	a := newSharedDB(t, path)
+	b := newSharedDB(t, path)
+
+	if _, err := a.CreateUser("user@example.com", "hash"); err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+
+	user, err := b.GetUserByEmail("user@example.com")
+	if err != nil {
+		t.Errorf("expected the other handle to see the new user, got %v", err)
+		return
+	}
+
+	// Changes made through b must build on what a wrote, and the other way around
+	if err := b.SetUserChirpyRed(user.Id, true); err != nil {
+		t.Errorf("could not upgrade user: %v", err)
+		return
+	}
+	if _, err := a.CreateUser("other@example.com", "hash"); err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+
+	for _, db := range []*DB{a, b} {
+		got, err := db.GetUserByEmail("user@example.com")
+		if err != nil || !got.IsChirpyRed {
+			t.Errorf("expected upgraded user, got %v, %v", got, err)
+			return
+		}
+		if _, err := db.GetUserByEmail("other@example.com"); err != nil {
+			t.Errorf("expected second user to exist, got %v", err)
+			return
+		}
+	}
+}
+
+func TestSharedConcurrentWrites(t *testing.T) {
+	const perHandle = 25
+
+	path := filepath.Join(t.TempDir(), "database.json")
+	handles := []*DB{newSharedDB(t, path), newSharedDB(t, path)}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, perHandle*len(handles))
+	for h, db := range handles {
+		for i := 0; i < perHandle; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := db.CreateChirp(fmt.Sprintf("handle %d chirp %d", h, i), h+1)
+				errs <- err
+			}()
+		}
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent write failed: %v", err)
+			return
+		}
+	}
+
+	for h, db := range handles {
+		chirps, err := db.GetChirps()
+		if err != nil {
+			t.Errorf("could not get chirps: %v", err)
+			return
+		}
+
+		if len(chirps) != perHandle*len(handles) {
+			t.Errorf("handle %d: expected %d chirps, got %d", h, perHandle*len(handles), len(chirps))
+			return
+		}
+
+		ids := map[int]bool{}
+		for _, c := range chirps {
+			ids[c.Id] = true
+		}
+		if len(ids) != len(chirps) {
+			t.Errorf("handle %d: expected unique chirp IDs, got %d distinct out of %d", h, len(ids), len(chirps))
+			return
+		}
+	}
+}
+
+func TestSharedRejectsWriteBehind(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	for _, opts := range []Options{{Shared: true, Journal: true}, {Shared: true, FlushInterval: 1}} {
+		if db, err := NewDBWithOptions(path, opts); err == nil {
+			db.Close()
+			t.Errorf("expected %+v to be rejected", opts)
+		}
+	}
+}
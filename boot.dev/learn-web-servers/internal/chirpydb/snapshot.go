@@ -0,0 +1,286 @@
+package chirpydb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Implemented by stores that can take consistent point-in-time copies of themselves while in use
+type Snapshotter interface {
+	// Writes a consistent copy of the database to a new file at path
+	SnapshotTo(path string) error
+
+	// Atomically replaces the contents of the database with a snapshot taken by SnapshotTo
+	RestoreFrom(path string) error
+}
+
+// How many snapshots to keep around
+// The newest snapshot is always kept
+type RetentionPolicy struct {
+	// Keep at most this many snapshots, zero means no limit
+	Keep int
+
+	// Delete snapshots older than this, zero means no limit
+	MaxAge time.Duration
+}
+
+type SnapshotInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Manages the snapshots of a store in a directory
+type Snapshots struct {
+	dir       string
+	store     Snapshotter
+	retention RetentionPolicy
+}
+
+const (
+	snapshotPrefix     = "chirpy-"
+	snapshotSuffix     = ".snapshot"
+	snapshotTimeFormat = "20060102T150405.000000000Z"
+)
+
+func NewSnapshots(dir string, store Snapshotter, retention RetentionPolicy) *Snapshots {
+	return &Snapshots{dir, store, retention}
+}
+
+// Takes a snapshot of the store and applies the retention policy
+func (s *Snapshots) Create() (SnapshotInfo, error) {
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("could not create snapshot directory: %w", err)
+	}
+
+	createdAt := time.Now().UTC()
+	name := snapshotPrefix + createdAt.Format(snapshotTimeFormat) + snapshotSuffix
+	path := filepath.Join(s.dir, name)
+
+	if err := s.store.SnapshotTo(path); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("could not take snapshot: %w", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	if err := s.prune(); err != nil {
+		return SnapshotInfo{}, fmt.Errorf("could not apply snapshot retention: %w", err)
+	}
+
+	return SnapshotInfo{name, info.Size(), createdAt}, nil
+}
+
+// Lists all snapshots, newest first
+func (s *Snapshots) List() ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []SnapshotInfo{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read snapshot directory: %w", err)
+	}
+
+	snapshots := []SnapshotInfo{}
+	for _, e := range entries {
+		createdAt, ok := parseSnapshotName(e.Name())
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			// Deleted in the meantime
+			continue
+		}
+
+		snapshots = append(snapshots, SnapshotInfo{e.Name(), info.Size(), createdAt})
+	}
+
+	slices.SortFunc(snapshots, func(a, b SnapshotInfo) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	return snapshots, nil
+}
+
+// Replaces the contents of the store with the snapshot called name
+func (s *Snapshots) Restore(name string) error {
+	if _, ok := parseSnapshotName(name); !ok || filepath.Base(name) != name {
+		return ErrNotExist
+	}
+
+	path := filepath.Join(s.dir, name)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return ErrNotExist
+	}
+
+	return s.store.RestoreFrom(path)
+}
+
+// Rewrites every snapshot under the active key of keys, so rotating the key of the store doesn't leave them behind
+// Snapshots that are still plain are encrypted
+func (s *Snapshots) Reencrypt(keys *Keyring) error {
+	snapshots, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	for _, snap := range snapshots {
+		if err := reencryptFile(filepath.Join(s.dir, snap.Name), keys); err != nil {
+			return fmt.Errorf("could not re-encrypt snapshot: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Snapshots) prune() error {
+	snapshots, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for i, snap := range snapshots {
+		// Never delete the newest one
+		if i == 0 {
+			continue
+		}
+
+		tooMany := s.retention.Keep > 0 && i >= s.retention.Keep
+		tooOld := s.retention.MaxAge > 0 && now.Sub(snap.CreatedAt) > s.retention.MaxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(s.dir, snap.Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseSnapshotName(name string) (time.Time, bool) {
+	ts, ok := strings.CutPrefix(name, snapshotPrefix)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	ts, ok = strings.CutSuffix(ts, snapshotSuffix)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	createdAt, err := time.Parse(snapshotTimeFormat, ts)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return createdAt, true
+}
+
+// Writes the in-memory database to path
+// Only the read lock is held, so the server keeps serving reads while the snapshot is taken
+func (db *DB) SnapshotTo(path string) error {
+	if err := db.refreshForRead(); err != nil {
+		return err
+	}
+
+	db.mux.RLock()
+	data, err := json.Marshal(db.data)
+	db.mux.RUnlock()
+
+	if err != nil {
+		return fmt.Errorf("error marshalling database json: %w", err)
+	}
+
+	if data, err = encryptFile(data, db.keys); err != nil {
+		return fmt.Errorf("could not encrypt snapshot: %w", err)
+	}
+
+	return WriteFileAtomic(path, data)
+}
+
+// Replaces the database with a snapshot
+// The snapshot is upgraded to the latest schema version if it is older
+func (db *DB) RestoreFrom(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read snapshot: %w", err)
+	}
+
+	restored, _, err := decodeDBFile(data, db.keys, db.tokenKey)
+	if err != nil {
+		return fmt.Errorf("could not decode snapshot: %w", err)
+	}
+
+	// Same lock order as Flush and Compact, so that a flush of the old data can't land after the restore
+	db.flushMux.Lock()
+	defer db.flushMux.Unlock()
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	var events []ChangeEvent
+
+	// Journal sequence numbers keep counting up from where they were, the journal is emptied below anyway
+	restored.JournalSeq = db.data.JournalSeq
+	restored.buildIndexes()
+
+	err = db.withFileLock(true, func() error {
+		// Make sure other processes see a new generation, even if the snapshot has the same one as the file
+		if err := db.reloadIfChanged(); err != nil {
+			return err
+		}
+		restored.Generation = db.data.Generation + 1
+
+		// The restore shows up in the change feed as the changes that undo everything since the snapshot
+		restored.ChangeSeq = db.data.ChangeSeq
+		if events, err = restored.newChangeEvents(diffFeedTables(&db.data, &restored), time.Now().UTC()); err != nil {
+			return err
+		}
+
+		logSize, err := db.appendChanges(events)
+		if err != nil {
+			return err
+		}
+
+		if err := db.writeDB(restored); err != nil {
+			db.truncateChanges(logSize)
+			return err
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if db.journal != nil {
+		if err := db.journal.Truncate(0); err != nil {
+			return fmt.Errorf("could not truncate journal: %w", err)
+		}
+		db.journalSize = 0
+	}
+
+	db.data = restored
+	db.gen++
+	db.flushedGen = db.gen
+	db.flushedChangeSeq = db.data.ChangeSeq
+	db.rememberChanges(events)
+
+	return nil
+}
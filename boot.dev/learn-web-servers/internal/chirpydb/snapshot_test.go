@@ -0,0 +1,158 @@
+package chirpydb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	for _, b := range storeBackends {
+		t.Run(b.name, func(t *testing.T) {
+			s := b.open(t)
+			snapshots := NewSnapshots(t.TempDir(), s.(Snapshotter), RetentionPolicy{})
+
+			kept, err := s.CreateChirp("kept", 1)
+			if err != nil {
+				t.Errorf("could not create chirp: %v", err)
+				return
+			}
+
+			// Writes keep going while the snapshot is taken
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					s.CreateUser(fmt.Sprintf("user%d@example.com", i), "hash")
+				}
+			}()
+
+			snapshot, err := snapshots.Create()
+			wg.Wait()
+			if err != nil {
+				t.Errorf("could not create snapshot: %v", err)
+				return
+			}
+			if snapshot.Size == 0 {
+				t.Errorf("expected snapshot to have a size")
+				return
+			}
+
+			if _, err := s.CreateChirp("dropped", 1); err != nil {
+				t.Errorf("could not create chirp: %v", err)
+				return
+			}
+			if err := s.DeleteChirp(kept.Id); err != nil {
+				t.Errorf("could not delete chirp: %v", err)
+				return
+			}
+
+			flushStore(t, s)
+			before, err := s.Changes(0, 0)
+			if err != nil {
+				t.Errorf("could not get changes: %v", err)
+				return
+			}
+
+			if err := snapshots.Restore(snapshot.Name); err != nil {
+				t.Errorf("could not restore snapshot: %v", err)
+				return
+			}
+
+			// The restore shows up in the change feed, continuing from where it was
+			restoreChanges, err := s.Changes(before[len(before)-1].Seq, 0)
+			if err != nil {
+				t.Errorf("could not get changes: %v", err)
+				return
+			}
+
+			var chirpOps []ChangeOp
+			for _, c := range restoreChanges {
+				if c.Entity == EntityChirp {
+					chirpOps = append(chirpOps, c.Op)
+				}
+			}
+			if !slices.Equal(chirpOps, []ChangeOp{ChangeCreate, ChangeDelete}) {
+				t.Errorf("expected the restore to recreate one chirp and delete another, got %v", restoreChanges)
+				return
+			}
+
+			chirps, err := s.GetChirps()
+			if err != nil {
+				t.Errorf("could not get chirps: %v", err)
+				return
+			}
+			if len(chirps) != 1 || !reflect.DeepEqual(chirps[0], kept) {
+				t.Errorf("expected only %v after restoring, got %v", kept, chirps)
+				return
+			}
+
+			// ID counters are restored too, and keep working after the restore
+			next, err := s.CreateChirp("next", 1)
+			if err != nil {
+				t.Errorf("could not create chirp: %v", err)
+				return
+			}
+			if next.Id != kept.Id+1 {
+				t.Errorf("expected chirp ID %d after restoring, got %d", kept.Id+1, next.Id)
+				return
+			}
+
+			for _, name := range []string{"missing", "../database.json", "chirpy-20200101T000000.000000000Z.snapshot"} {
+				if err := snapshots.Restore(name); !errors.Is(err, ErrNotExist) {
+					t.Errorf("expected ErrNotExist restoring %q, got %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	dir := t.TempDir()
+
+	// Pretend some old snapshots exist
+	for _, ts := range []time.Time{time.Now().Add(-48 * time.Hour), time.Now().Add(-2 * time.Hour), time.Now().Add(-time.Hour)} {
+		name := snapshotPrefix + ts.UTC().Format(snapshotTimeFormat) + snapshotSuffix
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0o600); err != nil {
+			t.Errorf("could not write snapshot: %v", err)
+			return
+		}
+	}
+
+	snapshots := NewSnapshots(dir, newTestDB(t), RetentionPolicy{Keep: 3, MaxAge: 24 * time.Hour})
+
+	created, err := snapshots.Create()
+	if err != nil {
+		t.Errorf("could not create snapshot: %v", err)
+		return
+	}
+
+	list, err := snapshots.List()
+	if err != nil {
+		t.Errorf("could not list snapshots: %v", err)
+		return
+	}
+
+	// The day old one is too old, the rest fit in the limit
+	if len(list) != 3 || list[0].Name != created.Name {
+		t.Errorf("expected 3 snapshots starting with %s, got %v", created.Name, list)
+		return
+	}
+
+	snapshots.retention.Keep = 1
+	if _, err := snapshots.Create(); err != nil {
+		t.Errorf("could not create snapshot: %v", err)
+		return
+	}
+
+	if list, _ := snapshots.List(); len(list) != 1 {
+		t.Errorf("expected only 1 snapshot to be kept, got %v", list)
+	}
+}
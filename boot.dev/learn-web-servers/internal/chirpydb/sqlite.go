@@ -0,0 +1,2046 @@
+package chirpydb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	// Pure Go SQLite driver, so we don't need cgo
+	_ "modernc.org/sqlite"
+)
+
+// A Store backed by an embedded SQLite database
+type SQLiteDB struct {
+	db *sql.DB
+
+	// See Options.TokenKey
+	tokenKey []byte
+
+	// Wakes up change feed subscribers
+	changes changeNotifier
+}
+
+// A schema migration
+// fn runs after sql in the same transaction, for changes that need Go code, like backfilling data
+type sqliteMigration struct {
+	sql string
+	fn  func(tx *sql.Tx, env migrationEnv) error
+}
+
+// Schema migrations, applied in order
+// The index of the last applied migration (plus one) is stored in the user_version pragma,
+// so existing entries must never be edited, only appended to
+var sqliteMigrations = []sqliteMigration{
+	{sql: `CREATE TABLE users (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		email         TEXT    NOT NULL,
+		password      TEXT    NOT NULL,
+		is_chirpy_red INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE UNIQUE INDEX users_email ON users(email);
+
+	CREATE TABLE chirps (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		body      TEXT    NOT NULL,
+		author_id INTEGER NOT NULL
+	);
+	CREATE INDEX chirps_author_id ON chirps(author_id);
+
+	CREATE TABLE refresh_tokens (
+		token      TEXT    PRIMARY KEY,
+		user_id    INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);`},
+
+	// Emails are looked up ignoring case
+	{sql: `CREATE INDEX users_email_nocase ON users(email COLLATE NOCASE);`},
+
+	// Change feed, written in the same transaction as the changes themselves
+	{sql: `CREATE TABLE changes (
+		seq       INTEGER PRIMARY KEY AUTOINCREMENT,
+		time      INTEGER NOT NULL,
+		op        TEXT    NOT NULL,
+		entity    TEXT    NOT NULL,
+		entity_id TEXT    NOT NULL,
+		before    TEXT,
+		after     TEXT
+	);`},
+
+	// Full-text search index, positions is a JSON array
+	{sql: `CREATE TABLE chirp_terms (
+		term      TEXT    NOT NULL,
+		chirp_id  INTEGER NOT NULL,
+		positions TEXT    NOT NULL,
+		PRIMARY KEY (term, chirp_id)
+	) WITHOUT ROWID;
+	CREATE INDEX chirp_terms_chirp_id ON chirp_terms(chirp_id);`,
+		fn: backfillChirpTerms},
+
+	// Times are stored as Unix nanoseconds, like the expiry of refresh tokens
+	{sql: `ALTER TABLE chirps ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE chirps ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX chirps_created_at ON chirps(created_at, id);
+	CREATE INDEX chirps_author_id_created_at ON chirps(author_id, created_at, id);`,
+		fn: backfillTimestamps},
+
+	// Earlier versions of edited chirps
+	{sql: `ALTER TABLE chirps ADD COLUMN edited INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE chirp_revisions (
+		chirp_id   INTEGER NOT NULL,
+		revision   INTEGER NOT NULL,
+		body       TEXT    NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (chirp_id, revision)
+	) WITHOUT ROWID;`},
+
+	// Threads, every existing chirp starts its own
+	{sql: `ALTER TABLE chirps ADD COLUMN reply_to INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE chirps ADD COLUMN root_id INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE chirps ADD COLUMN reply_count INTEGER NOT NULL DEFAULT 0;
+	UPDATE chirps SET root_id = id;
+	CREATE INDEX chirps_root_id ON chirps(root_id, id);`},
+
+	// Likes and rechirps
+	{sql: `ALTER TABLE chirps ADD COLUMN like_count INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE chirps ADD COLUMN rechirp_count INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE likes (
+		chirp_id   INTEGER NOT NULL,
+		user_id    INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (chirp_id, user_id)
+	) WITHOUT ROWID;
+	CREATE INDEX likes_user_id ON likes(user_id, chirp_id);
+	CREATE TABLE rechirps (
+		chirp_id   INTEGER NOT NULL,
+		user_id    INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (chirp_id, user_id)
+	) WITHOUT ROWID;
+	CREATE INDEX rechirps_user_id ON rechirps(user_id, chirp_id);`},
+
+	// Follows, and the timelines of followed chirps that are filled in as chirps are posted
+	{sql: `ALTER TABLE users ADD COLUMN follower_count INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN following_count INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE follows (
+		follower_id INTEGER NOT NULL,
+		followee_id INTEGER NOT NULL,
+		created_at  INTEGER NOT NULL,
+		PRIMARY KEY (follower_id, followee_id)
+	) WITHOUT ROWID;
+	CREATE INDEX follows_followee_id ON follows(followee_id, follower_id);
+	CREATE TABLE timeline (
+		user_id    INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		chirp_id   INTEGER NOT NULL,
+		author_id  INTEGER NOT NULL,
+		PRIMARY KEY (user_id, created_at, chirp_id)
+	) WITHOUT ROWID;
+	CREATE INDEX timeline_chirp_id ON timeline(chirp_id);
+	CREATE INDEX timeline_author_id ON timeline(user_id, author_id);`},
+
+	// Hashtags and mentions, stored on the chirp as JSON arrays and indexed by hashtag
+	{sql: `ALTER TABLE chirps ADD COLUMN hashtags TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE chirps ADD COLUMN mentions TEXT NOT NULL DEFAULT '[]';
+	CREATE TABLE chirp_hashtags (
+		tag        TEXT    NOT NULL,
+		chirp_id   INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (tag, chirp_id)
+	) WITHOUT ROWID;
+	CREATE INDEX chirp_hashtags_created_at ON chirp_hashtags(created_at);
+	CREATE INDEX chirp_hashtags_chirp_id ON chirp_hashtags(chirp_id);`,
+		fn: backfillChirpTags},
+
+	// Refresh token families, rotation and their audit log
+	// rotated_at is NULL until the token is exchanged
+	{sql: `ALTER TABLE refresh_tokens ADD COLUMN family_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE refresh_tokens ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE refresh_tokens ADD COLUMN rotated_at INTEGER;
+	CREATE INDEX refresh_tokens_family_id ON refresh_tokens(family_id);
+	CREATE TABLE token_events (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind       TEXT    NOT NULL,
+		family_id  TEXT    NOT NULL,
+		user_id    INTEGER NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	CREATE INDEX token_events_user_id ON token_events(user_id, id);`,
+		fn: backfillTokenFamilies},
+
+	// Refresh tokens are stored as keyed hashes
+	// hashed tells existing plain tokens apart from the hashes that replace them
+	{sql: `ALTER TABLE refresh_tokens RENAME COLUMN token TO token_hash;
+	ALTER TABLE refresh_tokens ADD COLUMN hashed INTEGER NOT NULL DEFAULT 0;`,
+		fn: hashPlainRefreshTokens},
+
+	// Sessions, which are the latest tokens of their families
+	// Rotation history is not kept, so existing tokens were logged in and last used when they were created
+	{sql: `ALTER TABLE refresh_tokens ADD COLUMN logged_in_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE refresh_tokens ADD COLUMN last_used_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE refresh_tokens ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+	ALTER TABLE refresh_tokens ADD COLUMN client_ip TEXT NOT NULL DEFAULT '';
+	UPDATE refresh_tokens SET logged_in_at = created_at, last_used_at = created_at;
+	CREATE INDEX refresh_tokens_user_id ON refresh_tokens(user_id);`},
+
+	// Running counts of hashtag uses per trending bucket, which replace scanning chirp_hashtags by time
+	{sql: `CREATE TABLE hashtag_counts (
+		bucket INTEGER NOT NULL,
+		tag    TEXT    NOT NULL,
+		count  INTEGER NOT NULL,
+		PRIMARY KEY (bucket, tag)
+	) WITHOUT ROWID;
+	DROP INDEX chirp_hashtags_created_at;`,
+		fn: backfillHashtagCounts},
+
+	// Emails are unique ignoring case, and the case-sensitive index goes away since every lookup ignores case
+	{sql: `DROP INDEX users_email;
+	DROP INDEX users_email_nocase;`,
+		fn: uniqueEmailsIgnoringCase},
+}
+
+// Columns of the chirps and users tables, in the order scanChirp and scanUser expect them
+const (
+	chirpColumns = "id, body, author_id, created_at, updated_at, edited, reply_to, root_id, reply_count, like_count, rechirp_count, hashtags, mentions"
+	userColumns  = "id, email, password, is_chirpy_red, created_at, updated_at, follower_count, following_count"
+)
+
+// chirpColumns of the chirps table joined as c
+var joinedChirpColumns = "c." + strings.ReplaceAll(chirpColumns, ", ", ", c.")
+
+// Tables that are not restored from snapshots
+// The change feed keeps going forward instead, and records the restore as changes
+var sqliteUnrestoredTables = []string{"changes"}
+
+// Opens the SQLite database at path, creating it and applying migrations if needed
+func NewSQLiteDB(path string, debug bool) (*SQLiteDB, error) {
+	return NewSQLiteDBWithOptions(path, Options{Debug: debug})
+}
+
+// Like NewSQLiteDB, only Debug and TokenKey are used from opts
+func NewSQLiteDBWithOptions(path string, opts Options) (*SQLiteDB, error) {
+	if len(opts.TokenKey) == 0 {
+		key, err := loadTokenKey(path)
+		if err != nil {
+			return nil, err
+		}
+		opts.TokenKey = key
+	}
+
+	if opts.Debug {
+		for _, suffix := range []string{"", "-wal", "-shm"} {
+			if err := os.Remove(path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				// Log the error and continue
+				log.Printf("could not remove test database: %v", err)
+			}
+		}
+	}
+
+	// Writers take the lock when the transaction begins, and wait for each other instead of failing
+	dsn := sqliteURI(path, "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+
+	sqlDB, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("could not open sqlite database: %w", err)
+	}
+
+	db := &SQLiteDB{db: sqlDB, tokenKey: opts.TokenKey}
+
+	fromVersion, err := db.migrate()
+	if err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+
+	// The plain tokens can still be read from free pages and the WAL until they are rewritten
+	if fromVersion < sqliteTokenHashVersion {
+		if _, err := sqlDB.Exec("VACUUM; PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+			sqlDB.Close()
+			return nil, fmt.Errorf("could not clear plain refresh tokens: %w", err)
+		}
+	}
+
+	return db, nil
+}
+
+func (db *SQLiteDB) Close() error {
+	db.changes.shutdown()
+	return db.db.Close()
+}
+
+// Applies all migrations that have not been applied yet
+// Returns the schema version the database was at before
+func (db *SQLiteDB) migrate() (fromVersion int, err error) {
+	env := migrationEnv{tokenKey: db.tokenKey}
+
+	err = db.update(func(tx *sql.Tx) error {
+		var version int
+		if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+			return fmt.Errorf("could not read schema version: %w", err)
+		}
+		fromVersion = version
+
+		if version > len(sqliteMigrations) {
+			return fmt.Errorf("database schema version %d is newer than this build supports", version)
+		}
+
+		for i := version; i < len(sqliteMigrations); i++ {
+			if _, err := tx.Exec(sqliteMigrations[i].sql); err != nil {
+				return fmt.Errorf("error applying migration %d: %w", i+1, err)
+			}
+
+			if fn := sqliteMigrations[i].fn; fn != nil {
+				if err := fn(tx, env); err != nil {
+					return fmt.Errorf("error applying migration %d: %w", i+1, err)
+				}
+			}
+		}
+
+		// Pragmas can't take parameters
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(sqliteMigrations))); err != nil {
+			return fmt.Errorf("could not update schema version: %w", err)
+		}
+
+		return nil
+	})
+
+	return fromVersion, err
+}
+
+// Runs fn inside a write transaction, committing only if it returns nil
+func (db *SQLiteDB) update(fn func(tx *sql.Tx) error) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	db.changes.notify()
+
+	return nil
+}
+
+// Records a change in the change feed, if the table is part of it
+func recordChange(tx *sql.Tx, c change) error {
+	event, ok, err := newChangeEvent(c, 0, time.Now().UTC())
+	if err != nil || !ok {
+		return err
+	}
+
+	// Missing values are stored as NULL
+	var before, after *string
+	if event.Before != nil {
+		before = new(string)
+		*before = string(event.Before)
+	}
+	if event.After != nil {
+		after = new(string)
+		*after = string(event.After)
+	}
+
+	_, err = tx.Exec("INSERT INTO changes (time, op, entity, entity_id, before, after) VALUES (?, ?, ?, ?, ?, ?)",
+		event.Time.UnixNano(), event.Op, event.Entity, event.Id, before, after)
+	if err != nil {
+		return fmt.Errorf("could not record change: %w", err)
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) CreateChirp(body string, authorId int) (Chirp, error) {
+	return db.createChirp(body, authorId, 0)
+}
+
+func (db *SQLiteDB) CreateReply(body string, authorId int, parentId int) (Chirp, error) {
+	return db.createChirp(body, authorId, parentId)
+}
+
+func (db *SQLiteDB) createChirp(body string, authorId int, parentId int) (Chirp, error) {
+	var chirp Chirp
+
+	err := db.update(func(tx *sql.Tx) error {
+		rootId := 0
+		if parentId != 0 {
+			parent, err := addReplyCount(tx, parentId, 1)
+			if errors.Is(err, ErrNotExist) {
+				return ErrParentNotExist
+			} else if err != nil {
+				return err
+			}
+
+			rootId = parent.RootId
+		}
+
+		now := time.Now().UTC()
+		res, err := tx.Exec("INSERT INTO chirps (body, author_id, created_at, updated_at, reply_to, root_id) VALUES (?, ?, ?, ?, ?, ?)",
+			body, authorId, now.UnixNano(), now.UnixNano(), parentId, rootId)
+		if err != nil {
+			return err
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		// Chirps that are not replies start their own thread
+		if rootId == 0 {
+			rootId = int(id)
+			if _, err := tx.Exec("UPDATE chirps SET root_id = ? WHERE id = ?", rootId, id); err != nil {
+				return err
+			}
+		}
+
+		// Fan out to the timelines of the author's followers, so reading them stays a single index scan
+		_, err = tx.Exec("INSERT INTO timeline (user_id, created_at, chirp_id, author_id) SELECT follower_id, ?, ?, ? FROM follows WHERE followee_id = ?",
+			now.UnixNano(), id, authorId, authorId)
+		if err != nil {
+			return err
+		}
+
+		chirp = Chirp{Id: int(id), Body: body, AuthorId: authorId, CreatedAt: now, UpdatedAt: now, ReplyTo: parentId, RootId: rootId}
+
+		if err := tagChirp(tx, &chirp); err != nil {
+			return err
+		}
+
+		if err := indexChirpText(tx, chirp.Id, chirp.Body); err != nil {
+			return err
+		}
+
+		return recordChange(tx, change{Table: tableChirps, Key: chirp.Id, After: chirp})
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+func (db *SQLiteDB) GetChirps() ([]Chirp, error) {
+	return db.queryChirps("SELECT " + chirpColumns + " FROM chirps ORDER BY id")
+}
+
+func (db *SQLiteDB) GetChirp(id int) (Chirp, error) {
+	return scanChirp(db.db.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", id))
+}
+
+func (db *SQLiteDB) DeleteChirp(id int) error {
+	return db.update(func(tx *sql.Tx) error {
+		chirp, err := scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", id))
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM chirps WHERE id = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM chirp_terms WHERE chirp_id = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM chirp_revisions WHERE chirp_id = ?", id); err != nil {
+			return err
+		}
+		if err := deleteChirpReactions(tx, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM timeline WHERE chirp_id = ?", id); err != nil {
+			return err
+		}
+		if err := countHashtags(tx, id, -1); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM chirp_hashtags WHERE chirp_id = ?", id); err != nil {
+			return err
+		}
+
+		if err := recordChange(tx, change{Table: tableChirps, Key: id, Before: chirp}); err != nil {
+			return err
+		}
+
+		// Replies stay in the thread, but the parent has one fewer
+		if chirp.ReplyTo != 0 {
+			if _, err := addReplyCount(tx, chirp.ReplyTo, -1); err != nil && !errors.Is(err, ErrNotExist) {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Changes the reply count of a chirp by delta, returning the updated chirp
+func addReplyCount(tx *sql.Tx, id int, delta int) (Chirp, error) {
+	chirp, err := scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", id))
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	if _, err := tx.Exec("UPDATE chirps SET reply_count = reply_count + ? WHERE id = ?", delta, id); err != nil {
+		return Chirp{}, err
+	}
+
+	before := chirp
+	chirp.ReplyCount += delta
+
+	return chirp, recordChange(tx, change{Table: tableChirps, Key: id, Before: before, After: chirp})
+}
+
+func (db *SQLiteDB) GetThread(rootId int) ([]Chirp, error) {
+	chirps, err := db.queryChirps("SELECT "+chirpColumns+" FROM chirps WHERE root_id = ? ORDER BY id", rootId)
+	if err != nil {
+		return []Chirp{}, err
+	}
+
+	if len(chirps) == 0 {
+		return []Chirp{}, ErrNotExist
+	}
+
+	return chirps, nil
+}
+
+func (db *SQLiteDB) UpdateChirp(id int, body string, check func(Chirp) error) (Chirp, error) {
+	var chirp Chirp
+
+	err := db.update(func(tx *sql.Tx) error {
+		var err error
+		if chirp, err = scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", id)); err != nil {
+			return err
+		}
+
+		if check != nil {
+			if err := check(chirp); err != nil {
+				return err
+			}
+		}
+
+		if chirp.Body == body {
+			return nil
+		}
+
+		// The next revision number is one past the last one of this chirp
+		_, err = tx.Exec(`INSERT INTO chirp_revisions (chirp_id, revision, body, created_at)
+			SELECT ?, COALESCE(MAX(revision), 0) + 1, ?, ? FROM chirp_revisions WHERE chirp_id = ?`,
+			id, chirp.Body, chirp.UpdatedAt.UnixNano(), id)
+		if err != nil {
+			return fmt.Errorf("could not save revision: %w", err)
+		}
+
+		now := time.Now().UTC()
+		if _, err := tx.Exec("UPDATE chirps SET body = ?, updated_at = ?, edited = 1 WHERE id = ?", body, now.UnixNano(), id); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM chirp_terms WHERE chirp_id = ?", id); err != nil {
+			return err
+		}
+		if err := indexChirpText(tx, id, body); err != nil {
+			return err
+		}
+
+		before := chirp
+		chirp.Body = body
+		chirp.UpdatedAt = now
+		chirp.Edited = true
+
+		if err := tagChirp(tx, &chirp); err != nil {
+			return err
+		}
+
+		return recordChange(tx, change{Table: tableChirps, Key: id, Before: before, After: chirp})
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+func (db *SQLiteDB) GetChirpRevisions(id int) ([]ChirpRevision, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return []ChirpRevision{}, err
+	}
+	defer tx.Rollback()
+
+	// Tells a chirp without revisions apart from one that doesn't exist
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM chirps WHERE id = ?)", id).Scan(&exists); err != nil {
+		return []ChirpRevision{}, err
+	}
+	if !exists {
+		return []ChirpRevision{}, ErrNotExist
+	}
+
+	rows, err := tx.Query("SELECT revision, body, created_at FROM chirp_revisions WHERE chirp_id = ? ORDER BY revision", id)
+	if err != nil {
+		return []ChirpRevision{}, err
+	}
+	defer rows.Close()
+
+	revisions := []ChirpRevision{}
+	for rows.Next() {
+		var r ChirpRevision
+		var createdAt int64
+		if err := rows.Scan(&r.Revision, &r.Body, &createdAt); err != nil {
+			return []ChirpRevision{}, err
+		}
+
+		r.CreatedAt = time.Unix(0, createdAt).UTC()
+		revisions = append(revisions, r)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (db *SQLiteDB) ListChirps(opts ListOptions) ([]Chirp, error) {
+	where, args := pageClause(opts)
+	return db.queryChirps("SELECT "+chirpColumns+" FROM chirps WHERE "+where, args...)
+}
+
+func (db *SQLiteDB) GetChirpsByAuthor(authorId int, opts ListOptions) ([]Chirp, error) {
+	where, args := pageClause(opts)
+	return db.queryChirps("SELECT "+chirpColumns+" FROM chirps WHERE author_id = ? AND "+where, append([]any{authorId}, args...)...)
+}
+
+// Builds the end of a WHERE clause that selects the page of rows opts asks for
+func pageClause(opts ListOptions) (string, []any) {
+	return pageClauseOn("created_at", "id", opts)
+}
+
+// Same as pageClause, for tables whose creation time and ID columns are named differently
+func pageClauseOn(createdAt, id string, opts ListOptions) (string, []any) {
+	conds := []string{"1"}
+	var args []any
+
+	if !opts.Since.IsZero() {
+		conds = append(conds, createdAt+" >= ?")
+		args = append(args, unixNanoClamped(opts.Since))
+	}
+	if !opts.Until.IsZero() {
+		conds = append(conds, createdAt+" < ?")
+		args = append(args, unixNanoClamped(opts.Until))
+	}
+
+	cmp, order := ">", "ASC"
+	if opts.Desc {
+		cmp, order = "<", "DESC"
+	}
+
+	orderBy := id + " " + order
+	if opts.SortBy == SortByCreatedAt {
+		orderBy = createdAt + " " + order + ", " + id + " " + order
+	}
+
+	if opts.After > 0 {
+		if opts.SortBy == SortByCreatedAt {
+			conds = append(conds, "("+createdAt+", "+id+") "+cmp+" (?, ?)")
+			args = append(args, unixNanoClamped(opts.AfterTime), opts.After)
+		} else {
+			conds = append(conds, id+" "+cmp+" ?")
+			args = append(args, opts.After)
+		}
+	}
+
+	// A negative limit means no limit
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	return strings.Join(conds, " AND ") + " ORDER BY " + orderBy + " LIMIT ?", append(args, limit)
+}
+
+// Builds the end of a WHERE clause that selects a page of rows sorted by column
+// Only ListOptions.Desc, After and Limit are used
+func columnPageClause(column string, opts ListOptions) (string, []any) {
+	cond, order := "1", "ASC"
+	var args []any
+
+	if opts.Desc {
+		order = "DESC"
+	}
+	if opts.After > 0 {
+		if opts.Desc {
+			cond = column + " < ?"
+		} else {
+			cond = column + " > ?"
+		}
+		args = append(args, opts.After)
+	}
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	return cond + " ORDER BY " + column + " " + order + " LIMIT ?", append(args, limit)
+}
+
+func (db *SQLiteDB) AddReaction(kind ReactionKind, chirpId, userId int) (Chirp, error) {
+	return db.react(kind, chirpId, userId, true)
+}
+
+func (db *SQLiteDB) RemoveReaction(kind ReactionKind, chirpId, userId int) (Chirp, error) {
+	return db.react(kind, chirpId, userId, false)
+}
+
+// Adds or removes a reaction and updates the count on the chirp
+func (db *SQLiteDB) react(kind ReactionKind, chirpId, userId int, add bool) (Chirp, error) {
+	table, err := reactionTable(kind)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	var chirp Chirp
+
+	err = db.update(func(tx *sql.Tx) error {
+		var err error
+		if chirp, err = scanChirp(tx.QueryRow("SELECT "+chirpColumns+" FROM chirps WHERE id = ?", chirpId)); err != nil {
+			return err
+		}
+
+		var res sql.Result
+		var delta int
+		if add {
+			res, err = tx.Exec("INSERT INTO "+table+" (chirp_id, user_id, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+				chirpId, userId, time.Now().UTC().UnixNano())
+			delta = 1
+		} else {
+			res, err = tx.Exec("DELETE FROM "+table+" WHERE chirp_id = ? AND user_id = ?", chirpId, userId)
+			delta = -1
+		}
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			// Nothing changed
+			return err
+		}
+
+		if _, err := tx.Exec("UPDATE chirps SET "+string(kind)+"_count = "+string(kind)+"_count + ? WHERE id = ?", delta, chirpId); err != nil {
+			return err
+		}
+
+		before := chirp
+		*chirp.reactionCount(kind) += delta
+
+		return recordChange(tx, change{Table: tableChirps, Key: chirpId, Before: before, After: chirp})
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+func (db *SQLiteDB) GetReactions(kind ReactionKind, chirpId int, opts ListOptions) ([]Reaction, error) {
+	table, err := reactionTable(kind)
+	if err != nil {
+		return []Reaction{}, err
+	}
+
+	where, args := columnPageClause("user_id", opts)
+	return db.queryReactions(
+		"SELECT EXISTS (SELECT 1 FROM chirps WHERE id = ?)", chirpId,
+		"SELECT chirp_id, user_id, created_at FROM "+table+" WHERE chirp_id = ? AND "+where, append([]any{chirpId}, args...))
+}
+
+func (db *SQLiteDB) GetUserReactions(kind ReactionKind, userId int, opts ListOptions) ([]Reaction, error) {
+	table, err := reactionTable(kind)
+	if err != nil {
+		return []Reaction{}, err
+	}
+
+	where, args := columnPageClause("chirp_id", opts)
+	return db.queryReactions(
+		"SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userId,
+		"SELECT chirp_id, user_id, created_at FROM "+table+" WHERE user_id = ? AND "+where, append([]any{userId}, args...))
+}
+
+// Runs a query for reactions, after checking that the row they belong to exists
+func (db *SQLiteDB) queryReactions(existsQuery string, id int, query string, args []any) ([]Reaction, error) {
+	reactions := []Reaction{}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return []Reaction{}, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(existsQuery, id).Scan(&exists); err != nil {
+		return []Reaction{}, err
+	}
+	if !exists {
+		return []Reaction{}, ErrNotExist
+	}
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return []Reaction{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Reaction
+		var createdAt int64
+		if err := rows.Scan(&r.ChirpId, &r.UserId, &createdAt); err != nil {
+			return []Reaction{}, err
+		}
+		r.CreatedAt = time.Unix(0, createdAt).UTC()
+		reactions = append(reactions, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return []Reaction{}, err
+	}
+
+	return reactions, nil
+}
+
+func (db *SQLiteDB) ReactedTo(kind ReactionKind, userId int, chirpIds []int) (map[int]bool, error) {
+	table, err := reactionTable(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	reacted := map[int]bool{}
+	if len(chirpIds) == 0 {
+		return reacted, nil
+	}
+
+	// One JSON array instead of a parameter per chirp, which would run into SQLite's limit on parameters for long listings
+	ids, err := json.Marshal(chirpIds)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.db.Query("SELECT chirp_id FROM "+table+" WHERE user_id = ? AND chirp_id IN (SELECT value FROM json_each(?))", userId, string(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		reacted[id] = true
+	}
+
+	return reacted, rows.Err()
+}
+
+// Removes every reaction to a chirp
+func deleteChirpReactions(tx *sql.Tx, chirpId int) error {
+	for _, table := range []string{tableLikes, tableRechirps} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE chirp_id = ?", chirpId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) CreateUser(email string, password string) (User, error) {
+	var user User
+
+	err := db.update(func(tx *sql.Tx) error {
+		if exists, err := emailTaken(tx, email, 0); err != nil {
+			return err
+		} else if exists {
+			return ErrExists
+		}
+
+		now := time.Now().UTC()
+		res, err := tx.Exec("INSERT INTO users (email, password, created_at, updated_at) VALUES (?, ?, ?, ?)",
+			email, password, now.UnixNano(), now.UnixNano())
+		if err != nil {
+			return err
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		user = User{Id: int(id), Email: email, Password: password, CreatedAt: now, UpdatedAt: now}
+
+		return recordChange(tx, change{Table: tableUsers, Key: user.Id, After: user})
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (db *SQLiteDB) GetUser(id int) (User, error) {
+	return scanUser(db.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+}
+
+func (db *SQLiteDB) GetUserByEmail(email string) (User, error) {
+	return scanUser(db.db.QueryRow("SELECT "+userColumns+" FROM users WHERE email = ? COLLATE NOCASE", email))
+}
+
+func (db *SQLiteDB) ChangeUserCredentials(id int, email, passwordHash string) (User, error) {
+	var user User
+
+	err := db.update(func(tx *sql.Tx) error {
+		before, after, err := updateUser(tx, id, email, passwordHash)
+		if err != nil {
+			return err
+		}
+		user = after
+
+		if passwordHash != before.Password {
+			_, err = revokeAllSessions(tx, id, after.UpdatedAt)
+		}
+
+		return err
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// Returns the user as it was before and after the update
+func updateUser(tx *sql.Tx, id int, email, password string) (User, User, error) {
+	before, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if err != nil {
+		return User{}, User{}, err
+	}
+
+	// Keeping the same email is fine, taking someone else's is not
+	if exists, err := emailTaken(tx, email, id); err != nil {
+		return User{}, User{}, err
+	} else if exists {
+		return User{}, User{}, ErrExists
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.Exec("UPDATE users SET email = ?, password = ?, updated_at = ? WHERE id = ?", email, password, now.UnixNano(), id); err != nil {
+		return User{}, User{}, err
+	}
+
+	user := before
+	user.Email = email
+	user.Password = password
+	user.UpdatedAt = now
+
+	return before, user, recordChange(tx, change{Table: tableUsers, Key: id, Before: before, After: user})
+}
+
+func (db *SQLiteDB) SetUserChirpyRed(userId int, isChirpyRed bool) error {
+	return db.update(func(tx *sql.Tx) error {
+		user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userId))
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if _, err := tx.Exec("UPDATE users SET is_chirpy_red = ?, updated_at = ? WHERE id = ?", isChirpyRed, now.UnixNano(), userId); err != nil {
+			return err
+		}
+
+		before := user
+		user.IsChirpyRed = isChirpyRed
+		user.UpdatedAt = now
+
+		return recordChange(tx, change{Table: tableUsers, Key: userId, Before: before, After: user})
+	})
+}
+
+func (db *SQLiteDB) Follow(followerId, followeeId int) (User, error) {
+	if followerId == followeeId {
+		return User{}, ErrFollowSelf
+	}
+
+	return db.follow(followerId, followeeId, true)
+}
+
+func (db *SQLiteDB) Unfollow(followerId, followeeId int) (User, error) {
+	return db.follow(followerId, followeeId, false)
+}
+
+// Adds or removes a follow, along with the followee's chirps in the follower's timeline
+func (db *SQLiteDB) follow(followerId, followeeId int, add bool) (User, error) {
+	var followee User
+
+	err := db.update(func(tx *sql.Tx) error {
+		follower, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", followerId))
+		if err != nil {
+			return err
+		}
+		if followee, err = scanUser(tx.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", followeeId)); err != nil {
+			return err
+		}
+
+		var res sql.Result
+		delta := 1
+		if add {
+			res, err = tx.Exec("INSERT INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?) ON CONFLICT DO NOTHING",
+				followerId, followeeId, time.Now().UTC().UnixNano())
+		} else {
+			res, err = tx.Exec("DELETE FROM follows WHERE follower_id = ? AND followee_id = ?", followerId, followeeId)
+			delta = -1
+		}
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			// Nothing changed
+			return err
+		}
+
+		if add {
+			_, err = tx.Exec("INSERT INTO timeline (user_id, created_at, chirp_id, author_id) SELECT ?, created_at, id, author_id FROM chirps WHERE author_id = ?",
+				followerId, followeeId)
+		} else {
+			_, err = tx.Exec("DELETE FROM timeline WHERE user_id = ? AND author_id = ?", followerId, followeeId)
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("UPDATE users SET following_count = following_count + ? WHERE id = ?", delta, followerId); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE users SET follower_count = follower_count + ? WHERE id = ?", delta, followeeId); err != nil {
+			return err
+		}
+
+		before := follower
+		follower.FollowingCount += delta
+		if err := recordChange(tx, change{Table: tableUsers, Key: followerId, Before: before, After: follower}); err != nil {
+			return err
+		}
+
+		before = followee
+		followee.FollowerCount += delta
+		return recordChange(tx, change{Table: tableUsers, Key: followeeId, Before: before, After: followee})
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return followee, nil
+}
+
+func (db *SQLiteDB) GetFollowers(userId int, opts ListOptions) ([]Follow, error) {
+	where, args := columnPageClause("follower_id", opts)
+	return db.queryFollows(userId, "SELECT follower_id, followee_id, created_at FROM follows WHERE followee_id = ? AND "+where, append([]any{userId}, args...))
+}
+
+func (db *SQLiteDB) GetFollowing(userId int, opts ListOptions) ([]Follow, error) {
+	where, args := columnPageClause("followee_id", opts)
+	return db.queryFollows(userId, "SELECT follower_id, followee_id, created_at FROM follows WHERE follower_id = ? AND "+where, append([]any{userId}, args...))
+}
+
+// Runs a query for follows, after checking that the user they belong to exists
+func (db *SQLiteDB) queryFollows(userId int, query string, args []any) ([]Follow, error) {
+	follows := []Follow{}
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return []Follow{}, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userId).Scan(&exists); err != nil {
+		return []Follow{}, err
+	}
+	if !exists {
+		return []Follow{}, ErrNotExist
+	}
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return []Follow{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var f Follow
+		var createdAt int64
+		if err := rows.Scan(&f.FollowerId, &f.FolloweeId, &createdAt); err != nil {
+			return []Follow{}, err
+		}
+		f.CreatedAt = time.Unix(0, createdAt).UTC()
+		follows = append(follows, f)
+	}
+
+	if err := rows.Err(); err != nil {
+		return []Follow{}, err
+	}
+
+	return follows, nil
+}
+
+func (db *SQLiteDB) GetTimeline(userId int, opts ListOptions) ([]Chirp, error) {
+	var exists bool
+	if err := db.db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", userId).Scan(&exists); err != nil {
+		return []Chirp{}, err
+	}
+	if !exists {
+		return []Chirp{}, ErrNotExist
+	}
+
+	// The page is picked from the timeline table alone, then joined with the chirps on it
+	opts.SortBy = SortByCreatedAt
+	where, args := pageClauseOn("t.created_at", "t.chirp_id", opts)
+
+	return db.queryChirps("SELECT "+joinedChirpColumns+" FROM timeline t JOIN chirps c ON c.id = t.chirp_id WHERE t.user_id = ? AND "+where,
+		append([]any{userId}, args...)...)
+}
+
+const refreshTokenColumns = "token_hash, user_id, expires_at, family_id, created_at, rotated_at, logged_in_at, last_used_at, user_agent, client_ip"
+
+func scanRefreshToken(row interface{ Scan(...any) error }) (RefreshToken, error) {
+	var t RefreshToken
+	var expiresAt, createdAt, loggedInAt, lastUsedAt int64
+	var rotatedAt sql.NullInt64
+
+	if err := row.Scan(&t.TokenHash, &t.UserId, &expiresAt, &t.FamilyId, &createdAt, &rotatedAt, &loggedInAt, &lastUsedAt, &t.UserAgent, &t.ClientIP); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return RefreshToken{}, ErrNotExist
+		}
+		return RefreshToken{}, err
+	}
+
+	t.ExpiresAt, t.CreatedAt = time.Unix(0, expiresAt).UTC(), time.Unix(0, createdAt).UTC()
+	t.LoggedInAt, t.LastUsedAt = time.Unix(0, loggedInAt).UTC(), time.Unix(0, lastUsedAt).UTC()
+	if rotatedAt.Valid {
+		rotated := time.Unix(0, rotatedAt.Int64).UTC()
+		t.RotatedAt = &rotated
+	}
+
+	return t, nil
+}
+
+func insertRefreshToken(tx *sql.Tx, t RefreshToken) error {
+	_, err := tx.Exec(`INSERT INTO refresh_tokens (token_hash, user_id, expires_at, family_id, created_at, hashed, logged_in_at, last_used_at, user_agent, client_ip)
+		VALUES (?, ?, ?, ?, ?, 1, ?, ?, ?, ?)`,
+		t.TokenHash, t.UserId, t.ExpiresAt.UnixNano(), t.FamilyId, t.CreatedAt.UnixNano(),
+		t.LoggedInAt.UnixNano(), t.LastUsedAt.UnixNano(), t.UserAgent, t.ClientIP)
+	return err
+}
+
+// The number of migrations up to the one that hashes refresh tokens
+const sqliteTokenHashVersion = 12
+
+// Hashes tokens that were stored in plain text before tokens were hashed
+func hashPlainRefreshTokens(tx *sql.Tx, env migrationEnv) error {
+	// Anyone could compute hashes made without a key
+	if len(env.tokenKey) == 0 {
+		return ErrNoTokenKey
+	}
+
+	rows, err := tx.Query("SELECT token_hash FROM refresh_tokens WHERE hashed = 0")
+	if err != nil {
+		return fmt.Errorf("could not read plain refresh tokens: %w", err)
+	}
+
+	var plain []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			rows.Close()
+			return err
+		}
+		plain = append(plain, token)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, token := range plain {
+		if _, err := tx.Exec("UPDATE refresh_tokens SET token_hash = ?, hashed = 1 WHERE token_hash = ?", hashRefreshToken(env.tokenKey, token), token); err != nil {
+			return fmt.Errorf("could not hash refresh token: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func insertTokenEvent(tx *sql.Tx, kind TokenEventKind, t RefreshToken, now time.Time) error {
+	_, err := tx.Exec("INSERT INTO token_events (kind, family_id, user_id, created_at) VALUES (?, ?, ?, ?)",
+		kind, t.FamilyId, t.UserId, now.UnixNano())
+	return err
+}
+
+func (db *SQLiteDB) AddRefreshToken(userId int, expiresAt time.Time, client Client) (RefreshToken, error) {
+	refreshToken, err := newRefreshToken(db.tokenKey, userId, "", expiresAt, client)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	err = db.update(func(tx *sql.Tx) error {
+		if err := insertRefreshToken(tx, refreshToken); err != nil {
+			return err
+		}
+
+		return insertTokenEvent(tx, TokenIssued, refreshToken, refreshToken.CreatedAt)
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	return refreshToken, nil
+}
+
+func (db *SQLiteDB) RevokeRefreshToken(tokenString string) error {
+	tokenHash := hashRefreshToken(db.tokenKey, tokenString)
+	return db.update(func(tx *sql.Tx) error {
+		refreshToken, err := scanRefreshToken(tx.QueryRow("SELECT "+refreshTokenColumns+" FROM refresh_tokens WHERE token_hash = ?", tokenHash))
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE family_id = ?", refreshToken.FamilyId); err != nil {
+			return err
+		}
+
+		return insertTokenEvent(tx, TokenRevoked, refreshToken, time.Now().UTC())
+	})
+}
+
+func (db *SQLiteDB) CheckRefreshToken(tokenString string) (userId int, err error) {
+	tokenHash := hashRefreshToken(db.tokenKey, tokenString)
+	refreshToken, err := scanRefreshToken(db.db.QueryRow("SELECT "+refreshTokenColumns+" FROM refresh_tokens WHERE token_hash = ?", tokenHash))
+	if err != nil {
+		return 0, err
+	}
+
+	if time.Now().UTC().After(refreshToken.ExpiresAt) {
+		if _, err := db.db.Exec("DELETE FROM refresh_tokens WHERE token_hash = ?", tokenHash); err != nil {
+			return 0, fmt.Errorf("error deleting expired token: %w", err)
+		}
+
+		return 0, ErrExpired
+	}
+
+	if refreshToken.RotatedAt != nil {
+		return 0, ErrTokenReused
+	}
+
+	return refreshToken.UserId, nil
+}
+
+func (db *SQLiteDB) RotateRefreshToken(tokenString string, expiresAt time.Time, client Client) (RefreshToken, error) {
+	tokenHash := hashRefreshToken(db.tokenKey, tokenString)
+	next, err := newRefreshToken(db.tokenKey, 0, "", expiresAt, client)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+
+	// Expired and reused tokens still commit their cleanup, so they are not returned as errors from the transaction
+	var rejected error
+
+	err = db.update(func(tx *sql.Tx) error {
+		refreshToken, err := scanRefreshToken(tx.QueryRow("SELECT "+refreshTokenColumns+" FROM refresh_tokens WHERE token_hash = ?", tokenHash))
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if now.After(refreshToken.ExpiresAt) {
+			rejected = ErrExpired
+			_, err := tx.Exec("DELETE FROM refresh_tokens WHERE token_hash = ?", tokenHash)
+			return err
+		}
+
+		if refreshToken.RotatedAt != nil {
+			rejected = ErrTokenReused
+			if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE family_id = ?", refreshToken.FamilyId); err != nil {
+				return err
+			}
+
+			return insertTokenEvent(tx, TokenReused, refreshToken, now)
+		}
+
+		// Exchanged tokens are only kept to notice them being reused, which stops mattering once they expire
+		if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE family_id = ? AND rotated_at IS NOT NULL AND expires_at < ?",
+			refreshToken.FamilyId, now.UnixNano()); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("UPDATE refresh_tokens SET rotated_at = ? WHERE token_hash = ?", now.UnixNano(), tokenHash); err != nil {
+			return err
+		}
+
+		next.UserId, next.FamilyId, next.CreatedAt = refreshToken.UserId, refreshToken.FamilyId, now
+		next.LoggedInAt, next.LastUsedAt = refreshToken.LoggedInAt, now
+		if err := insertRefreshToken(tx, next); err != nil {
+			return err
+		}
+
+		return insertTokenEvent(tx, TokenRotated, next, now)
+	})
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if rejected != nil {
+		return RefreshToken{}, rejected
+	}
+
+	return next, nil
+}
+
+func (db *SQLiteDB) GetTokenEvents(userId int, opts ListOptions) ([]TokenEvent, error) {
+	where, args := columnPageClause("id", opts)
+	rows, err := db.db.Query("SELECT id, kind, family_id, user_id, created_at FROM token_events WHERE user_id = ? AND "+where,
+		append([]any{userId}, args...)...)
+	if err != nil {
+		return []TokenEvent{}, err
+	}
+	defer rows.Close()
+
+	events := []TokenEvent{}
+	for rows.Next() {
+		var e TokenEvent
+		var createdAt int64
+		if err := rows.Scan(&e.Id, &e.Kind, &e.FamilyId, &e.UserId, &createdAt); err != nil {
+			return []TokenEvent{}, err
+		}
+
+		e.CreatedAt = time.Unix(0, createdAt).UTC()
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return []TokenEvent{}, err
+	}
+
+	return events, nil
+}
+
+// Latest tokens of the families of a user, which stand for their sessions
+func querySessionTokens(q interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}, userId int) ([]RefreshToken, error) {
+	rows, err := q.Query("SELECT "+refreshTokenColumns+" FROM refresh_tokens WHERE user_id = ? AND rotated_at IS NULL", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []RefreshToken{}
+	for rows.Next() {
+		t, err := scanRefreshToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+
+	return tokens, rows.Err()
+}
+
+func (db *SQLiteDB) GetSessions(userId int) ([]Session, error) {
+	tokens, err := querySessionTokens(db.db, userId)
+	if err != nil {
+		return []Session{}, err
+	}
+
+	sessions := []Session{}
+	now := time.Now().UTC()
+	for _, t := range tokens {
+		if now.Before(t.ExpiresAt) {
+			sessions = append(sessions, sessionOf(t))
+		}
+	}
+
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+func (db *SQLiteDB) RevokeSession(userId int, sessionId string) error {
+	return db.update(func(tx *sql.Tx) error {
+		refreshToken, err := scanRefreshToken(tx.QueryRow("SELECT "+refreshTokenColumns+" FROM refresh_tokens WHERE user_id = ? AND family_id = ? AND rotated_at IS NULL",
+			userId, sessionId))
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE family_id = ?", sessionId); err != nil {
+			return err
+		}
+
+		return insertTokenEvent(tx, TokenRevoked, refreshToken, time.Now().UTC())
+	})
+}
+
+func (db *SQLiteDB) RevokeAllSessions(userId int) (int, error) {
+	revoked := 0
+
+	err := db.update(func(tx *sql.Tx) error {
+		var err error
+		revoked, err = revokeAllSessions(tx, userId, time.Now().UTC())
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return revoked, nil
+}
+
+// Deletes every refresh token of a user, returning how many sessions had not expired yet
+// Expired sessions are deleted too, but not counted or logged since GetSessions doesn't show them either
+func revokeAllSessions(tx *sql.Tx, userId int, now time.Time) (int, error) {
+	tokens, err := querySessionTokens(tx, userId)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE user_id = ?", userId); err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, t := range tokens {
+		if !now.Before(t.ExpiresAt) {
+			continue
+		}
+
+		if err := insertTokenEvent(tx, TokenRevoked, t, now); err != nil {
+			return 0, err
+		}
+		revoked++
+	}
+
+	return revoked, nil
+}
+
+func (db *SQLiteDB) SearchChirps(query string, limit int) ([]SearchResult, error) {
+	ids, matches, err := searchIds(query, sqliteSearchSource{db.db}, limit)
+	if err != nil {
+		return []SearchResult{}, err
+	}
+
+	results := []SearchResult{}
+	for _, id := range ids {
+		chirp, err := db.GetChirp(id)
+		if errors.Is(err, ErrNotExist) {
+			// Deleted since the index was read
+			continue
+		} else if err != nil {
+			return []SearchResult{}, err
+		}
+
+		results = append(results, newSearchResult(chirp, matches[id]))
+	}
+
+	return results, nil
+}
+
+// Adds the words of a chirp to the search index
+func indexChirpText(tx *sql.Tx, id int, text string) error {
+	for term, positions := range termPositions(text) {
+		encoded, err := json.Marshal(positions)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("INSERT INTO chirp_terms (term, chirp_id, positions) VALUES (?, ?, ?)", term, id, string(encoded)); err != nil {
+			return fmt.Errorf("could not index chirp: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Fills in the hashtags and mentions of a chirp from its body, and stores and counts them
+func tagChirp(tx *sql.Tx, c *Chirp) error {
+	if err := countHashtags(tx, c.Id, -1); err != nil {
+		return err
+	}
+	if err := storeChirpTags(tx, c); err != nil {
+		return err
+	}
+
+	return countHashtags(tx, c.Id, 1)
+}
+
+// Like tagChirp without counting the hashtags, since migrations tag chirps before hashtag_counts exists
+func storeChirpTags(tx *sql.Tx, c *Chirp) error {
+	var lookupErr error
+	c.Hashtags = extractHashtags(c.Body)
+	c.Mentions = extractMentions(c.Body, func(id int) bool {
+		var found int
+		err := tx.QueryRow("SELECT 1 FROM users WHERE id = ?", id).Scan(&found)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			lookupErr = err
+		}
+		return err == nil
+	})
+	if lookupErr != nil {
+		return lookupErr
+	}
+
+	hashtags, err := json.Marshal(c.Hashtags)
+	if err != nil {
+		return err
+	}
+	mentions, err := json.Marshal(c.Mentions)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE chirps SET hashtags = ?, mentions = ? WHERE id = ?", string(hashtags), string(mentions), c.Id); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM chirp_hashtags WHERE chirp_id = ?", c.Id); err != nil {
+		return err
+	}
+	for _, tag := range c.Hashtags {
+		if _, err := tx.Exec("INSERT INTO chirp_hashtags (tag, chirp_id, created_at) VALUES (?, ?, ?)", tag, c.Id, c.CreatedAt.UnixNano()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Adds delta to the uses of the hashtags of a chirp in hashtag_counts, going by its rows in chirp_hashtags
+func countHashtags(tx *sql.Tx, chirpId int, delta int) error {
+	_, err := tx.Exec(`INSERT INTO hashtag_counts (bucket, tag, count)
+		SELECT created_at / ?, tag, ? FROM chirp_hashtags WHERE chirp_id = ?
+		ON CONFLICT (bucket, tag) DO UPDATE SET count = count + excluded.count`, int64(trendingBucket), delta, chirpId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM hashtag_counts WHERE count <= 0
+		AND (bucket, tag) IN (SELECT created_at / ?, tag FROM chirp_hashtags WHERE chirp_id = ?)`, int64(trendingBucket), chirpId)
+	return err
+}
+
+// Counts the hashtags that were used before their uses were counted
+func backfillHashtagCounts(tx *sql.Tx, _ migrationEnv) error {
+	_, err := tx.Exec(`INSERT INTO hashtag_counts (bucket, tag, count)
+		SELECT created_at / ?, tag, COUNT(*) FROM chirp_hashtags GROUP BY 1, 2`, int64(trendingBucket))
+	return err
+}
+
+// Tags the chirps that were posted before hashtags and mentions were extracted
+func backfillChirpTags(tx *sql.Tx, _ migrationEnv) error {
+	rows, err := tx.Query("SELECT id, body, created_at FROM chirps")
+	if err != nil {
+		return err
+	}
+
+	var chirps []Chirp
+	for rows.Next() {
+		var c Chirp
+		var createdAt int64
+		if err := rows.Scan(&c.Id, &c.Body, &createdAt); err != nil {
+			rows.Close()
+			return err
+		}
+		c.CreatedAt = time.Unix(0, createdAt).UTC()
+		chirps = append(chirps, c)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range chirps {
+		if err := storeChirpTags(tx, &c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) GetChirpsByHashtag(tag string, opts ListOptions) ([]Chirp, error) {
+	where, args := columnPageClause("h.chirp_id", opts)
+	return db.queryChirps("SELECT "+joinedChirpColumns+" FROM chirp_hashtags h JOIN chirps c ON c.id = h.chirp_id WHERE h.tag = ? AND "+where,
+		append([]any{tag}, args...)...)
+}
+
+func (db *SQLiteDB) TrendingHashtags(opts TrendingOptions) ([]TrendingTag, error) {
+	rows, err := db.db.Query("SELECT bucket, tag, count FROM hashtag_counts WHERE bucket >= ?", trendingBucketOf(opts.Now.Add(-opts.Window)))
+	if err != nil {
+		return []TrendingTag{}, err
+	}
+	defer rows.Close()
+
+	var uses []hashtagUse
+	for rows.Next() {
+		var u hashtagUse
+		var bucket int
+		if err := rows.Scan(&bucket, &u.tag, &u.count); err != nil {
+			return []TrendingTag{}, err
+		}
+		u.createdAt = trendingBucketStart(bucket)
+		uses = append(uses, u)
+	}
+
+	if err := rows.Err(); err != nil {
+		return []TrendingTag{}, err
+	}
+
+	return rankTrending(uses, opts), nil
+}
+
+// Gives existing chirps and users the time of the migration, since when they were really created is not known
+func backfillTimestamps(tx *sql.Tx, _ migrationEnv) error {
+	now := time.Now().UTC().UnixNano()
+
+	for _, table := range []string{"chirps", "users"} {
+		if _, err := tx.Exec("UPDATE "+table+" SET created_at = ?, updated_at = ? WHERE created_at = 0", now, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Puts every existing refresh token in a family of its own
+// When they were really created is not known, so they get the time of the migration
+func backfillTokenFamilies(tx *sql.Tx, _ migrationEnv) error {
+	_, err := tx.Exec("UPDATE refresh_tokens SET family_id = lower(hex(randomblob(16))), created_at = ?", time.Now().UTC().UnixNano())
+	return err
+}
+
+// Indexes the chirps that existed before there was a search index
+func backfillChirpTerms(tx *sql.Tx, _ migrationEnv) error {
+	rows, err := tx.Query("SELECT id, body FROM chirps")
+	if err != nil {
+		return err
+	}
+
+	var chirps []Chirp
+	for rows.Next() {
+		var c Chirp
+		if err := rows.Scan(&c.Id, &c.Body); err != nil {
+			rows.Close()
+			return err
+		}
+		chirps = append(chirps, c)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, c := range chirps {
+		if err := indexChirpText(tx, c.Id, c.Body); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Serves searches from the chirp_terms table
+type sqliteSearchSource struct {
+	db *sql.DB
+}
+
+func (src sqliteSearchSource) postings(term string) (map[int][]int, error) {
+	rows, err := src.db.Query("SELECT chirp_id, positions FROM chirp_terms WHERE term = ?", term)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	postings := map[int][]int{}
+	for rows.Next() {
+		var id int
+		var encoded string
+		if err := rows.Scan(&id, &encoded); err != nil {
+			return nil, err
+		}
+
+		var positions []int
+		if err := json.Unmarshal([]byte(encoded), &positions); err != nil {
+			return nil, fmt.Errorf("could not decode positions of %q in chirp %d: %w", term, id, err)
+		}
+		postings[id] = positions
+	}
+
+	return postings, rows.Err()
+}
+
+func (src sqliteSearchSource) termsWithPrefix(prefix string, limit int) ([]string, error) {
+	// Terms are valid UTF-8, which never contains 0xff, so this is the end of the range of terms starting with prefix
+	rows, err := src.db.Query("SELECT DISTINCT term FROM chirp_terms WHERE term >= ? AND term < ? ORDER BY term LIMIT ?", prefix, prefix+"\xff", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var terms []string
+	for rows.Next() {
+		var term string
+		if err := rows.Scan(&term); err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+	}
+
+	return terms, rows.Err()
+}
+
+func (src sqliteSearchSource) chirpCount() (int, error) {
+	var n int
+	err := src.db.QueryRow("SELECT COUNT(*) FROM chirps").Scan(&n)
+	return n, err
+}
+
+func (db *SQLiteDB) Changes(since uint64, limit int) ([]ChangeEvent, error) {
+	// A negative limit means no limit
+	if limit <= 0 {
+		limit = -1
+	}
+
+	rows, err := db.db.Query("SELECT seq, time, op, entity, entity_id, before, after FROM changes WHERE seq > ? ORDER BY seq LIMIT ?", since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []ChangeEvent{}
+	for rows.Next() {
+		var e ChangeEvent
+		var t int64
+		var before, after sql.NullString
+
+		if err := rows.Scan(&e.Seq, &t, &e.Op, &e.Entity, &e.Id, &before, &after); err != nil {
+			return nil, err
+		}
+
+		e.Time = time.Unix(0, t).UTC()
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func (db *SQLiteDB) Subscribe(ctx context.Context, since uint64) <-chan ChangeEvent {
+	return subscribe(ctx, since, &db.changes, db.Changes)
+}
+
+func (db *SQLiteDB) queryChirps(query string, args ...any) ([]Chirp, error) {
+	rows, err := db.db.Query(query, args...)
+	if err != nil {
+		return []Chirp{}, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		c, err := scanChirp(rows)
+		if err != nil {
+			return []Chirp{}, err
+		}
+		chirps = append(chirps, c)
+	}
+
+	return chirps, rows.Err()
+}
+
+// Returns a file: URI for the database at path with the given query
+// SQLite reads percent escapes in the path, and would take a ? in it as the start of the query
+func sqliteURI(path string, query string) string {
+	return "file:" + (&url.URL{Path: path}).EscapedPath() + "?" + query
+}
+
+// Makes the emails of users unique ignoring case
+// Users whose emails only differ in case are not merged, since they can't be told apart safely,
+// so they are reported and have to be fixed by hand before the migration can go through
+func uniqueEmailsIgnoringCase(tx *sql.Tx, _ migrationEnv) error {
+	rows, err := tx.Query(`SELECT group_concat(email, ', ') FROM users
+		GROUP BY email COLLATE NOCASE HAVING count(*) > 1 ORDER BY min(id)`)
+	if err != nil {
+		return err
+	}
+
+	var duplicates []string
+	for rows.Next() {
+		var emails string
+		if err := rows.Scan(&emails); err != nil {
+			rows.Close()
+			return err
+		}
+		duplicates = append(duplicates, "("+emails+")")
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		return fmt.Errorf("some users have emails that only differ in case, change all but one of each: %s", strings.Join(duplicates, ", "))
+	}
+
+	_, err = tx.Exec("CREATE UNIQUE INDEX users_email_nocase ON users(email COLLATE NOCASE)")
+	return err
+}
+
+// Reports whether a user other than exceptId already uses email
+func emailTaken(tx *sql.Tx, email string, exceptId int) (bool, error) {
+	var exists bool
+	err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email = ? COLLATE NOCASE AND id != ?)", email, exceptId).Scan(&exists)
+	return exists, err
+}
+
+// Either *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// Scans a row of chirpColumns
+func scanChirp(row rowScanner) (Chirp, error) {
+	var c Chirp
+	var createdAt, updatedAt int64
+	var hashtags, mentions string
+
+	err := row.Scan(&c.Id, &c.Body, &c.AuthorId, &createdAt, &updatedAt, &c.Edited, &c.ReplyTo, &c.RootId, &c.ReplyCount,
+		&c.LikeCount, &c.RechirpCount, &hashtags, &mentions)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrNotExist
+	} else if err != nil {
+		return Chirp{}, err
+	}
+
+	if err := json.Unmarshal([]byte(hashtags), &c.Hashtags); err != nil {
+		return Chirp{}, fmt.Errorf("could not decode hashtags of chirp %d: %w", c.Id, err)
+	}
+	if err := json.Unmarshal([]byte(mentions), &c.Mentions); err != nil {
+		return Chirp{}, fmt.Errorf("could not decode mentions of chirp %d: %w", c.Id, err)
+	}
+
+	c.CreatedAt = time.Unix(0, createdAt).UTC()
+	c.UpdatedAt = time.Unix(0, updatedAt).UTC()
+
+	return c, nil
+}
+
+// Scans a row of userColumns
+func scanUser(row rowScanner) (User, error) {
+	var u User
+	var createdAt, updatedAt int64
+
+	err := row.Scan(&u.Id, &u.Email, &u.Password, &u.IsChirpyRed, &createdAt, &updatedAt, &u.FollowerCount, &u.FollowingCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotExist
+	} else if err != nil {
+		return User{}, err
+	}
+
+	u.CreatedAt = time.Unix(0, createdAt).UTC()
+	u.UpdatedAt = time.Unix(0, updatedAt).UTC()
+
+	return u, nil
+}
+
+// Converts a time to Unix nanoseconds, clamped to the range that fits in an int64
+// so that far away bounds in queries still compare correctly
+func unixNanoClamped(t time.Time) int64 {
+	if t.Before(time.Unix(0, math.MinInt64)) {
+		return math.MinInt64
+	}
+	if t.After(time.Unix(0, math.MaxInt64)) {
+		return math.MaxInt64
+	}
+
+	return t.UnixNano()
+}
+
+// Returns ErrNotExist if a statement did not touch any rows
+func errIfNoRows(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrNotExist
+	}
+
+	return nil
+}
+
+// Writes a consistent copy of the database to path
+func (db *SQLiteDB) SnapshotTo(path string) error {
+	// VACUUM INTO refuses to overwrite files, so write next to the target and rename it into place
+	tmp := path + tempSuffix + "vacuum"
+	os.Remove(tmp)
+
+	if _, err := db.db.Exec("VACUUM INTO ?", tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// Replaces the contents of every table with the ones in a snapshot, in a single transaction
+func (db *SQLiteDB) RestoreFrom(path string) error {
+	ctx := context.Background()
+
+	// ATTACH only applies to one connection, so everything has to happen on the same one
+	conn, err := db.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "ATTACH DATABASE ? AS snapshot", sqliteURI(path, "mode=ro")); err != nil {
+		return fmt.Errorf("could not open snapshot: %w", err)
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE snapshot")
+
+	var version int
+	if err := conn.QueryRowContext(ctx, "PRAGMA snapshot.user_version").Scan(&version); err != nil {
+		return fmt.Errorf("could not read snapshot schema version: %w", err)
+	}
+	if version != len(sqliteMigrations) {
+		return fmt.Errorf("snapshot schema version %d does not match database schema version %d", version, len(sqliteMigrations))
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := loadFeedTables(tx)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT name FROM main.sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	if err != nil {
+		return err
+	}
+
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		if !slices.Contains(sqliteUnrestoredTables, name) {
+			tables = append(tables, name)
+		}
+	}
+	rows.Close()
+
+	for _, table := range tables {
+		if _, err := tx.Exec(fmt.Sprintf(`DELETE FROM main."%s"`, table)); err != nil {
+			return fmt.Errorf("could not clear %s: %w", table, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`INSERT INTO main."%s" SELECT * FROM snapshot."%s"`, table, table)); err != nil {
+			return fmt.Errorf("could not restore %s: %w", table, err)
+		}
+
+		// sqlite_sequence holds the AUTOINCREMENT counters
+		if _, err := tx.Exec("DELETE FROM main.sqlite_sequence WHERE name = ?", table); err != nil {
+			return fmt.Errorf("could not clear the counter of %s: %w", table, err)
+		}
+		if _, err := tx.Exec("INSERT INTO main.sqlite_sequence SELECT * FROM snapshot.sqlite_sequence WHERE name = ?", table); err != nil {
+			return fmt.Errorf("could not restore the counter of %s: %w", table, err)
+		}
+	}
+
+	after, err := loadFeedTables(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range diffFeedTables(&before, &after) {
+		if err := recordChange(tx, c); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	db.changes.notify()
+
+	return nil
+}
+
+// Reads the tables that are part of the change feed into a structure, so they can be diffed
+func loadFeedTables(tx *sql.Tx) (DBStructure, error) {
+	s := newDBStructure()
+
+	rows, err := tx.Query("SELECT " + chirpColumns + " FROM main.chirps")
+	if err != nil {
+		return DBStructure{}, err
+	}
+	for rows.Next() {
+		c, err := scanChirp(rows)
+		if err != nil {
+			rows.Close()
+			return DBStructure{}, err
+		}
+		s.Chirps.Items[c.Id] = c
+	}
+	rows.Close()
+
+	rows, err = tx.Query("SELECT " + userColumns + " FROM main.users")
+	if err != nil {
+		return DBStructure{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return DBStructure{}, err
+		}
+		s.Users.Items[u.Id] = u
+	}
+
+	return s, rows.Err()
+}
@@ -0,0 +1,210 @@
+package chirpydb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Creates a SQLite database with only the first version migrations applied,
+// and runs the statements in setup on it
+func newOldSQLiteDB(t *testing.T, version int, setup string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "database.sqlite")
+
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("could not open database: %v", err)
+	}
+	defer raw.Close()
+
+	for _, m := range sqliteMigrations[:version] {
+		if _, err := raw.Exec(m.sql); err != nil {
+			t.Fatalf("could not apply migration: %v", err)
+		}
+	}
+
+	if _, err := raw.Exec(fmt.Sprintf("PRAGMA user_version = %d; %s", version, setup)); err != nil {
+		t.Fatalf("could not set up database: %v", err)
+	}
+
+	return path
+}
+
+func TestSQLiteSearchBackfill(t *testing.T) {
+	// From before the search index existed
+	path := newOldSQLiteDB(t, 3, `INSERT INTO chirps (body, author_id) VALUES ('written before search existed', 1)`)
+
+	db, err := NewSQLiteDB(path, false)
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	results, err := db.SearchChirps(`"before search"`, 10)
+	if err != nil {
+		t.Errorf("could not search: %v", err)
+		return
+	}
+	if len(results) != 1 || results[0].Id != 1 {
+		t.Errorf("expected the existing chirp to be indexed, got %v", results)
+	}
+}
+
+func TestSQLiteTimestampBackfill(t *testing.T) {
+	path := newOldSQLiteDB(t, 4, `INSERT INTO chirps (body, author_id) VALUES ('old', 1);
+		INSERT INTO users (email, password) VALUES ('old@example.com', 'hash')`)
+
+	db, err := NewSQLiteDB(path, false)
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	chirp, err := db.GetChirp(1)
+	if err != nil {
+		t.Errorf("could not get chirp: %v", err)
+		return
+	}
+	user, err := db.GetUserByEmail("old@example.com")
+	if err != nil {
+		t.Errorf("could not get user: %v", err)
+		return
+	}
+
+	if chirp.CreatedAt.Unix() == 0 || !chirp.UpdatedAt.Equal(chirp.CreatedAt) || !user.CreatedAt.Equal(chirp.CreatedAt) {
+		t.Errorf("expected existing records to get the time of the migration, got %v and %v", chirp, user)
+	}
+}
+
+func TestSQLiteTagBackfill(t *testing.T) {
+	path := newOldSQLiteDB(t, 9, `INSERT INTO users (email, password) VALUES ('friend@example.com', 'hash');
+		INSERT INTO chirps (body, author_id, created_at) VALUES ('hi @1 #Old #old', 1, 1)`)
+
+	db, err := NewSQLiteDB(path, false)
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	chirp, err := db.GetChirp(1)
+	if err != nil {
+		t.Errorf("could not get chirp: %v", err)
+		return
+	}
+	if !slices.Equal(chirp.Hashtags, []string{"old"}) || !slices.Equal(chirp.Mentions, []int{1}) {
+		t.Errorf("expected the existing chirp to be tagged, got %v", chirp)
+		return
+	}
+
+	chirps, err := db.GetChirpsByHashtag("old", ListOptions{})
+	if err != nil || len(chirps) != 1 {
+		t.Errorf("expected the existing chirp to be indexed by hashtag, got %v (%v)", chirps, err)
+		return
+	}
+
+	trending, err := db.TrendingHashtags(TrendingOptions{Now: chirp.CreatedAt, Window: time.Hour})
+	if err != nil || len(trending) != 1 || trending[0].Tag != "old" || trending[0].Count != 1 {
+		t.Errorf("expected the existing chirp to be counted by the trending hashtags, got %v (%v)", trending, err)
+	}
+}
+
+func TestSQLiteHashPlainRefreshTokens(t *testing.T) {
+	path := newOldSQLiteDB(t, 11, `INSERT INTO refresh_tokens (token, user_id, expires_at, family_id) VALUES ('plain-token', 1, 9000000000000000000, 'family')`)
+
+	db, err := NewSQLiteDBWithOptions(path, Options{TokenKey: []byte("key")})
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	var plain int
+	if err := db.db.QueryRow("SELECT count(*) FROM refresh_tokens WHERE token_hash = 'plain-token' OR hashed = 0").Scan(&plain); err != nil || plain != 0 {
+		t.Errorf("expected the plain token to be hashed, got %d plain tokens (%v)", plain, err)
+		return
+	}
+
+	if userId, err := db.CheckRefreshToken("plain-token"); err != nil || userId != 1 {
+		t.Errorf("expected the existing token to keep working, got user %d (%v)", userId, err)
+		return
+	}
+
+	// Nor is it left in free pages or the WAL
+	for _, p := range []string{path, path + "-wal"} {
+		raw, err := os.ReadFile(p)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("could not read %s: %v", p, err)
+			return
+		}
+		if strings.Contains(string(raw), "plain-token") {
+			t.Errorf("expected the plain token to be gone from %s", p)
+			return
+		}
+	}
+}
+
+func TestSQLiteUniqueEmailsIgnoringCase(t *testing.T) {
+	version := len(sqliteMigrations) - 1
+	path := newOldSQLiteDB(t, version, `INSERT INTO users (email, password) VALUES ('a@example.com', 'hash'), ('A@Example.com', 'hash'), ('b@example.com', 'hash')`)
+
+	// Users that only differ in the case of their email can't both keep it
+	if _, err := NewSQLiteDB(path, false); err == nil || !strings.Contains(err.Error(), "(a@example.com, A@Example.com)") {
+		t.Errorf("expected the duplicate emails to be reported, got %v", err)
+		return
+	}
+
+	raw, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+	_, err = raw.Exec("UPDATE users SET email = 'other@example.com' WHERE id = 2")
+	raw.Close()
+	if err != nil {
+		t.Errorf("could not change email: %v", err)
+		return
+	}
+
+	db, err := NewSQLiteDB(path, false)
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if _, err := db.db.Exec("INSERT INTO users (email, password) VALUES ('B@EXAMPLE.COM', 'hash')"); err == nil {
+		t.Errorf("expected the index to reject an email that only differs in case")
+	}
+}
+
+func TestSQLiteEscapesPath(t *testing.T) {
+	// Neither the ? nor the %2F may be taken apart by SQLite
+	path := filepath.Join(t.TempDir(), "odd?name%2F#1.sqlite")
+
+	db, err := NewSQLiteDB(path, false)
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if _, err := db.CreateUser("user@example.com", "hash"); err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected the database at its exact path: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package chirpydb
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Store is the set of operations the API needs from a storage backend
+// Every backend must pass the conformance tests in store_test.go
+type Store interface {
+	CreateChirp(body string, authorId int) (Chirp, error)
+	// Fails with ErrParentNotExist if there is no chirp parentId
+	CreateReply(body string, authorId int, parentId int) (Chirp, error)
+	// Fails with ErrNotExist if the thread has no chirps left
+	GetThread(rootId int) ([]Chirp, error)
+	GetChirps() ([]Chirp, error)
+	GetChirp(id int) (Chirp, error)
+	DeleteChirp(id int) error
+	// Keeps the previous body as a revision, and marks the chirp as edited
+	// check, if not nil, is given the chirp inside the transaction, and an error from it cancels the edit
+	UpdateChirp(id int, body string, check func(Chirp) error) (Chirp, error)
+	// Returns the earlier versions of a chirp, oldest first
+	GetChirpRevisions(id int) ([]ChirpRevision, error)
+
+	// Reactions are idempotent, and return the chirp with its updated counts
+	AddReaction(kind ReactionKind, chirpId, userId int) (Chirp, error)
+	RemoveReaction(kind ReactionKind, chirpId, userId int) (Chirp, error)
+	// ListOptions.After refers to user IDs
+	GetReactions(kind ReactionKind, chirpId int, opts ListOptions) ([]Reaction, error)
+	// ListOptions.After refers to chirp IDs
+	GetUserReactions(kind ReactionKind, userId int, opts ListOptions) ([]Reaction, error)
+	ReactedTo(kind ReactionKind, userId int, chirpIds []int) (map[int]bool, error)
+
+	// Following is idempotent, and returns the followed user with the updated counts
+	Follow(followerId, followeeId int) (User, error)
+	Unfollow(followerId, followeeId int) (User, error)
+	// ListOptions.After refers to the IDs of the other users
+	GetFollowers(userId int, opts ListOptions) ([]Follow, error)
+	GetFollowing(userId int, opts ListOptions) ([]Follow, error)
+	// Chirps of followed users, ListOptions is used as with SortByCreatedAt
+	GetTimeline(userId int, opts ListOptions) ([]Chirp, error)
+
+	// Tags must be normalized with NormalizeHashtag
+	GetChirpsByHashtag(tag string, opts ListOptions) ([]Chirp, error)
+	TrendingHashtags(opts TrendingOptions) ([]TrendingTag, error)
+	// ListOptions.After refers to chirp IDs, also when sorting by creation time
+	ListChirps(opts ListOptions) ([]Chirp, error)
+	GetChirpsByAuthor(authorId int, opts ListOptions) ([]Chirp, error)
+	// Returns at most limit chirps matching query, best matches first
+	// Malformed queries fail with ErrBadQuery
+	SearchChirps(query string, limit int) ([]SearchResult, error)
+
+	CreateUser(email string, password string) (User, error)
+	GetUser(id int) (User, error)
+	// Emails are compared ignoring case
+	GetUserByEmail(email string) (User, error)
+	// Sets a user's email and password hash, and a hash other than the stored one also revokes every session of the user
+	// in the same transaction, so there is no way to change the password and keep the sessions
+	// Callers keeping the password pass the stored hash instead of hashing the password again
+	ChangeUserCredentials(id int, email, passwordHash string) (User, error)
+	SetUserChirpyRed(userId int, isChirpyRed bool) error
+
+	// Starts a new family of refresh tokens
+	AddRefreshToken(userId int, expiresAt time.Time, client Client) (RefreshToken, error)
+	// Revokes the whole family of the token
+	RevokeRefreshToken(tokenString string) error
+	// Tokens that were already rotated fail with ErrTokenReused, but their family is left alone
+	CheckRefreshToken(tokenString string) (userId int, err error)
+	// Exchanges a token for a new one, revoking its family if it was already exchanged before
+	RotateRefreshToken(tokenString string, expiresAt time.Time, client Client) (RefreshToken, error)
+	// Audit log of a user's refresh tokens, ListOptions.After refers to event IDs
+	GetTokenEvents(userId int, opts ListOptions) ([]TokenEvent, error)
+
+	// Sessions that have not expired, most recently used first
+	GetSessions(userId int) ([]Session, error)
+	// Fails with ErrNotExist if the session does not belong to the user
+	RevokeSession(userId int, sessionId string) error
+	// Returns how many sessions were revoked, leaving out expired ones like GetSessions does
+	RevokeAllSessions(userId int) (int, error)
+
+	// Returns up to limit changes after sequence number since, oldest first
+	// A limit of zero or less means no limit
+	Changes(since uint64, limit int) ([]ChangeEvent, error)
+	// Streams the changes after since, and then new changes as they are committed,
+	// until ctx is done or the store is closed
+	Subscribe(ctx context.Context, since uint64) <-chan ChangeEvent
+
+	// Releases any resources held by the store
+	Close() error
+}
+
+// Options for listing entities
+type ListOptions struct {
+	// Sort in descending order instead of ascending
+	Desc bool
+
+	// Maximum number of entities to return, zero means no limit
+	Limit int
+
+	// Only return entities that come after this ID in the sort order, zero means start from the beginning
+	// Pages that continue from the last ID of the previous one are not affected by inserts and deletes
+	After int
+
+	// What to sort by, one of the SortBy constants
+	SortBy string
+
+	// Creation time of the entity After refers to, only used when sorting by creation time
+	AfterTime time.Time
+
+	// Only return entities created at or after Since and before Until, zero means no bound
+	Since time.Time
+	Until time.Time
+}
+
+// Orders entities can be listed in
+// Entities created at the same time are sorted by ID
+const (
+	SortById        = ""
+	SortByCreatedAt = "created_at"
+)
+
+// Names of the available storage backends
+const (
+	BackendJSON   = "json"
+	BackendSQLite = "sqlite"
+)
+
+// Opens a store using the given backend
+// Options that don't apply to the backend are ignored
+func Open(backend string, path string, opts Options) (Store, error) {
+	switch backend {
+	case BackendJSON:
+		return NewDBWithOptions(path, opts)
+	case BackendSQLite:
+		if opts.Keys != nil {
+			return nil, fmt.Errorf("the %s backend does not support encryption at rest", BackendSQLite)
+		}
+
+		return NewSQLiteDBWithOptions(path, opts)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
@@ -0,0 +1,1769 @@
+package chirpydb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Every backend is run through the same conformance suite
+var storeBackends = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{
+		name: BackendJSON,
+		open: func(t *testing.T) Store {
+			return newTestDB(t)
+		},
+	},
+	{
+		name: BackendJSON + "-writebehind",
+		open: func(t *testing.T) Store {
+			db, err := NewDBWithOptions(filepath.Join(t.TempDir(), "database.json"), Options{FlushInterval: time.Millisecond})
+			if err != nil {
+				t.Fatalf("could not create database: %v", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return db
+		},
+	},
+	{
+		name: BackendJSON + "-journal",
+		open: func(t *testing.T) Store {
+			db, err := NewDBWithOptions(filepath.Join(t.TempDir(), "database.json"), Options{Journal: true, CompactInterval: time.Millisecond})
+			if err != nil {
+				t.Fatalf("could not create database: %v", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return db
+		},
+	},
+	{
+		name: BackendJSON + "-encrypted",
+		open: func(t *testing.T) Store {
+			db, err := NewDBWithOptions(filepath.Join(t.TempDir(), "database.json"), Options{Keys: newTestKeyring(t, "k1")})
+			if err != nil {
+				t.Fatalf("could not create database: %v", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return db
+		},
+	},
+	{
+		name: BackendSQLite,
+		open: func(t *testing.T) Store {
+			db, err := NewSQLiteDB(filepath.Join(t.TempDir(), "database.sqlite"), false)
+			if err != nil {
+				t.Fatalf("could not create database: %v", err)
+			}
+			t.Cleanup(func() { db.Close() })
+			return db
+		},
+	},
+}
+
+var storeConformanceTests = []struct {
+	name string
+	run  func(t *testing.T, s Store)
+}{
+	{"Chirps", testStoreChirps},
+	{"ChirpIdsNotReused", testStoreChirpIdsNotReused},
+	{"Users", testStoreUsers},
+	{"UpdateUser", testStoreUpdateUser},
+	{"ChangeUserCredentials", testStoreChangeUserCredentials},
+	{"ChirpyRed", testStoreChirpyRed},
+	{"RefreshTokens", testStoreRefreshTokens},
+	{"RefreshTokenRotation", testStoreRefreshTokenRotation},
+	{"Sessions", testStoreSessions},
+	{"ChirpsByAuthor", testStoreChirpsByAuthor},
+	{"ListChirpsPages", testStoreListChirpsPages},
+	{"Timestamps", testStoreTimestamps},
+	{"UpdateChirp", testStoreUpdateChirp},
+	{"Threads", testStoreThreads},
+	{"ListChirpsByTime", testStoreListChirpsByTime},
+	{"EmailIgnoresCase", testStoreEmailIgnoresCase},
+	{"ConcurrentCreates", testStoreConcurrentCreates},
+	{"Changes", testStoreChanges},
+	{"Subscribe", testStoreSubscribe},
+	{"Search", testStoreSearch},
+	{"Reactions", testStoreReactions},
+	{"Follows", testStoreFollows},
+	{"Timeline", testStoreTimeline},
+	{"Hashtags", testStoreHashtags},
+}
+
+// Write-behind stores only publish changes once they are on disk
+func flushStore(t *testing.T, s Store) {
+	t.Helper()
+
+	if f, ok := s.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			t.Fatalf("could not flush store: %v", err)
+		}
+	}
+}
+
+func TestStoreConformance(t *testing.T) {
+	for _, b := range storeBackends {
+		t.Run(b.name, func(t *testing.T) {
+			for _, c := range storeConformanceTests {
+				t.Run(c.name, func(t *testing.T) {
+					c.run(t, b.open(t))
+				})
+			}
+		})
+	}
+}
+
+func testStoreChirps(t *testing.T, s Store) {
+	first, err := s.CreateChirp("hello", 1)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	second, err := s.CreateChirp("world", 2)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	if first.Id != 1 || second.Id != 2 {
+		t.Errorf("expected chirp IDs 1 and 2, got %d and %d", first.Id, second.Id)
+		return
+	}
+
+	got, err := s.GetChirp(second.Id)
+	if err != nil {
+		t.Errorf("could not get chirp: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(got, second) {
+		t.Errorf("expected %v, got %v", second, got)
+		return
+	}
+
+	chirps, err := s.GetChirps()
+	if err != nil {
+		t.Errorf("could not get chirps: %v", err)
+		return
+	}
+	slices.SortFunc(chirps, func(a, b Chirp) int { return a.Id - b.Id })
+	if !reflect.DeepEqual(chirps, []Chirp{first, second}) {
+		t.Errorf("expected %v, got %v", []Chirp{first, second}, chirps)
+		return
+	}
+
+	if err := s.DeleteChirp(first.Id); err != nil {
+		t.Errorf("could not delete chirp: %v", err)
+		return
+	}
+	if _, err := s.GetChirp(first.Id); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for deleted chirp, got %v", err)
+		return
+	}
+	if err := s.DeleteChirp(first.Id); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist when deleting twice, got %v", err)
+	}
+}
+
+func testStoreChirpIdsNotReused(t *testing.T, s Store) {
+	chirp, err := s.CreateChirp("hello", 1)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	if err := s.DeleteChirp(chirp.Id); err != nil {
+		t.Errorf("could not delete chirp: %v", err)
+		return
+	}
+
+	next, err := s.CreateChirp("hello again", 1)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	if next.Id == chirp.Id {
+		t.Errorf("expected a new ID after deletion, got %d again", next.Id)
+	}
+}
+
+func testStoreUsers(t *testing.T, s Store) {
+	user, err := s.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+	if user.Id != 1 || user.IsChirpyRed {
+		t.Errorf("unexpected new user %v", user)
+		return
+	}
+
+	if _, err := s.CreateUser("user@example.com", "other"); !errors.Is(err, ErrExists) {
+		t.Errorf("expected ErrExists for duplicate email, got %v", err)
+		return
+	}
+
+	got, err := s.GetUserByEmail("user@example.com")
+	if err != nil {
+		t.Errorf("could not get user: %v", err)
+		return
+	}
+	if got != user {
+		t.Errorf("expected %v, got %v", user, got)
+		return
+	}
+
+	if got, err = s.GetUser(user.Id); err != nil || got != user {
+		t.Errorf("expected %v by ID, got %v (%v)", user, got, err)
+		return
+	}
+
+	if _, err := s.GetUserByEmail("nobody@example.com"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+		return
+	}
+	if _, err := s.GetUser(100); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for missing user ID, got %v", err)
+	}
+}
+
+func testStoreUpdateUser(t *testing.T, s Store) {
+	user, err := s.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+	if _, err := s.CreateUser("taken@example.com", "hash"); err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+
+	if _, err := s.ChangeUserCredentials(user.Id, "taken@example.com", "new"); !errors.Is(err, ErrExists) {
+		t.Errorf("expected ErrExists when taking another user's email, got %v", err)
+		return
+	}
+
+	// Changing only the password keeps the same email
+	updated, err := s.ChangeUserCredentials(user.Id, "user@example.com", "new")
+	if err != nil {
+		t.Errorf("could not update user: %v", err)
+		return
+	}
+	if updated.Password != "new" {
+		t.Errorf("expected password to be updated, got %v", updated)
+		return
+	}
+
+	updated, err = s.ChangeUserCredentials(user.Id, "renamed@example.com", "newer")
+	if err != nil {
+		t.Errorf("could not update user: %v", err)
+		return
+	}
+
+	got, err := s.GetUserByEmail("renamed@example.com")
+	if err != nil {
+		t.Errorf("could not get user: %v", err)
+		return
+	}
+	if got != updated {
+		t.Errorf("expected %v, got %v", updated, got)
+		return
+	}
+
+	if _, err := s.ChangeUserCredentials(100, "ghost@example.com", "hash"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for missing user, got %v", err)
+	}
+}
+
+func testStoreChangeUserCredentials(t *testing.T, s Store) {
+	user, err := s.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+	token, err := s.AddRefreshToken(user.Id, time.Now().Add(time.Hour), Client{})
+	if err != nil {
+		t.Errorf("could not add refresh token: %v", err)
+		return
+	}
+
+	// Keeping the hash only changes the email
+	if _, err := s.ChangeUserCredentials(user.Id, "renamed@example.com", "hash"); err != nil {
+		t.Errorf("could not change credentials: %v", err)
+		return
+	}
+	if sessions, err := s.GetSessions(user.Id); err != nil || len(sessions) != 1 {
+		t.Errorf("expected the session to survive keeping the password, got %v (%v)", sessions, err)
+		return
+	}
+
+	// Nothing changes if the update fails
+	if _, err := s.CreateUser("taken@example.com", "hash"); err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+	if _, err := s.ChangeUserCredentials(user.Id, "taken@example.com", "new"); !errors.Is(err, ErrExists) {
+		t.Errorf("expected ErrExists when taking another user's email, got %v", err)
+		return
+	}
+	if _, err := s.CheckRefreshToken(token.Token); err != nil {
+		t.Errorf("expected the session to survive a failed update, got %v", err)
+		return
+	}
+
+	updated, err := s.ChangeUserCredentials(user.Id, "renamed@example.com", "new")
+	if err != nil || updated.Password != "new" {
+		t.Errorf("could not change credentials, got %v (%v)", updated, err)
+		return
+	}
+	if _, err := s.CheckRefreshToken(token.Token); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected a new password to revoke the session, got %v", err)
+		return
+	}
+
+	if _, err := s.ChangeUserCredentials(100, "ghost@example.com", "hash"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for missing user, got %v", err)
+	}
+}
+
+func testStoreChirpyRed(t *testing.T, s Store) {
+	user, err := s.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+
+	if err := s.SetUserChirpyRed(user.Id, true); err != nil {
+		t.Errorf("could not upgrade user: %v", err)
+		return
+	}
+	// Upgrading twice is not an error
+	if err := s.SetUserChirpyRed(user.Id, true); err != nil {
+		t.Errorf("could not upgrade user twice: %v", err)
+		return
+	}
+
+	got, err := s.GetUserByEmail(user.Email)
+	if err != nil {
+		t.Errorf("could not get user: %v", err)
+		return
+	}
+	if !got.IsChirpyRed {
+		t.Errorf("expected user to be Chirpy Red")
+		return
+	}
+
+	if err := s.SetUserChirpyRed(100, true); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for missing user, got %v", err)
+	}
+}
+
+func testStoreRefreshTokens(t *testing.T, s Store) {
+	token, err := s.AddRefreshToken(7, time.Now().Add(time.Hour), Client{})
+	if err != nil {
+		t.Errorf("could not add refresh token: %v", err)
+		return
+	}
+	if token.TokenHash == "" || token.TokenHash == token.Token {
+		t.Errorf("expected the token to be stored as a hash, got %q", token.TokenHash)
+		return
+	}
+
+	userId, err := s.CheckRefreshToken(token.Token)
+	if err != nil {
+		t.Errorf("could not check refresh token: %v", err)
+		return
+	}
+	if userId != 7 {
+		t.Errorf("expected user ID 7, got %d", userId)
+		return
+	}
+
+	if err := s.RevokeRefreshToken(token.Token); err != nil {
+		t.Errorf("could not revoke refresh token: %v", err)
+		return
+	}
+	if _, err := s.CheckRefreshToken(token.Token); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for revoked token, got %v", err)
+		return
+	}
+	if err := s.RevokeRefreshToken(token.Token); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist when revoking twice, got %v", err)
+		return
+	}
+
+	expired, err := s.AddRefreshToken(7, time.Now().Add(-time.Minute), Client{})
+	if err != nil {
+		t.Errorf("could not add refresh token: %v", err)
+		return
+	}
+	if _, err := s.CheckRefreshToken(expired.Token); !errors.Is(err, ErrExpired) {
+		t.Errorf("expected ErrExpired, got %v", err)
+		return
+	}
+	// Expired tokens are deleted once they are seen
+	if _, err := s.CheckRefreshToken(expired.Token); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for deleted expired token, got %v", err)
+	}
+}
+
+func testStoreRefreshTokenRotation(t *testing.T, s Store) {
+	first, err := s.AddRefreshToken(7, time.Now().Add(time.Hour), Client{})
+	if err != nil {
+		t.Errorf("could not add refresh token: %v", err)
+		return
+	}
+
+	second, err := s.RotateRefreshToken(first.Token, time.Now().Add(2*time.Hour), Client{})
+	if err != nil {
+		t.Errorf("could not rotate refresh token: %v", err)
+		return
+	}
+	if second.Token == first.Token || second.FamilyId != first.FamilyId || second.UserId != 7 {
+		t.Errorf("expected a new token in the same family, got %v after %v", second, first)
+		return
+	}
+	if _, err := s.CheckRefreshToken(first.Token); !errors.Is(err, ErrTokenReused) {
+		t.Errorf("expected ErrTokenReused for the rotated token, got %v", err)
+		return
+	}
+
+	third, err := s.RotateRefreshToken(second.Token, time.Now().Add(time.Hour), Client{})
+	if err != nil {
+		t.Errorf("could not rotate refresh token: %v", err)
+		return
+	}
+
+	// A separate login is a separate family, and survives the reuse below
+	other, err := s.AddRefreshToken(7, time.Now().Add(time.Hour), Client{})
+	if err != nil {
+		t.Errorf("could not add refresh token: %v", err)
+		return
+	}
+
+	// Presenting a rotated token again takes down the whole family, including its latest token
+	if _, err := s.RotateRefreshToken(first.Token, time.Now().Add(time.Hour), Client{}); !errors.Is(err, ErrTokenReused) {
+		t.Errorf("expected ErrTokenReused, got %v", err)
+		return
+	}
+	for _, token := range []RefreshToken{first, second, third} {
+		if _, err := s.RotateRefreshToken(token.Token, time.Now().Add(time.Hour), Client{}); !errors.Is(err, ErrNotExist) {
+			t.Errorf("expected the family to be revoked, got %v", err)
+			return
+		}
+	}
+	if userId, err := s.CheckRefreshToken(other.Token); err != nil || userId != 7 {
+		t.Errorf("expected the other family to be untouched, got user %d and %v", userId, err)
+		return
+	}
+
+	expired, err := s.AddRefreshToken(7, time.Now().Add(-time.Minute), Client{})
+	if err != nil {
+		t.Errorf("could not add refresh token: %v", err)
+		return
+	}
+	if _, err := s.RotateRefreshToken(expired.Token, time.Now().Add(time.Hour), Client{}); !errors.Is(err, ErrExpired) {
+		t.Errorf("expected ErrExpired, got %v", err)
+		return
+	}
+
+	if err := s.RevokeRefreshToken(other.Token); err != nil {
+		t.Errorf("could not revoke refresh token: %v", err)
+		return
+	}
+
+	events, err := s.GetTokenEvents(7, ListOptions{})
+	if err != nil {
+		t.Errorf("could not get token events: %v", err)
+		return
+	}
+
+	var kinds []TokenEventKind
+	for _, e := range events {
+		kinds = append(kinds, e.Kind)
+	}
+	expected := []TokenEventKind{TokenIssued, TokenRotated, TokenRotated, TokenIssued, TokenReused, TokenIssued, TokenRevoked}
+	if !slices.Equal(kinds, expected) {
+		t.Errorf("expected events %v, got %v", expected, kinds)
+		return
+	}
+	if events[4].FamilyId != first.FamilyId || events[6].FamilyId != other.FamilyId {
+		t.Errorf("expected events to name their families, got %v", events)
+		return
+	}
+
+	page, err := s.GetTokenEvents(7, ListOptions{Desc: true, Limit: 2})
+	if err != nil {
+		t.Errorf("could not get token events: %v", err)
+		return
+	}
+	if len(page) != 2 || page[0].Id != events[6].Id || page[1].Id != events[5].Id {
+		t.Errorf("expected the two latest events, got %v", page)
+		return
+	}
+
+	// Exchanged tokens are dropped once they expire, the next time their family is refreshed
+	short, err := s.AddRefreshToken(8, time.Now().Add(20*time.Millisecond), Client{})
+	if err != nil {
+		t.Errorf("could not add refresh token: %v", err)
+		return
+	}
+	next, err := s.RotateRefreshToken(short.Token, time.Now().Add(time.Hour), Client{})
+	if err != nil {
+		t.Errorf("could not rotate refresh token: %v", err)
+		return
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := s.RotateRefreshToken(next.Token, time.Now().Add(time.Hour), Client{}); err != nil {
+		t.Errorf("could not rotate refresh token: %v", err)
+		return
+	}
+	if _, err := s.CheckRefreshToken(short.Token); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected the expired exchanged token to be dropped, got %v", err)
+		return
+	}
+	if _, err := s.CheckRefreshToken(next.Token); !errors.Is(err, ErrTokenReused) {
+		t.Errorf("expected the exchanged token that has not expired to be kept, got %v", err)
+	}
+}
+
+func testStoreSessions(t *testing.T, s Store) {
+	phone := Client{UserAgent: "phone", IP: "192.0.2.1"}
+	laptop := Client{UserAgent: "laptop", IP: "192.0.2.2"}
+
+	first, err := s.AddRefreshToken(7, time.Now().Add(time.Hour), phone)
+	if err != nil {
+		t.Errorf("could not add refresh token: %v", err)
+		return
+	}
+	second, err := s.AddRefreshToken(7, time.Now().Add(time.Hour), laptop)
+	if err != nil {
+		t.Errorf("could not add refresh token: %v", err)
+		return
+	}
+	if _, err := s.AddRefreshToken(8, time.Now().Add(time.Hour), laptop); err != nil {
+		t.Errorf("could not add refresh token: %v", err)
+		return
+	}
+	expired, err := s.AddRefreshToken(7, time.Now().Add(-time.Minute), laptop)
+	if err != nil {
+		t.Errorf("could not add refresh token: %v", err)
+		return
+	}
+
+	// Refreshing from somewhere else moves the session along with it
+	moved := Client{UserAgent: "phone", IP: "198.51.100.1"}
+	if _, err := s.RotateRefreshToken(first.Token, time.Now().Add(time.Hour), moved); err != nil {
+		t.Errorf("could not rotate refresh token: %v", err)
+		return
+	}
+
+	sessions, err := s.GetSessions(7)
+	if err != nil {
+		t.Errorf("could not get sessions: %v", err)
+		return
+	}
+	if len(sessions) != 2 || sessions[0].Id != first.FamilyId || sessions[1].Id != second.FamilyId {
+		t.Errorf("expected the two live sessions, most recently used first, got %v", sessions)
+		return
+	}
+	if sessions[0].ClientIP != moved.IP || sessions[0].UserAgent != moved.UserAgent ||
+		!sessions[0].CreatedAt.Equal(first.CreatedAt) || !sessions[0].LastUsedAt.After(sessions[0].CreatedAt) {
+		t.Errorf("expected the refreshed session to keep its login time and record its last use, got %v", sessions[0])
+		return
+	}
+
+	// Other users' sessions can't be revoked
+	if err := s.RevokeSession(8, first.FamilyId); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for another user's session, got %v", err)
+		return
+	}
+	if err := s.RevokeSession(7, second.FamilyId); err != nil {
+		t.Errorf("could not revoke session: %v", err)
+		return
+	}
+	if _, err := s.CheckRefreshToken(second.Token); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected the revoked session's token to be gone, got %v", err)
+		return
+	}
+	if err := s.RevokeSession(7, second.FamilyId); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist when revoking twice, got %v", err)
+		return
+	}
+
+	// The expired session is cleaned up too, but only the live one counts
+	revoked, err := s.RevokeAllSessions(7)
+	if err != nil || revoked != 1 {
+		t.Errorf("expected 1 session to be revoked, got %d (%v)", revoked, err)
+		return
+	}
+	if _, err := s.CheckRefreshToken(expired.Token); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected the expired session's token to be gone, got %v", err)
+		return
+	}
+	if sessions, err := s.GetSessions(7); err != nil || len(sessions) != 0 {
+		t.Errorf("expected no sessions left, got %v (%v)", sessions, err)
+		return
+	}
+	if sessions, err := s.GetSessions(8); err != nil || len(sessions) != 1 {
+		t.Errorf("expected the other user's session to be untouched, got %v (%v)", sessions, err)
+	}
+}
+
+func testStoreChirpsByAuthor(t *testing.T, s Store) {
+	for i := 0; i < 6; i++ {
+		// Authors 1 and 2 take turns
+		if _, err := s.CreateChirp(fmt.Sprintf("chirp %d", i), i%2+1); err != nil {
+			t.Errorf("could not create chirp: %v", err)
+			return
+		}
+	}
+
+	if err := s.DeleteChirp(3); err != nil {
+		t.Errorf("could not delete chirp: %v", err)
+		return
+	}
+
+	ids := func(chirps []Chirp) []int {
+		res := []int{}
+		for _, c := range chirps {
+			res = append(res, c.Id)
+		}
+		return res
+	}
+
+	cases := []struct {
+		authorId int
+		opts     ListOptions
+		expected []int
+	}{
+		{1, ListOptions{}, []int{1, 5}},
+		{2, ListOptions{}, []int{2, 4, 6}},
+		{2, ListOptions{Desc: true}, []int{6, 4, 2}},
+		{2, ListOptions{Limit: 2}, []int{2, 4}},
+		{2, ListOptions{Desc: true, Limit: 1}, []int{6}},
+		{3, ListOptions{}, []int{}},
+	}
+
+	for _, c := range cases {
+		chirps, err := s.GetChirpsByAuthor(c.authorId, c.opts)
+		if err != nil {
+			t.Errorf("could not get chirps by author: %v", err)
+			return
+		}
+
+		if got := ids(chirps); !slices.Equal(got, c.expected) {
+			t.Errorf("author %d with %+v: expected %v, got %v", c.authorId, c.opts, c.expected, got)
+			return
+		}
+	}
+}
+
+func testStoreEmailIgnoresCase(t *testing.T, s Store) {
+	user, err := s.CreateUser("User@Example.com", "hash")
+	if err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+
+	got, err := s.GetUserByEmail("user@example.COM")
+	if err != nil {
+		t.Errorf("could not get user: %v", err)
+		return
+	}
+	if got.Id != user.Id {
+		t.Errorf("expected user %d, got %d", user.Id, got.Id)
+		return
+	}
+
+	if _, err := s.CreateUser("USER@example.com", "hash"); !errors.Is(err, ErrExists) {
+		t.Errorf("expected ErrExists for an email differing only in case, got %v", err)
+		return
+	}
+
+	if _, err := s.ChangeUserCredentials(user.Id, "new@example.com", "hash"); err != nil {
+		t.Errorf("could not update user: %v", err)
+		return
+	}
+	if _, err := s.GetUserByEmail("user@example.com"); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected old email to be gone, got %v", err)
+		return
+	}
+	if _, err := s.GetUserByEmail("NEW@example.com"); err != nil {
+		t.Errorf("expected new email to be found, got %v", err)
+	}
+}
+
+func testStoreConcurrentCreates(t *testing.T, s Store) {
+	const n = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := s.CreateChirp(fmt.Sprintf("chirp %d", i), 1)
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := s.CreateUser(fmt.Sprintf("user%d@example.com", i), "hash")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent create failed: %v", err)
+			return
+		}
+	}
+
+	chirps, err := s.GetChirps()
+	if err != nil {
+		t.Errorf("could not get chirps: %v", err)
+		return
+	}
+	if len(chirps) != n {
+		t.Errorf("expected %d chirps, got %d", n, len(chirps))
+	}
+}
+
+func testStoreChanges(t *testing.T, s Store) {
+	user, err := s.CreateUser("user@example.com", "secret-hash")
+	if err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+	chirp, err := s.CreateChirp("hello", user.Id)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	if _, err := s.ChangeUserCredentials(user.Id, "new@example.com", "secret-hash"); err != nil {
+		t.Errorf("could not update user: %v", err)
+		return
+	}
+	if err := s.SetUserChirpyRed(user.Id, true); err != nil {
+		t.Errorf("could not upgrade user: %v", err)
+		return
+	}
+	if err := s.DeleteChirp(chirp.Id); err != nil {
+		t.Errorf("could not delete chirp: %v", err)
+		return
+	}
+
+	// Refresh tokens are not part of the feed
+	if _, err := s.AddRefreshToken(user.Id, time.Now().Add(time.Hour), Client{}); err != nil {
+		t.Errorf("could not add refresh token: %v", err)
+		return
+	}
+
+	flushStore(t, s)
+	changes, err := s.Changes(0, 0)
+	if err != nil {
+		t.Errorf("could not get changes: %v", err)
+		return
+	}
+
+	expected := []struct {
+		op     ChangeOp
+		entity string
+	}{
+		{ChangeCreate, EntityUser},
+		{ChangeCreate, EntityChirp},
+		{ChangeUpdate, EntityUser},
+		{ChangeUpdate, EntityUser},
+		{ChangeDelete, EntityChirp},
+	}
+	if len(changes) != len(expected) {
+		t.Errorf("expected %d changes, got %v", len(expected), changes)
+		return
+	}
+
+	for i, c := range changes {
+		if c.Seq != uint64(i+1) || c.Op != expected[i].op || c.Entity != expected[i].entity {
+			t.Errorf("expected change %d to be %s %s, got %+v", i+1, expected[i].op, expected[i].entity, c)
+			return
+		}
+
+		if (c.Before == nil) != (c.Op == ChangeCreate) || (c.After == nil) != (c.Op == ChangeDelete) {
+			t.Errorf("unexpected before/after for %s: %+v", c.Op, c)
+			return
+		}
+
+		if strings.Contains(string(c.Before)+string(c.After), "secret-hash") {
+			t.Errorf("expected password hashes to be left out of the feed, got %+v", c)
+			return
+		}
+	}
+
+	var updated User
+	if err := json.Unmarshal(changes[2].After, &updated); err != nil {
+		t.Errorf("could not decode change: %v", err)
+		return
+	}
+	if changes[2].Id != strconv.Itoa(user.Id) || updated.Email != "new@example.com" {
+		t.Errorf("expected change 3 to update the email of user %d, got %+v", user.Id, changes[2])
+		return
+	}
+
+	page, err := s.Changes(2, 2)
+	if err != nil {
+		t.Errorf("could not get changes: %v", err)
+		return
+	}
+	if len(page) != 2 || page[0].Seq != 3 || page[1].Seq != 4 {
+		t.Errorf("expected changes 3 and 4, got %v", page)
+		return
+	}
+
+	if rest, err := s.Changes(5, 10); err != nil || len(rest) != 0 {
+		t.Errorf("expected no changes after the last one, got %v, %v", rest, err)
+	}
+}
+
+func testStoreSubscribe(t *testing.T, s Store) {
+	if _, err := s.CreateChirp("before", 1); err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := s.Subscribe(ctx, 0)
+
+	next := func() (ChangeEvent, bool) {
+		select {
+		case e, ok := <-events:
+			return e, ok
+		case <-time.After(5 * time.Second):
+			return ChangeEvent{}, false
+		}
+	}
+
+	if e, ok := next(); !ok || e.Seq != 1 {
+		t.Errorf("expected to catch up on change 1 first, got %+v", e)
+		return
+	}
+
+	// Changes made while subscribed are delivered in order
+	for i := 0; i < 5; i++ {
+		if _, err := s.CreateChirp(fmt.Sprintf("after %d", i), 1); err != nil {
+			t.Errorf("could not create chirp: %v", err)
+			return
+		}
+	}
+
+	for seq := uint64(2); seq <= 6; seq++ {
+		if e, ok := next(); !ok || e.Seq != seq {
+			t.Errorf("expected change %d, got %+v", seq, e)
+			return
+		}
+	}
+
+	cancel()
+	for range events {
+		// Drain until the subscription is closed
+	}
+}
+
+func chirpIds(chirps []Chirp) []int {
+	ids := []int{}
+	for _, c := range chirps {
+		ids = append(ids, c.Id)
+	}
+
+	return ids
+}
+
+func testStoreListChirpsPages(t *testing.T, s Store) {
+	for i := 1; i <= 10; i++ {
+		if _, err := s.CreateChirp(fmt.Sprintf("chirp %d", i), i%2+1); err != nil {
+			t.Errorf("could not create chirp: %v", err)
+			return
+		}
+	}
+
+	if err := s.DeleteChirp(6); err != nil {
+		t.Errorf("could not delete chirp: %v", err)
+		return
+	}
+
+	cases := []struct {
+		opts     ListOptions
+		authorId int
+		expected []int
+	}{
+		{ListOptions{}, 0, []int{1, 2, 3, 4, 5, 7, 8, 9, 10}},
+		{ListOptions{Limit: 3}, 0, []int{1, 2, 3}},
+		{ListOptions{Limit: 3, After: 3}, 0, []int{4, 5, 7}},
+		{ListOptions{Limit: 3, After: 5}, 0, []int{7, 8, 9}},
+		{ListOptions{Limit: 3, After: 9}, 0, []int{10}},
+		{ListOptions{Limit: 3, After: 10}, 0, []int{}},
+		{ListOptions{Desc: true, Limit: 3}, 0, []int{10, 9, 8}},
+		{ListOptions{Desc: true, Limit: 3, After: 8}, 0, []int{7, 5, 4}},
+		{ListOptions{Desc: true, After: 2}, 0, []int{1}},
+		// The cursor doesn't have to exist anymore
+		{ListOptions{Desc: true, Limit: 2, After: 6}, 0, []int{5, 4}},
+		{ListOptions{Limit: 2, After: 6}, 0, []int{7, 8}},
+		{ListOptions{Limit: 2}, 1, []int{2, 4}},
+		{ListOptions{Limit: 2, After: 4}, 1, []int{8, 10}},
+		{ListOptions{Desc: true, Limit: 2, After: 9}, 2, []int{7, 5}},
+	}
+
+	for _, c := range cases {
+		var chirps []Chirp
+		var err error
+		if c.authorId != 0 {
+			chirps, err = s.GetChirpsByAuthor(c.authorId, c.opts)
+		} else {
+			chirps, err = s.ListChirps(c.opts)
+		}
+		if err != nil {
+			t.Errorf("could not list chirps with %+v: %v", c.opts, err)
+			return
+		}
+
+		if ids := chirpIds(chirps); !slices.Equal(ids, c.expected) {
+			t.Errorf("expected %v with %+v and author %d, got %v", c.expected, c.opts, c.authorId, ids)
+			return
+		}
+	}
+}
+
+func resultIds(results []SearchResult) []int {
+	ids := []int{}
+	for _, r := range results {
+		ids = append(ids, r.Id)
+	}
+	return ids
+}
+
+func testStoreSearch(t *testing.T, s Store) {
+	bodies := []string{
+		"The quick brown fox",
+		"A lazy brown dog sleeps",
+		"Quick thinking, quick acting",
+		"Foxes and dogs are friends",
+		"brown brown brown",
+	}
+	for _, body := range bodies {
+		if _, err := s.CreateChirp(body, 1); err != nil {
+			t.Errorf("could not create chirp: %v", err)
+			return
+		}
+	}
+
+	cases := []struct {
+		query    string
+		expected []int
+	}{
+		{"quick", []int{3, 1}},
+		{"brown", []int{5, 2, 1}},
+		{"quick brown", []int{1}},
+		{`"brown fox"`, []int{1}},
+		{`"fox brown"`, []int{}},
+		{"fox*", []int{4, 1}},
+		{"fox OR dog", []int{2, 1}},
+		{"brown -dog", []int{5, 1}},
+		{"brown NOT (dog OR fox)", []int{5}},
+		{"nothing", []int{}},
+	}
+
+	for _, c := range cases {
+		results, err := s.SearchChirps(c.query, 10)
+		if err != nil {
+			t.Errorf("could not search for %q: %v", c.query, err)
+			return
+		}
+
+		if ids := resultIds(results); !slices.Equal(ids, c.expected) {
+			t.Errorf("expected %v for %q, got %v", c.expected, c.query, ids)
+			return
+		}
+	}
+
+	if results, err := s.SearchChirps("brown", 1); err != nil || len(results) != 1 {
+		t.Errorf("expected a single result with a limit of 1, got %v (%v)", resultIds(results), err)
+		return
+	}
+
+	if _, err := s.SearchChirps("(brown", 10); !errors.Is(err, ErrBadQuery) {
+		t.Errorf("expected ErrBadQuery for an unbalanced query, got %v", err)
+		return
+	}
+
+	// Deleted chirps drop out of the index
+	if err := s.DeleteChirp(1); err != nil {
+		t.Errorf("could not delete chirp: %v", err)
+		return
+	}
+
+	results, err := s.SearchChirps("quick", 10)
+	if err != nil {
+		t.Errorf("could not search: %v", err)
+		return
+	}
+	if ids := resultIds(results); !slices.Equal(ids, []int{3}) {
+		t.Errorf("expected only chirp 3 after deleting chirp 1, got %v", ids)
+		return
+	}
+
+	if results[0].Highlighted != "<mark>Quick</mark> thinking, <mark>quick</mark> acting" {
+		t.Errorf("unexpected highlight %q", results[0].Highlighted)
+	}
+}
+
+func testStoreTimestamps(t *testing.T, s Store) {
+	start := time.Now().UTC()
+
+	chirp, err := s.CreateChirp("hello", 1)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	if chirp.CreatedAt.Before(start) || chirp.CreatedAt.Location() != time.UTC || !chirp.UpdatedAt.Equal(chirp.CreatedAt) {
+		t.Errorf("unexpected timestamps on new chirp %v", chirp)
+		return
+	}
+
+	if got, err := s.GetChirp(chirp.Id); err != nil || !reflect.DeepEqual(got, chirp) {
+		t.Errorf("expected %v to be stored as is, got %v (%v)", chirp, got, err)
+		return
+	}
+
+	user, err := s.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+	if user.CreatedAt.Before(start) || !user.UpdatedAt.Equal(user.CreatedAt) {
+		t.Errorf("unexpected timestamps on new user %v", user)
+		return
+	}
+
+	updated, err := s.ChangeUserCredentials(user.Id, "user@example.com", "new")
+	if err != nil {
+		t.Errorf("could not update user: %v", err)
+		return
+	}
+	if !updated.CreatedAt.Equal(user.CreatedAt) || updated.UpdatedAt.Before(user.UpdatedAt) {
+		t.Errorf("expected only the update time to move, got %v after %v", updated, user)
+		return
+	}
+
+	if err := s.SetUserChirpyRed(user.Id, true); err != nil {
+		t.Errorf("could not upgrade user: %v", err)
+		return
+	}
+	red, err := s.GetUserByEmail("user@example.com")
+	if err != nil {
+		t.Errorf("could not get user: %v", err)
+		return
+	}
+	if !red.CreatedAt.Equal(user.CreatedAt) || red.UpdatedAt.Before(updated.UpdatedAt) {
+		t.Errorf("expected only the update time to move, got %v after %v", red, updated)
+	}
+}
+
+func testStoreListChirpsByTime(t *testing.T, s Store) {
+	var all []Chirp
+	for i := 1; i <= 8; i++ {
+		chirp, err := s.CreateChirp(fmt.Sprintf("chirp %d", i), i%2+1)
+		if err != nil {
+			t.Errorf("could not create chirp: %v", err)
+			return
+		}
+		all = append(all, chirp)
+	}
+
+	// The expected IDs are worked out from the stored times, since fast clocks can give chirps the same one
+	since, until := all[2].CreatedAt, all[6].CreatedAt
+	var inRange []int
+	for _, c := range all {
+		if !c.CreatedAt.Before(since) && c.CreatedAt.Before(until) {
+			inRange = append(inRange, c.Id)
+		}
+	}
+
+	chirps, err := s.ListChirps(ListOptions{Since: since, Until: until})
+	if err != nil {
+		t.Errorf("could not list chirps: %v", err)
+		return
+	}
+	if ids := chirpIds(chirps); !slices.Equal(ids, inRange) {
+		t.Errorf("expected %v between %v and %v, got %v", inRange, since, until, ids)
+		return
+	}
+
+	// Walk through pages sorted by time in both directions
+	// Creation times never go down as IDs go up, so the order matches the IDs
+	for _, desc := range []bool{false, true} {
+		for _, authorId := range []int{0, 1} {
+			var expected []int
+			for _, c := range all {
+				if authorId == 0 || c.AuthorId == authorId {
+					expected = append(expected, c.Id)
+				}
+			}
+			if desc {
+				slices.Reverse(expected)
+			}
+
+			opts := ListOptions{SortBy: SortByCreatedAt, Desc: desc, Limit: 3}
+			var seen []int
+			for pages := 0; ; pages++ {
+				if pages > 10 {
+					t.Errorf("too many pages")
+					return
+				}
+
+				var page []Chirp
+				if authorId != 0 {
+					page, err = s.GetChirpsByAuthor(authorId, opts)
+				} else {
+					page, err = s.ListChirps(opts)
+				}
+				if err != nil {
+					t.Errorf("could not list chirps: %v", err)
+					return
+				}
+				if len(page) == 0 {
+					break
+				}
+
+				seen = append(seen, chirpIds(page)...)
+				opts.After, opts.AfterTime = page[len(page)-1].Id, page[len(page)-1].CreatedAt
+			}
+
+			if !slices.Equal(seen, expected) {
+				t.Errorf("expected %v sorted by time (desc %v, author %d), got %v", expected, desc, authorId, seen)
+				return
+			}
+		}
+	}
+}
+
+func testStoreUpdateChirp(t *testing.T, s Store) {
+	original, err := s.CreateChirp("first draft", 1)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	if original.Edited {
+		t.Errorf("expected a new chirp not to be edited, got %v", original)
+		return
+	}
+
+	edited, err := s.UpdateChirp(original.Id, "second draft", nil)
+	if err != nil {
+		t.Errorf("could not update chirp: %v", err)
+		return
+	}
+	if edited.Body != "second draft" || !edited.Edited || !edited.CreatedAt.Equal(original.CreatedAt) || edited.UpdatedAt.Before(original.UpdatedAt) {
+		t.Errorf("unexpected edited chirp %v", edited)
+		return
+	}
+	if got, err := s.GetChirp(original.Id); err != nil || !reflect.DeepEqual(got, edited) {
+		t.Errorf("expected %v to be stored, got %v (%v)", edited, got, err)
+		return
+	}
+
+	// Setting the same body again is not a new revision
+	if _, err := s.UpdateChirp(original.Id, "second draft", nil); err != nil {
+		t.Errorf("could not update chirp: %v", err)
+		return
+	}
+	final, err := s.UpdateChirp(original.Id, "final", nil)
+	if err != nil {
+		t.Errorf("could not update chirp: %v", err)
+		return
+	}
+
+	revisions, err := s.GetChirpRevisions(original.Id)
+	if err != nil {
+		t.Errorf("could not get revisions: %v", err)
+		return
+	}
+	expected := []ChirpRevision{
+		{Revision: 1, Body: "first draft", CreatedAt: original.CreatedAt},
+		{Revision: 2, Body: "second draft", CreatedAt: edited.UpdatedAt},
+	}
+	if !slices.EqualFunc(revisions, expected, func(a, b ChirpRevision) bool {
+		return a.Revision == b.Revision && a.Body == b.Body && a.CreatedAt.Equal(b.CreatedAt)
+	}) {
+		t.Errorf("expected revisions %v, got %v", expected, revisions)
+		return
+	}
+
+	// Search follows the current body
+	if results, err := s.SearchChirps("draft", 10); err != nil || len(results) != 0 {
+		t.Errorf("expected old bodies not to be searchable, got %v (%v)", resultIds(results), err)
+		return
+	}
+	if results, err := s.SearchChirps("final", 10); err != nil || len(results) != 1 {
+		t.Errorf("expected the new body to be searchable, got %v (%v)", resultIds(results), err)
+		return
+	}
+
+	flushStore(t, s)
+	changes, err := s.Changes(0, 0)
+	if err != nil {
+		t.Errorf("could not get changes: %v", err)
+		return
+	}
+	if last := changes[len(changes)-1]; last.Op != ChangeUpdate || last.Entity != EntityChirp {
+		t.Errorf("expected the edit in the change feed, got %v", last)
+		return
+	}
+
+	if _, err := s.UpdateChirp(100, "ghost", nil); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for missing chirp, got %v", err)
+		return
+	}
+
+	// A failed check leaves the chirp alone
+	errRefused := errors.New("refused")
+	if _, err := s.UpdateChirp(final.Id, "refused", func(c Chirp) error {
+		if c.Body != "final" {
+			t.Errorf("expected the check to see the current chirp, got %v", c)
+		}
+		return errRefused
+	}); !errors.Is(err, errRefused) {
+		t.Errorf("expected the check's error, got %v", err)
+		return
+	}
+	if chirp, err := s.GetChirp(final.Id); err != nil || chirp.Body != "final" {
+		t.Errorf("expected the chirp to be unchanged, got %v (%v)", chirp, err)
+		return
+	}
+
+	// Revisions go away with their chirp
+	if err := s.DeleteChirp(final.Id); err != nil {
+		t.Errorf("could not delete chirp: %v", err)
+		return
+	}
+	if _, err := s.GetChirpRevisions(final.Id); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for revisions of a deleted chirp, got %v", err)
+	}
+}
+
+func testStoreThreads(t *testing.T, s Store) {
+	root, err := s.CreateChirp("root", 1)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	if root.RootId != root.Id || root.ReplyTo != 0 {
+		t.Errorf("expected a chirp that is not a reply to start its own thread, got %v", root)
+		return
+	}
+
+	reply := func(parentId int) Chirp {
+		chirp, err := s.CreateReply("reply", 2, parentId)
+		if err != nil {
+			t.Fatalf("could not reply to %d: %v", parentId, err)
+		}
+		return chirp
+	}
+
+	first := reply(root.Id)
+	nested := reply(first.Id)
+	second := reply(root.Id)
+
+	if nested.ReplyTo != first.Id || nested.RootId != root.Id {
+		t.Errorf("expected a nested reply in the same thread, got %v", nested)
+		return
+	}
+
+	if _, err := s.CreateReply("reply", 2, 100); !errors.Is(err, ErrParentNotExist) {
+		t.Errorf("expected ErrParentNotExist when replying to a missing chirp, got %v", err)
+		return
+	}
+
+	replyCount := func(id int) int {
+		chirp, err := s.GetChirp(id)
+		if err != nil {
+			t.Fatalf("could not get chirp: %v", err)
+		}
+		return chirp.ReplyCount
+	}
+	threadIds := func(rootId int) []int {
+		chirps, err := s.GetThread(rootId)
+		if err != nil {
+			t.Fatalf("could not get thread: %v", err)
+		}
+		return chirpIds(chirps)
+	}
+
+	if n := replyCount(root.Id); n != 2 {
+		t.Errorf("expected 2 replies to the root, got %d", n)
+		return
+	}
+	if ids := threadIds(root.Id); !slices.Equal(ids, []int{root.Id, first.Id, nested.Id, second.Id}) {
+		t.Errorf("unexpected thread %v", ids)
+		return
+	}
+
+	// Replies outlive their parents
+	if err := s.DeleteChirp(first.Id); err != nil {
+		t.Errorf("could not delete chirp: %v", err)
+		return
+	}
+	if n := replyCount(root.Id); n != 1 {
+		t.Errorf("expected 1 reply to the root after deleting the other, got %d", n)
+		return
+	}
+	if err := s.DeleteChirp(root.Id); err != nil {
+		t.Errorf("could not delete chirp: %v", err)
+		return
+	}
+	if ids := threadIds(root.Id); !slices.Equal(ids, []int{nested.Id, second.Id}) {
+		t.Errorf("expected the replies to stay in the thread, got %v", ids)
+		return
+	}
+	if got, err := s.GetChirp(nested.Id); err != nil || got.ReplyTo != first.Id {
+		t.Errorf("expected the nested reply to keep its parent, got %v (%v)", got, err)
+		return
+	}
+	if _, err := s.CreateReply("reply", 2, root.Id); !errors.Is(err, ErrParentNotExist) {
+		t.Errorf("expected ErrParentNotExist when replying to a deleted chirp, got %v", err)
+		return
+	}
+
+	if _, err := s.GetThread(100); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for a missing thread, got %v", err)
+	}
+}
+
+func reactionUserIds(reactions []Reaction) []int {
+	ids := make([]int, len(reactions))
+	for i, r := range reactions {
+		ids[i] = r.UserId
+	}
+
+	return ids
+}
+
+func testStoreReactions(t *testing.T, s Store) {
+	var users []User
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		user, err := s.CreateUser(email, "hash")
+		if err != nil {
+			t.Errorf("could not create user: %v", err)
+			return
+		}
+		users = append(users, user)
+	}
+
+	first, err := s.CreateChirp("first", users[0].Id)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	second, err := s.CreateChirp("second", users[0].Id)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	for _, user := range users {
+		if _, err := s.AddReaction(ReactionLike, first.Id, user.Id); err != nil {
+			t.Errorf("could not like chirp: %v", err)
+			return
+		}
+	}
+
+	// Liking again changes nothing
+	chirp, err := s.AddReaction(ReactionLike, first.Id, users[0].Id)
+	if err != nil {
+		t.Errorf("could not like chirp: %v", err)
+		return
+	}
+	if chirp.LikeCount != 3 || chirp.RechirpCount != 0 {
+		t.Errorf("expected 3 likes and no rechirps, got %v", chirp)
+		return
+	}
+
+	if chirp, err = s.AddReaction(ReactionRechirp, first.Id, users[1].Id); err != nil || chirp.RechirpCount != 1 {
+		t.Errorf("expected 1 rechirp, got %v (%v)", chirp, err)
+		return
+	}
+	if _, err := s.AddReaction(ReactionLike, second.Id, users[1].Id); err != nil {
+		t.Errorf("could not like chirp: %v", err)
+		return
+	}
+
+	if chirp, err = s.RemoveReaction(ReactionLike, first.Id, users[0].Id); err != nil || chirp.LikeCount != 2 {
+		t.Errorf("expected 2 likes after unliking, got %v (%v)", chirp, err)
+		return
+	}
+	if chirp, err = s.RemoveReaction(ReactionLike, first.Id, users[0].Id); err != nil || chirp.LikeCount != 2 {
+		t.Errorf("expected unliking twice to change nothing, got %v (%v)", chirp, err)
+		return
+	}
+	if chirp, err = s.GetChirp(first.Id); err != nil || chirp.LikeCount != 2 || chirp.RechirpCount != 1 {
+		t.Errorf("expected the counts to be stored, got %v (%v)", chirp, err)
+		return
+	}
+
+	likes, err := s.GetReactions(ReactionLike, first.Id, ListOptions{})
+	if err != nil {
+		t.Errorf("could not get likes: %v", err)
+		return
+	}
+	if ids := reactionUserIds(likes); !slices.Equal(ids, []int{users[1].Id, users[2].Id}) {
+		t.Errorf("unexpected likes %v", likes)
+		return
+	}
+	if likes[0].CreatedAt.IsZero() {
+		t.Errorf("expected likes to have a creation time, got %v", likes[0])
+		return
+	}
+
+	likes, err = s.GetReactions(ReactionLike, first.Id, ListOptions{Desc: true, Limit: 1})
+	if err != nil {
+		t.Errorf("could not get likes: %v", err)
+		return
+	}
+	if ids := reactionUserIds(likes); !slices.Equal(ids, []int{users[2].Id}) {
+		t.Errorf("unexpected page of likes %v", likes)
+		return
+	}
+
+	userLikes, err := s.GetUserReactions(ReactionLike, users[1].Id, ListOptions{After: first.Id})
+	if err != nil {
+		t.Errorf("could not get likes of user: %v", err)
+		return
+	}
+	if len(userLikes) != 1 || userLikes[0].ChirpId != second.Id {
+		t.Errorf("expected the user to like the second chirp after the first, got %v", userLikes)
+		return
+	}
+
+	reacted, err := s.ReactedTo(ReactionLike, users[1].Id, []int{first.Id, second.Id, 100})
+	if err != nil {
+		t.Errorf("could not check likes: %v", err)
+		return
+	}
+	if !reacted[first.Id] || !reacted[second.Id] || len(reacted) != 2 {
+		t.Errorf("expected the user to have liked both chirps, got %v", reacted)
+		return
+	}
+
+	// Listings can ask about more chirps than SQLite allows parameters in a statement
+	manyIds := []int{second.Id}
+	for id := 1000; len(manyIds) < 40000; id++ {
+		manyIds = append(manyIds, id)
+	}
+	if reacted, err := s.ReactedTo(ReactionLike, users[1].Id, manyIds); err != nil || len(reacted) != 1 || !reacted[second.Id] {
+		t.Errorf("expected one liked chirp out of many, got %d (%v)", len(reacted), err)
+		return
+	}
+
+	if _, err := s.AddReaction(ReactionLike, 100, users[0].Id); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist when liking a missing chirp, got %v", err)
+		return
+	}
+	if _, err := s.GetReactions(ReactionLike, 100, ListOptions{}); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for likes of a missing chirp, got %v", err)
+		return
+	}
+	if _, err := s.GetUserReactions(ReactionLike, 100, ListOptions{}); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for likes of a missing user, got %v", err)
+		return
+	}
+
+	// Reactions go away with their chirp
+	if err := s.DeleteChirp(first.Id); err != nil {
+		t.Errorf("could not delete chirp: %v", err)
+		return
+	}
+	if userLikes, err = s.GetUserReactions(ReactionLike, users[2].Id, ListOptions{}); err != nil || len(userLikes) != 0 {
+		t.Errorf("expected the likes of a deleted chirp to be gone, got %v (%v)", userLikes, err)
+		return
+	}
+	if rechirps, err := s.GetUserReactions(ReactionRechirp, users[1].Id, ListOptions{}); err != nil || len(rechirps) != 0 {
+		t.Errorf("expected the rechirps of a deleted chirp to be gone, got %v (%v)", rechirps, err)
+	}
+}
+
+func testStoreFollows(t *testing.T, s Store) {
+	var users []User
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		user, err := s.CreateUser(email, "hash")
+		if err != nil {
+			t.Errorf("could not create user: %v", err)
+			return
+		}
+		users = append(users, user)
+	}
+	a, b, c := users[0].Id, users[1].Id, users[2].Id
+
+	for _, f := range [][2]int{{a, c}, {b, c}, {a, b}, {a, c}} {
+		if _, err := s.Follow(f[0], f[1]); err != nil {
+			t.Errorf("could not follow user: %v", err)
+			return
+		}
+	}
+
+	if _, err := s.Follow(a, a); !errors.Is(err, ErrFollowSelf) {
+		t.Errorf("expected ErrFollowSelf when following yourself, got %v", err)
+		return
+	}
+	if _, err := s.Follow(a, 100); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist when following a missing user, got %v", err)
+		return
+	}
+
+	user, err := s.GetUser(c)
+	if err != nil || user.FollowerCount != 2 || user.FollowingCount != 0 {
+		t.Errorf("expected 2 followers, got %v (%v)", user, err)
+		return
+	}
+	if user, err = s.GetUser(a); err != nil || user.FollowerCount != 0 || user.FollowingCount != 2 {
+		t.Errorf("expected 2 followed users, got %v (%v)", user, err)
+		return
+	}
+
+	followers, err := s.GetFollowers(c, ListOptions{})
+	if err != nil {
+		t.Errorf("could not get followers: %v", err)
+		return
+	}
+	if len(followers) != 2 || followers[0].FollowerId != a || followers[1].FollowerId != b || followers[0].CreatedAt.IsZero() {
+		t.Errorf("unexpected followers %v", followers)
+		return
+	}
+
+	following, err := s.GetFollowing(a, ListOptions{Desc: true, Limit: 1})
+	if err != nil {
+		t.Errorf("could not get followed users: %v", err)
+		return
+	}
+	if len(following) != 1 || following[0].FolloweeId != c {
+		t.Errorf("unexpected page of followed users %v", following)
+		return
+	}
+
+	if user, err = s.Unfollow(a, c); err != nil || user.Id != c || user.FollowerCount != 1 {
+		t.Errorf("expected 1 follower after unfollowing, got %v (%v)", user, err)
+		return
+	}
+	if user, err = s.Unfollow(a, c); err != nil || user.FollowerCount != 1 {
+		t.Errorf("expected unfollowing twice to change nothing, got %v (%v)", user, err)
+		return
+	}
+
+	if following, err = s.GetFollowing(a, ListOptions{}); err != nil || len(following) != 1 || following[0].FolloweeId != b {
+		t.Errorf("expected only the second user to be followed, got %v (%v)", following, err)
+		return
+	}
+	if _, err := s.GetFollowers(100, ListOptions{}); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for followers of a missing user, got %v", err)
+	}
+}
+
+func testStoreTimeline(t *testing.T, s Store) {
+	var users []User
+	for _, email := range []string{"reader@example.com", "a@example.com", "b@example.com", "c@example.com"} {
+		user, err := s.CreateUser(email, "hash")
+		if err != nil {
+			t.Errorf("could not create user: %v", err)
+			return
+		}
+		users = append(users, user)
+	}
+	reader, a, b, c := users[0].Id, users[1].Id, users[2].Id, users[3].Id
+
+	post := func(authorId int) Chirp {
+		chirp, err := s.CreateChirp("chirp", authorId)
+		if err != nil {
+			t.Fatalf("could not create chirp: %v", err)
+		}
+		return chirp
+	}
+	timeline := func(opts ListOptions) []int {
+		chirps, err := s.GetTimeline(reader, opts)
+		if err != nil {
+			t.Fatalf("could not get timeline: %v", err)
+		}
+		return chirpIds(chirps)
+	}
+
+	// Chirps from before the follow show up too
+	a1 := post(a)
+	if _, err := s.Follow(reader, a); err != nil {
+		t.Errorf("could not follow user: %v", err)
+		return
+	}
+	post(b)
+	a2 := post(a)
+	c1 := post(c)
+	post(reader)
+	if _, err := s.Follow(reader, c); err != nil {
+		t.Errorf("could not follow user: %v", err)
+		return
+	}
+	a3 := post(a)
+
+	newest := ListOptions{Desc: true}
+	if ids := timeline(newest); !slices.Equal(ids, []int{a3.Id, c1.Id, a2.Id, a1.Id}) {
+		t.Errorf("unexpected timeline %v", ids)
+		return
+	}
+
+	page := newest
+	page.Limit = 2
+	page.After, page.AfterTime = c1.Id, c1.CreatedAt
+	if ids := timeline(page); !slices.Equal(ids, []int{a2.Id, a1.Id}) {
+		t.Errorf("unexpected second page %v", ids)
+		return
+	}
+
+	if err := s.DeleteChirp(a2.Id); err != nil {
+		t.Errorf("could not delete chirp: %v", err)
+		return
+	}
+	if _, err := s.Unfollow(reader, c); err != nil {
+		t.Errorf("could not unfollow user: %v", err)
+		return
+	}
+	if ids := timeline(newest); !slices.Equal(ids, []int{a3.Id, a1.Id}) {
+		t.Errorf("expected deleted and unfollowed chirps to leave the timeline, got %v", ids)
+		return
+	}
+
+	// Edits and reactions don't move chirps around
+	if _, err := s.UpdateChirp(a1.Id, "edited", nil); err != nil {
+		t.Errorf("could not update chirp: %v", err)
+		return
+	}
+	if chirps, err := s.GetTimeline(reader, newest); err != nil || len(chirps) != 2 || chirps[1].Body != "edited" {
+		t.Errorf("expected the edited chirp in the timeline, got %v (%v)", chirps, err)
+		return
+	}
+
+	if chirps, err := s.GetTimeline(b, newest); err != nil || len(chirps) != 0 {
+		t.Errorf("expected an empty timeline without follows, got %v (%v)", chirps, err)
+		return
+	}
+	if _, err := s.GetTimeline(100, newest); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected ErrNotExist for the timeline of a missing user, got %v", err)
+	}
+}
+
+func testStoreHashtags(t *testing.T, s Store) {
+	user, err := s.CreateUser("friend@example.com", "hash")
+	if err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+
+	first, err := s.CreateChirp(fmt.Sprintf("#Go #go #news for @%d and @%d, not @%s", user.Id, user.Id+100, user.Email), user.Id)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	if !slices.Equal(first.Hashtags, []string{"go", "news"}) || !slices.Equal(first.Mentions, []int{user.Id}) {
+		t.Errorf("unexpected hashtags and mentions %v and %v", first.Hashtags, first.Mentions)
+		return
+	}
+	if got, err := s.GetChirp(first.Id); err != nil || !reflect.DeepEqual(got, first) {
+		t.Errorf("expected the hashtags and mentions to be stored, got %v (%v)", got, err)
+		return
+	}
+
+	second, err := s.CreateChirp("more #go", user.Id)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	if _, err := s.CreateChirp("no tags", user.Id); err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	tagged := func(tag string, opts ListOptions) []int {
+		chirps, err := s.GetChirpsByHashtag(tag, opts)
+		if err != nil {
+			t.Fatalf("could not get chirps by hashtag: %v", err)
+		}
+		return chirpIds(chirps)
+	}
+
+	if ids := tagged("go", ListOptions{Desc: true}); !slices.Equal(ids, []int{second.Id, first.Id}) {
+		t.Errorf("unexpected chirps tagged go %v", ids)
+		return
+	}
+	if ids := tagged("go", ListOptions{After: first.Id, Limit: 1}); !slices.Equal(ids, []int{second.Id}) {
+		t.Errorf("unexpected page of chirps tagged go %v", ids)
+		return
+	}
+
+	now := time.Now()
+	trending, err := s.TrendingHashtags(TrendingOptions{Now: now, Window: time.Hour, HalfLife: time.Hour})
+	if err != nil {
+		t.Errorf("could not get trending hashtags: %v", err)
+		return
+	}
+	if len(trending) != 2 || trending[0].Tag != "go" || trending[0].Count != 2 || trending[1].Tag != "news" {
+		t.Errorf("unexpected trending hashtags %v", trending)
+		return
+	}
+
+	// Only uses inside the window count
+	trending, err = s.TrendingHashtags(TrendingOptions{Now: now.Add(2 * time.Hour), Window: time.Hour, HalfLife: time.Hour})
+	if err != nil || len(trending) != 0 {
+		t.Errorf("expected nothing to trend after the window, got %v (%v)", trending, err)
+		return
+	}
+
+	// Edits retag the chirp
+	edited, err := s.UpdateChirp(first.Id, "now about #rust", nil)
+	if err != nil {
+		t.Errorf("could not update chirp: %v", err)
+		return
+	}
+	if !slices.Equal(edited.Hashtags, []string{"rust"}) || len(edited.Mentions) != 0 {
+		t.Errorf("expected the edit to change the hashtags and mentions, got %v", edited)
+		return
+	}
+	if ids := tagged("go", ListOptions{}); !slices.Equal(ids, []int{second.Id}) {
+		t.Errorf("expected the edited chirp to lose its old hashtag, got %v", ids)
+		return
+	}
+	trending, err = s.TrendingHashtags(TrendingOptions{Now: now, Window: time.Hour})
+	if err != nil || !reflect.DeepEqual(trending, []TrendingTag{{"go", 1, 1}, {"rust", 1, 1}}) {
+		t.Errorf("expected the edit to be counted by the trending hashtags, got %v (%v)", trending, err)
+		return
+	}
+
+	if err := s.DeleteChirp(first.Id); err != nil {
+		t.Errorf("could not delete chirp: %v", err)
+		return
+	}
+	if ids := tagged("rust", ListOptions{}); len(ids) != 0 {
+		t.Errorf("expected the deleted chirp to lose its hashtags, got %v", ids)
+		return
+	}
+	trending, err = s.TrendingHashtags(TrendingOptions{Now: now, Window: time.Hour})
+	if err != nil || len(trending) != 1 || trending[0].Tag != "go" {
+		t.Errorf("expected the deleted chirp to stop counting, got %v (%v)", trending, err)
+	}
+}
@@ -0,0 +1,203 @@
+package chirpydb
+
+import (
+	"cmp"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// A hashtag starts a word, so "a#b" and "&#39;" are not hashtags
+	hashtagRegexp = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_#&])#([\p{L}\p{N}_]+)`)
+
+	// Users don't have names, so they are mentioned by ID, as in @42
+	// Not by email, since resolving those would tell anyone posting a chirp whether an email has an account
+	mentionRegexp = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_.@])@([0-9]+)\b`)
+)
+
+// Longest hashtag that is kept, anything longer is cut off
+const maxHashtagLength = 100
+
+// Returns the hashtags in a chirp, lowercased and without the #, in the order they first appear
+func extractHashtags(body string) []string {
+	tags := []string{}
+	for _, m := range hashtagRegexp.FindAllStringSubmatch(body, -1) {
+		tag := strings.ToLower(m[1])
+		if runes := []rune(tag); len(runes) > maxHashtagLength {
+			tag = string(runes[:maxHashtagLength])
+		}
+
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
+
+// Returns the IDs of the users mentioned in a chirp, in the order they are first mentioned
+// Mentions of users that don't exist are left out
+func extractMentions(body string, userExists func(id int) bool) []int {
+	ids := []int{}
+	for _, m := range mentionRegexp.FindAllStringSubmatch(body, -1) {
+		id, err := strconv.Atoi(m[1])
+		if err != nil || slices.Contains(ids, id) {
+			continue
+		}
+
+		if userExists(id) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// Normalizes a hashtag the way extractHashtags does, accepting it with or without the #
+// Returns false if it is not a valid hashtag
+func NormalizeHashtag(tag string) (string, bool) {
+	tag = strings.TrimPrefix(tag, "#")
+	tags := extractHashtags("#" + tag)
+	if len(tags) != 1 || tags[0] != strings.ToLower(tag) {
+		return "", false
+	}
+
+	return tags[0], true
+}
+
+// A hashtag that is being used a lot right now
+type TrendingTag struct {
+	Tag string `json:"tag"`
+
+	// Uses in the window, each counting less the older it is
+	Score float64 `json:"score"`
+
+	// Uses in the window
+	Count int `json:"count"`
+}
+
+// How TrendingHashtags ranks hashtags
+type TrendingOptions struct {
+	// Only uses at or after Now-Window count
+	Now    time.Time
+	Window time.Duration
+
+	// A use counts half as much every HalfLife, zero means uses don't decay
+	HalfLife time.Duration
+
+	Limit int
+}
+
+// Uses of hashtags are counted per bucket of this length
+// so trending hashtags don't rescan every chirp in the window, which makes the window and decay only this precise
+const trendingBucket = time.Minute
+
+// Returns the bucket that uses of hashtags at t are counted in
+func trendingBucketOf(t time.Time) int {
+	return int(unixNanoClamped(t) / int64(trendingBucket))
+}
+
+func trendingBucketStart(bucket int) time.Time {
+	return time.Unix(0, int64(bucket)*int64(trendingBucket)).UTC()
+}
+
+// Uses of a hashtag in one bucket
+type hashtagUse struct {
+	tag       string
+	createdAt time.Time
+	count     int
+}
+
+// Adds up the decayed uses of each hashtag and returns the top ones, highest score first
+func rankTrending(uses []hashtagUse, opts TrendingOptions) []TrendingTag {
+	byTag := map[string]*TrendingTag{}
+	for _, u := range uses {
+		t, ok := byTag[u.tag]
+		if !ok {
+			t = &TrendingTag{Tag: u.tag}
+			byTag[u.tag] = t
+		}
+
+		t.Count += u.count
+		if opts.HalfLife <= 0 {
+			t.Score += float64(u.count)
+			continue
+		}
+
+		// Uses from the future (clock skew) count fully
+		age := max(0, opts.Now.Sub(u.createdAt))
+		t.Score += float64(u.count) * math.Exp2(-float64(age)/float64(opts.HalfLife))
+	}
+
+	trending := make([]TrendingTag, 0, len(byTag))
+	for _, t := range byTag {
+		trending = append(trending, *t)
+	}
+
+	slices.SortFunc(trending, func(a, b TrendingTag) int {
+		if c := cmp.Compare(b.Score, a.Score); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Tag, b.Tag)
+	})
+
+	if opts.Limit > 0 && len(trending) > opts.Limit {
+		trending = trending[:opts.Limit]
+	}
+
+	return trending
+}
+
+// Fills in the hashtags and mentions of a chirp from its body
+func (s *DBStructure) tagChirp(c *Chirp) {
+	c.Hashtags = extractHashtags(c.Body)
+	c.Mentions = extractMentions(c.Body, func(id int) bool {
+		_, ok := s.Users.Items[id]
+		return ok
+	})
+}
+
+// Returns a page of the chirps with a hashtag, sorted by ID
+func (db *DB) GetChirpsByHashtag(tag string, opts ListOptions) ([]Chirp, error) {
+	chirps := []Chirp{}
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		for _, id := range pageIds(dbStruct.idx.chirpsByHashtag[tag], opts) {
+			chirps = append(chirps, dbStruct.Chirps.Items[id])
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []Chirp{}, err
+	}
+
+	return chirps, nil
+}
+
+// Ranks the hashtags used in the window by how much and how recently they were used
+func (db *DB) TrendingHashtags(opts TrendingOptions) ([]TrendingTag, error) {
+	var uses []hashtagUse
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		buckets := dbStruct.idx.hashtagBuckets
+		start, _ := slices.BinarySearch(buckets, trendingBucketOf(opts.Now.Add(-opts.Window)))
+
+		for _, bucket := range buckets[start:] {
+			for tag, count := range dbStruct.idx.hashtagCounts[bucket] {
+				uses = append(uses, hashtagUse{tag, trendingBucketStart(bucket), count})
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return []TrendingTag{}, err
+	}
+
+	return rankTrending(uses, opts), nil
+}
@@ -0,0 +1,104 @@
+package chirpydb
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExtractHashtags(t *testing.T) {
+	cases := []struct {
+		body     string
+		expected []string
+	}{
+		{"no tags here", []string{}},
+		{"#Go is #fun, #go!", []string{"go", "fun"}},
+		{"(#paren) #snake_case #日本", []string{"paren", "snake_case", "日本"}},
+		// Not at the start of a word
+		{"a#b &#39; ##double", []string{}},
+		{"# alone", []string{}},
+	}
+
+	for _, c := range cases {
+		if tags := extractHashtags(c.body); !slices.Equal(tags, c.expected) {
+			t.Errorf("expected %v for %q, got %v", c.expected, c.body, tags)
+			return
+		}
+	}
+}
+
+func TestExtractMentions(t *testing.T) {
+	lookup := func(id int) bool {
+		return id == 1 || id == 2
+	}
+
+	cases := []struct {
+		body     string
+		expected []int
+	}{
+		{"hi @2 and @1.", []int{2, 1}},
+		{"@1 @1", []int{1}},
+		{"@3", []int{}},
+		// Emails, numbers in words and mentions by email are not mentions
+		{"mail a@1.example.com", []int{}},
+		{"@12abc", []int{}},
+		{"@a@example.com", []int{}},
+	}
+
+	for _, c := range cases {
+		if ids := extractMentions(c.body, lookup); !slices.Equal(ids, c.expected) {
+			t.Errorf("expected %v for %q, got %v", c.expected, c.body, ids)
+			return
+		}
+	}
+}
+
+func TestNormalizeHashtag(t *testing.T) {
+	for tag, expected := range map[string]string{"Go": "go", "#Go": "go", "snake_case": "snake_case"} {
+		if got, ok := NormalizeHashtag(tag); !ok || got != expected {
+			t.Errorf("expected %q for %q, got %q (%v)", expected, tag, got, ok)
+			return
+		}
+	}
+
+	for _, tag := range []string{"", "#", "two words", "a#b"} {
+		if got, ok := NormalizeHashtag(tag); ok {
+			t.Errorf("expected %q to be invalid, got %q", tag, got)
+			return
+		}
+	}
+}
+
+func TestRankTrending(t *testing.T) {
+	now := time.Now()
+	uses := []hashtagUse{
+		// Used a lot, but a while ago
+		{"old", now.Add(-4 * time.Hour), 2},
+		{"old", now.Add(-4 * time.Hour), 1},
+		// Used less, but just now
+		{"new", now, 1},
+		{"new", now.Add(-time.Minute), 1},
+		{"tie", now.Add(-time.Hour), 1},
+		{"tia", now.Add(-time.Hour), 1},
+	}
+
+	trending := rankTrending(uses, TrendingOptions{Now: now, Window: 24 * time.Hour, HalfLife: time.Hour})
+
+	var tags []string
+	for _, tag := range trending {
+		tags = append(tags, tag.Tag)
+	}
+	if !slices.Equal(tags, []string{"new", "tia", "tie", "old"}) {
+		t.Errorf("unexpected ranking %v", trending)
+		return
+	}
+	if trending[3].Count != 3 || trending[3].Score > 0.19 || trending[3].Score < 0.18 {
+		t.Errorf("expected 3 uses worth 3/16, got %v", trending[3])
+		return
+	}
+
+	trending = rankTrending(uses, TrendingOptions{Now: now, Window: 24 * time.Hour, Limit: 1})
+	if len(trending) != 1 || trending[0].Tag != "old" || trending[0].Score != 3 {
+		t.Errorf("expected plain counts without a half-life, got %v", trending)
+	}
+}
@@ -0,0 +1,202 @@
+package chirpydb
+
+import "slices"
+
+// Names of the tables in DBStructure, matching their JSON keys
+const (
+	tableChirps         = "chirps"
+	tableUsers          = "users"
+	tableRefreshTokens  = "refresh_tokens"
+	tableTokenEvents    = "token_events"
+	tableChirpRevisions = "chirp_revisions"
+	tableLikes          = "likes"
+	tableRechirps       = "rechirps"
+	tableFollows        = "follows"
+)
+
+// A single change made to a table inside a transaction
+// Before is nil if the entity was created, and After is nil if it was deleted
+type change struct {
+	Table  string
+	Key    any
+	Before any
+	After  any
+}
+
+// Everything a transaction changed, so that it can be undone
+type txLog struct {
+	changes []change
+	undo    []func()
+}
+
+func (tx *txLog) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+
+	tx.changes = nil
+	tx.undo = nil
+}
+
+// Sets items[key] to v, recording the change in the current transaction
+// Outside a transaction (e.g. while loading) the change is applied without being recorded
+func dbPut[K comparable, T any](s *DBStructure, table string, items map[K]T, key K, v T) {
+	old, existed := items[key]
+	items[key] = v
+
+	var before any
+	if existed {
+		before = old
+	}
+	s.reindex(table, before, v)
+
+	if s.tx == nil {
+		return
+	}
+
+	s.tx.changes = append(s.tx.changes, change{Table: table, Key: key, Before: before, After: v})
+	s.tx.undo = append(s.tx.undo, func() {
+		if existed {
+			items[key] = old
+		} else {
+			delete(items, key)
+		}
+		s.reindex(table, v, before)
+	})
+}
+
+// Deletes items[key], recording the change in the current transaction
+// Returns false if there was nothing to delete
+func dbDelete[K comparable, T any](s *DBStructure, table string, items map[K]T, key K) bool {
+	old, existed := items[key]
+	if !existed {
+		return false
+	}
+
+	delete(items, key)
+	s.reindex(table, old, nil)
+
+	if s.tx == nil {
+		return true
+	}
+
+	s.tx.changes = append(s.tx.changes, change{Table: table, Key: key, Before: old})
+	s.tx.undo = append(s.tx.undo, func() {
+		items[key] = old
+		s.reindex(table, nil, old)
+	})
+
+	return true
+}
+
+// Reserves the next ID of m
+func dbNextId[T any](s *DBStructure, m *DBMap[T]) int {
+	id := m.IdCount
+	m.IdCount++
+
+	if s.tx != nil {
+		s.tx.undo = append(s.tx.undo, func() {
+			m.IdCount = id
+		})
+	}
+
+	return id
+}
+
+// Sets the next ID of m, recording the change in the current transaction
+func dbSetIdCount[T any](s *DBStructure, m *DBMap[T], n int) {
+	old := m.IdCount
+	m.IdCount = n
+
+	if s.tx != nil {
+		s.tx.undo = append(s.tx.undo, func() {
+			m.IdCount = old
+		})
+	}
+}
+
+func (s *DBStructure) NewChirpId() int {
+	return dbNextId(s, &s.Chirps)
+}
+
+func (s *DBStructure) PutChirp(chirp Chirp) {
+	dbPut(s, tableChirps, s.Chirps.Items, chirp.Id, chirp)
+}
+
+// Deletes a chirp along with its revisions, and takes it off the reply count of its parent
+func (s *DBStructure) DeleteChirp(id int) bool {
+	chirp, ok := s.Chirps.Items[id]
+	if !ok {
+		return false
+	}
+
+	dbDelete(s, tableChirps, s.Chirps.Items, id)
+	s.DeleteChirpRevisions(id)
+	s.deleteChirpReactions(id)
+
+	if parent, ok := s.Chirps.Items[chirp.ReplyTo]; ok {
+		parent.ReplyCount--
+		s.PutChirp(parent)
+	}
+
+	return true
+}
+
+// Appends a revision to the history of a chirp
+func (s *DBStructure) AddChirpRevision(chirpId int, revision ChirpRevision) {
+	// The old slice is cloned, since the transaction may need it back
+	revisions := append(slices.Clone(s.ChirpRevisions[chirpId]), revision)
+	dbPut(s, tableChirpRevisions, s.ChirpRevisions, chirpId, revisions)
+}
+
+func (s *DBStructure) DeleteChirpRevisions(chirpId int) bool {
+	return dbDelete(s, tableChirpRevisions, s.ChirpRevisions, chirpId)
+}
+
+// The likes or rechirps table
+func (s *DBStructure) reactions(table string) map[string]Reaction {
+	if table == tableRechirps {
+		return s.Rechirps
+	}
+	return s.Likes
+}
+
+func (s *DBStructure) PutReaction(table string, r Reaction) {
+	dbPut(s, table, s.reactions(table), reactionKey(r.ChirpId, r.UserId), r)
+}
+
+func (s *DBStructure) DeleteReaction(table string, chirpId, userId int) bool {
+	return dbDelete(s, table, s.reactions(table), reactionKey(chirpId, userId))
+}
+
+func (s *DBStructure) PutFollow(f Follow) {
+	dbPut(s, tableFollows, s.Follows, followKey(f.FollowerId, f.FolloweeId), f)
+}
+
+func (s *DBStructure) DeleteFollow(followerId, followeeId int) bool {
+	return dbDelete(s, tableFollows, s.Follows, followKey(followerId, followeeId))
+}
+
+func (s *DBStructure) NewUserId() int {
+	return dbNextId(s, &s.Users)
+}
+
+func (s *DBStructure) PutUser(user User) {
+	dbPut(s, tableUsers, s.Users.Items, user.Id, user)
+}
+
+func (s *DBStructure) PutRefreshToken(token RefreshToken) {
+	dbPut(s, tableRefreshTokens, s.RefreshTokens, token.TokenHash, token)
+}
+
+func (s *DBStructure) DeleteRefreshToken(tokenHash string) bool {
+	return dbDelete(s, tableRefreshTokens, s.RefreshTokens, tokenHash)
+}
+
+func (s *DBStructure) NewTokenEventId() int {
+	return dbNextId(s, &s.TokenEvents)
+}
+
+func (s *DBStructure) PutTokenEvent(event TokenEvent) {
+	dbPut(s, tableTokenEvents, s.TokenEvents.Items, event.Id, event)
+}
@@ -1,47 +1,66 @@
 package chirpydb
 
-import (
-	"errors"
-)
+import "time"
 
 type User struct {
 	Id    int    `json:"id"`
 	Email string `json:"email"`
 
 	// We should not be marshalling passwords, but our database is in JSON so we have to lol
-	Password string `json:"password"`
+	// It is left out of the change feed, which is why it can be empty
+	Password string `json:"password,omitempty"`
 
 	IsChirpyRed bool `json:"is_chirpy_red"`
+
+	// Always in UTC
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	FollowerCount  int `json:"follower_count"`
+	FollowingCount int `json:"following_count"`
 }
 
 // Creates a new user and saves it to disk
 func (db *DB) CreateUser(email string, password string) (User, error) {
-	_, err := db.GetUserByEmail(email)
-	if !errors.Is(err, ErrNotExist) {
-		if err == nil {
-			// Entity already exists
-			return User{}, ErrExists
-		} else {
-			return User{}, err
+	var user User
+
+	err := db.Update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.userByEmail(email); ok {
+			return ErrExists
 		}
-	}
 
-	dbStruct, err := db.loadDB()
+		now := time.Now().UTC()
+		user = User{
+			Id:        dbStruct.NewUserId(),
+			Email:     email,
+			Password:  password,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+
+		dbStruct.PutUser(user)
+
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	user := User{
-		dbStruct.Users.IdCount,
-		email,
-		password,
-		false,
-	}
+	return user, nil
+}
 
-	dbStruct.Users.IdCount++
-	dbStruct.Users.Items[user.Id] = user
+func (db *DB) GetUser(id int) (User, error) {
+	var user User
 
-	if err := db.writeDB(dbStruct); err != nil {
+	err := db.View(func(dbStruct *DBStructure) error {
+		var ok bool
+		if user, ok = dbStruct.Users.Items[id]; !ok {
+			return ErrNotExist
+		}
+
+		return nil
+	})
+	if err != nil {
 		return User{}, err
 	}
 
@@ -49,68 +68,80 @@ func (db *DB) CreateUser(email string, password string) (User, error) {
 }
 
 func (db *DB) GetUserByEmail(email string) (User, error) {
-	dbStruct, err := db.loadDB()
+	var user User
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		var ok bool
+		if user, ok = dbStruct.userByEmail(email); !ok {
+			return ErrNotExist
+		}
+
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	for _, v := range dbStruct.Users.Items {
-		if v.Email == email {
-			return v, nil
+	return user, nil
+}
+
+func (db *DB) ChangeUserCredentials(id int, email, passwordHash string) (User, error) {
+	var user User
+
+	err := db.Update(func(dbStruct *DBStructure) error {
+		before, ok := dbStruct.Users.Items[id]
+		if !ok {
+			return ErrNotExist
 		}
-	}
 
-	return User{}, ErrNotExist
-}
+		var err error
+		if user, err = dbStruct.updateUser(id, email, passwordHash); err != nil {
+			return err
+		}
 
-func (db *DB) UpdateUser(id int, email, password string) (User, error) {
-	_, err := db.GetUserByEmail(email)
-	if !errors.Is(err, ErrNotExist) {
-		if err == nil {
-			return User{}, ErrExists
-		} else {
-			return User{}, err
+		if passwordHash != before.Password {
+			dbStruct.revokeAllSessions(id, user.UpdatedAt)
 		}
-	}
 
-	dbStruct, err := db.loadDB()
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	user, ok := dbStruct.Users.Items[id]
+	return user, nil
+}
+
+func (s *DBStructure) updateUser(id int, email, password string) (User, error) {
+	user, ok := s.Users.Items[id]
 	if !ok {
 		return User{}, ErrNotExist
 	}
 
+	// Keeping the same email is fine, taking someone else's is not
+	if other, ok := s.userByEmail(email); ok && other.Id != id {
+		return User{}, ErrExists
+	}
+
 	user.Email = email
 	user.Password = password
-	dbStruct.Users.Items[id] = user
-
-	if err := db.writeDB(dbStruct); err != nil {
-		return User{}, err
-	}
+	user.UpdatedAt = time.Now().UTC()
+	s.PutUser(user)
 
 	return user, nil
 }
 
 func (db *DB) SetUserChirpyRed(userId int, isChirpyRed bool) error {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	user, ok := dbStruct.Users.Items[userId]
-	if !ok {
-		return ErrNotExist
-	}
-
-	user.IsChirpyRed = isChirpyRed
-	dbStruct.Users.Items[userId] = user
+	return db.Update(func(dbStruct *DBStructure) error {
+		user, ok := dbStruct.Users.Items[userId]
+		if !ok {
+			return ErrNotExist
+		}
 
-	if err := db.writeDB(dbStruct); err != nil {
-		return err
-	}
+		user.IsChirpyRed = isChirpyRed
+		user.UpdatedAt = time.Now().UTC()
+		dbStruct.PutUser(user)
 
-	return nil
+		return nil
+	})
 }
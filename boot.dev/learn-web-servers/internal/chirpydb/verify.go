@@ -0,0 +1,448 @@
+package chirpydb
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of problems Verify can find
+type IssueKind string
+
+const (
+	// An entity is stored under a different key than its own ID
+	IssueKeyMismatch IssueKind = "key_mismatch"
+
+	// A chirp whose author does not exist
+	IssueDanglingAuthor IssueKind = "dangling_author"
+
+	// A refresh token whose user does not exist
+	IssueDanglingTokenUser IssueKind = "dangling_token_user"
+
+	// A refresh token that expired but was never removed
+	IssueExpiredToken IssueKind = "expired_token"
+
+	// Users whose emails only differ in case, or not at all
+	IssueDuplicateEmail IssueKind = "duplicate_email"
+
+	// An ID counter that would hand out an ID that is already taken
+	IssueIdCounter IssueKind = "id_counter"
+
+	// Revisions of a chirp that does not exist
+	IssueDanglingRevisions IssueKind = "dangling_revisions"
+
+	// A chirp whose reply count does not match its replies
+	IssueReplyCount IssueKind = "reply_count"
+
+	// A like or rechirp of a chirp or by a user that does not exist
+	IssueDanglingReaction IssueKind = "dangling_reaction"
+
+	// A chirp whose like or rechirp count does not match its reactions
+	IssueReactionCount IssueKind = "reaction_count"
+
+	// A follow of or by a user that does not exist
+	IssueDanglingFollow IssueKind = "dangling_follow"
+
+	// A user whose follower or following count does not match their follows
+	IssueFollowCount IssueKind = "follow_count"
+)
+
+// A problem found in the database
+type Issue struct {
+	Kind  IssueKind `json:"kind"`
+	Table string    `json:"table"`
+
+	// Key of the entity the issue is about, empty if it is about the whole table
+	Key string `json:"key,omitempty"`
+
+	Message string `json:"message"`
+
+	// Whether Repair fixed the issue
+	Repaired bool `json:"repaired"`
+
+	// Nil if the issue can't be repaired without a human deciding what to keep
+	repair func(s *DBStructure)
+}
+
+func (i Issue) String() string {
+	s := fmt.Sprintf("%s: %s", i.Table, i.Message)
+	if i.Key != "" {
+		s = fmt.Sprintf("%s[%s]: %s", i.Table, i.Key, i.Message)
+	}
+
+	if i.Repaired {
+		s += " (repaired)"
+	}
+
+	return s
+}
+
+// Checks the database for inconsistencies without changing anything
+func (db *DB) Verify() ([]Issue, error) {
+	var issues []Issue
+
+	err := db.View(func(dbStruct *DBStructure) error {
+		issues = dbStruct.check(time.Now())
+		return nil
+	})
+
+	return issues, err
+}
+
+// Checks the database and repairs everything that can be repaired without losing data anyone could use
+// Chirps by missing authors and refresh tokens that can't be used anymore are deleted, and ID counters are moved past
+// the largest ID; duplicate emails are only reported
+// All issues that were found are returned, with Repaired set on the ones that were fixed
+func (db *DB) Repair() ([]Issue, error) {
+	var issues []Issue
+
+	err := db.Update(func(dbStruct *DBStructure) error {
+		issues = dbStruct.check(time.Now())
+
+		for i := range issues {
+			if issues[i].repair != nil {
+				issues[i].repair(dbStruct)
+				issues[i].Repaired = true
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return issues, nil
+}
+
+// Refresh tokens are secrets, so issues only show the start of them
+func tokenRef(token string) string {
+	if len(token) <= 8 {
+		return token
+	}
+
+	return token[:8] + "..."
+}
+
+// Finds all issues in the structure, in a stable order
+// Key mismatches come first, since repairing them changes the entities the other checks look at
+func (s *DBStructure) check(now time.Time) []Issue {
+	var issues []Issue
+
+	chirpIds := slices.Sorted(maps.Keys(s.Chirps.Items))
+	userIds := slices.Sorted(maps.Keys(s.Users.Items))
+	tokens := slices.Sorted(maps.Keys(s.RefreshTokens))
+
+	for _, id := range chirpIds {
+		if chirp := s.Chirps.Items[id]; chirp.Id != id {
+			issues = append(issues, Issue{
+				Kind:    IssueKeyMismatch,
+				Table:   tableChirps,
+				Key:     strconv.Itoa(id),
+				Message: fmt.Sprintf("chirp is stored under key %d but has ID %d", id, chirp.Id),
+				repair: func(s *DBStructure) {
+					// A chirp that started its own thread still does
+					if chirp.RootId == chirp.Id {
+						chirp.RootId = id
+					}
+
+					chirp.Id = id
+					s.PutChirp(chirp)
+				},
+			})
+		}
+	}
+
+	for _, id := range userIds {
+		if user := s.Users.Items[id]; user.Id != id {
+			issues = append(issues, Issue{
+				Kind:    IssueKeyMismatch,
+				Table:   tableUsers,
+				Key:     strconv.Itoa(id),
+				Message: fmt.Sprintf("user is stored under key %d but has ID %d", id, user.Id),
+				repair: func(s *DBStructure) {
+					user.Id = id
+					s.PutUser(user)
+				},
+			})
+		}
+	}
+
+	for _, token := range tokens {
+		if refreshToken := s.RefreshTokens[token]; refreshToken.TokenHash != token {
+			issues = append(issues, Issue{
+				Kind:    IssueKeyMismatch,
+				Table:   tableRefreshTokens,
+				Key:     tokenRef(token),
+				Message: "refresh token is stored under a different key than its own hash",
+				repair: func(s *DBStructure) {
+					refreshToken.TokenHash = token
+					s.PutRefreshToken(refreshToken)
+				},
+			})
+		}
+	}
+
+	for _, id := range chirpIds {
+		chirp := s.Chirps.Items[id]
+		if _, ok := s.Users.Items[chirp.AuthorId]; !ok {
+			issues = append(issues, Issue{
+				Kind:    IssueDanglingAuthor,
+				Table:   tableChirps,
+				Key:     strconv.Itoa(id),
+				Message: fmt.Sprintf("author %d does not exist", chirp.AuthorId),
+				repair: func(s *DBStructure) {
+					s.DeleteChirp(id)
+				},
+			})
+		}
+	}
+
+	for _, token := range tokens {
+		refreshToken := s.RefreshTokens[token]
+		deleteToken := func(s *DBStructure) {
+			s.DeleteRefreshToken(token)
+		}
+
+		if _, ok := s.Users.Items[refreshToken.UserId]; !ok {
+			issues = append(issues, Issue{
+				Kind:    IssueDanglingTokenUser,
+				Table:   tableRefreshTokens,
+				Key:     tokenRef(token),
+				Message: fmt.Sprintf("user %d does not exist", refreshToken.UserId),
+				repair:  deleteToken,
+			})
+		} else if now.After(refreshToken.ExpiresAt) {
+			issues = append(issues, Issue{
+				Kind:    IssueExpiredToken,
+				Table:   tableRefreshTokens,
+				Key:     tokenRef(token),
+				Message: fmt.Sprintf("expired at %s", refreshToken.ExpiresAt.Format(time.RFC3339)),
+				repair:  deleteToken,
+			})
+		}
+	}
+
+	for _, id := range slices.Sorted(maps.Keys(s.ChirpRevisions)) {
+		if _, ok := s.Chirps.Items[id]; !ok {
+			issues = append(issues, Issue{
+				Kind:    IssueDanglingRevisions,
+				Table:   tableChirpRevisions,
+				Key:     strconv.Itoa(id),
+				Message: fmt.Sprintf("chirp %d does not exist", id),
+				repair: func(s *DBStructure) {
+					s.DeleteChirpRevisions(id)
+				},
+			})
+		}
+	}
+
+	replyCounts := map[int]int{}
+	for _, chirp := range s.Chirps.Items {
+		if chirp.ReplyTo != 0 {
+			replyCounts[chirp.ReplyTo]++
+		}
+	}
+
+	for _, id := range chirpIds {
+		if chirp := s.Chirps.Items[id]; chirp.ReplyCount != replyCounts[id] {
+			issues = append(issues, Issue{
+				Kind:    IssueReplyCount,
+				Table:   tableChirps,
+				Key:     strconv.Itoa(id),
+				Message: fmt.Sprintf("reply count is %d but there are %d replies", chirp.ReplyCount, replyCounts[id]),
+				repair: func(s *DBStructure) {
+					// Other repairs may have deleted replies since the check
+					chirp, ok := s.Chirps.Items[id]
+					if !ok {
+						return
+					}
+
+					chirp.ReplyCount = 0
+					for _, c := range s.Chirps.Items {
+						if c.ReplyTo == id {
+							chirp.ReplyCount++
+						}
+					}
+					s.PutChirp(chirp)
+				},
+			})
+		}
+	}
+
+	for _, kind := range reactionKinds {
+		table, _ := reactionTable(kind)
+		items := s.reactions(table)
+
+		for _, key := range slices.Sorted(maps.Keys(items)) {
+			r := items[key]
+
+			var message string
+			if _, ok := s.Chirps.Items[r.ChirpId]; !ok {
+				message = fmt.Sprintf("chirp %d does not exist", r.ChirpId)
+			} else if _, ok := s.Users.Items[r.UserId]; !ok {
+				message = fmt.Sprintf("user %d does not exist", r.UserId)
+			} else {
+				continue
+			}
+
+			issues = append(issues, Issue{
+				Kind:    IssueDanglingReaction,
+				Table:   table,
+				Key:     key,
+				Message: message,
+				repair: func(s *DBStructure) {
+					if !s.DeleteReaction(table, r.ChirpId, r.UserId) {
+						return
+					}
+
+					// Keep the count in line with the reactions that are left
+					if chirp, ok := s.Chirps.Items[r.ChirpId]; ok {
+						*chirp.reactionCount(kind)--
+						s.PutChirp(chirp)
+					}
+				},
+			})
+		}
+
+		for _, id := range chirpIds {
+			chirp := s.Chirps.Items[id]
+			if count := len(s.idx.reactionsByChirp[table][id]); *chirp.reactionCount(kind) != count {
+				issues = append(issues, Issue{
+					Kind:    IssueReactionCount,
+					Table:   tableChirps,
+					Key:     strconv.Itoa(id),
+					Message: fmt.Sprintf("%s count is %d but there are %d", kind, *chirp.reactionCount(kind), count),
+					repair: func(s *DBStructure) {
+						chirp, ok := s.Chirps.Items[id]
+						if !ok {
+							return
+						}
+
+						*chirp.reactionCount(kind) = len(s.idx.reactionsByChirp[table][id])
+						s.PutChirp(chirp)
+					},
+				})
+			}
+		}
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(s.Follows)) {
+		f := s.Follows[key]
+
+		missing := f.FollowerId
+		if _, ok := s.Users.Items[missing]; ok {
+			missing = f.FolloweeId
+			if _, ok := s.Users.Items[missing]; ok {
+				continue
+			}
+		}
+
+		issues = append(issues, Issue{
+			Kind:    IssueDanglingFollow,
+			Table:   tableFollows,
+			Key:     key,
+			Message: fmt.Sprintf("user %d does not exist", missing),
+			repair: func(s *DBStructure) {
+				if !s.DeleteFollow(f.FollowerId, f.FolloweeId) {
+					return
+				}
+
+				// Keep the counts in line with the follows that are left
+				if user, ok := s.Users.Items[f.FollowerId]; ok {
+					user.FollowingCount--
+					s.PutUser(user)
+				}
+				if user, ok := s.Users.Items[f.FolloweeId]; ok {
+					user.FollowerCount--
+					s.PutUser(user)
+				}
+			},
+		})
+	}
+
+	for _, id := range userIds {
+		user := s.Users.Items[id]
+		followers, following := len(s.idx.followers[id]), len(s.idx.following[id])
+		if user.FollowerCount == followers && user.FollowingCount == following {
+			continue
+		}
+
+		issues = append(issues, Issue{
+			Kind:  IssueFollowCount,
+			Table: tableUsers,
+			Key:   strconv.Itoa(id),
+			Message: fmt.Sprintf("follower and following counts are %d and %d but there are %d and %d",
+				user.FollowerCount, user.FollowingCount, followers, following),
+			repair: func(s *DBStructure) {
+				user, ok := s.Users.Items[id]
+				if !ok {
+					return
+				}
+
+				user.FollowerCount, user.FollowingCount = len(s.idx.followers[id]), len(s.idx.following[id])
+				s.PutUser(user)
+			},
+		})
+	}
+
+	usersByEmail := map[string][]int{}
+	for _, id := range userIds {
+		key := emailKey(s.Users.Items[id].Email)
+		usersByEmail[key] = append(usersByEmail[key], id)
+	}
+
+	for _, email := range slices.Sorted(maps.Keys(usersByEmail)) {
+		if ids := usersByEmail[email]; len(ids) > 1 {
+			idStrings := make([]string, len(ids))
+			for i, id := range ids {
+				idStrings[i] = strconv.Itoa(id)
+			}
+
+			issues = append(issues, Issue{
+				Kind:    IssueDuplicateEmail,
+				Table:   tableUsers,
+				Key:     email,
+				Message: fmt.Sprintf("users %s share the same email", strings.Join(idStrings, ", ")),
+			})
+		}
+	}
+
+	if issue, ok := checkIdCount(tableChirps, &s.Chirps, chirpIds); ok {
+		issue.repair = func(s *DBStructure) {
+			dbSetIdCount(s, &s.Chirps, chirpIds[len(chirpIds)-1]+1)
+		}
+		issues = append(issues, issue)
+	}
+	if issue, ok := checkIdCount(tableUsers, &s.Users, userIds); ok {
+		issue.repair = func(s *DBStructure) {
+			dbSetIdCount(s, &s.Users, userIds[len(userIds)-1]+1)
+		}
+		issues = append(issues, issue)
+	}
+	eventIds := slices.Sorted(maps.Keys(s.TokenEvents.Items))
+	if issue, ok := checkIdCount(tableTokenEvents, &s.TokenEvents, eventIds); ok {
+		issue.repair = func(s *DBStructure) {
+			dbSetIdCount(s, &s.TokenEvents, eventIds[len(eventIds)-1]+1)
+		}
+		issues = append(issues, issue)
+	}
+
+	return issues
+}
+
+// Reports an issue if the next ID of m is not past all of its sorted keys
+func checkIdCount[T any](table string, m *DBMap[T], ids []int) (Issue, bool) {
+	if len(ids) == 0 || m.IdCount > ids[len(ids)-1] {
+		return Issue{}, false
+	}
+
+	return Issue{
+		Kind:    IssueIdCounter,
+		Table:   table,
+		Message: fmt.Sprintf("next ID is %d but the largest ID is %d", m.IdCount, ids[len(ids)-1]),
+	}, true
+}
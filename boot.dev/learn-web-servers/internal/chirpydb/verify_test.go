@@ -0,0 +1,179 @@
+package chirpydb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A database that was edited by hand, with one of every issue Verify knows about
+const damagedDBJson = `{
+	"schema_version": 1,
+	"chirps": {"id_count": 3, "items": {
+		"1": {"id": 1, "body": "fine", "author_id": 1},
+		"2": {"id": 2, "body": "orphan", "author_id": 9},
+		"3": {"id": 3, "body": "uncounted reply", "author_id": 1, "reply_to": 1},
+		"5": {"id": 4, "body": "misplaced", "author_id": 1}
+	}},
+	"users": {"id_count": 3, "items": {
+		"1": {"id": 1, "email": "user@example.com"},
+		"2": {"id": 2, "email": "USER@example.com"}
+	}},
+	"refresh_tokens": {
+		"dangling": {"token": "dangling", "user_id": 9, "expires_at": "2999-01-01T00:00:00Z"},
+		"expired": {"token": "expired", "user_id": 1, "expires_at": "2000-01-01T00:00:00Z"},
+		"valid": {"token": "valid", "user_id": 2, "expires_at": "2999-01-01T00:00:00Z"}
+	},
+	"chirp_revisions": {
+		"7": [{"revision": 1, "body": "deleted", "created_at": "2024-01-01T00:00:00Z"}]
+	},
+	"likes": {
+		"1:9": {"chirp_id": 1, "user_id": 9, "created_at": "2024-01-01T00:00:00Z"},
+		"8:1": {"chirp_id": 8, "user_id": 1, "created_at": "2024-01-01T00:00:00Z"}
+	},
+	"follows": {
+		"1:9": {"follower_id": 1, "followee_id": 9, "created_at": "2024-01-01T00:00:00Z"}
+	}
+}`
+
+func countIssues(issues []Issue) map[IssueKind]int {
+	counts := map[IssueKind]int{}
+	for _, issue := range issues {
+		counts[issue.Kind]++
+	}
+
+	return counts
+}
+
+func TestVerifyAndRepair(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	if err := os.WriteFile(path, []byte(damagedDBJson), 0600); err != nil {
+		t.Errorf("could not write database file: %v", err)
+		return
+	}
+
+	db, err := NewDB(path, false)
+	if err != nil {
+		t.Errorf("could not open database: %v", err)
+		return
+	}
+
+	issues, err := db.Verify()
+	if err != nil {
+		t.Errorf("could not verify database: %v", err)
+		return
+	}
+
+	expected := map[IssueKind]int{
+		IssueKeyMismatch:       1,
+		IssueDanglingAuthor:    1,
+		IssueDanglingTokenUser: 1,
+		IssueExpiredToken:      1,
+		IssueDuplicateEmail:    1,
+		IssueIdCounter:         1,
+		IssueDanglingRevisions: 1,
+		IssueReplyCount:        1,
+		IssueDanglingReaction:  2,
+		IssueReactionCount:     1,
+		IssueDanglingFollow:    1,
+		IssueFollowCount:       1,
+	}
+	counts := countIssues(issues)
+	if len(counts) != len(expected) {
+		t.Errorf("expected issues %v, got %v", expected, issues)
+		return
+	}
+	for kind, n := range expected {
+		if counts[kind] != n {
+			t.Errorf("expected %d %s issues, got %v", n, kind, issues)
+			return
+		}
+	}
+
+	for _, issue := range issues {
+		if issue.Repaired {
+			t.Errorf("expected Verify not to repair anything, got %v", issue)
+			return
+		}
+	}
+
+	issues, err = db.Repair()
+	if err != nil {
+		t.Errorf("could not repair database: %v", err)
+		return
+	}
+
+	for _, issue := range issues {
+		if issue.Repaired == (issue.Kind == IssueDuplicateEmail) {
+			t.Errorf("unexpected repair state: %v", issue)
+			return
+		}
+	}
+
+	if _, err := db.GetChirp(2); !errors.Is(err, ErrNotExist) {
+		t.Errorf("expected the orphaned chirp to be deleted, got %v", err)
+		return
+	}
+
+	chirp, err := db.CreateChirp("new", 1)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+	if chirp.Id != 6 {
+		t.Errorf("expected the repaired counter to hand out ID 6, got %d", chirp.Id)
+		return
+	}
+	db.Close()
+
+	// The repairs must have been written to disk
+	db, err = NewDB(path, false)
+	if err != nil {
+		t.Errorf("could not reopen database: %v", err)
+		return
+	}
+	defer db.Close()
+
+	issues, err = db.Verify()
+	if err != nil {
+		t.Errorf("could not verify database: %v", err)
+		return
+	}
+	if len(issues) != 1 || issues[0].Kind != IssueDuplicateEmail {
+		t.Errorf("expected only the duplicate email to be left, got %v", issues)
+		return
+	}
+
+	authorChirps, err := db.GetChirpsByAuthor(1, ListOptions{})
+	if err != nil {
+		t.Errorf("could not get chirps by author: %v", err)
+		return
+	}
+	if len(authorChirps) != 4 || authorChirps[2].Id != 5 || authorChirps[2].RootId != 5 {
+		t.Errorf("expected the misplaced chirp to be indexed under its key, got %v", authorChirps)
+	}
+}
+
+func TestVerifyCleanDB(t *testing.T) {
+	db := newTestDB(t)
+
+	user, err := db.CreateUser("user@example.com", "hash")
+	if err != nil {
+		t.Errorf("could not create user: %v", err)
+		return
+	}
+	if _, err := db.CreateChirp("hello", user.Id); err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	issues, err := db.Verify()
+	if err != nil {
+		t.Errorf("could not verify database: %v", err)
+		return
+	}
+	if len(issues) != 0 {
+		t.Errorf("expected no issues, got %v", issues)
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mosamadeeb/chirpy/internal/chirpydb"
+)
+
+// Access tokens are signed with one key of a keyset, and name it in their kid header
+// Verification accepts any key in the keyset, so the signing key can be rotated without logging everyone out:
+// the old key stays around until every token it signed has expired
+
+// Algorithms keys can use
+const (
+	algHS256 = "HS256"
+	algRS256 = "RS256"
+	algEdDSA = "EdDSA"
+)
+
+var jwtAlgs = []string{algHS256, algRS256, algEdDSA}
+
+// Key made from JWT_SECRET, which also verifies tokens issued before keys had IDs
+const legacyJWTKeyId = "default"
+
+var (
+	errUnknownAlg = errors.New("unknown signing algorithm")
+	errUnknownKid = errors.New("unknown signing key")
+)
+
+type jwtKey struct {
+	Id        string
+	Alg       string
+	CreatedAt time.Time
+
+	// When a retired key stops being accepted, zero for the signing key
+	ExpiresAt time.Time
+
+	// HMAC secret for HS256, PKCS #8 DER private key otherwise
+	material []byte
+
+	// []byte, *rsa.PrivateKey or ed25519.PrivateKey
+	signKey any
+}
+
+// A key as stored in the keyset file
+type jwtKeyEntry struct {
+	Id        string    `json:"kid"`
+	Alg       string    `json:"alg"`
+	Key       []byte    `json:"key"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type jwtKeyFile struct {
+	SigningKeyId string        `json:"signing_key_id"`
+	Keys         []jwtKeyEntry `json:"keys"`
+}
+
+// Creates a key from its stored material
+func parseJWTKey(entry jwtKeyEntry) (*jwtKey, error) {
+	key := &jwtKey{
+		Id:        entry.Id,
+		Alg:       entry.Alg,
+		CreatedAt: entry.CreatedAt,
+		ExpiresAt: entry.ExpiresAt,
+		material:  entry.Key,
+	}
+
+	if entry.Id == "" {
+		return nil, errors.New("key has no ID")
+	}
+
+	switch entry.Alg {
+	case algHS256:
+		if len(entry.Key) == 0 {
+			return nil, fmt.Errorf("key %q has no secret", entry.Id)
+		}
+		key.signKey = entry.Key
+	case algRS256, algEdDSA:
+		parsed, err := x509.ParsePKCS8PrivateKey(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", entry.Id, err)
+		}
+
+		switch parsed := parsed.(type) {
+		case *rsa.PrivateKey:
+			if entry.Alg != algRS256 {
+				return nil, fmt.Errorf("key %q is an RSA key, not %s", entry.Id, entry.Alg)
+			}
+			key.signKey = parsed
+		case ed25519.PrivateKey:
+			if entry.Alg != algEdDSA {
+				return nil, fmt.Errorf("key %q is an Ed25519 key, not %s", entry.Id, entry.Alg)
+			}
+			key.signKey = parsed
+		default:
+			return nil, fmt.Errorf("key %q has an unsupported type %T", entry.Id, parsed)
+		}
+	default:
+		return nil, fmt.Errorf("key %q: %w %q", entry.Id, errUnknownAlg, entry.Alg)
+	}
+
+	return key, nil
+}
+
+// Generates a new key with a random ID
+func generateJWTKey(alg string) (*jwtKey, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, err
+	}
+
+	var material []byte
+	switch alg {
+	case algHS256:
+		material = make([]byte, 32)
+		if _, err := rand.Read(material); err != nil {
+			return nil, err
+		}
+	case algRS256, algEdDSA:
+		var private any
+		var err error
+		if alg == algRS256 {
+			private, err = rsa.GenerateKey(rand.Reader, 2048)
+		} else {
+			_, private, err = ed25519.GenerateKey(rand.Reader)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if material, err = x509.MarshalPKCS8PrivateKey(private); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w %q", errUnknownAlg, alg)
+	}
+
+	return parseJWTKey(jwtKeyEntry{
+		Id:        hex.EncodeToString(idBytes),
+		Alg:       alg,
+		Key:       material,
+		CreatedAt: time.Now().UTC(),
+	})
+}
+
+func (k *jwtKey) entry() jwtKeyEntry {
+	return jwtKeyEntry{k.Id, k.Alg, k.material, k.CreatedAt, k.ExpiresAt}
+}
+
+func (k *jwtKey) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Alg)
+}
+
+func (k *jwtKey) verifyKey() any {
+	switch key := k.signKey.(type) {
+	case *rsa.PrivateKey:
+		return &key.PublicKey
+	case ed25519.PrivateKey:
+		return key.Public()
+	default:
+		return key
+	}
+}
+
+func (k *jwtKey) expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// A public key in the JSON Web Key format (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Ed25519
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// Returns false for HMAC keys, which have no public half
+func (k *jwtKey) jwk() (jwk, bool) {
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	switch key := k.verifyKey().(type) {
+	case *rsa.PublicKey:
+		return jwk{Kty: "RSA", Kid: k.Id, Alg: k.Alg, Use: "sig", N: b64(key.N.Bytes()), E: b64(big.NewInt(int64(key.E)).Bytes())}, true
+	case ed25519.PublicKey:
+		return jwk{Kty: "OKP", Kid: k.Id, Alg: k.Alg, Use: "sig", Crv: "Ed25519", X: b64(key)}, true
+	default:
+		return jwk{}, false
+	}
+}
+
+// The keys access tokens are signed and verified with
+type jwtKeyset struct {
+	mu      sync.RWMutex
+	keys    []*jwtKey
+	signing *jwtKey
+
+	// File the keyset is saved to when it changes, empty if it is only kept in memory
+	path string
+
+	// The file as it was last read or written, so that keys rotated by another process get picked up
+	file os.FileInfo
+}
+
+func newJWTKeyset(path string, keys []*jwtKey, signingId string) (*jwtKeyset, error) {
+	ks := &jwtKeyset{path: path}
+
+	for _, key := range keys {
+		if slices.ContainsFunc(ks.keys, func(k *jwtKey) bool { return k.Id == key.Id }) {
+			return nil, fmt.Errorf("duplicate key ID %q", key.Id)
+		}
+
+		ks.keys = append(ks.keys, key)
+		if key.Id == signingId {
+			ks.signing = key
+		}
+	}
+
+	if ks.signing == nil {
+		return nil, fmt.Errorf("signing key %q is not in the keyset", signingId)
+	}
+	if !ks.signing.ExpiresAt.IsZero() {
+		return nil, fmt.Errorf("signing key %q is retired", signingId)
+	}
+
+	return ks, nil
+}
+
+// Keyset with a single HS256 key, made from a shared secret
+func newSecretJWTKeyset(secret string) (*jwtKeyset, error) {
+	key, err := parseJWTKey(jwtKeyEntry{Id: legacyJWTKeyId, Alg: algHS256, Key: []byte(secret), CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return nil, err
+	}
+
+	return newJWTKeyset("", []*jwtKey{key}, key.Id)
+}
+
+// Reads the keyset from path
+// If the file does not exist yet, it is created with a key made from secret, or with a new EdDSA key if there is no secret
+// An empty path keeps the keyset in memory only, which means rotated keys are lost on restart
+func loadJWTKeyset(path string, secret string) (*jwtKeyset, error) {
+	if path == "" {
+		return initialJWTKeyset(secret)
+	}
+
+	// Another process starting at the same time must not create a different keyset
+	var ks *jwtKeyset
+	err := chirpydb.WithLockFile(path+keysetLockSuffix, func() error {
+		loaded, err := readJWTKeyset(path)
+		if err == nil {
+			ks = loaded
+			return nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		created, err := initialJWTKeyset(secret)
+		if err != nil {
+			return err
+		}
+
+		created.path = path
+		if err := created.save(created.keys, created.signing); err != nil {
+			return err
+		}
+
+		ks = created
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ks, nil
+}
+
+// The keyset a new keyset file starts with, see loadJWTKeyset
+func initialJWTKeyset(secret string) (*jwtKeyset, error) {
+	if secret != "" {
+		return newSecretJWTKeyset(secret)
+	}
+
+	key, err := generateJWTKey(algEdDSA)
+	if err != nil {
+		return nil, err
+	}
+
+	return newJWTKeyset("", []*jwtKey{key}, key.Id)
+}
+
+// Reads the keyset file at path
+func readJWTKeyset(path string) (*jwtKeyset, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Stat the file that is read, in case it gets replaced in between
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var file jwtKeyFile
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return nil, fmt.Errorf("could not parse keyset: %w", err)
+	}
+
+	keys := make([]*jwtKey, 0, len(file.Keys))
+	for _, entry := range file.Keys {
+		key, err := parseJWTKey(entry)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	ks, err := newJWTKeyset(path, keys, file.SigningKeyId)
+	if err != nil {
+		return nil, err
+	}
+
+	ks.file = info
+	return ks, nil
+}
+
+// Lock file next to the keyset file, which is held while changing it
+// The keyset file itself is replaced on every save, so it can't hold the lock
+const keysetLockSuffix = ".lock"
+
+// Runs fn while holding the lock on the keyset file, so that several processes changing it don't lose each other's keys
+// This just runs fn if the keyset is only kept in memory
+func (ks *jwtKeyset) withFileLock(fn func() error) error {
+	if ks.path == "" {
+		return fn()
+	}
+
+	return chirpydb.WithLockFile(ks.path+keysetLockSuffix, fn)
+}
+
+// Picks up the keyset file if another process replaced it since it was last read
+// Errors are only logged, since the keys in memory still work
+func (ks *jwtKeyset) reload() {
+	if err := ks.refresh(); err != nil {
+		log.Printf("Error reloading keyset: %v\n", err)
+	}
+}
+
+// Like reload, but returns the error
+func (ks *jwtKeyset) refresh() error {
+	if ks.path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(ks.path)
+	if err != nil {
+		return err
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	// Every save renames a new file into place, so an unchanged file is the same one with the same mtime
+	if ks.file != nil && os.SameFile(info, ks.file) && info.ModTime().Equal(ks.file.ModTime()) {
+		return nil
+	}
+
+	loaded, err := readJWTKeyset(ks.path)
+	if err != nil {
+		return err
+	}
+
+	ks.keys, ks.signing, ks.file = loaded.keys, loaded.signing, loaded.file
+	return nil
+}
+
+// Writes keys to the keyset file, replacing it atomically
+// Must be called with both locks held, or before the keyset is shared
+func (ks *jwtKeyset) save(keys []*jwtKey, signing *jwtKey) error {
+	if ks.path == "" {
+		return nil
+	}
+
+	file := jwtKeyFile{SigningKeyId: signing.Id, Keys: make([]jwtKeyEntry, len(keys))}
+	for i, key := range keys {
+		file.Keys[i] = key.entry()
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Synced to disk, so a rotated key is not lost to a crash after tokens were signed with it
+	if err := chirpydb.WriteFileAtomic(ks.path, data); err != nil {
+		return fmt.Errorf("could not write keyset: %w", err)
+	}
+
+	info, err := os.Stat(ks.path)
+	if err != nil {
+		return fmt.Errorf("could not write keyset: %w", err)
+	}
+
+	ks.file = info
+	return nil
+}
+
+// Signs claims with the signing key
+func (ks *jwtKeyset) sign(claims jwt.Claims) (string, error) {
+	ks.reload()
+
+	ks.mu.RLock()
+	key := ks.signing
+	ks.mu.RUnlock()
+
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.Id
+
+	return token.SignedString(key.signKey)
+}
+
+// Finds the key a token was signed with, for jwt.Parse
+// Tokens without a kid were issued before keys had IDs, and can only have been signed with the legacy key
+func (ks *jwtKeyset) keyFunc(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		kid = legacyJWTKeyId
+	}
+
+	key := ks.find(kid)
+	if key == nil {
+		// Another process sharing the keyset file may have rotated to a key this one has not seen yet
+		ks.reload()
+		if key = ks.find(kid); key == nil {
+			return nil, errUnknownKid
+		}
+	}
+
+	if t.Method.Alg() != key.Alg {
+		return nil, errors.New("unexpected signing method")
+	}
+
+	return key.verifyKey(), nil
+}
+
+// Returns the key with the given ID, or nil if there is none or it expired
+func (ks *jwtKeyset) find(kid string) *jwtKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	i := slices.IndexFunc(ks.keys, func(k *jwtKey) bool { return k.Id == kid })
+	if i < 0 || ks.keys[i].expired(time.Now()) {
+		return nil
+	}
+
+	return ks.keys[i]
+}
+
+// Makes a new key of the given algorithm the signing key, or one of the same algorithm as the current one if alg is empty
+// The old signing key keeps verifying tokens for as long as they can live, and keys that retired before that are dropped
+func (ks *jwtKeyset) rotate(alg string) (jwtKeyRes, error) {
+	var res jwtKeyRes
+
+	// Other processes rotating at the same time wait for this one, and then build on the keyset it saved
+	err := ks.withFileLock(func() error {
+		// Build on the latest keyset, so that keys another process rotated to are kept
+		if err := ks.refresh(); err != nil {
+			return err
+		}
+
+		var err error
+		res, err = ks.addSigningKey(alg)
+		return err
+	})
+	if err != nil {
+		return jwtKeyRes{}, err
+	}
+
+	return res, nil
+}
+
+// The part of rotate that changes the keyset, must be called with the file lock held
+func (ks *jwtKeyset) addSigningKey(alg string) (jwtKeyRes, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if alg == "" {
+		alg = ks.signing.Alg
+	}
+
+	key, err := generateJWTKey(alg)
+	if err != nil {
+		return jwtKeyRes{}, err
+	}
+
+	now := time.Now().UTC()
+	retired := *ks.signing
+	retired.ExpiresAt = now.Add(jwtDefaultTimeout)
+
+	keys := make([]*jwtKey, 0, len(ks.keys)+1)
+	for _, k := range ks.keys {
+		if k == ks.signing {
+			keys = append(keys, &retired)
+		} else if !k.expired(now) {
+			keys = append(keys, k)
+		}
+	}
+	keys = append(keys, key)
+
+	if err := ks.save(keys, key); err != nil {
+		return jwtKeyRes{}, err
+	}
+
+	ks.keys, ks.signing = keys, key
+	return ks.keyRes(key), nil
+}
+
+// Public keys of every key that still verifies tokens
+func (ks *jwtKeyset) jwks() []jwk {
+	ks.reload()
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	now := time.Now()
+	res := []jwk{}
+	for _, key := range ks.keys {
+		if key.expired(now) {
+			continue
+		}
+
+		if pub, ok := key.jwk(); ok {
+			res = append(res, pub)
+		}
+	}
+
+	return res
+}
+
+// A key as shown to admins, without its material
+type jwtKeyRes struct {
+	Id        string     `json:"kid"`
+	Alg       string     `json:"alg"`
+	Signing   bool       `json:"signing"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (ks *jwtKeyset) list() []jwtKeyRes {
+	ks.reload()
+
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	res := make([]jwtKeyRes, 0, len(ks.keys))
+	for _, key := range ks.keys {
+		res = append(res, ks.keyRes(key))
+	}
+
+	return res
+}
+
+// Must be called with the lock held
+func (ks *jwtKeyset) keyRes(key *jwtKey) jwtKeyRes {
+	res := jwtKeyRes{Id: key.Id, Alg: key.Alg, Signing: key == ks.signing, CreatedAt: key.CreatedAt}
+	if !key.ExpiresAt.IsZero() {
+		expiresAt := key.ExpiresAt
+		res.ExpiresAt = &expiresAt
+	}
+
+	return res
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The kid header of a token, without verifying it
+func tokenKid(t *testing.T, token string) string {
+	t.Helper()
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &chirpyClaims{})
+	if err != nil {
+		t.Fatalf("could not parse token: %v", err)
+	}
+
+	kid, _ := parsed.Header["kid"].(string)
+	return kid
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	s := newTestServer(t)
+	s.ApiCfg.adminApiKey = testAdminApiKey
+	user, oldToken := newTestUser(t, s, "user@example.com")
+
+	// Tokens issued before keys had IDs
+	noKidToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   "1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).SignedString([]byte(testJwtSecret))
+	if err != nil {
+		t.Errorf("could not create token: %v", err)
+		return
+	}
+
+	do := func(method, path, auth, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+
+		rec := httptest.NewRecorder()
+		s.Mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rotate := func(alg string) jwtKeyRes {
+		rec := do("POST", "/admin/jwt-keys/rotate", "ApiKey "+testAdminApiKey, `{"alg":"`+alg+`"}`)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("expected status %d when rotating to %s, got %d", http.StatusCreated, alg, rec.Code)
+		}
+
+		var key jwtKeyRes
+		json.NewDecoder(rec.Body).Decode(&key)
+		return key
+	}
+
+	if rec := do("POST", "/admin/jwt-keys/rotate", "", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d without the admin key, got %d", http.StatusUnauthorized, rec.Code)
+		return
+	}
+	if rec := do("POST", "/admin/jwt-keys/rotate", "ApiKey "+testAdminApiKey, `{"alg":"none"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an unknown algorithm, got %d", http.StatusBadRequest, rec.Code)
+		return
+	}
+
+	edKey := rotate(algEdDSA)
+	if !edKey.Signing || edKey.Alg != algEdDSA {
+		t.Errorf("expected a new EdDSA signing key, got %v", edKey)
+		return
+	}
+
+	newToken, err := createJWT(user.Id, time.Hour, s.ApiCfg.jwtKeys)
+	if err != nil {
+		t.Errorf("could not create JWT: %v", err)
+		return
+	}
+	if kid := tokenKid(t, newToken); kid != edKey.Id {
+		t.Errorf("expected the new token to be signed with %s, got %s", edKey.Id, kid)
+		return
+	}
+
+	// Nobody is logged out by the rotation
+	for _, token := range []string{oldToken, noKidToken, newToken} {
+		if rec := do("GET", "/api/timeline", "Bearer "+token, ""); rec.Code != http.StatusOK {
+			t.Errorf("expected status %d for token signed with %q, got %d", http.StatusOK, tokenKid(t, token), rec.Code)
+			return
+		}
+	}
+
+	// The published key verifies the new token
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(do("GET", "/.well-known/jwks.json", "", "").Body).Decode(&jwks); err != nil {
+		t.Errorf("could not decode JWKS: %v", err)
+		return
+	}
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != edKey.Id || jwks.Keys[0].Crv != "Ed25519" {
+		t.Errorf("expected only the EdDSA key to be published, got %v", jwks.Keys)
+		return
+	}
+	pub, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+	if err != nil {
+		t.Errorf("could not decode public key: %v", err)
+		return
+	}
+	if _, err := jwt.ParseWithClaims(newToken, &chirpyClaims{}, func(*jwt.Token) (any, error) { return ed25519.PublicKey(pub), nil }); err != nil {
+		t.Errorf("could not verify token with the published key: %v", err)
+		return
+	}
+
+	rsaKey := rotate(algRS256)
+	var keys []jwtKeyRes
+	json.NewDecoder(do("GET", "/admin/jwt-keys", "ApiKey "+testAdminApiKey, "").Body).Decode(&keys)
+	if len(keys) != 3 || keys[0].ExpiresAt == nil || keys[1].ExpiresAt == nil || keys[2].Id != rsaKey.Id || !keys[2].Signing {
+		t.Errorf("expected two retired keys and the RSA signing key, got %v", keys)
+		return
+	}
+
+	// Once retired keys expire, their tokens do too
+	for _, key := range s.ApiCfg.jwtKeys.keys[:2] {
+		key.ExpiresAt = time.Now().Add(-time.Second)
+	}
+	for _, token := range []string{oldToken, noKidToken, newToken} {
+		if rec := do("GET", "/api/timeline", "Bearer "+token, ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d for token signed with expired key %q, got %d", http.StatusUnauthorized, tokenKid(t, token), rec.Code)
+			return
+		}
+	}
+
+	rsaToken, err := createJWT(user.Id, time.Hour, s.ApiCfg.jwtKeys)
+	if err != nil {
+		t.Errorf("could not create JWT: %v", err)
+		return
+	}
+	if rec := do("GET", "/api/timeline", "Bearer "+rsaToken, ""); rec.Code != http.StatusOK {
+		t.Errorf("expected status %d for a token signed with the RSA key, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestLoadJWTKeyset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt_keys.json")
+
+	keys, err := loadJWTKeyset(path, testJwtSecret)
+	if err != nil {
+		t.Errorf("could not create keyset: %v", err)
+		return
+	}
+
+	oldToken, err := createJWT(1, time.Hour, keys)
+	if err != nil {
+		t.Errorf("could not create JWT: %v", err)
+		return
+	}
+
+	rotated, err := keys.rotate(algRS256)
+	if err != nil {
+		t.Errorf("could not rotate keys: %v", err)
+		return
+	}
+
+	// The secret is only used to seed a new keyset
+	reloaded, err := loadJWTKeyset(path, "ignored")
+	if err != nil {
+		t.Errorf("could not reload keyset: %v", err)
+		return
+	}
+
+	if reloaded.signing.Id != rotated.Id || len(reloaded.keys) != 2 {
+		t.Errorf("expected the rotated keyset to be saved, got %v", reloaded.list())
+		return
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+oldToken)
+	if _, err := authenticateJWT(req, reloaded); err != nil {
+		t.Errorf("expected the old token to survive a restart, got %v", err)
+	}
+}
+
+func TestSharedJWTKeyset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwt_keys.json")
+
+	first, err := loadJWTKeyset(path, testJwtSecret)
+	if err != nil {
+		t.Errorf("could not create keyset: %v", err)
+		return
+	}
+	second, err := loadJWTKeyset(path, "ignored")
+	if err != nil {
+		t.Errorf("could not load keyset: %v", err)
+		return
+	}
+
+	// Another process rotates the keys
+	rotated, err := second.rotate(algEdDSA)
+	if err != nil {
+		t.Errorf("could not rotate keys: %v", err)
+		return
+	}
+
+	newToken, err := createJWT(1, time.Hour, second)
+	if err != nil {
+		t.Errorf("could not create JWT: %v", err)
+		return
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+newToken)
+	if _, err := authenticateJWT(req, first); err != nil {
+		t.Errorf("expected a token signed with the new key to be accepted, got %v", err)
+		return
+	}
+
+	token, err := createJWT(1, time.Hour, first)
+	if err != nil {
+		t.Errorf("could not create JWT: %v", err)
+		return
+	}
+	if kid := tokenKid(t, token); kid != rotated.Id {
+		t.Errorf("expected tokens to be signed with %s after the rotation, got %s", rotated.Id, kid)
+		return
+	}
+
+	// Rotating again builds on the keyset the other process saved
+	if _, err := first.rotate(""); err != nil {
+		t.Errorf("could not rotate keys: %v", err)
+		return
+	}
+	if keys := second.list(); len(keys) != 3 {
+		t.Errorf("expected both rotations to be kept, got %v", keys)
+		return
+	}
+
+	// Rotations at the same time wait for each other instead of overwriting each other's keys
+	var wg sync.WaitGroup
+	for _, ks := range []*jwtKeyset{first, second, first, second} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ks.rotate(""); err != nil {
+				t.Errorf("could not rotate keys: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	onDisk, err := readJWTKeyset(path)
+	if err != nil {
+		t.Errorf("could not read keyset: %v", err)
+		return
+	}
+	if keys := onDisk.list(); len(keys) != 7 {
+		t.Errorf("expected every rotation to be kept, got %v", keys)
+	}
+}
@@ -1,31 +1,142 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	chirpydb "github.com/mosamadeeb/chirpy/internal/chirpydb"
 )
 
+// Reads the database encryption keys from DB_ENCRYPTION_KEYS, or from the file in DB_ENCRYPTION_KEYS_FILE
+// Returns nil if neither is set, in which case the database is not encrypted
+func loadKeyring() (*chirpydb.Keyring, error) {
+	spec := os.Getenv("DB_ENCRYPTION_KEYS")
+
+	if path := os.Getenv("DB_ENCRYPTION_KEYS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		spec = string(data)
+	}
+
+	if spec == "" {
+		return nil, nil
+	}
+
+	return chirpydb.ParseKeyring(spec, os.Getenv("DB_ENCRYPTION_KEY_ID"))
+}
+
 func main() {
 	godotenv.Load()
 
 	dbg := flag.Bool("debug", false, "Enable debug mode")
+	backend := flag.String("store", chirpydb.BackendJSON, "Storage backend to use (json or sqlite)")
+	dbPath := flag.String("db", "", "Path to the database file (defaults to ./database.json or ./database.sqlite)")
+	flushInterval := flag.Duration("flush-interval", 0, "How often the JSON database is written to disk (0 writes on every change)")
+	journal := flag.Bool("journal", false, "Append changes to a journal instead of rewriting the JSON database")
+	compactInterval := flag.Duration("compact-interval", time.Minute, "How often the journal is folded into the JSON database")
+	shared := flag.Bool("shared", false, "Lock the JSON database so that other processes can use it at the same time")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "Report which schema migrations the JSON database needs, without applying them")
+	snapshotDir := flag.String("snapshot-dir", "./snapshots", "Directory where database snapshots are stored")
+	snapshotKeep := flag.Int("snapshot-keep", 10, "How many snapshots to keep (0 keeps all of them)")
+	snapshotMaxAge := flag.Duration("snapshot-max-age", 0, "Delete snapshots older than this (0 keeps them regardless of age)")
+	editWindow := flag.Duration("edit-window", 5*time.Minute, "How long authors can edit their chirps after posting them (0 means forever)")
+	redEditWindow := flag.Duration("red-edit-window", 0, "How long Chirpy Red users can edit their chirps after posting them (0 means forever)")
 	flag.Parse()
 
+	if *dbPath == "" {
+		if *backend == chirpydb.BackendSQLite {
+			*dbPath = "./database.sqlite"
+		} else {
+			*dbPath = "./database.json"
+		}
+	}
+
+	keys, err := loadKeyring()
+	if err != nil {
+		log.Fatalf("could not load encryption keys: %v\n", err)
+	}
+
+	if *migrateDryRun {
+		plan, err := chirpydb.PlanMigrations(*dbPath, keys)
+		if err != nil {
+			log.Fatalf("could not plan migrations: %v\n", err)
+		}
+
+		fmt.Print(plan)
+		return
+	}
+
+	// Opening the database could migrate or recover the file, which a dump must not do
+	if args := flag.Args(); len(args) >= 2 && args[0] == "db" && args[1] == "decrypt" {
+		if err := runDBDecrypt(args[2:], *backend, *dbPath, keys); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Make sure the database file exists
-	db, err := chirpydb.NewDB("./database.json", *dbg)
+	db, err := chirpydb.Open(*backend, *dbPath, chirpydb.Options{
+		Debug:           *dbg,
+		FlushInterval:   *flushInterval,
+		Journal:         *journal,
+		CompactInterval: *compactInterval,
+		Shared:          *shared,
+		Keys:            keys,
+		// Changing the key logs everyone out once their access token expires
+		// If it isn't set, the database generates one and keeps it next to itself
+		TokenKey: []byte(os.Getenv("REFRESH_TOKEN_KEY")),
+	})
 	if err != nil {
 		log.Fatalf("could not create database connection: %v\n", err)
 	}
 
-	jwtSecret := os.Getenv("JWT_SECRET")
+	var snapshots *chirpydb.Snapshots
+	if snapshotter, ok := db.(chirpydb.Snapshotter); ok {
+		snapshots = chirpydb.NewSnapshots(*snapshotDir, snapshotter, chirpydb.RetentionPolicy{
+			Keep:   *snapshotKeep,
+			MaxAge: *snapshotMaxAge,
+		})
+	}
+
+	if flag.NArg() > 0 {
+		err := runCommand(flag.Args(), db, snapshots)
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Tokens signed with JWT_SECRET stay valid when moving to a keyset file, since it seeds the keyset
+	jwtKeys, err := loadJWTKeyset(os.Getenv("JWT_KEYS_FILE"), os.Getenv("JWT_SECRET"))
+	if err != nil {
+		log.Fatalf("could not load JWT keys: %v\n", err)
+	}
+
 	polkaApi := os.Getenv("POLKA_API")
-	state := newServerState(http.NewServeMux(), &apiConfig{jwtSecret: jwtSecret, polkaApi: polkaApi}, db)
+	adminApiKey := os.Getenv("ADMIN_API_KEY")
+	state := newServerState(http.NewServeMux(), &apiConfig{
+		jwtKeys:       jwtKeys,
+		polkaApi:      polkaApi,
+		adminApiKey:   adminApiKey,
+		editWindow:    *editWindow,
+		redEditWindow: *redEditWindow,
+	}, db)
+	state.Snapshots = snapshots
 
 	serve := http.Server{
 		Handler: state.Mux,
@@ -46,7 +157,7 @@ func main() {
 	stopChan := make(chan struct{})
 	go func() {
 		err := serve.ListenAndServe()
-		if err != nil {
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			// ListenAndServe never returns nil
 			fmt.Println(err)
 		}
@@ -56,6 +167,24 @@ func main() {
 
 	fmt.Println("Server up and running!")
 
+	// Shut down gracefully on Ctrl+C, so that pending database writes are not lost
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
 	// Wait until server shuts down
-	<-stopChan
+	select {
+	case <-sigChan:
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := serve.Shutdown(ctx); err != nil {
+			fmt.Println(err)
+		}
+		<-stopChan
+	case <-stopChan:
+	}
+
+	if err := db.Close(); err != nil {
+		log.Printf("could not close database: %v\n", err)
+	}
 }
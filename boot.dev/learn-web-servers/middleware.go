@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mosamadeeb/chirpy/internal/chirpydb"
+)
+
+// What an access token lets its bearer do
+const (
+	scopeChirpsWrite = "chirps:write"
+	scopeUsersWrite  = "users:write"
+)
+
+// Access tokens are given every scope, and older tokens without a scope claim are treated the same
+var allScopes = []string{scopeChirpsWrite, scopeUsersWrite}
+
+// Roles come from the user, not the token, so they change as soon as the user does
+const roleChirpyRed = "chirpy_red"
+
+// The authenticated caller of a request
+type principal struct {
+	User   chirpydb.User
+	Scopes []string
+	Roles  []string
+}
+
+func (p principal) hasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope)
+}
+
+func (p principal) hasRole(role string) bool {
+	return slices.Contains(p.Roles, role)
+}
+
+type principalKey struct{}
+
+// Returns the caller that requireAuth or optionalAuth put in the context
+// It is false for anonymous requests
+func principalFromContext(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(principal)
+	return p, ok
+}
+
+// The ID of the caller, or 0 for anonymous requests
+func callerId(r *http.Request) int {
+	p, _ := principalFromContext(r.Context())
+	return p.User.Id
+}
+
+// Something the caller must have for requireAuth to let the request through
+// It returns the message to send back when the caller does not have it
+type authRequirement func(p principal) (ok bool, msg string)
+
+func requireScope(scope string) authRequirement {
+	return func(p principal) (bool, string) {
+		return p.hasScope(scope), "Access token is missing the " + scope + " scope"
+	}
+}
+
+func requireRole(role string) authRequirement {
+	return func(p principal) (bool, string) {
+		return p.hasRole(role), "Only " + role + " users can do this"
+	}
+}
+
+// Errors that make a request unauthenticated, rather than failing it
+var (
+	errNoToken      = errors.New("no access token")
+	errInvalidToken = errors.New("invalid access token")
+)
+
+// Validates the bearer token of a request and loads the user it belongs to
+func (s serverState) authenticate(r *http.Request) (principal, error) {
+	if r.Header.Get("Authorization") == "" {
+		return principal{}, errNoToken
+	}
+
+	claims, err := authenticateJWT(r, s.ApiCfg.jwtKeys)
+	if err != nil {
+		return principal{}, errInvalidToken
+	}
+
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return principal{}, errInvalidToken
+	}
+
+	user, err := s.DB.GetUser(userId)
+	if err != nil {
+		if errors.Is(err, chirpydb.ErrNotExist) {
+			// The token outlived its user
+			return principal{}, errInvalidToken
+		}
+
+		return principal{}, err
+	}
+
+	p := principal{User: user, Scopes: allScopes, Roles: []string{}}
+	if claims.Scope != "" {
+		p.Scopes = strings.Fields(claims.Scope)
+	}
+	if user.IsChirpyRed {
+		p.Roles = append(p.Roles, roleChirpyRed)
+	}
+
+	return p, nil
+}
+
+func respondUnauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="chirpy"`)
+	respondWithError(w, http.StatusUnauthorized, "Missing or invalid access token")
+}
+
+// Middleware that only lets requests through with a valid access token whose caller meets every requirement
+// The caller is put in the request context
+func (s serverState) requireAuth(reqs ...authRequirement) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			p, err := s.authenticate(r)
+			if errors.Is(err, errNoToken) || errors.Is(err, errInvalidToken) {
+				respondUnauthorized(w)
+				return
+			} else if err != nil {
+				log.Printf("Error authenticating request: %v\n", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			for _, req := range reqs {
+				if ok, msg := req(p); !ok {
+					respondWithError(w, http.StatusForbidden, msg)
+					return
+				}
+			}
+
+			next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+		}
+	}
+}
+
+// Middleware that puts the caller in the request context if there is a valid access token
+// Routes using it serve public data, so requests without a token, or with an expired or invalid one, go through anonymously
+func (s serverState) optionalAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := s.authenticate(r)
+		if errors.Is(err, errNoToken) || errors.Is(err, errInvalidToken) {
+			next(w, r)
+			return
+		} else if err != nil {
+			log.Printf("Error authenticating request: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	}
+}
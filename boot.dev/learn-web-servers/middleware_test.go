@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequireAuth(t *testing.T) {
+	s := newTestServer(t)
+	user, token := newTestUser(t, s, "user@example.com")
+
+	usersOnly, err := createScopedJWT(user.Id, time.Hour, s.ApiCfg.jwtKeys, []string{scopeUsersWrite})
+	if err != nil {
+		t.Errorf("could not create JWT: %v", err)
+		return
+	}
+	expired, err := createJWT(user.Id, -time.Hour, s.ApiCfg.jwtKeys)
+	if err != nil {
+		t.Errorf("could not create JWT: %v", err)
+		return
+	}
+	// A token for a user that was never created
+	orphan, err := createJWT(100, time.Hour, s.ApiCfg.jwtKeys)
+	if err != nil {
+		t.Errorf("could not create JWT: %v", err)
+		return
+	}
+
+	var seen principal
+	handler := s.requireAuth(requireScope(scopeChirpsWrite))(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = principalFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	})
+	redOnly := s.requireAuth(requireRole(roleChirpyRed))(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	do := func(h http.HandlerFunc, token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		h(rec, req)
+
+		return rec
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		code  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"garbage token", "not-a-token", http.StatusUnauthorized},
+		{"expired token", expired, http.StatusUnauthorized},
+		{"deleted user", orphan, http.StatusUnauthorized},
+		{"missing scope", usersOnly, http.StatusForbidden},
+		{"valid token", token, http.StatusNoContent},
+	} {
+		rec := do(handler, tc.token)
+		if rec.Code != tc.code {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.code, rec.Code)
+			return
+		}
+
+		if tc.code == http.StatusNoContent {
+			continue
+		}
+
+		var res struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || res.Error == "" {
+			t.Errorf("%s: expected an error body, got %q", tc.name, rec.Body.String())
+			return
+		}
+		if tc.code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a WWW-Authenticate header", tc.name)
+			return
+		}
+	}
+
+	if seen.User.Id != user.Id || !seen.hasScope(scopeUsersWrite) || len(seen.Roles) != 0 {
+		t.Errorf("expected the caller in the context, got %v", seen)
+		return
+	}
+
+	// Roles follow the user, so an old token picks up an upgrade right away
+	if rec := do(redOnly, token); rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d before upgrading, got %d", http.StatusForbidden, rec.Code)
+		return
+	}
+	if err := s.DB.SetUserChirpyRed(user.Id, true); err != nil {
+		t.Errorf("could not upgrade user: %v", err)
+		return
+	}
+	if rec := do(redOnly, token); rec.Code != http.StatusNoContent {
+		t.Errorf("expected status %d after upgrading, got %d", http.StatusNoContent, rec.Code)
+	}
+}
+
+func TestOptionalAuth(t *testing.T) {
+	s := newTestServer(t)
+	user, token := newTestUser(t, s, "user@example.com")
+
+	var seen principal
+	var ok bool
+	handler := s.optionalAuth(func(w http.ResponseWriter, r *http.Request) {
+		seen, ok = principalFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusNoContent || ok {
+		t.Errorf("expected an anonymous request to go through without a caller, got status %d", rec.Code)
+		return
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler(rec, req)
+	if rec.Code != http.StatusNoContent || !ok || seen.User.Id != user.Id {
+		t.Errorf("expected the caller in the context, got %v with status %d", seen, rec.Code)
+		return
+	}
+
+	// A stale token doesn't take away access to public data
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer not-a-token")
+	handler(rec, req)
+	if rec.Code != http.StatusNoContent || ok {
+		t.Errorf("expected an invalid token to go through without a caller, got status %d", rec.Code)
+	}
+}
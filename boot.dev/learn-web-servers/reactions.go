@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/mosamadeeb/chirpy/internal/chirpydb"
+)
+
+// Path segments of the reaction endpoints
+var reactionPaths = map[string]chirpydb.ReactionKind{
+	"likes":    chirpydb.ReactionLike,
+	"rechirps": chirpydb.ReactionRechirp,
+}
+
+// A chirp as seen by the user asking for it
+// The flags are left out when nobody is logged in
+type chirpRes struct {
+	chirpydb.Chirp
+	LikedByMe     *bool `json:"liked_by_me,omitempty"`
+	RechirpedByMe *bool `json:"rechirped_by_me,omitempty"`
+}
+
+// A user who reacted to a chirp
+type reactionRes struct {
+	UserId    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Adds what the viewer has reacted to to a list of chirps
+func (s serverState) createChirpResponses(viewerId int, chirps []chirpydb.Chirp) ([]chirpRes, error) {
+	res := make([]chirpRes, len(chirps))
+	for i, c := range chirps {
+		res[i].Chirp = c
+	}
+
+	if viewerId == 0 || len(chirps) == 0 {
+		return res, nil
+	}
+
+	ids := make([]int, len(chirps))
+	for i, c := range chirps {
+		ids[i] = c.Id
+	}
+
+	liked, err := s.DB.ReactedTo(chirpydb.ReactionLike, viewerId, ids)
+	if err != nil {
+		return nil, err
+	}
+	rechirped, err := s.DB.ReactedTo(chirpydb.ReactionRechirp, viewerId, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range res {
+		likedByMe, rechirpedByMe := liked[ids[i]], rechirped[ids[i]]
+		res[i].LikedByMe, res[i].RechirpedByMe = &likedByMe, &rechirpedByMe
+	}
+
+	return res, nil
+}
+
+func (s serverState) createChirpResponse(viewerId int, chirp chirpydb.Chirp) (chirpRes, error) {
+	res, err := s.createChirpResponses(viewerId, []chirpydb.Chirp{chirp})
+	if err != nil {
+		return chirpRes{}, err
+	}
+
+	return res[0], nil
+}
+
+// Reads the limit and cursor parameters of a listing sorted by ID
+// Cursors hold the last ID of the page, and the listing and ID they were made for
+func idPageOptions(query url.Values, listing string, ownerId int) (chirpydb.ListOptions, error) {
+	var opts chirpydb.ListOptions
+
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		if opts.Limit, err = strconv.Atoi(limitStr); err != nil || opts.Limit <= 0 || opts.Limit > maxChirpsLimit {
+			return chirpydb.ListOptions{}, fmt.Errorf("Limit must be between 1 and %d", maxChirpsLimit)
+		}
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		c, ok := decodeChirpCursor(cursor)
+		if !ok || c.Sort != listing || c.AuthorId != ownerId {
+			return chirpydb.ListOptions{}, errors.New("Invalid cursor")
+		}
+
+		opts.After = c.LastId
+	}
+
+	return opts, nil
+}
+
+// Sets the Link header to the page after the one ending at lastId
+func setNextPageLink(w http.ResponseWriter, r *http.Request, listing string, ownerId int, lastId int) {
+	next := r.URL.Query()
+	next.Set("cursor", encodeChirpCursor(chirpCursor{Sort: listing, AuthorId: ownerId, LastId: lastId}))
+	nextUrl := url.URL{Path: r.URL.Path, RawQuery: next.Encode()}
+	w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, nextUrl.String()))
+}
+
+func (s serverState) handleReactionsApi() {
+	for path, kind := range reactionPaths {
+		// Reacting twice, or taking back a reaction that is not there, is not an error
+		react := func(w http.ResponseWriter, r *http.Request) {
+			userId := callerId(r)
+
+			chirpId, err := strconv.Atoi(r.PathValue("chirpID"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			var chirp chirpydb.Chirp
+			if r.Method == http.MethodDelete {
+				chirp, err = s.DB.RemoveReaction(kind, chirpId, userId)
+			} else {
+				chirp, err = s.DB.AddReaction(kind, chirpId, userId)
+			}
+			if err != nil {
+				if errors.Is(err, chirpydb.ErrNotExist) {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				log.Printf("Error saving %s to database: %v\n", kind, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			res, err := s.createChirpResponse(userId, chirp)
+			if err != nil {
+				log.Printf("Error loading reactions from database: %v\n", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			respondWithJSON(w, http.StatusOK, res)
+		}
+
+		s.Mux.HandleFunc("POST /api/chirps/{chirpID}/"+path, s.requireAuth(requireScope(scopeChirpsWrite))(react))
+		s.Mux.HandleFunc("DELETE /api/chirps/{chirpID}/"+path, s.requireAuth(requireScope(scopeChirpsWrite))(react))
+
+		// Users who reacted to a chirp, sorted by user ID
+		s.Mux.HandleFunc("GET /api/chirps/{chirpID}/"+path, func(w http.ResponseWriter, r *http.Request) {
+			chirpId, err := strconv.Atoi(r.PathValue("chirpID"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			opts, err := idPageOptions(r.URL.Query(), path, chirpId)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			// Ask for one more than the limit, to know whether there is a next page
+			pageOpts := opts
+			if opts.Limit > 0 {
+				pageOpts.Limit++
+			}
+
+			reactions, err := s.DB.GetReactions(kind, chirpId, pageOpts)
+			if err != nil {
+				if errors.Is(err, chirpydb.ErrNotExist) {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				log.Printf("Error loading %s from database: %v\n", path, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if opts.Limit > 0 && len(reactions) > opts.Limit {
+				reactions = reactions[:opts.Limit]
+				setNextPageLink(w, r, path, chirpId, reactions[len(reactions)-1].UserId)
+			}
+
+			res := make([]reactionRes, len(reactions))
+			for i, reaction := range reactions {
+				res[i] = reactionRes{reaction.UserId, reaction.CreatedAt}
+			}
+
+			respondWithJSON(w, http.StatusOK, res)
+		})
+
+		// Chirps a user reacted to, sorted by chirp ID
+		s.Mux.HandleFunc("GET /api/users/{userID}/"+path, s.optionalAuth(func(w http.ResponseWriter, r *http.Request) {
+			userId, err := strconv.Atoi(r.PathValue("userID"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			viewerId := callerId(r)
+
+			listing := "user-" + path
+			opts, err := idPageOptions(r.URL.Query(), listing, userId)
+			if err != nil {
+				respondWithError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+
+			pageOpts := opts
+			if opts.Limit > 0 {
+				pageOpts.Limit++
+			}
+
+			reactions, err := s.DB.GetUserReactions(kind, userId, pageOpts)
+			if err != nil {
+				if errors.Is(err, chirpydb.ErrNotExist) {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				log.Printf("Error loading %s from database: %v\n", path, err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			if opts.Limit > 0 && len(reactions) > opts.Limit {
+				reactions = reactions[:opts.Limit]
+				setNextPageLink(w, r, listing, userId, reactions[len(reactions)-1].ChirpId)
+			}
+
+			chirps := make([]chirpydb.Chirp, 0, len(reactions))
+			for _, reaction := range reactions {
+				chirp, err := s.DB.GetChirp(reaction.ChirpId)
+				if err != nil {
+					if errors.Is(err, chirpydb.ErrNotExist) {
+						// Deleted after we listed it
+						continue
+					}
+
+					log.Printf("Error loading chirp from database: %v\n", err)
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+
+				chirps = append(chirps, chirp)
+			}
+
+			res, err := s.createChirpResponses(viewerId, chirps)
+			if err != nil {
+				log.Printf("Error loading reactions from database: %v\n", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			respondWithJSON(w, http.StatusOK, res)
+		}))
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReactions(t *testing.T) {
+	s := newTestServer(t)
+	author, authorToken := newTestUser(t, s, "author@example.com")
+	fan, fanToken := newTestUser(t, s, "fan@example.com")
+
+	chirp, err := s.DB.CreateChirp("likeable", author.Id)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	do := func(method, path, token string, v any) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		s.Mux.ServeHTTP(rec, req)
+
+		if v != nil {
+			json.NewDecoder(rec.Body).Decode(v)
+		}
+
+		return rec.Code
+	}
+
+	likesPath := fmt.Sprintf("/api/chirps/%d/likes", chirp.Id)
+
+	if code := do("POST", likesPath, "", nil); code != http.StatusUnauthorized {
+		t.Errorf("expected status %d when liking without a token, got %d", http.StatusUnauthorized, code)
+		return
+	}
+	if code := do("POST", "/api/chirps/100/likes", fanToken, nil); code != http.StatusNotFound {
+		t.Errorf("expected status %d when liking a missing chirp, got %d", http.StatusNotFound, code)
+		return
+	}
+
+	// Liking twice counts once
+	var res map[string]any
+	for range 2 {
+		if code := do("POST", likesPath, fanToken, &res); code != http.StatusOK {
+			t.Errorf("expected status %d when liking, got %d", http.StatusOK, code)
+			return
+		}
+	}
+	if res["like_count"] != 1.0 || res["liked_by_me"] != true || res["rechirped_by_me"] != false {
+		t.Errorf("expected one like by the caller, got %v", res)
+		return
+	}
+
+	if code := do("POST", fmt.Sprintf("/api/chirps/%d/rechirps", chirp.Id), authorToken, &res); code != http.StatusOK || res["rechirp_count"] != 1.0 {
+		t.Errorf("expected one rechirp, got %v with status %d", res, code)
+		return
+	}
+
+	// The flags are only there for whoever is logged in
+	var chirps []map[string]any
+	if code := do("GET", "/api/chirps", fanToken, &chirps); code != http.StatusOK || len(chirps) != 1 {
+		t.Errorf("expected one chirp, got %v with status %d", chirps, code)
+		return
+	}
+	if chirps[0]["liked_by_me"] != true || chirps[0]["rechirped_by_me"] != false || chirps[0]["like_count"] != 1.0 {
+		t.Errorf("expected the fan's view of the chirp, got %v", chirps[0])
+		return
+	}
+	if code := do("GET", fmt.Sprintf("/api/chirps/%d", chirp.Id), authorToken, &res); code != http.StatusOK || res["liked_by_me"] != false || res["rechirped_by_me"] != true {
+		t.Errorf("expected the author's view of the chirp, got %v with status %d", res, code)
+		return
+	}
+
+	// Editing, and posting at the end, answer with the caller's view of the chirp like getting it does
+	res = nil
+	if rec := doRequest(s.Mux, "PUT", fmt.Sprintf("/api/chirps/%d", chirp.Id), "Bearer "+authorToken, `{"body": "still likeable"}`, &res); rec.Code != http.StatusOK ||
+		res["liked_by_me"] != false || res["rechirped_by_me"] != true || res["like_count"] != 1.0 {
+		t.Errorf("expected the author's view of the edited chirp, got %v with status %d", res, rec.Code)
+		return
+	}
+
+	res = nil
+	if code := do("GET", fmt.Sprintf("/api/chirps/%d", chirp.Id), "", &res); code != http.StatusOK {
+		t.Errorf("expected status %d for an anonymous request, got %d", http.StatusOK, code)
+		return
+	}
+	if _, ok := res["liked_by_me"]; ok {
+		t.Errorf("expected no flags for an anonymous request, got %v", res)
+		return
+	}
+
+	// A stale token is served like an anonymous request, even though the fan liked the chirp
+	expiredToken, err := createJWT(fan.Id, -time.Hour, s.ApiCfg.jwtKeys)
+	if err != nil {
+		t.Errorf("could not create JWT: %v", err)
+		return
+	}
+	for _, token := range []string{expiredToken, "not-a-token"} {
+		chirps = nil
+		if code := do("GET", "/api/chirps", token, &chirps); code != http.StatusOK || len(chirps) != 1 {
+			t.Errorf("expected status %d for a stale token, got %d", http.StatusOK, code)
+			return
+		}
+		if chirps[0]["liked_by_me"] == true {
+			t.Errorf("expected the chirp not to be liked by an anonymous caller, got %v", chirps[0])
+			return
+		}
+	}
+
+	var likes []map[string]any
+	if code := do("GET", likesPath, "", &likes); code != http.StatusOK || len(likes) != 1 || likes[0]["user_id"] != float64(fan.Id) {
+		t.Errorf("expected the fan to have liked the chirp, got %v with status %d", likes, code)
+		return
+	}
+
+	if code := do("GET", fmt.Sprintf("/api/users/%d/likes", fan.Id), "", &chirps); code != http.StatusOK || len(chirps) != 1 || chirps[0]["id"] != float64(chirp.Id) {
+		t.Errorf("expected the liked chirp, got %v with status %d", chirps, code)
+		return
+	}
+	if code := do("GET", "/api/users/100/likes", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected status %d for likes of a missing user, got %d", http.StatusNotFound, code)
+		return
+	}
+
+	// Unliking twice is fine too
+	for range 2 {
+		if code := do("DELETE", likesPath, fanToken, &res); code != http.StatusOK {
+			t.Errorf("expected status %d when unliking, got %d", http.StatusOK, code)
+			return
+		}
+	}
+	if res["like_count"] != 0.0 || res["liked_by_me"] != false {
+		t.Errorf("expected no likes left, got %v", res)
+		return
+	}
+
+	res = nil
+	if rec := doRequest(s.Mux, "POST", "/api/chirps", "Bearer "+authorToken, `{"body": "new"}`, &res); rec.Code != http.StatusCreated ||
+		res["liked_by_me"] != false || res["rechirped_by_me"] != false {
+		t.Errorf("expected the author's view of the new chirp, got %v with status %d", res, rec.Code)
+	}
+}
+
+func TestReactionsPagination(t *testing.T) {
+	s := newTestServer(t)
+	author, _ := newTestUser(t, s, "author@example.com")
+
+	chirp, err := s.DB.CreateChirp("popular", author.Id)
+	if err != nil {
+		t.Errorf("could not create chirp: %v", err)
+		return
+	}
+
+	for i := range 5 {
+		_, token := newTestUser(t, s, fmt.Sprintf("fan%d@example.com", i))
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", fmt.Sprintf("/api/chirps/%d/likes", chirp.Id), nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		s.Mux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("could not like chirp, got status %d", rec.Code)
+			return
+		}
+	}
+
+	var userIds []int
+	next := fmt.Sprintf("/api/chirps/%d/likes?limit=2", chirp.Id)
+	for pages := 0; next != ""; pages++ {
+		if pages > 5 {
+			t.Errorf("too many pages")
+			return
+		}
+
+		rec := httptest.NewRecorder()
+		s.Mux.ServeHTTP(rec, httptest.NewRequest("GET", next, nil))
+
+		var likes []reactionRes
+		json.NewDecoder(rec.Body).Decode(&likes)
+		for _, like := range likes {
+			userIds = append(userIds, like.UserId)
+		}
+
+		next = ""
+		if link := rec.Header().Get("Link"); link != "" {
+			next = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+
+	if len(userIds) != 5 || userIds[0] != 2 || userIds[4] != 6 {
+		t.Errorf("expected all five fans in order, got %v", userIds)
+	}
+}
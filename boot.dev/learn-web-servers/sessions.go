@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/mosamadeeb/chirpy/internal/chirpydb"
+)
+
+// Describes the client making a request, for the session its refresh token belongs to
+// Forwarding headers can be set by anyone, so only the address of the connection is used
+func requestClient(r *http.Request) chirpydb.Client {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return chirpydb.Client{UserAgent: r.UserAgent(), IP: ip}
+}
+
+// Sessions are the user's logins, each one lasting as long as its family of refresh tokens
+// Revoking a session only stops it from being refreshed, access tokens that were already issued work until they expire
+func (s serverState) handleSessionsApi() {
+	s.Mux.HandleFunc("GET /api/sessions", s.requireAuth()(func(w http.ResponseWriter, r *http.Request) {
+		sessions, err := s.DB.GetSessions(callerId(r))
+		if err != nil {
+			log.Printf("Error fetching sessions from database: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, sessions)
+	}))
+
+	s.Mux.HandleFunc("DELETE /api/sessions/{sessionID}", s.requireAuth(requireScope(scopeUsersWrite))(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.DB.RevokeSession(callerId(r), r.PathValue("sessionID")); err != nil {
+			if errors.Is(err, chirpydb.ErrNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			log.Printf("Error revoking session in DB: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	s.Mux.HandleFunc("POST /api/sessions/revoke-all", s.requireAuth(requireScope(scopeUsersWrite))(func(w http.ResponseWriter, r *http.Request) {
+		revoked, err := s.DB.RevokeAllSessions(callerId(r))
+		if err != nil {
+			log.Printf("Error revoking sessions in DB: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, struct {
+			Revoked int `json:"revoked"`
+		}{revoked})
+	}))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/mosamadeeb/chirpy/internal/chirpydb"
+)
+
+func TestSessions(t *testing.T) {
+	s := newTestServer(t)
+
+	credentials := `{"email":"user@example.com","password":"hunter2"}`
+	if code := doRequest(s.Mux, "POST", "/api/users", "", credentials, nil).Code; code != http.StatusCreated {
+		t.Errorf("could not create user, got status %d", code)
+		return
+	}
+
+	type loginRes struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	var phone, laptop loginRes
+	if code := doRequest(s.Mux, "POST", "/api/login", "", credentials, &phone, "User-Agent", "phone").Code; code != http.StatusOK {
+		t.Errorf("could not log in, got status %d", code)
+		return
+	}
+	if code := doRequest(s.Mux, "POST", "/api/login", "", credentials, &laptop, "User-Agent", "laptop").Code; code != http.StatusOK {
+		t.Errorf("could not log in, got status %d", code)
+		return
+	}
+
+	var sessions []chirpydb.Session
+	if code := doRequest(s.Mux, "GET", "/api/sessions", "", "", nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("expected status %d without a token, got %d", http.StatusUnauthorized, code)
+		return
+	}
+	if code := doRequest(s.Mux, "GET", "/api/sessions", "Bearer "+phone.Token, "", &sessions).Code; code != http.StatusOK {
+		t.Errorf("could not list sessions, got status %d", code)
+		return
+	}
+	if len(sessions) != 2 || sessions[0].UserAgent != "laptop" || sessions[1].UserAgent != "phone" || sessions[0].ClientIP == "" {
+		t.Errorf("expected both logins with their clients, got %v", sessions)
+		return
+	}
+
+	if code := doRequest(s.Mux, "DELETE", "/api/sessions/unknown", "Bearer "+phone.Token, "", nil).Code; code != http.StatusNotFound {
+		t.Errorf("expected status %d for an unknown session, got %d", http.StatusNotFound, code)
+		return
+	}
+	if code := doRequest(s.Mux, "DELETE", "/api/sessions/"+sessions[0].Id, "Bearer "+phone.Token, "", nil).Code; code != http.StatusNoContent {
+		t.Errorf("could not revoke session, got status %d", code)
+		return
+	}
+	if code := doRequest(s.Mux, "POST", "/api/refresh", "Bearer "+laptop.RefreshToken, "", nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("expected status %d for a revoked session, got %d", http.StatusUnauthorized, code)
+		return
+	}
+
+	// Changing the password logs out everywhere
+	if code := doRequest(s.Mux, "PUT", "/api/users", "Bearer "+phone.Token, `{"email":"user@example.com","password":"correct horse"}`, nil).Code; code != http.StatusOK {
+		t.Errorf("could not update user, got status %d", code)
+		return
+	}
+	if code := doRequest(s.Mux, "POST", "/api/refresh", "Bearer "+phone.RefreshToken, "", nil).Code; code != http.StatusUnauthorized {
+		t.Errorf("expected status %d after changing the password, got %d", http.StatusUnauthorized, code)
+		return
+	}
+
+	credentials = `{"email":"user@example.com","password":"correct horse"}`
+	for range 2 {
+		if code := doRequest(s.Mux, "POST", "/api/login", "", credentials, &phone).Code; code != http.StatusOK {
+			t.Errorf("could not log in, got status %d", code)
+			return
+		}
+	}
+
+	var res struct {
+		Revoked int `json:"revoked"`
+	}
+	if code := doRequest(s.Mux, "POST", "/api/sessions/revoke-all", "Bearer "+phone.Token, "", &res).Code; code != http.StatusOK || res.Revoked != 2 {
+		t.Errorf("expected 2 sessions to be revoked, got %d with status %d", res.Revoked, code)
+		return
+	}
+	if code := doRequest(s.Mux, "GET", "/api/sessions", "Bearer "+phone.Token, "", &sessions).Code; code != http.StatusOK || len(sessions) != 0 {
+		t.Errorf("expected no sessions left, got %v with status %d", sessions, code)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/mosamadeeb/chirpy/internal/chirpydb"
+)
+
+// Limits on how many levels of replies GET /api/chirps/{chirpID}/thread returns
+const (
+	defaultThreadDepth = 10
+	maxThreadDepth     = 100
+)
+
+// A chirp in a conversation tree
+// Deleted chirps that still have replies are kept as placeholders with only an ID
+type threadNode struct {
+	Id int `json:"id"`
+	*chirpydb.Chirp
+
+	Deleted bool          `json:"deleted,omitempty"`
+	Replies []*threadNode `json:"replies"`
+}
+
+// Builds the conversation tree of a thread from its chirps, which must be sorted by ID
+// Replies whose parent was deleted hang off a placeholder for it, and placeholders whose own parent
+// is not known hang off the root
+func buildThread(rootId int, chirps []chirpydb.Chirp) map[int]*threadNode {
+	nodes := map[int]*threadNode{}
+	node := func(id int) *threadNode {
+		n, ok := nodes[id]
+		if !ok {
+			n = &threadNode{Id: id, Deleted: true, Replies: []*threadNode{}}
+			nodes[id] = n
+		}
+		return n
+	}
+
+	for i := range chirps {
+		n := node(chirps[i].Id)
+		n.Chirp = &chirps[i]
+		n.Deleted = false
+	}
+
+	root := node(rootId)
+	for _, c := range chirps {
+		if c.Id == rootId {
+			continue
+		}
+
+		_, known := nodes[c.ReplyTo]
+		parent := node(c.ReplyTo)
+		if !known && c.ReplyTo != rootId {
+			root.Replies = append(root.Replies, parent)
+		}
+
+		parent.Replies = append(parent.Replies, nodes[c.Id])
+	}
+
+	// Placeholders were added as they were found, so put everything back in ID order
+	for _, n := range nodes {
+		slices.SortFunc(n.Replies, func(a, b *threadNode) int { return cmp.Compare(a.Id, b.Id) })
+	}
+
+	return nodes
+}
+
+// Drops the replies that are more than depth levels below n
+func pruneThread(n *threadNode, depth int) {
+	if depth == 0 {
+		n.Replies = []*threadNode{}
+		return
+	}
+
+	for _, reply := range n.Replies {
+		pruneThread(reply, depth-1)
+	}
+}
+
+func (s serverState) handleThreadsApi() {
+	// The whole conversation a chirp is part of, starting from the chirp that began it
+	// With subtree=true, only the chirp and the replies below it
+	s.Mux.HandleFunc("GET /api/chirps/{chirpID}/thread", func(w http.ResponseWriter, r *http.Request) {
+		chirpId, err := strconv.Atoi(r.PathValue("chirpID"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		query := r.URL.Query()
+
+		depth := defaultThreadDepth
+		if depthStr := query.Get("depth"); depthStr != "" {
+			if depth, err = strconv.Atoi(depthStr); err != nil || depth < 0 || depth > maxThreadDepth {
+				respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Depth must be between 0 and %d", maxThreadDepth))
+				return
+			}
+		}
+
+		subtree := false
+		if subtreeStr := query.Get("subtree"); subtreeStr != "" {
+			if subtree, err = strconv.ParseBool(subtreeStr); err != nil {
+				respondWithError(w, http.StatusBadRequest, "Subtree must be true or false")
+				return
+			}
+		}
+
+		chirp, err := s.DB.GetChirp(chirpId)
+		if err != nil {
+			if errors.Is(err, chirpydb.ErrNotExist) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			log.Printf("Error loading chirp from database: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		chirps, err := s.DB.GetThread(chirp.RootId)
+		if err != nil {
+			if errors.Is(err, chirpydb.ErrNotExist) {
+				// Deleted after we got it
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			log.Printf("Error loading thread from database: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		nodes := buildThread(chirp.RootId, chirps)
+
+		top, ok := nodes[chirp.RootId]
+		if subtree {
+			top, ok = nodes[chirpId]
+		}
+		if !ok {
+			// Deleted after we got it
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		pruneThread(top, depth)
+
+		respondWithJSON(w, http.StatusOK, top)
+	})
+}
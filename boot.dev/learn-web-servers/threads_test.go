@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Short form of a thread for comparing, like 1(2(3) 4)
+// Deleted chirps are marked with an x
+func threadShape(n map[string]any) string {
+	s := fmt.Sprint(n["id"])
+	if deleted, _ := n["deleted"].(bool); deleted {
+		s += "x"
+	}
+
+	replies, _ := n["replies"].([]any)
+	if len(replies) == 0 {
+		return s
+	}
+
+	var parts []string
+	for _, r := range replies {
+		parts = append(parts, threadShape(r.(map[string]any)))
+	}
+
+	return s + "(" + strings.Join(parts, " ") + ")"
+}
+
+func TestThreads(t *testing.T) {
+	s := newTestServer(t)
+	_, token := newTestUser(t, s, "chirper@example.com")
+
+	post := func(body string, replyTo int) (map[string]any, int) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/api/chirps", strings.NewReader(fmt.Sprintf(`{"body": %q, "reply_to": %d}`, body, replyTo)))
+		req.Header.Set("Authorization", "Bearer "+token)
+		s.Mux.ServeHTTP(rec, req)
+
+		var chirp map[string]any
+		json.NewDecoder(rec.Body).Decode(&chirp)
+
+		return chirp, rec.Code
+	}
+
+	getThread := func(path string) (string, int) {
+		rec := httptest.NewRecorder()
+		s.Mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+
+		var thread map[string]any
+		json.NewDecoder(rec.Body).Decode(&thread)
+
+		return threadShape(thread), rec.Code
+	}
+
+	// 1
+	// ├─ 2
+	// │  └─ 3
+	// │     └─ 4
+	// └─ 5
+	for _, replyTo := range []int{0, 1, 2, 3, 1} {
+		if _, code := post("hello", replyTo); code != http.StatusCreated {
+			t.Errorf("expected status %d when replying to %d, got %d", http.StatusCreated, replyTo, code)
+			return
+		}
+	}
+
+	if _, code := post("hello", 100); code != http.StatusBadRequest {
+		t.Errorf("expected status %d when replying to a missing chirp, got %d", http.StatusBadRequest, code)
+		return
+	}
+
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{"/api/chirps/4/thread", "1(2(3(4)) 5)"},
+		{"/api/chirps/1/thread?depth=1", "1(2 5)"},
+		{"/api/chirps/1/thread?depth=0", "1"},
+		{"/api/chirps/2/thread?subtree=true", "2(3(4))"},
+	}
+	for _, c := range cases {
+		shape, code := getThread(c.path)
+		if code != http.StatusOK || shape != c.expected {
+			t.Errorf("expected %s for %s, got %s with status %d", c.expected, c.path, shape, code)
+			return
+		}
+	}
+
+	// Deleted chirps stay in the tree as placeholders while they have replies
+	// Where a deleted reply was in the tree is not known anymore, so it moves up to the root
+	for _, id := range []int{1, 3} {
+		if err := s.DB.DeleteChirp(id); err != nil {
+			t.Errorf("could not delete chirp: %v", err)
+			return
+		}
+	}
+
+	if shape, code := getThread("/api/chirps/4/thread"); code != http.StatusOK || shape != "1x(2 3x(4) 5)" {
+		t.Errorf("expected placeholders for the deleted chirps, got %s with status %d", shape, code)
+		return
+	}
+
+	if _, code := getThread("/api/chirps/1/thread"); code != http.StatusNotFound {
+		t.Errorf("expected status %d for the thread of a deleted chirp, got %d", http.StatusNotFound, code)
+		return
+	}
+	if _, code := getThread("/api/chirps/2/thread?depth=1000"); code != http.StatusBadRequest {
+		t.Errorf("expected status %d for a deep thread, got %d", http.StatusBadRequest, code)
+	}
+}
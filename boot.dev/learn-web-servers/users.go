@@ -5,7 +5,7 @@ import (
 	"errors"
 	"log"
 	"net/http"
-	"strconv"
+	"time"
 
 	"github.com/mosamadeeb/chirpy/internal/chirpydb"
 	"golang.org/x/crypto/bcrypt"
@@ -13,9 +13,14 @@ import (
 
 // Mirrors User but with password removed
 type userRes struct {
-	Id          int    `json:"id"`
-	Email       string `json:"email"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	Id          int       `json:"id"`
+	Email       string    `json:"email"`
+	IsChirpyRed bool      `json:"is_chirpy_red"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+
+	FollowerCount  int `json:"follower_count"`
+	FollowingCount int `json:"following_count"`
 }
 
 func createUserRes(u chirpydb.User) userRes {
@@ -23,6 +28,10 @@ func createUserRes(u chirpydb.User) userRes {
 		u.Id,
 		u.Email,
 		u.IsChirpyRed,
+		u.CreatedAt,
+		u.UpdatedAt,
+		u.FollowerCount,
+		u.FollowingCount,
 	}
 }
 
@@ -62,26 +71,9 @@ func (s serverState) handleUsersApi() {
 		respondWithJSON(w, http.StatusCreated, createUserRes(user))
 	})
 
-	s.Mux.HandleFunc("PUT /api/users", func(w http.ResponseWriter, r *http.Request) {
-		token, err := authenticateJWT(r, s.ApiCfg.jwtSecret)
-		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-
-		idStr, err := token.Claims.GetSubject()
-		if err != nil {
-			log.Printf("Could not get user ID from JWT: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-
-		userId, err := strconv.Atoi(idStr)
-		if err != nil {
-			log.Printf("Could not get user ID from JWT: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	s.Mux.HandleFunc("PUT /api/users", s.requireAuth(requireScope(scopeUsersWrite))(func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := principalFromContext(r.Context())
+		userId := caller.User.Id
 
 		var userReq struct {
 			Email    string `json:"email"`
@@ -94,14 +86,20 @@ func (s serverState) handleUsersApi() {
 			return
 		}
 
-		encPassword, err := bcrypt.GenerateFromPassword([]byte(userReq.Password), bcrypt.DefaultCost)
-		if err != nil {
-			log.Printf("Error hashing user password: %v\n", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		// Keeping the password keeps its hash, anything else changes it and logs out every session
+		// If the password changed since the caller was loaded, the hashes differ and sessions are revoked anyway
+		passwordHash := caller.User.Password
+		if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(userReq.Password)) != nil {
+			encPassword, err := bcrypt.GenerateFromPassword([]byte(userReq.Password), bcrypt.DefaultCost)
+			if err != nil {
+				log.Printf("Error hashing user password: %v\n", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			passwordHash = string(encPassword)
 		}
 
-		user, err := s.DB.UpdateUser(userId, userReq.Email, string(encPassword))
+		user, err := s.DB.ChangeUserCredentials(userId, userReq.Email, passwordHash)
 		if err != nil {
 			if errors.Is(err, chirpydb.ErrNotExist) {
 				// Ah yes, user must have deleted their account and *then* proceeded to update their credentials
@@ -121,5 +119,5 @@ func (s serverState) handleUsersApi() {
 		}
 
 		respondWithJSON(w, http.StatusOK, createUserRes(user))
-	})
+	}))
 }